@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/dbmedialab/prebid-server/adapters"
+	"github.com/dbmedialab/prebid-server/config"
+	"github.com/dbmedialab/prebid-server/pbs"
+	"github.com/dbmedialab/prebid-server/pbsmetrics"
+	"github.com/mxmCherry/openrtb"
+)
+
+// responseCacheMaxEntries caps how many responses each adapter's cache holds. Responses which don't fit
+// once the expired ones are gone aren't cached.
+const responseCacheMaxEntries = 1000
+
+// Parts of the request which the response cache can key on, set by the adapter's response_cache.key_fields.
+// The ad unit codes are always part of the key.
+const (
+	RESPONSE_CACHE_KEY_SIZES  = "sizes"
+	RESPONSE_CACHE_KEY_PARAMS = "params"
+	RESPONSE_CACHE_KEY_GEO    = "geo"
+	RESPONSE_CACHE_KEY_DOMAIN = "domain"
+)
+
+// defaultResponseCacheKeyFields are used when response_cache.key_fields is empty
+var defaultResponseCacheKeyFields = []string{RESPONSE_CACHE_KEY_SIZES, RESPONSE_CACHE_KEY_PARAMS, RESPONSE_CACHE_KEY_GEO}
+
+// responseCache holds an adapter's recent responses, keyed on the parts of the request which decide them.
+// It's only meant for demand whose bids don't depend on the user, like house or PMP endpoints.
+type responseCache struct {
+	ttl       time.Duration
+	keyFields map[string]bool
+
+	mu      sync.Mutex
+	entries map[string]responseCacheEntry
+}
+
+type responseCacheEntry struct {
+	bids    pbs.PBSBidSlice
+	expires time.Time
+}
+
+// newResponseCache makes the cache configured for an adapter, or returns nil if it's not turned on
+func newResponseCache(cfg *config.ResponseCache) *responseCache {
+	if cfg.TTLSeconds <= 0 {
+		return nil
+	}
+	fields := cfg.KeyFields
+	if len(fields) == 0 {
+		fields = defaultResponseCacheKeyFields
+	}
+	c := &responseCache{
+		ttl:       time.Duration(cfg.TTLSeconds) * time.Second,
+		keyFields: make(map[string]bool, len(fields)),
+		entries:   make(map[string]responseCacheEntry),
+	}
+	for _, field := range fields {
+		c.keyFields[field] = true
+	}
+	return c
+}
+
+// cacheKeyUnit is the part of an ad unit which goes into the cache key
+type cacheKeyUnit struct {
+	Code   string           `json:"code"`
+	Sizes  []openrtb.Format `json:"sizes,omitempty"`
+	Params json.RawMessage  `json:"params,omitempty"`
+}
+
+type cacheKey struct {
+	Units    []cacheKeyUnit `json:"units"`
+	Endpoint string         `json:"endpoint,omitempty"`
+	Country  string         `json:"country,omitempty"`
+	Region   string         `json:"region,omitempty"`
+	Metro    string         `json:"metro,omitempty"`
+	City     string         `json:"city,omitempty"`
+	Domain   string         `json:"domain,omitempty"`
+}
+
+// key hashes the configured parts of the request. Two requests with the same key get the same response.
+func (c *responseCache) key(req *pbs.PBSRequest, bidder *pbs.PBSBidder) string {
+	// Accounts with their own endpoint get their own responses
+	k := cacheKey{Endpoint: bidder.Endpoint}
+	for _, unit := range bidder.AdUnits {
+		u := cacheKeyUnit{Code: unit.Code}
+		if c.keyFields[RESPONSE_CACHE_KEY_SIZES] {
+			u.Sizes = unit.Sizes
+		}
+		if c.keyFields[RESPONSE_CACHE_KEY_PARAMS] {
+			u.Params = unit.Params
+		}
+		k.Units = append(k.Units, u)
+	}
+	if c.keyFields[RESPONSE_CACHE_KEY_GEO] && req.Device != nil && req.Device.Geo != nil {
+		k.Country = req.Device.Geo.Country
+		k.Region = req.Device.Geo.Region
+		k.Metro = req.Device.Geo.Metro
+		k.City = req.Device.Geo.City
+	}
+	if c.keyFields[RESPONSE_CACHE_KEY_DOMAIN] {
+		k.Domain = req.Domain
+	}
+	// Only strings, formats and raw JSON go in, so this can't fail
+	data, _ := json.Marshal(&k)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *responseCache) get(key string) (pbs.PBSBidSlice, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.bids, true
+}
+
+func (c *responseCache) put(key string, bids pbs.PBSBidSlice) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.entries) >= responseCacheMaxEntries {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= responseCacheMaxEntries {
+			return
+		}
+	}
+	c.entries[key] = responseCacheEntry{bids: copyBids(bids), expires: now.Add(c.ttl)}
+}
+
+// copyBids copies every bid, so the cached ones aren't changed by the rest of the auction
+func copyBids(bids pbs.PBSBidSlice) pbs.PBSBidSlice {
+	if bids == nil {
+		return nil
+	}
+	copied := make(pbs.PBSBidSlice, len(bids))
+	for i, bid := range bids {
+		b := *bid
+		copied[i] = &b
+	}
+	return copied
+}
+
+// cachingAdapter answers from the adapter's response cache when it can, and caches the responses
+// of the calls it has to make. Failed calls aren't cached.
+type cachingAdapter struct {
+	adapters.Adapter
+	cache   *responseCache
+	metrics *pbsmetrics.AdapterMetrics
+}
+
+func (a *cachingAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidder *pbs.PBSBidder) (pbs.PBSBidSlice, error) {
+	key := a.cache.key(req, bidder)
+	if cached, ok := a.cache.get(key); ok {
+		a.metrics.ResponseCacheHitMeter.Mark(1)
+		bids := copyBids(cached)
+		// Bid IDs are made for each request, so the cached bids get the ones from this request
+		for _, bid := range bids {
+			bid.BidID = bidder.LookupBidID(bid.AdUnitCode)
+		}
+		return bids, nil
+	}
+
+	a.metrics.ResponseCacheMissMeter.Mark(1)
+	bids, err := a.Adapter.Call(ctx, req, bidder)
+	if err == nil {
+		a.cache.put(key, bids)
+	}
+	return bids, err
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/dbmedialab/prebid-server/config"
+	"github.com/dbmedialab/prebid-server/pbs"
+	"github.com/dbmedialab/prebid-server/pbsmetrics"
+	"github.com/mxmCherry/openrtb"
+)
+
+// countingAdapter bids once on each ad unit, and counts its calls
+type countingAdapter struct {
+	adUnitAdapter
+	calls int
+}
+
+func (a *countingAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidder *pbs.PBSBidder) (pbs.PBSBidSlice, error) {
+	a.calls++
+	return a.adUnitAdapter.Call(ctx, req, bidder)
+}
+
+func cacheTestBidder(bidID string, params string) *pbs.PBSBidder {
+	return &pbs.PBSBidder{
+		BidderCode: "appnexus",
+		AdUnits: []pbs.PBSAdUnit{
+			{Code: "first", BidID: bidID, Sizes: []openrtb.Format{{W: 300, H: 250}}, Params: json.RawMessage(params)},
+		},
+	}
+}
+
+func TestNewResponseCache(t *testing.T) {
+	if c := newResponseCache(&config.ResponseCache{}); c != nil {
+		t.Errorf("The response cache should be off without a TTL")
+	}
+	c := newResponseCache(&config.ResponseCache{TTLSeconds: 10})
+	if c == nil || !c.keyFields[RESPONSE_CACHE_KEY_SIZES] || !c.keyFields[RESPONSE_CACHE_KEY_PARAMS] || !c.keyFields[RESPONSE_CACHE_KEY_GEO] || c.keyFields[RESPONSE_CACHE_KEY_DOMAIN] {
+		t.Errorf("Expected the default key fields; got %+v", c)
+	}
+}
+
+func TestResponseCacheKey(t *testing.T) {
+	c := newResponseCache(&config.ResponseCache{TTLSeconds: 10, KeyFields: []string{RESPONSE_CACHE_KEY_PARAMS, RESPONSE_CACHE_KEY_GEO}})
+	req := &pbs.PBSRequest{Device: &openrtb.Device{Geo: &openrtb.Geo{Country: "NOR"}}}
+	key := c.key(req, cacheTestBidder("a", `{"placementId": 1}`))
+
+	if other := c.key(req, cacheTestBidder("b", `{"placementId": 1}`)); other != key {
+		t.Errorf("Bid IDs shouldn't be part of the key")
+	}
+	if other := c.key(req, cacheTestBidder("a", `{"placementId": 2}`)); other == key {
+		t.Errorf("Params should be part of the key")
+	}
+	if other := c.key(&pbs.PBSRequest{Device: &openrtb.Device{Geo: &openrtb.Geo{Country: "SWE"}}}, cacheTestBidder("a", `{"placementId": 1}`)); other == key {
+		t.Errorf("Geo should be part of the key")
+	}
+	if other := c.key(&pbs.PBSRequest{Device: &openrtb.Device{Geo: &openrtb.Geo{Country: "NOR"}}, Domain: "example.com"}, cacheTestBidder("a", `{"placementId": 1}`)); other != key {
+		t.Errorf("The domain shouldn't be part of the key unless it's configured")
+	}
+}
+
+func TestCachingAdapter(t *testing.T) {
+	m := pbsmetrics.NewMetrics([]string{"appnexus"})
+	inner := &countingAdapter{}
+	ex := &cachingAdapter{Adapter: inner, cache: newResponseCache(&config.ResponseCache{TTLSeconds: 10}), metrics: m.AdapterMetrics["appnexus"]}
+	req := &pbs.PBSRequest{}
+
+	bids, err := ex.Call(context.Background(), req, cacheTestBidder("a", `{"placementId": 1}`))
+	if err != nil || len(bids) != 1 {
+		t.Fatalf("Expected a bid from the adapter; got %d bids and error %v", len(bids), err)
+	}
+	bids[0].Price = 99
+
+	bids, err = ex.Call(context.Background(), req, cacheTestBidder("b", `{"placementId": 1}`))
+	if err != nil || len(bids) != 1 {
+		t.Fatalf("Expected a bid from the cache; got %d bids and error %v", len(bids), err)
+	}
+	if inner.calls != 1 {
+		t.Errorf("The second call should have been answered from the cache; the adapter was called %d times", inner.calls)
+	}
+	if bids[0].BidID != "b" {
+		t.Errorf("Cached bids should get the bid ID of the new request; got %s", bids[0].BidID)
+	}
+	if bids[0].Price == 99 {
+		t.Errorf("Changes to returned bids shouldn't leak into the cache")
+	}
+	if hits, misses := m.AdapterMetrics["appnexus"].ResponseCacheHitMeter.Count(), m.AdapterMetrics["appnexus"].ResponseCacheMissMeter.Count(); hits != 1 || misses != 1 {
+		t.Errorf("Expected 1 hit and 1 miss; got %d and %d", hits, misses)
+	}
+}
+
+func TestTestAccountSkipsResponseCache(t *testing.T) {
+	m := pbsmetrics.NewMetrics([]string{"appnexus"})
+	cfg := &config.Configuration{TestBids: config.TestBids{
+		AccountID:       "test",
+		StoredResponses: map[string]string{"appnexus": `[{"price": 42}]`},
+	}}
+	saved := responseCaches
+	responseCaches = map[string]*responseCache{"appnexus": newResponseCache(&config.ResponseCache{TTLSeconds: 10})}
+	defer func() { responseCaches = saved }()
+	inner := &countingAdapter{}
+	req := &pbs.PBSRequest{}
+
+	test := auctionAdapter(cfg, inner, "appnexus", true, m.AdapterMetrics["appnexus"])
+	bids, err := test.Call(context.Background(), req, cacheTestBidder("a", `{"placementId": 1}`))
+	if err != nil || len(bids) != 1 || bids[0].Price != 42 {
+		t.Fatalf("Expected the stored response for the test account; got %v and error %v", bids, err)
+	}
+
+	live := auctionAdapter(cfg, inner, "appnexus", false, m.AdapterMetrics["appnexus"])
+	bids, err = live.Call(context.Background(), req, cacheTestBidder("b", `{"placementId": 1}`))
+	if err != nil || len(bids) != 1 || bids[0].Price == 42 {
+		t.Errorf("Real accounts shouldn't get the test account's stored response; got %v and error %v", bids, err)
+	}
+	if inner.calls != 1 {
+		t.Errorf("The real account's call should have gone to the adapter; it was called %d times", inner.calls)
+	}
+}
@@ -1,11 +1,22 @@
 package adapters
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
 	"github.com/dbmedialab/prebid-server/pbs"
 	"github.com/dbmedialab/prebid-server/ssl"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -30,6 +41,14 @@ type Adapter interface {
 	Call(ctx context.Context, req *pbs.PBSRequest, bidder *pbs.PBSBidder) (pbs.PBSBidSlice, error)
 }
 
+// endpoint is the URI which should be called for the bidder: the account's own endpoint if it has one, or else uri
+func endpoint(bidder *pbs.PBSBidder, uri string) string {
+	if bidder.Endpoint != "" {
+		return bidder.Endpoint
+	}
+	return uri
+}
+
 // HTTPAdapterConfig groups options which control how HTTP requests are made by adapters.
 type HTTPAdapterConfig struct {
 	// See IdleConnTimeout on https://golang.org/pkg/net/http/#Transport
@@ -38,6 +57,37 @@ type HTTPAdapterConfig struct {
 	MaxConns int
 	// See MaxIdleConnsPerHost on https://golang.org/pkg/net/http/#Transport
 	MaxConnsPerHost int
+	// UserAgent identifies prebid-server to the bidders. It's sent on every request which
+	// doesn't set its own User-Agent header.
+	UserAgent string
+	// ConnectTimeout limits how long it takes to open a connection. 0 leaves it to the call's deadline.
+	ConnectTimeout time.Duration
+	// See TLSHandshakeTimeout on https://golang.org/pkg/net/http/#Transport
+	TLSHandshakeTimeout time.Duration
+	// See ResponseHeaderTimeout on https://golang.org/pkg/net/http/#Transport
+	ResponseHeaderTimeout time.Duration
+	// ResponseFieldMap renames fields in the bidder's JSON responses before the adapter parses them
+	ResponseFieldMap FieldMap
+	// ByteCounter, if set, is told the size of every request body sent and response body received
+	ByteCounter ByteCounter
+	// Proxy, if set, is the HTTP(S) proxy which every request goes through. Its user info, if any, is
+	// sent as the proxy's basic auth credentials.
+	Proxy *url.URL
+	// BodyFormat is how the request bodies are sent. "form" sends the adapter's JSON bodies form encoded instead,
+	// for bidders which don't take JSON. Empty or "json" sends them as they are.
+	BodyFormat string
+}
+
+// Request body formats, for HTTPAdapterConfig.BodyFormat
+const (
+	BODY_FORMAT_JSON = "json"
+	BODY_FORMAT_FORM = "form"
+)
+
+// ByteCounter keeps track of the bandwidth used by an adapter
+type ByteCounter interface {
+	RequestBytes(n int64)
+	ResponseBytes(n int64)
 }
 
 type HTTPAdapter struct {
@@ -50,26 +100,257 @@ var DefaultHTTPAdapterConfig = &HTTPAdapterConfig{
 	MaxConns:        50,
 	MaxConnsPerHost: 10,
 	IdleConnTimeout: 60 * time.Second,
+	UserAgent:       "prebid-server",
 }
 
 // NewHTTPAdapter creates an HTTPAdapter which obeys the rules given by the config, and
 // has all the available SSL certs available in the project.
 func NewHTTPAdapter(c *HTTPAdapterConfig) *HTTPAdapter {
 	ts := &http.Transport{
-		MaxIdleConns:        c.MaxConns,
-		MaxIdleConnsPerHost: c.MaxConnsPerHost,
-		IdleConnTimeout:     c.IdleConnTimeout,
-		TLSClientConfig:     &tls.Config{RootCAs: ssl.GetRootCAPool()},
+		MaxIdleConns:          c.MaxConns,
+		MaxIdleConnsPerHost:   c.MaxConnsPerHost,
+		IdleConnTimeout:       c.IdleConnTimeout,
+		TLSClientConfig:       &tls.Config{RootCAs: ssl.GetRootCAPool()},
+		TLSHandshakeTimeout:   c.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: c.ResponseHeaderTimeout,
+	}
+	if c.ConnectTimeout > 0 {
+		ts.DialContext = (&net.Dialer{Timeout: c.ConnectTimeout}).DialContext
+	}
+	if c.Proxy != nil {
+		ts.Proxy = http.ProxyURL(c.Proxy)
+	}
+
+	var rt http.RoundTripper = ts
+	if c.UserAgent != "" {
+		rt = &userAgentTransport{
+			userAgent: c.UserAgent,
+			transport: rt,
+		}
+	}
+	if c.ByteCounter != nil {
+		rt = &countingTransport{
+			counter:   c.ByteCounter,
+			transport: rt,
+		}
+	}
+	if c.BodyFormat == BODY_FORMAT_FORM {
+		rt = &formBodyTransport{transport: rt}
+	}
+	if len(c.ResponseFieldMap) > 0 {
+		rt = &fieldMapTransport{
+			fields:    c.ResponseFieldMap,
+			transport: rt,
+		}
 	}
 
 	return &HTTPAdapter{
 		Transport: ts,
 		Client: &http.Client{
-			Transport: ts,
+			Transport: rt,
 		},
 	}
 }
 
+// userAgentTransport adds a User-Agent header to the requests which don't have one yet
+type userAgentTransport struct {
+	userAgent string
+	transport http.RoundTripper
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		// RoundTrippers must not modify the request, so set the header on a copy
+		withUA := *req
+		withUA.Header = make(http.Header, len(req.Header)+1)
+		for k, v := range req.Header {
+			withUA.Header[k] = v
+		}
+		withUA.Header.Set("User-Agent", t.userAgent)
+		req = &withUA
+	}
+	return t.transport.RoundTrip(req)
+}
+
+// formBodyTransport sends JSON object bodies form encoded. Each of the object's fields becomes a form field,
+// with strings sent as they are and any other value as its JSON. Bodies which aren't JSON objects are sent unchanged.
+type formBodyTransport struct {
+	transport http.RoundTripper
+}
+
+func (t *formBodyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil {
+		return t.transport.RoundTrip(req)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	form, ok := formEncode(body)
+	if !ok {
+		form = body
+	}
+
+	// RoundTrippers must not modify the request, so change the body on a copy
+	encoded := *req
+	encoded.Body = ioutil.NopCloser(bytes.NewReader(form))
+	encoded.ContentLength = int64(len(form))
+	if ok {
+		encoded.Header = make(http.Header, len(req.Header))
+		for k, v := range req.Header {
+			encoded.Header[k] = v
+		}
+		encoded.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return t.transport.RoundTrip(&encoded)
+}
+
+func formEncode(body []byte) ([]byte, bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil || fields == nil {
+		return nil, false
+	}
+	form := make(url.Values, len(fields))
+	for key, value := range fields {
+		var s string
+		if err := json.Unmarshal(value, &s); err == nil {
+			form.Set(key, s)
+		} else {
+			form.Set(key, string(value))
+		}
+	}
+	return []byte(form.Encode()), true
+}
+
+// FieldMap renames fields in a JSON document. Each rename has the dot separated path to a field, and the new
+// name it gets in the same object. Arrays along the path are walked through, so "seatbid.bid.cpm" renames
+// the field in every bid of every seatbid.
+type FieldMap []fieldRename
+
+type fieldRename struct {
+	path []string
+	to   string
+}
+
+// FieldRename gives a field's dot separated path, and the new name it should get.
+type FieldRename struct {
+	Path string
+	To   string
+}
+
+// NewFieldMap makes a FieldMap which applies the renames in order.
+func NewFieldMap(renames []FieldRename) (FieldMap, error) {
+	fields := make(FieldMap, 0, len(renames))
+	for _, rename := range renames {
+		segments := strings.Split(rename.Path, ".")
+		for _, segment := range segments {
+			if segment == "" {
+				return nil, fmt.Errorf("Invalid field path '%s'", rename.Path)
+			}
+		}
+		if rename.To == "" || strings.Contains(rename.To, ".") {
+			return nil, fmt.Errorf("Invalid new name '%s' for field '%s'. It must be a field name, not a path", rename.To, rename.Path)
+		}
+		fields = append(fields, fieldRename{path: segments, to: rename.To})
+	}
+	return fields, nil
+}
+
+// Apply renames the fields in the JSON document. Documents which aren't valid JSON are returned unchanged.
+// Numbers are kept as they were written, so IDs too big for a float64 aren't rounded.
+func (m FieldMap) Apply(data []byte) []byte {
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return data
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return data
+	}
+	for _, field := range m {
+		renameField(doc, field.path, field.to)
+	}
+	renamed, err := json.Marshal(doc)
+	if err != nil {
+		return data
+	}
+	return renamed
+}
+
+func renameField(doc interface{}, path []string, to string) {
+	switch value := doc.(type) {
+	case []interface{}:
+		for _, elem := range value {
+			renameField(elem, path, to)
+		}
+	case map[string]interface{}:
+		if len(path) > 1 {
+			renameField(value[path[0]], path[1:], to)
+		} else if field, ok := value[path[0]]; ok {
+			delete(value, path[0])
+			value[to] = field
+		}
+	}
+}
+
+// fieldMapTransport applies a FieldMap to the bodies of the responses
+type fieldMapTransport struct {
+	fields    FieldMap
+	transport http.RoundTripper
+}
+
+func (t *fieldMapTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil || resp.Body == nil {
+		return resp, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > 0 {
+		body = t.fields.Apply(body)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Del("Content-Length")
+	return resp, nil
+}
+
+// countingTransport reports the size of the request and response bodies to a ByteCounter.
+// Response bytes are counted as they're read.
+type countingTransport struct {
+	counter   ByteCounter
+	transport http.RoundTripper
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.ContentLength > 0 {
+		t.counter.RequestBytes(req.ContentLength)
+	}
+	resp, err := t.transport.RoundTrip(req)
+	if err == nil && resp.Body != nil {
+		resp.Body = &countingBody{ReadCloser: resp.Body, counter: t.counter}
+	}
+	return resp, err
+}
+
+type countingBody struct {
+	io.ReadCloser
+	counter ByteCounter
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.counter.ResponseBytes(int64(n))
+	}
+	return n, err
+}
+
 // used for callOne (possibly pull all of the shared code here)
 type callOneResult struct {
 	statusCode   int
@@ -77,3 +358,68 @@ type callOneResult struct {
 	bid          *pbs.PBSBid
 	Error        error
 }
+
+// Error classes returned by ClassifyError. These let us tell a bidder that can't be reached apart from
+// one which is reachable, but responds with garbage.
+const (
+	ERROR_CLASS_DNS                = "dns"
+	ERROR_CLASS_CONNECTION_REFUSED = "connection_refused"
+	ERROR_CLASS_TLS                = "tls"
+	ERROR_CLASS_BAD_STATUS         = "bad_status"
+	ERROR_CLASS_BAD_RESPONSE       = "bad_response"
+	ERROR_CLASS_OTHER              = "other"
+)
+
+// BadStatusError is returned by adapters when the bidder's server responds with an unexpected HTTP status code.
+type BadStatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *BadStatusError) Error() string {
+	return e.Message
+}
+
+// BadResponseError is returned by adapters when the bidder's server responds with a body which can't be parsed.
+type BadResponseError struct {
+	Err error
+}
+
+func (e *BadResponseError) Error() string {
+	return e.Err.Error()
+}
+
+// ClassifyError buckets an error returned from Adapter.Call into one of the ERROR_CLASS_* values.
+// Timeouts and cancellations aren't classified here, since the caller can check for those on the context.
+func ClassifyError(err error) string {
+	for err != nil {
+		switch e := err.(type) {
+		case *BadStatusError:
+			return ERROR_CLASS_BAD_STATUS
+		case *BadResponseError:
+			return ERROR_CLASS_BAD_RESPONSE
+		case *net.DNSError:
+			return ERROR_CLASS_DNS
+		case x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError, tls.RecordHeaderError:
+			return ERROR_CLASS_TLS
+		case syscall.Errno:
+			if e == syscall.ECONNREFUSED {
+				return ERROR_CLASS_CONNECTION_REFUSED
+			}
+			return ERROR_CLASS_OTHER
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		default:
+			// The TLS handshake reports most of its failures as plain errors.
+			if strings.HasPrefix(err.Error(), "tls: ") || strings.HasPrefix(err.Error(), "x509: ") {
+				return ERROR_CLASS_TLS
+			}
+			return ERROR_CLASS_OTHER
+		}
+	}
+	return ERROR_CLASS_OTHER
+}
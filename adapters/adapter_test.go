@@ -0,0 +1,252 @@
+package adapters
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context/ctxhttp"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{&BadStatusError{StatusCode: 500, Message: "HTTP status: 500"}, ERROR_CLASS_BAD_STATUS},
+		{&BadResponseError{errors.New("unexpected end of JSON input")}, ERROR_CLASS_BAD_RESPONSE},
+		{&url.Error{Op: "Post", URL: "http://bidder.invalid", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "bidder.invalid"}}}, ERROR_CLASS_DNS},
+		{&url.Error{Op: "Post", URL: "http://127.0.0.1:1", Err: &net.OpError{Op: "dial", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}}}, ERROR_CLASS_CONNECTION_REFUSED},
+		{&url.Error{Op: "Post", URL: "https://bidder.com", Err: errors.New("tls: handshake failure")}, ERROR_CLASS_TLS},
+		{errors.New("something else"), ERROR_CLASS_OTHER},
+	}
+
+	for _, test := range tests {
+		if class := ClassifyError(test.err); class != test.expected {
+			t.Errorf("Expected %s for error '%v', got %s", test.expected, test.err, class)
+		}
+	}
+}
+
+func TestClassifyConnectionRefused(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	_, err := ctxhttp.Do(context.Background(), http.DefaultClient, req)
+	if err == nil {
+		t.Fatal("Request to a closed server should fail")
+	}
+	if class := ClassifyError(err); class != ERROR_CLASS_CONNECTION_REFUSED {
+		t.Errorf("Expected %s for error '%v', got %s", ERROR_CLASS_CONNECTION_REFUSED, err, class)
+	}
+}
+
+func TestHTTPAdapterUserAgent(t *testing.T) {
+	var userAgents []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents = append(userAgents, r.Header.Get("User-Agent"))
+	}))
+	defer server.Close()
+
+	conf := *DefaultHTTPAdapterConfig
+	conf.UserAgent = "prebid-server/test"
+	a := NewHTTPAdapter(&conf)
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	if _, err := ctxhttp.Do(context.Background(), a.Client, req); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if req.Header.Get("User-Agent") != "" {
+		t.Errorf("The caller's request shouldn't be modified")
+	}
+
+	req, _ = http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("User-Agent", "custom")
+	if _, err := ctxhttp.Do(context.Background(), a.Client, req); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+
+	if len(userAgents) != 2 || userAgents[0] != "prebid-server/test" || userAgents[1] != "custom" {
+		t.Errorf("Unexpected User-Agents sent: %v", userAgents)
+	}
+}
+
+func TestHTTPAdapterTimeouts(t *testing.T) {
+	a := NewHTTPAdapter(DefaultHTTPAdapterConfig)
+	if a.Transport.DialContext != nil || a.Transport.TLSHandshakeTimeout != 0 || a.Transport.ResponseHeaderTimeout != 0 {
+		t.Errorf("The default config shouldn't set any stage timeouts")
+	}
+
+	c := *DefaultHTTPAdapterConfig
+	c.ConnectTimeout = 20 * time.Millisecond
+	c.TLSHandshakeTimeout = 30 * time.Millisecond
+	c.ResponseHeaderTimeout = 400 * time.Millisecond
+	a = NewHTTPAdapter(&c)
+	if a.Transport.DialContext == nil {
+		t.Errorf("A connect timeout should set a dialer")
+	}
+	if a.Transport.TLSHandshakeTimeout != 30*time.Millisecond || a.Transport.ResponseHeaderTimeout != 400*time.Millisecond {
+		t.Errorf("Stage timeouts weren't applied: %v %v", a.Transport.TLSHandshakeTimeout, a.Transport.ResponseHeaderTimeout)
+	}
+}
+
+func TestHTTPAdapterProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String()+" "+r.Header.Get("Proxy-Authorization"))
+	}))
+	defer proxy.Close()
+
+	if a := NewHTTPAdapter(DefaultHTTPAdapterConfig); a.Transport.Proxy != nil {
+		t.Errorf("The default config should connect directly")
+	}
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	proxyURL.User = url.UserPassword("prebid", "secret")
+	c := *DefaultHTTPAdapterConfig
+	c.Proxy = proxyURL
+	a := NewHTTPAdapter(&c)
+
+	req, _ := http.NewRequest("GET", "http://bidder.invalid/openrtb2", nil)
+	if _, err := ctxhttp.Do(context.Background(), a.Client, req); err != nil {
+		t.Fatalf("Request through the proxy failed: %v", err)
+	}
+	// Basic auth for prebid:secret
+	if len(proxied) != 1 || proxied[0] != "http://bidder.invalid/openrtb2 Basic cHJlYmlkOnNlY3JldA==" {
+		t.Errorf("The request should have gone through the proxy with its credentials; got %v", proxied)
+	}
+}
+
+func TestHTTPAdapterFormBody(t *testing.T) {
+	var contentType string
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		form = r.PostForm
+	}))
+	defer server.Close()
+
+	c := *DefaultHTTPAdapterConfig
+	c.BodyFormat = BODY_FORMAT_FORM
+	a := NewHTTPAdapter(&c)
+
+	req, _ := http.NewRequest("POST", server.URL, strings.NewReader(`{"id": "abc", "tmax": 500, "imp": [{"id": "1"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := ctxhttp.Do(context.Background(), a.Client, req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("The stub couldn't parse the form; got status %d", resp.StatusCode)
+	}
+	if contentType != "application/x-www-form-urlencoded" {
+		t.Errorf("Expected a form content type; got %s", contentType)
+	}
+	if form.Get("id") != "abc" || form.Get("tmax") != "500" || form.Get("imp") != `[{"id": "1"}]` {
+		t.Errorf("The JSON fields should be sent as form fields; got %v", form)
+	}
+	if req.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("The caller's request shouldn't be modified")
+	}
+}
+
+func TestFieldMap(t *testing.T) {
+	invalid := [][]FieldRename{
+		{{Path: "seatbid..cpm", To: "price"}},
+		{{Path: "seatbid.bid.cpm", To: ""}},
+		{{Path: "seatbid.bid.cpm", To: "seatbid.bid.price"}},
+	}
+	for _, renames := range invalid {
+		if _, err := NewFieldMap(renames); err == nil {
+			t.Errorf("Expected field map %v to be invalid", renames)
+		}
+	}
+
+	fields, err := NewFieldMap([]FieldRename{{Path: "seatbid.bid.cpm", To: "price"}, {Path: "bidid", To: "id"}})
+	if err != nil {
+		t.Fatalf("Failed to make field map: %v", err)
+	}
+	renamed := fields.Apply([]byte(`{"bidid": "abc", "seatbid": [{"bid": [{"cpm": 1.5}, {"cpm": 2}]}]}`))
+	if string(renamed) != `{"id":"abc","seatbid":[{"bid":[{"price":1.5},{"price":2}]}]}` {
+		t.Errorf("Fields weren't renamed: %s", renamed)
+	}
+	if notJSON := fields.Apply([]byte("garbage")); string(notJSON) != "garbage" {
+		t.Errorf("Invalid JSON should be left alone; got %s", notJSON)
+	}
+	if trailing := fields.Apply([]byte(`{"bidid": "abc"} garbage`)); string(trailing) != `{"bidid": "abc"} garbage` {
+		t.Errorf("JSON with trailing garbage should be left alone; got %s", trailing)
+	}
+
+	// Big IDs and prices must come through exactly as the bidder wrote them
+	renamed = fields.Apply([]byte(`{"bidid": 12345678901234567891, "seatbid": [{"bid": [{"cpm": 1.10, "crid": 9007199254740993}]}]}`))
+	if string(renamed) != `{"id":12345678901234567891,"seatbid":[{"bid":[{"crid":9007199254740993,"price":1.10}]}]}` {
+		t.Errorf("Numbers should be kept as they were; got %s", renamed)
+	}
+}
+
+func TestHTTPAdapterFieldMap(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"seatbid": [{"bid": [{"cpm": 1.5}]}]}`))
+	}))
+	defer server.Close()
+
+	c := *DefaultHTTPAdapterConfig
+	c.ResponseFieldMap, _ = NewFieldMap([]FieldRename{{Path: "seatbid.bid.cpm", To: "price"}})
+	resp, err := NewHTTPAdapter(&c).Client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != `{"seatbid":[{"bid":[{"price":1.5}]}]}` {
+		t.Errorf("Response fields weren't renamed: %s", body)
+	}
+}
+
+type testByteCounter struct {
+	requestBytes  int64
+	responseBytes int64
+}
+
+func (c *testByteCounter) RequestBytes(n int64) {
+	c.requestBytes += n
+}
+
+func (c *testByteCounter) ResponseBytes(n int64) {
+	c.responseBytes += n
+}
+
+func TestHTTPAdapterByteCounter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0123456789"))
+	}))
+	defer server.Close()
+
+	counter := &testByteCounter{}
+	c := *DefaultHTTPAdapterConfig
+	c.ByteCounter = counter
+	resp, err := NewHTTPAdapter(&c).Client.Post(server.URL, "text/plain", strings.NewReader("abcde"))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if counter.requestBytes != 5 || counter.responseBytes != 10 {
+		t.Errorf("Expected 5 request and 10 response bytes; got %d and %d", counter.requestBytes, counter.responseBytes)
+	}
+}
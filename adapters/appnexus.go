@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"net/url"
 	"strings"
 
 	"github.com/dbmedialab/prebid-server/pbs"
@@ -74,7 +73,7 @@ func (a *AppNexusAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidder
 	if err != nil {
 		return nil, err
 	}
-	uri := a.URI
+	uri := endpoint(bidder, a.URI)
 	for i, unit := range bidder.AdUnits {
 		var params appnexusParams
 		err := json.Unmarshal(unit.Params, &params)
@@ -90,7 +89,7 @@ func (a *AppNexusAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidder
 			anReq.Imp[i].TagID = params.InvCode
 			if params.Member != "" {
 				// this assumes that the same member ID is used across all tags, which should be the case
-				uri = fmt.Sprintf("%s?member_id=%s", a.URI, params.Member)
+				uri = fmt.Sprintf("%s?member_id=%s", endpoint(bidder, a.URI), params.Member)
 			}
 
 		}
@@ -164,7 +163,10 @@ func (a *AppNexusAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidder
 	responseBody := string(body)
 
 	if anResp.StatusCode != 200 {
-		return nil, fmt.Errorf("HTTP status %d; body: %s", anResp.StatusCode, responseBody)
+		return nil, &BadStatusError{
+			StatusCode: anResp.StatusCode,
+			Message:    fmt.Sprintf("HTTP status %d; body: %s", anResp.StatusCode, responseBody),
+		}
 	}
 
 	if req.IsDebug {
@@ -174,7 +176,7 @@ func (a *AppNexusAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidder
 	var bidResp openrtb.BidResponse
 	err = json.Unmarshal(body, &bidResp)
 	if err != nil {
-		return nil, err
+		return nil, &BadResponseError{err}
 	}
 
 	bids := make(pbs.PBSBidSlice, 0)
@@ -190,15 +192,17 @@ func (a *AppNexusAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidder
 			}
 
 			pbid := pbs.PBSBid{
-				BidID:       bidID,
-				AdUnitCode:  bid.ImpID,
-				BidderCode:  bidder.BidderCode,
-				Price:       bid.Price,
-				Adm:         bid.AdM,
-				Creative_id: bid.CrID,
-				Width:       bid.W,
-				Height:      bid.H,
-				DealId:      bid.DealID,
+				BidID:        bidID,
+				AdUnitCode:   bid.ImpID,
+				BidderCode:   bidder.BidderCode,
+				Price:        bid.Price,
+				Adm:          bid.AdM,
+				WinNoticeURL: bid.BURL,
+				ImpressionID: bid.ID,
+				Creative_id:  bid.CrID,
+				Width:        bid.W,
+				Height:       bid.H,
+				DealId:       bid.DealID,
 			}
 			mediaType := "banner"
 			// Test for video
@@ -220,13 +224,14 @@ func (a *AppNexusAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidder
 func NewAppNexusAdapter(config *HTTPAdapterConfig, externalURL string) *AppNexusAdapter {
 	a := NewHTTPAdapter(config)
 
-	redirect_uri := fmt.Sprintf("%s/setuid?bidder=adnxs&uid=$UID", externalURL)
-	usersyncURL := "//ib.adnxs.com/getuid?"
+	redirect_uri := fmt.Sprintf("%s/setuid?bidder=adnxs&gdpr={{.GDPR}}&gdpr_consent={{.GDPRConsent}}&uid=$UID", externalURL)
+	usersyncURL := "//ib.adnxs.com/getuid?{{.RedirectURL}}"
 
 	info := &pbs.UsersyncInfo{
-		URL:         fmt.Sprintf("%s%s", usersyncURL, url.QueryEscape(redirect_uri)),
+		URL:         usersyncURL,
 		Type:        "redirect",
 		SupportCORS: false,
+		RedirectURL: redirect_uri,
 	}
 
 	return &AppNexusAdapter{
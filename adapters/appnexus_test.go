@@ -177,6 +177,7 @@ func DummyAppNexusServer(w http.ResponseWriter, r *http.Request) {
 			ImpID: imp.ID,
 			Price: andata.tags[i].bid,
 			AdM:   andata.tags[i].content,
+			BURL:  "http://win.adnxs.com/" + imp.ID,
 		}
 
 		if imp.Video != nil {
@@ -323,7 +324,7 @@ func TestAppNexusBasicResponse(t *testing.T) {
 	cacheClient, _ := dummycache.New()
 	hcs := pbs.HostCookieSettings{}
 
-	pbReq, err := pbs.ParsePBSRequest(req, cacheClient, &hcs)
+	pbReq, err := pbs.ParsePBSRequest(req, cacheClient, &hcs, nil)
 	if err != nil {
 		t.Fatalf("ParsePBSRequest failed: %v", err)
 	}
@@ -359,6 +360,12 @@ func TestAppNexusBasicResponse(t *testing.T) {
 				if bid.Adm != tag.content {
 					t.Errorf("Incorrect bid markup '%s' expected '%s'", bid.Adm, tag.content)
 				}
+				if bid.WinNoticeURL != "http://win.adnxs.com/"+tag.code {
+					t.Errorf("Incorrect win notice URL '%s'", bid.WinNoticeURL)
+				}
+				if bid.ImpressionID != "random-id" {
+					t.Errorf("Incorrect impression ID '%s'", bid.ImpressionID)
+				}
 			}
 		}
 		if !matched {
@@ -379,9 +386,19 @@ func TestAppNexusBasicResponse(t *testing.T) {
 
 func TestAppNexusUserSyncInfo(t *testing.T) {
 	an := NewAppNexusAdapter(DefaultHTTPAdapterConfig, "localhost")
-	if an.usersyncInfo.URL != "//ib.adnxs.com/getuid?localhost%2Fsetuid%3Fbidder%3Dadnxs%26uid%3D%24UID" {
+	if an.usersyncInfo.URL != "//ib.adnxs.com/getuid?{{.RedirectURL}}" {
+		t.Fatalf("should have matched")
+	}
+	if an.usersyncInfo.RedirectURL != "localhost/setuid?bidder=adnxs&gdpr={{.GDPR}}&gdpr_consent={{.GDPRConsent}}&uid=$UID" {
 		t.Fatalf("should have matched")
 	}
+	info, err := an.usersyncInfo.WithMacros(pbs.UsersyncMacros{GDPR: "1", GDPRConsent: "BOEFEAyOEFEAyAHABDENAI4AAAB9vABAASA"})
+	if err != nil {
+		t.Fatalf("Failed to fill in the macros: %v", err)
+	}
+	if info.URL != "//ib.adnxs.com/getuid?localhost%2Fsetuid%3Fbidder%3Dadnxs%26gdpr%3D1%26gdpr_consent%3DBOEFEAyOEFEAyAHABDENAI4AAAB9vABAASA%26uid%3D%24UID" {
+		t.Fatalf("should have matched; got %s", info.URL)
+	}
 	if an.usersyncInfo.Type != "redirect" {
 		t.Fatalf("should be redirect")
 	}
@@ -61,9 +61,13 @@ func coinFlip() bool {
 	return rand.Intn(2) != 0
 }
 
-func (a *FacebookAdapter) callOne(ctx context.Context, reqJSON bytes.Buffer) (result callOneResult, err error) {
+// callOne sends the request to the account's own endpoint, if override is set, or else splits the
+// traffic between the secure and non-secure endpoints
+func (a *FacebookAdapter) callOne(ctx context.Context, override string, reqJSON bytes.Buffer) (result callOneResult, err error) {
 	url := a.URI
-	if coinFlip() {
+	if override != "" {
+		url = override
+	} else if coinFlip() {
 		//50% of traffic to non-secure endpoint
 		url = a.nonSecureUri
 	}
@@ -84,13 +88,17 @@ func (a *FacebookAdapter) callOne(ctx context.Context, reqJSON bytes.Buffer) (re
 	result.responseBody = string(body)
 
 	if anResp.StatusCode != 200 {
-		err = fmt.Errorf("HTTP status %d; body: %s", anResp.StatusCode, result.responseBody)
+		err = &BadStatusError{
+			StatusCode: anResp.StatusCode,
+			Message:    fmt.Sprintf("HTTP status %d; body: %s", anResp.StatusCode, result.responseBody),
+		}
 		return
 	}
 
 	var bidResp openrtb.BidResponse
 	err = json.Unmarshal(body, &bidResp)
 	if err != nil {
+		err = &BadResponseError{err}
 		return
 	}
 	if len(bidResp.SeatBid) == 0 {
@@ -102,9 +110,11 @@ func (a *FacebookAdapter) callOne(ctx context.Context, reqJSON bytes.Buffer) (re
 	bid := bidResp.SeatBid[0].Bid[0]
 
 	result.bid = &pbs.PBSBid{
-		AdUnitCode: bid.ImpID,
-		Price:      bid.Price,
-		Adm:        bid.AdM,
+		AdUnitCode:   bid.ImpID,
+		Price:        bid.Price,
+		Adm:          bid.AdM,
+		WinNoticeURL: bid.BURL,
+		ImpressionID: bid.ID,
 	}
 	return
 }
@@ -212,7 +222,7 @@ func (a *FacebookAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidder
 
 	for i, _ := range requests {
 		go func(bidder *pbs.PBSBidder, reqJSON bytes.Buffer) {
-			result, err := a.callOne(ctx, reqJSON)
+			result, err := a.callOne(ctx, bidder.Endpoint, reqJSON)
 			result.Error = err
 			if result.bid != nil {
 				result.bid.BidderCode = bidder.BidderCode
@@ -241,7 +251,7 @@ func (a *FacebookAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidder
 		}
 		if req.IsDebug {
 			debug := &pbs.BidderDebug{
-				RequestURI:   a.URI,
+				RequestURI:   endpoint(bidder, a.URI),
 				RequestBody:  requests[i].String(),
 				StatusCode:   result.statusCode,
 				ResponseBody: result.responseBody,
@@ -79,7 +79,7 @@ func (a *IndexAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidder *pb
 	j, _ := json.Marshal(indexReq)
 
 	debug := &pbs.BidderDebug{
-		RequestURI: a.URI,
+		RequestURI: endpoint(bidder, a.URI),
 	}
 
 	if req.IsDebug {
@@ -87,7 +87,7 @@ func (a *IndexAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidder *pb
 		bidder.Debug = append(bidder.Debug, debug)
 	}
 
-	httpReq, err := http.NewRequest("POST", a.URI, bytes.NewBuffer(j))
+	httpReq, err := http.NewRequest("POST", endpoint(bidder, a.URI), bytes.NewBuffer(j))
 	httpReq.Header.Add("Content-Type", "application/json;charset=utf-8")
 	httpReq.Header.Add("Accept", "application/json")
 
@@ -103,7 +103,10 @@ func (a *IndexAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidder *pb
 	}
 
 	if ixResp.StatusCode != 200 {
-		return nil, fmt.Errorf("HTTP status: %d", ixResp.StatusCode)
+		return nil, &BadStatusError{
+			StatusCode: ixResp.StatusCode,
+			Message:    fmt.Sprintf("HTTP status: %d", ixResp.StatusCode),
+		}
 	}
 
 	defer ixResp.Body.Close()
@@ -119,7 +122,7 @@ func (a *IndexAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidder *pb
 	var bidResp openrtb.BidResponse
 	err = json.Unmarshal(body, &bidResp)
 	if err != nil {
-		return nil, fmt.Errorf("Error parsing response: %v", err)
+		return nil, &BadResponseError{fmt.Errorf("Error parsing response: %v", err)}
 	}
 
 	bids := make(pbs.PBSBidSlice, 0)
@@ -135,15 +138,17 @@ func (a *IndexAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidder *pb
 			}
 
 			pbid := pbs.PBSBid{
-				BidID:       bidID,
-				AdUnitCode:  bidder.AdUnits[i].Code, // todo: check this
-				BidderCode:  bidder.BidderCode,
-				Price:       bid.Price,
-				Adm:         bid.AdM,
-				Creative_id: bid.CrID,
-				Width:       bid.W,
-				Height:      bid.H,
-				DealId:      bid.DealID,
+				BidID:        bidID,
+				AdUnitCode:   bidder.AdUnits[i].Code, // todo: check this
+				BidderCode:   bidder.BidderCode,
+				Price:        bid.Price,
+				Adm:          bid.AdM,
+				WinNoticeURL: bid.BURL,
+				ImpressionID: bid.ID,
+				Creative_id:  bid.CrID,
+				Width:        bid.W,
+				Height:       bid.H,
+				DealId:       bid.DealID,
 			}
 			bids = append(bids, &pbid)
 		}
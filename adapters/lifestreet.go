@@ -45,8 +45,8 @@ type lifestreetParams struct {
 	SlotTag string `json:"slot_tag"`
 }
 
-func (a *LifestreetAdapter) callOne(ctx context.Context, req *pbs.PBSRequest, reqJSON bytes.Buffer) (result callOneResult, err error) {
-	httpReq, err := http.NewRequest("POST", a.URI, &reqJSON)
+func (a *LifestreetAdapter) callOne(ctx context.Context, req *pbs.PBSRequest, uri string, reqJSON bytes.Buffer) (result callOneResult, err error) {
+	httpReq, err := http.NewRequest("POST", uri, &reqJSON)
 	httpReq.Header.Add("Content-Type", "application/json;charset=utf-8")
 	httpReq.Header.Add("Accept", "application/json")
 
@@ -67,13 +67,17 @@ func (a *LifestreetAdapter) callOne(ctx context.Context, req *pbs.PBSRequest, re
 	}
 
 	if lsmResp.StatusCode != 200 {
-		err = fmt.Errorf("HTTP status %d; body: %s", lsmResp.StatusCode, result.responseBody)
+		err = &BadStatusError{
+			StatusCode: lsmResp.StatusCode,
+			Message:    fmt.Sprintf("HTTP status %d; body: %s", lsmResp.StatusCode, result.responseBody),
+		}
 		return
 	}
 
 	var bidResp openrtb.BidResponse
 	err = json.Unmarshal(body, &bidResp)
 	if err != nil {
+		err = &BadResponseError{err}
 		return
 	}
 	if len(bidResp.SeatBid) == 0 || len(bidResp.SeatBid[0].Bid) == 0 {
@@ -82,14 +86,16 @@ func (a *LifestreetAdapter) callOne(ctx context.Context, req *pbs.PBSRequest, re
 	bid := bidResp.SeatBid[0].Bid[0]
 
 	result.bid = &pbs.PBSBid{
-		AdUnitCode:  bid.ImpID,
-		Price:       bid.Price,
-		Adm:         bid.AdM,
-		Creative_id: bid.CrID,
-		Width:       bid.W,
-		Height:      bid.H,
-		DealId:      bid.DealID,
-		NURL:        bid.NURL,
+		AdUnitCode:   bid.ImpID,
+		Price:        bid.Price,
+		Adm:          bid.AdM,
+		WinNoticeURL: bid.BURL,
+		ImpressionID: bid.ID,
+		Creative_id:  bid.CrID,
+		Width:        bid.W,
+		Height:       bid.H,
+		DealId:       bid.DealID,
+		NURL:         bid.NURL,
 	}
 	return
 }
@@ -156,7 +162,7 @@ func (a *LifestreetAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidde
 	ch := make(chan callOneResult)
 	for i, _ := range bidder.AdUnits {
 		go func(bidder *pbs.PBSBidder, reqJSON bytes.Buffer) {
-			result, err := a.callOne(ctx, req, reqJSON)
+			result, err := a.callOne(ctx, req, endpoint(bidder, a.URI), reqJSON)
 			result.Error = err
 			if result.bid != nil {
 				result.bid.BidderCode = bidder.BidderCode
@@ -180,7 +186,7 @@ func (a *LifestreetAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidde
 		}
 		if req.IsDebug {
 			debug := &pbs.BidderDebug{
-				RequestURI:   a.URI,
+				RequestURI:   endpoint(bidder, a.URI),
 				RequestBody:  requests[i].String(),
 				StatusCode:   result.statusCode,
 				ResponseBody: result.responseBody,
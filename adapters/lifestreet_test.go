@@ -229,7 +229,7 @@ func TestLifestreetBasicResponse(t *testing.T) {
 
 	cacheClient, _ := dummycache.New()
 	hcs := pbs.HostCookieSettings{}
-	pbReq, err := pbs.ParsePBSRequest(req, cacheClient, &hcs)
+	pbReq, err := pbs.ParsePBSRequest(req, cacheClient, &hcs, nil)
 	if err != nil {
 		t.Fatalf("ParsePBSRequest failed: %v", err)
 	}
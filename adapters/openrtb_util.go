@@ -3,6 +3,7 @@ package adapters
 import (
 	"github.com/dbmedialab/prebid-server/pbs"
 
+	"encoding/json"
 	"errors"
 
 	"github.com/mxmCherry/openrtb"
@@ -141,13 +142,14 @@ func makeOpenRTBGeneric(req *pbs.PBSRequest, bidder *pbs.PBSBidder, bidderFamily
 			User:   req.User,
 			Source: &openrtb.Source{
 				TID: req.Tid,
+				Ext: sourceExt(req),
 			},
 			AT:   1,
 			TMax: req.TimeoutMillis,
 		}, nil
 	}
 
-	buyerUID, _, _ := req.Cookie.GetUID(bidderFamily)
+	buyerUID := buyerUID(req, bidder, bidderFamily)
 	id, _, _ := req.Cookie.GetUID("adnxs")
 
 	return openrtb.BidRequest{
@@ -165,12 +167,35 @@ func makeOpenRTBGeneric(req *pbs.PBSRequest, bidder *pbs.PBSBidder, bidderFamily
 		Source: &openrtb.Source{
 			FD:  1, // upstream, aka header
 			TID: req.Tid,
+			Ext: sourceExt(req),
 		},
 		AT:   1,
 		TMax: req.TimeoutMillis,
 	}, nil
 }
 
+// buyerUID is the bidder's own ID for the user. That's the one the auction found for the bidder, which
+// follows the host's cookie_family, or else the one in the cookie for bidderFamily.
+func buyerUID(req *pbs.PBSRequest, bidder *pbs.PBSBidder, bidderFamily string) string {
+	if bidder.UserID != "" {
+		return bidder.UserID
+	}
+	uid, _, _ := req.Cookie.GetUID(bidderFamily)
+	return uid
+}
+
+// sourceExt carries the request's supply chain, as source.ext.schain. It's nil if the request has none.
+func sourceExt(req *pbs.PBSRequest) openrtb.RawJSON {
+	if req.SChain == nil {
+		return nil
+	}
+	ext, err := json.Marshal(map[string]*pbs.SupplyChain{"schain": req.SChain})
+	if err != nil {
+		return nil
+	}
+	return ext
+}
+
 func copyFormats(sizes []openrtb.Format) []openrtb.Format {
 	sizesCopy := make([]openrtb.Format, len(sizes))
 	for i := 0; i < len(sizes); i++ {
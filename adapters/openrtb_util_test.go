@@ -1,6 +1,8 @@
 package adapters
 
 import (
+	"encoding/json"
+
 	"github.com/mxmCherry/openrtb"
 	"github.com/dbmedialab/prebid-server/pbs"
 	"github.com/stretchr/testify/assert"
@@ -57,6 +59,40 @@ func TestOpenRTB(t *testing.T) {
 	assert.EqualValues(t, resp.Imp[0].Instl, 1)
 }
 
+func TestOpenRTBSupplyChain(t *testing.T) {
+	pbReq := pbs.PBSRequest{
+		SChain: &pbs.SupplyChain{
+			Complete: 1,
+			Ver:      "1.0",
+			Nodes:    []pbs.SupplyChainNode{{ASI: "publisher.com", SID: "123", HP: 1}},
+		},
+	}
+	pbBidder := pbs.PBSBidder{
+		BidderCode: "bannerCode",
+		AdUnits: []pbs.PBSAdUnit{
+			{
+				Code:       "unitCode",
+				MediaTypes: []pbs.MediaType{pbs.MEDIA_TYPE_BANNER},
+				Sizes:      []openrtb.Format{{W: 10, H: 12}},
+			},
+		},
+	}
+	resp, err := makeOpenRTBGeneric(&pbReq, &pbBidder, "test", []pbs.MediaType{pbs.MEDIA_TYPE_BANNER}, true)
+	assert.Equal(t, err, nil)
+
+	var ext struct {
+		SChain pbs.SupplyChain `json:"schain"`
+	}
+	assert.Equal(t, json.Unmarshal(resp.Source.Ext, &ext), nil)
+	assert.Equal(t, ext.SChain.Ver, "1.0")
+	assert.Equal(t, len(ext.SChain.Nodes), 1)
+	assert.Equal(t, ext.SChain.Nodes[0].ASI, "publisher.com")
+
+	pbReq.SChain = nil
+	resp, _ = makeOpenRTBGeneric(&pbReq, &pbBidder, "test", []pbs.MediaType{pbs.MEDIA_TYPE_BANNER}, true)
+	assert.Equal(t, len(resp.Source.Ext), 0)
+}
+
 func TestOpenRTBVideo(t *testing.T) {
 
 	pbReq := pbs.PBSRequest{}
@@ -396,6 +432,31 @@ func TestOpenRTBUserWithCookie(t *testing.T) {
 	assert.EqualValues(t, resp.User.BuyerUID, "abcde")
 }
 
+func TestOpenRTBUserWithBidderUserID(t *testing.T) {
+	pbsCookie := pbs.NewPBSCookie()
+	pbsCookie.TrySync("test", "abcde")
+	pbsCookie.TrySync("other", "fghij")
+	pbReq := pbs.PBSRequest{
+		User:   &openrtb.User{},
+		Cookie: pbsCookie,
+	}
+	pbBidder := pbs.PBSBidder{
+		BidderCode: "bannerCode",
+		// The auction looked the ID up under the host's cookie_family for the bidder
+		UserID: "fghij",
+		AdUnits: []pbs.PBSAdUnit{
+			{
+				Code:       "unitCode",
+				MediaTypes: []pbs.MediaType{pbs.MEDIA_TYPE_BANNER},
+				Sizes:      []openrtb.Format{{W: 300, H: 250}},
+			},
+		},
+	}
+	resp, err := makeOpenRTBGeneric(&pbReq, &pbBidder, "test", []pbs.MediaType{pbs.MEDIA_TYPE_BANNER}, true)
+	assert.Equal(t, err, nil)
+	assert.EqualValues(t, resp.User.BuyerUID, "fghij")
+}
+
 func TestSizesCopy(t *testing.T) {
 	formats := []openrtb.Format{
 		{
@@ -149,7 +149,7 @@ func (a *PubmaticAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidder
 	reqJSON, err := json.Marshal(pbReq)
 
 	debug := &pbs.BidderDebug{
-		RequestURI: a.URI,
+		RequestURI: endpoint(bidder, a.URI),
 	}
 
 	if req.IsDebug {
@@ -157,8 +157,8 @@ func (a *PubmaticAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidder
 		bidder.Debug = append(bidder.Debug, debug)
 	}
 
-	userId, _, _ := req.Cookie.GetUID(a.FamilyName())
-	httpReq, err := http.NewRequest("POST", a.URI, bytes.NewBuffer(reqJSON))
+	userId := buyerUID(req, bidder, a.FamilyName())
+	httpReq, err := http.NewRequest("POST", endpoint(bidder, a.URI), bytes.NewBuffer(reqJSON))
 	httpReq.Header.Add("Content-Type", "application/json;charset=utf-8")
 	httpReq.Header.Add("Accept", "application/json")
 	httpReq.AddCookie(&http.Cookie{
@@ -178,7 +178,10 @@ func (a *PubmaticAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidder
 	}
 
 	if pbResp.StatusCode != 200 {
-		return nil, fmt.Errorf("HTTP status: %d", pbResp.StatusCode)
+		return nil, &BadStatusError{
+			StatusCode: pbResp.StatusCode,
+			Message:    fmt.Sprintf("HTTP status: %d", pbResp.StatusCode),
+		}
 	}
 
 	defer pbResp.Body.Close()
@@ -194,7 +197,7 @@ func (a *PubmaticAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidder
 	var bidResp openrtb.BidResponse
 	err = json.Unmarshal(body, &bidResp)
 	if err != nil {
-		return nil, err
+		return nil, &BadResponseError{err}
 	}
 
 	bids := make(pbs.PBSBidSlice, 0)
@@ -210,15 +213,17 @@ func (a *PubmaticAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidder
 			}
 
 			pbid := pbs.PBSBid{
-				BidID:       bidID,
-				AdUnitCode:  bid.ImpID,
-				BidderCode:  bidder.BidderCode,
-				Price:       bid.Price,
-				Adm:         bid.AdM,
-				Creative_id: bid.CrID,
-				Width:       bid.W,
-				Height:      bid.H,
-				DealId:      bid.DealID,
+				BidID:        bidID,
+				AdUnitCode:   bid.ImpID,
+				BidderCode:   bidder.BidderCode,
+				Price:        bid.Price,
+				Adm:          bid.AdM,
+				WinNoticeURL: bid.BURL,
+				ImpressionID: bid.ID,
+				Creative_id:  bid.CrID,
+				Width:        bid.W,
+				Height:       bid.H,
+				DealId:       bid.DealID,
 			}
 
 			bids = append(bids, &pbid)
@@ -652,7 +652,7 @@ func TestPubmaticSampleRequest(t *testing.T) {
 	cacheClient, _ := dummycache.New()
 	hcs := pbs.HostCookieSettings{}
 
-	_, err = pbs.ParsePBSRequest(httpReq, cacheClient, &hcs)
+	_, err = pbs.ParsePBSRequest(httpReq, cacheClient, &hcs, nil)
 	if err != nil {
 		t.Fatalf("Error when parsing request: %v", err)
 	}
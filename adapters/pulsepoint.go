@@ -104,7 +104,7 @@ func (a *PulsePointAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidde
 	}
 	reqJSON, err := json.Marshal(ppReq)
 	debug := &pbs.BidderDebug{
-		RequestURI: a.URI,
+		RequestURI: endpoint(bidder, a.URI),
 	}
 
 	if req.IsDebug {
@@ -112,7 +112,7 @@ func (a *PulsePointAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidde
 		bidder.Debug = append(bidder.Debug, debug)
 	}
 
-	httpReq, err := http.NewRequest("POST", a.URI, bytes.NewBuffer(reqJSON))
+	httpReq, err := http.NewRequest("POST", endpoint(bidder, a.URI), bytes.NewBuffer(reqJSON))
 	httpReq.Header.Add("Content-Type", "application/json;charset=utf-8")
 	httpReq.Header.Add("Accept", "application/json")
 
@@ -128,7 +128,10 @@ func (a *PulsePointAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidde
 	}
 
 	if ppResp.StatusCode != 200 {
-		return nil, fmt.Errorf("HTTP status: %d", ppResp.StatusCode)
+		return nil, &BadStatusError{
+			StatusCode: ppResp.StatusCode,
+			Message:    fmt.Sprintf("HTTP status: %d", ppResp.StatusCode),
+		}
 	}
 
 	defer ppResp.Body.Close()
@@ -144,7 +147,7 @@ func (a *PulsePointAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidde
 	var bidResp openrtb.BidResponse
 	err = json.Unmarshal(body, &bidResp)
 	if err != nil {
-		return nil, err
+		return nil, &BadResponseError{err}
 	}
 
 	bids := make(pbs.PBSBidSlice, 0)
@@ -157,14 +160,16 @@ func (a *PulsePointAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidde
 			}
 
 			pbid := pbs.PBSBid{
-				BidID:       bidID,
-				AdUnitCode:  bid.ImpID,
-				BidderCode:  bidder.BidderCode,
-				Price:       bid.Price,
-				Adm:         bid.AdM,
-				Creative_id: bid.CrID,
-				Width:       bid.W,
-				Height:      bid.H,
+				BidID:        bidID,
+				AdUnitCode:   bid.ImpID,
+				BidderCode:   bidder.BidderCode,
+				Price:        bid.Price,
+				Adm:          bid.AdM,
+				WinNoticeURL: bid.BURL,
+				ImpressionID: bid.ID,
+				Creative_id:  bid.CrID,
+				Width:        bid.W,
+				Height:       bid.H,
 			}
 			bids = append(bids, &pbid)
 		}
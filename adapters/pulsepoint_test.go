@@ -118,6 +118,23 @@ func TestPulsePointBiddingBehavior(t *testing.T) {
 	VerifyIntValue(int(bids[0].Price*100), 210, t)
 }
 
+/**
+ * Verify the account's own endpoint is called instead of the configured one.
+ */
+func TestPulsePointEndpointOverride(t *testing.T) {
+	server := CreateService(BidOnTags("1001")).Server
+	ctx := context.TODO()
+	req := SampleRequest(1, t)
+	bidder := req.Bidders[0]
+	bidder.Endpoint = server.URL
+	adapter := NewPulsePointAdapter(DefaultHTTPAdapterConfig, "http://localhost:1/unused", "http://localhost")
+	bids, err := adapter.Call(ctx, req, bidder)
+	if err != nil {
+		t.Fatalf("Call to the account's endpoint failed: %v", err)
+	}
+	VerifyIntValue(len(bids), 1, t)
+}
+
 /**
  * Verify bidding behavior on multiple impressions, some impressions make a bid
  */
@@ -273,7 +290,7 @@ func SampleRequest(numberOfImpressions int, t *testing.T) *pbs.PBSRequest {
 	cacheClient, _ := dummycache.New()
 	hcs := pbs.HostCookieSettings{}
 
-	parsedReq, err := pbs.ParsePBSRequest(httpReq, cacheClient, &hcs)
+	parsedReq, err := pbs.ParsePBSRequest(httpReq, cacheClient, &hcs, nil)
 	if err != nil {
 		t.Fatalf("Error when parsing request: %v", err)
 	}
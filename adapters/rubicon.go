@@ -184,11 +184,10 @@ func parseRubiconSizes(sizes []openrtb.Format) (primary int, alt []int, err erro
 	return
 }
 
-func (a *RubiconAdapter) callOne(ctx context.Context, req *pbs.PBSRequest, reqJSON bytes.Buffer) (result callOneResult, err error) {
-	httpReq, err := http.NewRequest("POST", a.URI, &reqJSON)
+func (a *RubiconAdapter) callOne(ctx context.Context, req *pbs.PBSRequest, uri string, reqJSON bytes.Buffer) (result callOneResult, err error) {
+	httpReq, err := http.NewRequest("POST", uri, &reqJSON)
 	httpReq.Header.Add("Content-Type", "application/json;charset=utf-8")
 	httpReq.Header.Add("Accept", "application/json")
-	httpReq.Header.Add("User-Agent", "prebid-server/1.0")
 	httpReq.SetBasicAuth(a.XAPIUsername, a.XAPIPassword)
 
 	rubiResp, e := ctxhttp.Do(ctx, a.http.Client, httpReq)
@@ -208,13 +207,17 @@ func (a *RubiconAdapter) callOne(ctx context.Context, req *pbs.PBSRequest, reqJS
 	}
 
 	if rubiResp.StatusCode != 200 {
-		err = fmt.Errorf("HTTP status %d; body: %s", rubiResp.StatusCode, result.responseBody)
+		err = &BadStatusError{
+			StatusCode: rubiResp.StatusCode,
+			Message:    fmt.Sprintf("HTTP status %d; body: %s", rubiResp.StatusCode, result.responseBody),
+		}
 		return
 	}
 
 	var bidResp openrtb.BidResponse
 	err = json.Unmarshal(body, &bidResp)
 	if err != nil {
+		err = &BadResponseError{err}
 		return
 	}
 	if len(bidResp.SeatBid) == 0 {
@@ -226,13 +229,15 @@ func (a *RubiconAdapter) callOne(ctx context.Context, req *pbs.PBSRequest, reqJS
 	bid := bidResp.SeatBid[0].Bid[0]
 
 	result.bid = &pbs.PBSBid{
-		AdUnitCode:  bid.ImpID,
-		Price:       bid.Price,
-		Adm:         bid.AdM,
-		Creative_id: bid.CrID,
-		Width:       bid.W,
-		Height:      bid.H,
-		DealId:      bid.DealID,
+		AdUnitCode:   bid.ImpID,
+		Price:        bid.Price,
+		Adm:          bid.AdM,
+		WinNoticeURL: bid.BURL,
+		ImpressionID: bid.ID,
+		Creative_id:  bid.CrID,
+		Width:        bid.W,
+		Height:       bid.H,
+		DealId:       bid.DealID,
 	}
 
 	// Pull out any server-side determined targeting
@@ -327,7 +332,7 @@ func (a *RubiconAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidder *
 	ch := make(chan callOneResult)
 	for i, _ := range bidder.AdUnits {
 		go func(bidder *pbs.PBSBidder, reqJSON bytes.Buffer) {
-			result, err := a.callOne(ctx, req, reqJSON)
+			result, err := a.callOne(ctx, req, endpoint(bidder, a.URI), reqJSON)
 			result.Error = err
 			if result.bid != nil {
 				result.bid.BidderCode = bidder.BidderCode
@@ -351,7 +356,7 @@ func (a *RubiconAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidder *
 		}
 		if req.IsDebug {
 			debug := &pbs.BidderDebug{
-				RequestURI:   a.URI,
+				RequestURI:   endpoint(bidder, a.URI),
 				RequestBody:  requests[i].String(),
 				StatusCode:   result.statusCode,
 				ResponseBody: result.responseBody,
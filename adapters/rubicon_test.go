@@ -304,7 +304,7 @@ func TestRubiconBasicResponse(t *testing.T) {
 	cacheClient, _ := dummycache.New()
 	hcs := pbs.HostCookieSettings{}
 
-	pbReq, err := pbs.ParsePBSRequest(req, cacheClient, &hcs)
+	pbReq, err := pbs.ParsePBSRequest(req, cacheClient, &hcs, nil)
 	if err != nil {
 		t.Fatalf("ParsePBSRequest failed: %v", err)
 	}
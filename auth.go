@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/dbmedialab/prebid-server/config"
+	"github.com/julienschmidt/httprouter"
+)
+
+// apiKeyHeader carries the partner's API key on /auction requests
+const apiKeyHeader = "X-Api-Key"
+
+// checkAPIKeys makes sure none of the API keys is empty, since an empty key would match the requests
+// which don't send one
+func checkAPIKeys(keys []config.APIKey) error {
+	for i, key := range keys {
+		if key.Key == "" {
+			return fmt.Errorf("api_keys entry %d has an empty key", i)
+		}
+	}
+	return nil
+}
+
+// requireAPIKey rejects the requests which don't carry one of the configured API keys, or whose account_id
+// isn't allowed for their key. The handler is returned unchanged when there are no keys.
+func requireAPIKey(handle httprouter.Handle, keys []config.APIKey) httprouter.Handle {
+	if len(keys) == 0 {
+		return handle
+	}
+	// A nil account list means the key can be used for every account
+	accounts := make(map[string]map[string]bool, len(keys))
+	for _, key := range keys {
+		var allowed map[string]bool
+		if len(key.AccountIDs) > 0 {
+			allowed = make(map[string]bool, len(key.AccountIDs))
+			for _, id := range key.AccountIDs {
+				allowed[id] = true
+			}
+		}
+		accounts[key.Key] = allowed
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		key := r.Header.Get(apiKeyHeader)
+		allowed, ok := accounts[key]
+		ok = ok && key != ""
+		if ok && allowed != nil {
+			body, err := ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				writeAuctionError(w, "Failed to read the request body", err)
+				return
+			}
+			// The auction reads the body again, and reports it if it isn't valid JSON
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			var req struct {
+				AccountID string `json:"account_id"`
+			}
+			json.Unmarshal(body, &req)
+			ok = allowed[req.AccountID]
+		}
+		if !ok {
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			writeAuctionError(w, "Invalid API key", nil)
+			return
+		}
+		handle(w, r, ps)
+	}
+}
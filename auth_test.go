@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dbmedialab/prebid-server/config"
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestRequireAPIKey(t *testing.T) {
+	var handledBody string
+	handle := func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		body, _ := ioutil.ReadAll(r.Body)
+		handledBody = string(body)
+	}
+	keys := []config.APIKey{
+		{Key: "open"},
+		{Key: "partner", AccountIDs: []string{"1001"}},
+	}
+	limited := requireAPIKey(handle, keys)
+
+	tests := []struct {
+		description string
+		key         string
+		body        string
+		code        int
+	}{
+		{"Requests without a key are rejected", "", `{"account_id":"1001"}`, http.StatusUnauthorized},
+		{"Unknown keys are rejected", "unknown", `{"account_id":"1001"}`, http.StatusUnauthorized},
+		{"Keys without accounts allow every account", "open", `{"account_id":"2002"}`, http.StatusOK},
+		{"Keys allow their own accounts", "partner", `{"account_id":"1001"}`, http.StatusOK},
+		{"Keys don't allow other accounts", "partner", `{"account_id":"2002"}`, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		handledBody = ""
+		req := httptest.NewRequest("POST", "/auction", strings.NewReader(test.body))
+		if test.key != "" {
+			req.Header.Set(apiKeyHeader, test.key)
+		}
+		rr := httptest.NewRecorder()
+		limited(rr, req, nil)
+		if rr.Code != test.code {
+			t.Errorf("%s: expected status %d; got %d", test.description, test.code, rr.Code)
+		}
+		if test.code == http.StatusOK && handledBody != test.body {
+			t.Errorf("%s: the handler should get the whole body; got %s", test.description, handledBody)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	requireAPIKey(handle, nil)(rr, httptest.NewRequest("POST", "/auction", strings.NewReader("{}")), nil)
+	if rr.Code != http.StatusOK {
+		t.Errorf("The auction should be open without any keys; got status %d", rr.Code)
+	}
+}
+
+func TestRequireAPIKeyEmptyKey(t *testing.T) {
+	keys := []config.APIKey{{Key: "partner"}, {Key: ""}}
+	if err := checkAPIKeys(keys); err == nil {
+		t.Errorf("Empty API keys should be rejected")
+	}
+	if err := checkAPIKeys(keys[:1]); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	handle := func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {}
+	rr := httptest.NewRecorder()
+	requireAPIKey(handle, keys)(rr, httptest.NewRequest("POST", "/auction", strings.NewReader("{}")), nil)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Requests without the header should be rejected, even with an empty key configured; got status %d", rr.Code)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dbmedialab/prebid-server/pbsmetrics"
+)
+
+// bandwidthTracker counts the bytes an adapter sends and receives, and trips when the adapter uses
+// more than its limit within a window. A tripped adapter isn't called again until the window is over.
+//
+// A nil *bandwidthTracker never trips, so callers don't need to check whether a limit is configured.
+type bandwidthTracker struct {
+	limit  int64
+	window time.Duration
+
+	mu          sync.Mutex
+	windowStart time.Time
+	used        int64
+
+	// metrics is set once the adapter metrics exist, before any auctions are run
+	metrics *pbsmetrics.AdapterMetrics
+}
+
+func newBandwidthTracker(limit int64, window time.Duration) *bandwidthTracker {
+	return &bandwidthTracker{
+		limit:       limit,
+		window:      window,
+		windowStart: time.Now(),
+	}
+}
+
+func (t *bandwidthTracker) RequestBytes(n int64) {
+	t.add(n)
+	if t.metrics != nil {
+		t.metrics.RequestBytesMeter.Mark(n)
+	}
+}
+
+func (t *bandwidthTracker) ResponseBytes(n int64) {
+	t.add(n)
+	if t.metrics != nil {
+		t.metrics.ResponseBytesMeter.Mark(n)
+	}
+}
+
+func (t *bandwidthTracker) add(n int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rollWindow()
+	t.used += n
+}
+
+// tripped is true if the adapter has used up its bandwidth for the current window
+func (t *bandwidthTracker) tripped() bool {
+	if t == nil || t.limit <= 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rollWindow()
+	return t.used >= t.limit
+}
+
+func (t *bandwidthTracker) rollWindow() {
+	if now := time.Now(); now.Sub(t.windowStart) >= t.window {
+		t.windowStart = now
+		t.used = 0
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBandwidthTracker(t *testing.T) {
+	tracker := newBandwidthTracker(100, 20*time.Millisecond)
+	tracker.RequestBytes(40)
+	tracker.ResponseBytes(50)
+	if tracker.tripped() {
+		t.Errorf("The tracker shouldn't trip under its limit")
+	}
+	tracker.ResponseBytes(10)
+	if !tracker.tripped() {
+		t.Errorf("The tracker should trip at its limit")
+	}
+
+	time.Sleep(25 * time.Millisecond)
+	if tracker.tripped() {
+		t.Errorf("The tracker should reset once the window is over")
+	}
+}
+
+func TestUnlimitedBandwidthTracker(t *testing.T) {
+	tracker := newBandwidthTracker(0, time.Minute)
+	tracker.ResponseBytes(1 << 30)
+	if tracker.tripped() {
+		t.Errorf("A tracker without a limit should never trip")
+	}
+
+	var none *bandwidthTracker
+	if none.tripped() {
+		t.Errorf("A nil tracker should never trip")
+	}
+}
@@ -11,6 +11,9 @@ type App struct {
 type Account struct {
 	ID               string `json:"id"`
 	PriceGranularity string `json:"price_granularity"`
+	// RequestSecret signs the account's /auction requests. Requests aren't checked if it's empty.
+	// The dummy datacache never sets it.
+	RequestSecret string `json:"request_secret"`
 }
 
 type Configuration struct {
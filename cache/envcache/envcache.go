@@ -0,0 +1,92 @@
+package envcache
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/dbmedialab/prebid-server/cache"
+	"github.com/golang/glog"
+)
+
+// Cache is an immutable cache of accounts, parsed once from JSON injected into the environment
+type Cache struct {
+	accounts *accountService
+	config   *configService
+}
+
+// accountSettings are the settings that can be given for each account in the JSON
+type accountSettings struct {
+	PriceGranularity string `json:"price_granularity"`
+	RequestSecret    string `json:"request_secret"`
+}
+
+// New parses data as a JSON object mapping account IDs to their settings, e.g.
+//
+//	{"acct1": {"price_granularity": "med", "request_secret": "s3cret"}, "acct2": {}}
+func New(data []byte) (*Cache, error) {
+	var settings map[string]accountSettings
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("Invalid account JSON: %v", err)
+	}
+
+	accounts := make(map[string]*cache.Account, len(settings))
+	for id, s := range settings {
+		accounts[id] = &cache.Account{
+			ID:               id,
+			PriceGranularity: s.PriceGranularity,
+			RequestSecret:    s.RequestSecret,
+		}
+	}
+	glog.Infof("Loaded %d accounts", len(accounts))
+
+	return &Cache{
+		accounts: &accountService{accounts},
+		config:   &configService{},
+	}, nil
+}
+
+func (c *Cache) Accounts() cache.AccountsService {
+	return c.accounts
+}
+func (c *Cache) Config() cache.ConfigService {
+	return c.config
+}
+
+// Close will always return nil
+func (c *Cache) Close() error {
+	return nil
+}
+
+// accountService handles the account information
+type accountService struct {
+	accounts map[string]*cache.Account
+}
+
+// Get will return a copy of the Account if it exists
+func (s *accountService) Get(id string) (*cache.Account, error) {
+	account, ok := s.accounts[id]
+	if !ok {
+		return nil, fmt.Errorf("Not found")
+	}
+	a := *account
+	return &a, nil
+}
+
+// Set not supported, always returns an error since the accounts are fixed at startup
+func (s *accountService) Set(account *cache.Account) error {
+	return fmt.Errorf("Not supported")
+}
+
+// configService has no configs, since only accounts can be injected
+type configService struct {
+}
+
+// Get will always return an error
+func (s *configService) Get(id string) (string, error) {
+	return "", fmt.Errorf("Not found")
+}
+
+// Set not supported, always returns an error
+func (s *configService) Set(id, value string) error {
+	return fmt.Errorf("Not supported")
+}
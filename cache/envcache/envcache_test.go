@@ -0,0 +1,45 @@
+package envcache
+
+import "testing"
+
+func TestEnvCache(t *testing.T) {
+	c, err := New([]byte(`{"account1": {"price_granularity": "med", "request_secret": "s3cret"}, "account2": {}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account, err := c.Accounts().Get("account1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.ID != "account1" {
+		t.Error("Wrong account returned")
+	}
+	if account.PriceGranularity != "med" {
+		t.Errorf("Wrong price granularity returned: %s", account.PriceGranularity)
+	}
+	if account.RequestSecret != "s3cret" {
+		t.Errorf("Wrong request secret returned: %s", account.RequestSecret)
+	}
+
+	if _, err := c.Accounts().Get("account2"); err != nil {
+		t.Errorf("Accounts without settings should still be found")
+	}
+
+	if _, err := c.Accounts().Get("account3"); err == nil {
+		t.Errorf("Unknown accounts should not be found")
+	}
+
+	if err := c.Accounts().Set(account); err == nil {
+		t.Errorf("Accounts should be read only")
+	}
+}
+
+func TestEnvCacheInvalidJSON(t *testing.T) {
+	if _, err := New([]byte(`["account1"]`)); err == nil {
+		t.Errorf("A JSON array should be rejected")
+	}
+	if _, err := New([]byte(``)); err == nil {
+		t.Errorf("Empty data should be rejected")
+	}
+}
@@ -3,15 +3,22 @@ package filecache
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/dbmedialab/prebid-server/cache"
 	"gopkg.in/yaml.v2"
 )
 
+// shared holds the data loaded from the file. The maps are swapped as a pair when the file is reloaded,
+// so they must be accessed while holding the lock.
 type shared struct {
-	Configs  map[string]string
-	Accounts map[string]bool
+	sync.RWMutex
+	Configs map[string]string
+	// Accounts maps each account ID to its request secret, which is empty for accounts without one
+	Accounts map[string]string
 }
 
 // Cache is a file backed cache
@@ -19,6 +26,11 @@ type Cache struct {
 	shared   *shared
 	accounts *accountService
 	config   *configService
+
+	filename string
+	modTime  time.Time
+	done     chan struct{}
+	once     sync.Once
 }
 
 type fileConfig struct {
@@ -29,6 +41,8 @@ type fileConfig struct {
 type fileCacheFile struct {
 	Configs  []fileConfig `yaml:"configs"`
 	Accounts []string     `yaml:"accounts"`
+	// RequestSecrets maps account IDs to the secret which signs their requests. Every ID must be in Accounts.
+	RequestSecrets map[string]string `yaml:"request_secrets"`
 }
 
 // New will load the file into memory
@@ -37,48 +51,120 @@ func New(filename string) (*Cache, error) {
 		glog.Infof("Reading inventory urls from %s", filename)
 	}
 
-	b, err := ioutil.ReadFile(filename)
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	configs, accounts, err := readFile(filename)
 	if err != nil {
 		return nil, err
 	}
 
+	s := &shared{
+		Configs:  configs,
+		Accounts: accounts,
+	}
+
+	return &Cache{
+		shared:   s,
+		accounts: &accountService{s},
+		config:   &configService{s},
+		filename: filename,
+		modTime:  info.ModTime(),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// readFile parses the file into the config and account maps
+func readFile(filename string) (map[string]string, map[string]string, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	if glog.V(2) {
 		glog.Infof("Parsing filecache YAML")
 	}
 
 	var u fileCacheFile
 	if err = yaml.Unmarshal(b, &u); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if glog.V(2) {
 		glog.Infof("Building URL map")
 	}
 
-	s := &shared{}
-
-	s.Configs = make(map[string]string, len(u.Configs))
+	configs := make(map[string]string, len(u.Configs))
 	for _, config := range u.Configs {
-		s.Configs[config.ID] = config.Config
+		configs[config.ID] = config.Config
 	}
 	glog.Infof("Loaded %d configs", len(u.Configs))
 
-	s.Accounts = make(map[string]bool, len(u.Accounts))
+	accounts := make(map[string]string, len(u.Accounts))
 	for _, Account := range u.Accounts {
-		s.Accounts[Account] = true
+		accounts[Account] = ""
+	}
+	for id, secret := range u.RequestSecrets {
+		if _, ok := accounts[id]; !ok {
+			return nil, nil, fmt.Errorf("request_secrets has account %s, which isn't in accounts", id)
+		}
+		accounts[id] = secret
 	}
 	glog.Infof("Loaded %d accounts", len(u.Accounts))
 
-	return &Cache{
-		shared:   s,
-		accounts: &accountService{s},
-		config:   &configService{s},
-	}, nil
+	return configs, accounts, nil
+}
+
+// Reload re-reads the file if it was modified since the last successful load. The new data replaces the
+// old data atomically. If the file can't be read or parsed, the old data is kept and an error is returned.
+func (c *Cache) Reload() error {
+	info, err := os.Stat(c.filename)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(c.modTime) {
+		return nil
+	}
+
+	configs, accounts, err := readFile(c.filename)
+	if err != nil {
+		return err
+	}
+
+	c.shared.Lock()
+	c.shared.Configs = configs
+	c.shared.Accounts = accounts
+	c.shared.Unlock()
+	c.modTime = info.ModTime()
+	return nil
 }
 
-// Close does nothing
-// TODO: close the file
+// WatchFile checks the file for changes every interval, and reloads it when it has been modified.
+// Reload errors are logged, and the previously loaded data stays in use. Watching stops when the Cache is closed.
+func (c *Cache) WatchFile(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.Reload(); err != nil {
+					glog.Errorf("Failed to reload filecache %s, keeping the previous data: %v", c.filename, err)
+				}
+			case <-c.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops watching the file, if WatchFile was called
 func (c *Cache) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+	})
 	return nil
 }
 
@@ -96,11 +182,15 @@ type accountService struct {
 
 // Get will return Account from memory if it exists
 func (s *accountService) Get(id string) (*cache.Account, error) {
-	if _, ok := s.shared.Accounts[id]; !ok {
+	s.shared.RLock()
+	secret, ok := s.shared.Accounts[id]
+	s.shared.RUnlock()
+	if !ok {
 		return nil, fmt.Errorf("Not found")
 	}
 	return &cache.Account{
-		ID: id,
+		ID:            id,
+		RequestSecret: secret,
 	}, nil
 }
 
@@ -116,7 +206,9 @@ type configService struct {
 
 // Get will return config from memory if it exists
 func (s *configService) Get(id string) (string, error) {
+	s.shared.RLock()
 	cfg, ok := s.shared.Configs[id]
+	s.shared.RUnlock()
 	if !ok {
 		return "", fmt.Errorf("Not found")
 	}
@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 )
@@ -77,3 +78,104 @@ func TestFileCache(t *testing.T) {
 		t.Error("config should not exist in cache")
 	}
 }
+
+func writeFileCache(t *testing.T, filename string, fcf *fileCacheFile) {
+	bytes, err := yaml.Marshal(fcf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, bytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileCacheReload(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "filecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpfile.Close()
+	defer os.Remove(tmpfile.Name())
+
+	writeFileCache(t, tmpfile.Name(), &fileCacheFile{Accounts: []string{"account1"}})
+
+	dataCache, err := New(tmpfile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dataCache.Close()
+
+	// Unchanged file should be a no-op
+	if err := dataCache.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dataCache.Accounts().Get("account1"); err != nil {
+		t.Error("account1 should exist in cache")
+	}
+
+	writeFileCache(t, tmpfile.Name(), &fileCacheFile{Accounts: []string{"account2"}})
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(tmpfile.Name(), future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dataCache.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dataCache.Accounts().Get("account1"); err == nil {
+		t.Error("account1 should have been removed on reload")
+	}
+	if _, err := dataCache.Accounts().Get("account2"); err != nil {
+		t.Error("account2 should have been added on reload")
+	}
+
+	// A broken file must not replace the loaded data
+	if err := ioutil.WriteFile(tmpfile.Name(), []byte("accounts: [unterminated"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	future = future.Add(time.Minute)
+	if err := os.Chtimes(tmpfile.Name(), future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dataCache.Reload(); err == nil {
+		t.Error("reload of a broken file should fail")
+	}
+	if _, err := dataCache.Accounts().Get("account2"); err != nil {
+		t.Error("account2 should still exist after a failed reload")
+	}
+}
+
+func TestFileCacheRequestSecrets(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "filecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpfile.Close()
+	defer os.Remove(tmpfile.Name())
+
+	writeFileCache(t, tmpfile.Name(), &fileCacheFile{
+		Accounts:       []string{"signed", "unsigned"},
+		RequestSecrets: map[string]string{"signed": "s3cret"},
+	})
+	dataCache, err := New(tmpfile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dataCache.Close()
+
+	if a, err := dataCache.Accounts().Get("signed"); err != nil || a.RequestSecret != "s3cret" {
+		t.Errorf("Expected the account's request secret to be loaded; got %+v and error %v", a, err)
+	}
+	if a, err := dataCache.Accounts().Get("unsigned"); err != nil || a.RequestSecret != "" {
+		t.Errorf("Accounts without a secret shouldn't get one; got %+v and error %v", a, err)
+	}
+
+	writeFileCache(t, tmpfile.Name(), &fileCacheFile{
+		Accounts:       []string{"signed"},
+		RequestSecrets: map[string]string{"typo": "s3cret"},
+	})
+	if _, err := New(tmpfile.Name()); err == nil {
+		t.Errorf("Secrets for unknown accounts should be rejected")
+	}
+}
@@ -3,14 +3,18 @@ package postgrescache
 import (
 	"bytes"
 	"database/sql"
+	"encoding/binary"
 	"encoding/gob"
 	"fmt"
+	"sync/atomic"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 
 	"github.com/coocood/freecache"
 	"github.com/golang/glog"
 	"github.com/dbmedialab/prebid-server/cache"
+	"github.com/rcrowley/go-metrics"
 )
 
 type PostgresConfig struct {
@@ -21,6 +25,9 @@ type PostgresConfig struct {
 	Password string
 	TTL      int
 	Size     int
+	// ServeStale keeps the entries past their TTL, and serves them while the database can't be reached,
+	// instead of failing the lookup. They're still refreshed as soon as the database is back.
+	ServeStale bool
 }
 
 func (c PostgresConfig) uri() string {
@@ -53,6 +60,9 @@ type shared struct {
 	db         *sql.DB
 	lru        *freecache.Cache
 	ttlSeconds int
+
+	serveStale bool
+	staleMeter metrics.Meter
 }
 
 func newShared(conf PostgresConfig) (*shared, error) {
@@ -65,6 +75,8 @@ func newShared(conf PostgresConfig) (*shared, error) {
 		db:         db,
 		lru:        freecache.NewCache(conf.Size),
 		ttlSeconds: conf.TTL,
+		serveStale: conf.ServeStale,
+		staleMeter: metrics.NilMeter{},
 	}
 
 	if err := s.db.Ping(); err != nil {
@@ -75,6 +87,62 @@ func newShared(conf PostgresConfig) (*shared, error) {
 	return s, nil
 }
 
+// expiryLength is the size of the expiry time kept in front of each value, when stale entries are served
+const expiryLength = 8
+
+// get looks up a value in the LRU. When stale entries are served, the LRU never expires them itself,
+// so each value starts with its expiry time, and stale is set once that's passed.
+func (s *shared) get(key string) (value []byte, stale bool, err error) {
+	b, err := s.lru.Get([]byte(key))
+	if err != nil || !s.serveStale {
+		return b, false, err
+	}
+	if len(b) < expiryLength {
+		return nil, false, freecache.ErrNotFound
+	}
+	expires := int64(binary.BigEndian.Uint64(b[:expiryLength]))
+	return b[expiryLength:], expires != 0 && time.Now().Unix() >= expires, nil
+}
+
+func (s *shared) set(key string, value []byte) {
+	if !s.serveStale {
+		s.lru.Set([]byte(key), value, s.ttlSeconds)
+		return
+	}
+	var expires time.Time
+	if s.ttlSeconds > 0 {
+		expires = time.Now().Add(time.Duration(s.ttlSeconds) * time.Second)
+	}
+	s.setExpiring(key, value, expires)
+}
+
+// setExpiring stores a value which goes stale at expires, or never if it's the zero time
+func (s *shared) setExpiring(key string, value []byte, expires time.Time) {
+	b := make([]byte, expiryLength+len(value))
+	if !expires.IsZero() {
+		binary.BigEndian.PutUint64(b[:expiryLength], uint64(expires.Unix()))
+	}
+	copy(b[expiryLength:], value)
+	s.lru.Set([]byte(key), b, 0)
+}
+
+// staleRetryInterval is how long a stale value is served as is, once the database lookup for it failed,
+// before the database is tried again
+const staleRetryInterval = 10 * time.Second
+
+// useStale decides whether a stale value should be served after the database lookup failed with err.
+// Values which the database no longer has are never served. The value is stored again to expire after
+// staleRetryInterval, so the lookups for it don't each wait on the database while it's down.
+func (s *shared) useStale(key string, value []byte, stale bool, err error) bool {
+	if !stale || err == sql.ErrNoRows {
+		return false
+	}
+	s.setExpiring(key, value, time.Now().Add(staleRetryInterval))
+	s.staleMeter.Mark(1)
+	glog.Warningf("Serving the stale datacache entry for %s for the next %v, since the database lookup failed: %v", key, staleRetryInterval, err)
+	return true
+}
+
 // Cache postgres
 type Cache struct {
 	shared   *shared
@@ -107,23 +175,59 @@ func (c *Cache) Close() error {
 	return c.shared.db.Close()
 }
 
+// SetStaleMeter sets the meter which counts the failed database lookups which fell back to a stale entry
+func (c *Cache) SetStaleMeter(meter metrics.Meter) {
+	c.shared.staleMeter = meter
+}
+
 // AccountService handles the account information
 type accountService struct {
 	shared *shared
+	// noRequestSecret is set once the database turned out not to have the request_secret column
+	noRequestSecret int32
+}
+
+const (
+	accountQuery = "SELECT uuid, price_granularity, request_secret FROM accounts_account where uuid = $1 LIMIT 1"
+	// legacyAccountQuery is used on databases which predate request secrets. They're migrated with
+	//   ALTER TABLE accounts_account ADD COLUMN request_secret text;
+	legacyAccountQuery = "SELECT uuid, price_granularity FROM accounts_account where uuid = $1 LIMIT 1"
+)
+
+// queryAccount looks up the account in the database. Its request secret is left null if the database
+// doesn't have the column yet.
+func (s *accountService) queryAccount(key string, id *string, priceGranularity, requestSecret *sql.NullString) error {
+	if atomic.LoadInt32(&s.noRequestSecret) == 0 {
+		err := s.shared.db.QueryRow(accountQuery, key).Scan(id, priceGranularity, requestSecret)
+		if !isUndefinedColumn(err) {
+			return err
+		}
+		atomic.StoreInt32(&s.noRequestSecret, 1)
+		glog.Warningf("accounts_account has no request_secret column, so account request secrets won't be loaded: %v", err)
+	}
+	return s.shared.db.QueryRow(legacyAccountQuery, key).Scan(id, priceGranularity)
+}
+
+func isUndefinedColumn(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "42703"
 }
 
 // Get echos back the account
 func (s *accountService) Get(key string) (*cache.Account, error) {
 	var account cache.Account
 
-	b, err := s.shared.lru.Get([]byte(key))
-	if err == nil {
+	b, stale, err := s.shared.get(key)
+	if err == nil && !stale {
 		return decodeAccount(b), nil
 	}
 
 	var id string
-	var priceGranularity sql.NullString
-	if err := s.shared.db.QueryRow("SELECT uuid, price_granularity FROM accounts_account where uuid = $1 LIMIT 1", key).Scan(&id, &priceGranularity); err != nil {
+	var priceGranularity, requestSecret sql.NullString
+	if err := s.queryAccount(key, &id, &priceGranularity, &requestSecret); err != nil {
+		if s.shared.useStale(key, b, stale, err) {
+			return decodeAccount(b), nil
+		}
 		/* TODO -- We should store failed attempts in the LRU as well to stop from hitting to DB */
 		return nil, err
 	}
@@ -132,13 +236,16 @@ func (s *accountService) Get(key string) (*cache.Account, error) {
 	if priceGranularity.Valid {
 		account.PriceGranularity = priceGranularity.String
 	}
+	if requestSecret.Valid {
+		account.RequestSecret = requestSecret.String
+	}
 
 	buf := bytes.Buffer{}
 	if err := gob.NewEncoder(&buf).Encode(&account); err != nil {
 		panic(err)
 	}
 
-	s.shared.lru.Set([]byte(key), buf.Bytes(), s.shared.ttlSeconds)
+	s.shared.set(key, buf.Bytes())
 	return &account, nil
 }
 
@@ -166,14 +273,18 @@ func (s *configService) Set(id, value string) error {
 }
 
 func (s *configService) Get(key string) (string, error) {
-	if b, err := s.shared.lru.Get([]byte(key)); err == nil {
+	b, stale, err := s.shared.get(key)
+	if err == nil && !stale {
 		return string(b), nil
 	}
 	var config string
 	if err := s.shared.db.QueryRow("SELECT config FROM s2sconfig_config where uuid = $1 LIMIT 1", key).Scan(&config); err != nil {
+		if s.shared.useStale(key, b, stale, err) {
+			return string(b), nil
+		}
 		/* TODO -- We should store failed attempts in the LRU as well to stop from hitting to DB */
 		return "", err
 	}
-	s.shared.lru.Set([]byte(key), []byte(config), s.shared.ttlSeconds)
+	s.shared.set(key, []byte(config))
 	return config, nil
 }
@@ -1,13 +1,20 @@
 package postgrescache
 
 import (
+	"bytes"
 	"database/sql"
+	"encoding/gob"
+	"errors"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/coocood/freecache"
+	"github.com/dbmedialab/prebid-server/cache"
 	"github.com/erikstmartin/go-testdb"
 	"github.com/golang/glog"
+	"github.com/lib/pq"
+	"github.com/rcrowley/go-metrics"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -53,6 +60,8 @@ func stubnewShared(conf PostgresConfig) *shared {
 		db:         db,
 		lru:        freecache.NewCache(conf.Size),
 		ttlSeconds: 0,
+		serveStale: conf.ServeStale,
+		staleMeter: metrics.NilMeter{},
 	}
 	return s
 }
@@ -60,8 +69,8 @@ func stubnewShared(conf PostgresConfig) *shared {
 func TestPostgresDbPriceGranularity(t *testing.T) {
 	defer testdb.Reset()
 
-	sql := "SELECT uuid, price_granularity FROM accounts_account where uuid = $1 LIMIT 1"
-	columns := []string{"uuid", "price_granularity"}
+	sql := "SELECT uuid, price_granularity, request_secret FROM accounts_account where uuid = $1 LIMIT 1"
+	columns := []string{"uuid", "price_granularity", "request_secret"}
 	result := `
 	  bdc928ef-f725-4688-8171-c104cc715bdf,med
 	  `
@@ -94,8 +103,8 @@ func TestPostgresDbPriceGranularity(t *testing.T) {
 func TestPostgresDbNullPriceGranularity(t *testing.T) {
 	defer testdb.Reset()
 
-	sql := "SELECT uuid, price_granularity FROM accounts_account where uuid = $1 LIMIT 1"
-	columns := []string{"uuid", "price_granularity"}
+	sql := "SELECT uuid, price_granularity, request_secret FROM accounts_account where uuid = $1 LIMIT 1"
+	columns := []string{"uuid", "price_granularity", "request_secret"}
 	result := `
 	  bdc928ef-f725-4688-8171-c104cc715bdf
 	  `
@@ -124,3 +133,109 @@ func TestPostgresDbNullPriceGranularity(t *testing.T) {
 		t.Error("Expected null string")
 	}
 }
+
+func TestPostgresDbRequestSecret(t *testing.T) {
+	defer testdb.Reset()
+
+	sql := "SELECT uuid, price_granularity, request_secret FROM accounts_account where uuid = $1 LIMIT 1"
+	columns := []string{"uuid", "price_granularity", "request_secret"}
+	testdb.StubQuery(sql, testdb.RowsFromCSVString(columns, "signed,med,s3cret"))
+
+	dataCache := StubNew(PostgresConfig{Size: 100})
+	account, err := dataCache.Accounts().Get("signed")
+	if err != nil {
+		t.Fatalf("test postgres db errored: %v", err)
+	}
+	if account.RequestSecret != "s3cret" {
+		t.Errorf("Expected the request secret to be loaded; got '%s'", account.RequestSecret)
+	}
+
+	// The secret is kept in the LRU along with the rest of the account
+	testdb.StubQueryError(sql, errors.New("connection refused"))
+	if account, err := dataCache.Accounts().Get("signed"); err != nil || account.RequestSecret != "s3cret" {
+		t.Errorf("Expected the cached account to keep its secret; got %+v and error %v", account, err)
+	}
+}
+
+func TestPostgresDbWithoutRequestSecret(t *testing.T) {
+	defer testdb.Reset()
+
+	testdb.StubQueryError(accountQuery, &pq.Error{Code: "42703", Message: `column "request_secret" does not exist`})
+	testdb.StubQuery(legacyAccountQuery, testdb.RowsFromCSVString([]string{"uuid", "price_granularity"}, "old,med"))
+
+	dataCache := StubNew(PostgresConfig{Size: 1024 * 1024})
+	account, err := dataCache.Accounts().Get("old")
+	if err != nil {
+		t.Fatalf("Accounts should still load from a database without the request_secret column: %v", err)
+	}
+	if account.ID != "old" || account.PriceGranularity != "med" || account.RequestSecret != "" {
+		t.Errorf("Unexpected account: %+v", account)
+	}
+
+	// Once the column is known to be missing, it isn't asked for again
+	testdb.StubQuery(accountQuery, testdb.RowsFromCSVString([]string{"uuid", "price_granularity", "request_secret"}, "other,med,s3cret"))
+	testdb.StubQuery(legacyAccountQuery, testdb.RowsFromCSVString([]string{"uuid", "price_granularity"}, "other,med"))
+	if account, err := dataCache.Accounts().Get("other"); err != nil || account.RequestSecret != "" {
+		t.Errorf("Expected the legacy query to be used; got %+v and error %v", account, err)
+	}
+
+	// Other errors don't switch to the legacy query
+	fresh := StubNew(PostgresConfig{Size: 1024 * 1024})
+	testdb.StubQueryError(accountQuery, errors.New("connection refused"))
+	if _, err := fresh.Accounts().Get("old"); err == nil {
+		t.Errorf("The lookup should fail while the database is down")
+	}
+	if fresh.accounts.noRequestSecret != 0 {
+		t.Errorf("A failed lookup shouldn't be taken for a missing column")
+	}
+}
+
+func TestPostgresServeStale(t *testing.T) {
+	defer testdb.Reset()
+
+	sql := "SELECT uuid, price_granularity, request_secret FROM accounts_account where uuid = $1 LIMIT 1"
+	testdb.StubQueryError(sql, errors.New("connection refused"))
+
+	dataCache := StubNew(PostgresConfig{Size: 1024 * 1024, ServeStale: true})
+	meter := metrics.NewMeter()
+	dataCache.SetStaleMeter(meter)
+
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(&cache.Account{ID: "stale", PriceGranularity: "dense"})
+	dataCache.shared.setExpiring("stale", buf.Bytes(), time.Now().Add(-time.Minute))
+
+	account, err := dataCache.Accounts().Get("stale")
+	if err != nil {
+		t.Fatalf("The stale account should be served while the database is down: %v", err)
+	}
+	if account.ID != "stale" || account.PriceGranularity != "dense" {
+		t.Errorf("Unexpected stale account: %+v", account)
+	}
+	if meter.Count() != 1 {
+		t.Errorf("The stale lookup should be counted; got %d", meter.Count())
+	}
+
+	if _, err := dataCache.Accounts().Get("uncached"); err == nil {
+		t.Errorf("Accounts which were never cached should still fail")
+	}
+
+	// The database isn't tried again for a while, even if it's back
+	testdb.StubQuery(sql, testdb.RowsFromCSVString([]string{"uuid", "price_granularity", "request_secret"}, "stale,med,"))
+	if account, err := dataCache.Accounts().Get("stale"); err != nil || account.PriceGranularity != "dense" {
+		t.Errorf("The stale account should be served until the retry; got %+v and error %v", account, err)
+	}
+	if meter.Count() != 1 {
+		t.Errorf("Only the failed lookup should be counted; got %d", meter.Count())
+	}
+	dataCache.shared.setExpiring("stale", buf.Bytes(), time.Now().Add(-time.Minute))
+	if account, err := dataCache.Accounts().Get("stale"); err != nil || account.PriceGranularity != "med" {
+		t.Errorf("The account should be refreshed once the retry is due; got %+v and error %v", account, err)
+	}
+
+	// Accounts which were deleted from the database aren't served, however recently they were cached
+	dataCache.shared.setExpiring("stale", buf.Bytes(), time.Now().Add(-time.Minute))
+	testdb.StubQuery(sql, testdb.RowsFromCSVString([]string{"uuid", "price_granularity", "request_secret"}, ""))
+	if _, err := dataCache.Accounts().Get("stale"); err == nil {
+		t.Errorf("An account missing from the database shouldn't be served stale")
+	}
+}
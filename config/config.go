@@ -1,6 +1,8 @@
 package config
 
 import (
+	"strings"
+
 	"github.com/spf13/viper"
 )
 
@@ -11,12 +13,200 @@ type Configuration struct {
 	Port            int                `mapstructure:"port"`
 	AdminPort       int                `mapstructure:"admin_port"`
 	DefaultTimeout  uint64             `mapstructure:"default_timeout_ms"`
+	TimeoutBuffer   uint64             `mapstructure:"timeout_buffer_ms"`
 	CacheURL        string             `mapstructure:"prebid_cache_url"`
+	CacheBatchSize  int                `mapstructure:"prebid_cache_batch_size"`
+	CacheIDSecret   string             `mapstructure:"prebid_cache_id_secret"`
 	RecaptchaSecret string             `mapstructure:"recaptcha_secret"`
 	HostCookie      HostCookie         `mapstructure:"host_cookie"`
 	Metrics         Metrics            `mapstructure:"metrics"`
 	DataCache       DataCache          `mapstructure:"datacache"`
+	Trace           Trace              `mapstructure:"trace"`
+	TestBids        TestBids           `mapstructure:"test_bids"`
+	SafariNoCookie  SafariNoCookie     `mapstructure:"safari_no_cookie"`
+	KeyValues       KeyValues          `mapstructure:"key_values"`
+	Pprof           Pprof              `mapstructure:"pprof"`
+	Chaos           Chaos              `mapstructure:"chaos"`
+	Alerts          Alerts             `mapstructure:"alerts"`
+	Overload        Overload           `mapstructure:"overload"`
 	Adapters        map[string]Adapter `mapstructure:"adapters"`
+
+	// ErrorDegradation shortens the timeout of the adapters which fail too often, so they don't hold up the auctions
+	ErrorDegradation ErrorDegradation `mapstructure:"error_degradation"`
+	// RecaptchaDisabled lets /optout requests through without a recaptcha, for internal opt-out flows
+	RecaptchaDisabled bool `mapstructure:"recaptcha_disabled"`
+	// RecaptchaMinScore is the lowest recaptcha v3 score /optout accepts. 0 accepts any recaptcha which passes,
+	// and is needed for v2 recaptchas, since they have no score.
+	RecaptchaMinScore float64 `mapstructure:"recaptcha_min_score"`
+
+	// APIKeys are the keys which /auction accepts in its X-Api-Key header. /auction is open to anyone when
+	// there are none.
+	APIKeys []APIKey `mapstructure:"api_keys"`
+
+	// FillMetricSizes are the "WxH" creative sizes whose bids are counted for each account. Bids of other
+	// sizes aren't counted, so oddball sizes don't each add a metric.
+	FillMetricSizes []string `mapstructure:"fill_metric_sizes"`
+
+	// SummaryLogLevel is the glog verbosity of the line logged at the end of every auction. 0 always logs it,
+	// and a negative level turns it off.
+	SummaryLogLevel int `mapstructure:"summary_log_level"`
+
+	// CurrencyRates are the exchange rates from US Dollars, like "eur: 0.85", used to convert bids for requests
+	// which ask for another currency
+	CurrencyRates map[string]float64 `mapstructure:"currency_rates"`
+
+	// InvalidMarkup is "sanitize" or "drop", and decides what happens to bids whose adm isn't valid UTF-8:
+	// the invalid bytes are replaced, or the bid is dropped.
+	InvalidMarkup string `mapstructure:"invalid_markup"`
+	// MaxBidsPerAdapter caps the bids accepted from a single adapter call. The lowest priced bids over the cap are dropped.
+	// Adapters can override it with their own max_bids. 0 means no limit.
+	MaxBidsPerAdapter int `mapstructure:"max_bids_per_adapter"`
+	// BandwidthWindowSeconds is the window for the adapters' max_bandwidth_bytes
+	BandwidthWindowSeconds int `mapstructure:"bandwidth_window_seconds"`
+	// CacheUnavailable is either "inline" or "error", and decides what happens to cache_markup requests when
+	// prebid cache isn't configured, or none of the bids could be put in it. "inline" returns the bids with
+	// their markup, and sets cache_unavailable in the response.
+	CacheUnavailable string `mapstructure:"cache_unavailable"`
+	// MinBidsToCache is the fewest bids an auction needs for them to be put in prebid cache. Auctions with
+	// fewer bids return them with their markup, even when the request asks for cache_markup.
+	MinBidsToCache int `mapstructure:"min_bids_to_cache"`
+	// CacheTTLSeconds is how long the bids put in prebid cache are kept, when the request doesn't say.
+	// CacheTTLByMediaType overrides it for the bids of each media type, like "video". 0 leaves it to prebid cache.
+	CacheTTLSeconds     int64            `mapstructure:"cache_ttl_seconds"`
+	CacheTTLByMediaType map[string]int64 `mapstructure:"cache_ttl_by_media_type"`
+	// MaxCachedBids caps how many bids, taken by highest CPM, are put in prebid cache for each request.
+	// The other bids are returned with their markup. 0 means no limit.
+	MaxCachedBids int `mapstructure:"max_cached_bids"`
+	// MinAdSize is the smallest creative size accepted, so bids like 1x1 trackers can be dropped. Smaller bids
+	// are only kept when their ad unit asked for that size. Accounts can set their own min_ad_size.
+	MinAdSize AdSize `mapstructure:"min_ad_size"`
+	// OutboundUserAgent is the User-Agent sent on requests to the bidders
+	OutboundUserAgent string `mapstructure:"outbound_user_agent"`
+	// OutboundProxy is the HTTP(S) proxy which the adapters' requests go through. Adapters can set their own
+	// proxy to override it. Requests go straight to the bidders when the URL is empty.
+	OutboundProxy Proxy `mapstructure:"outbound_proxy"`
+	// MaxConcurrentAdapterCalls caps the adapter calls in flight across all auctions. 0 means no limit.
+	MaxConcurrentAdapterCalls int `mapstructure:"max_concurrent_adapter_calls"`
+	// MaxConcurrentAuctions caps the /auction requests being processed at once. Requests over the cap wait up to
+	// AuctionQueueTimeoutMillis for a slot, and are turned away with a 503 if none comes free. 0 means no limit.
+	MaxConcurrentAuctions     int    `mapstructure:"max_concurrent_auctions"`
+	AuctionQueueTimeoutMillis uint64 `mapstructure:"auction_queue_timeout_ms"`
+	// MaxConcurrentAuctionsPerIP caps the /auction requests in flight from a single client IP. Requests over
+	// the cap are turned away with a 429. 0 means no limit.
+	MaxConcurrentAuctionsPerIP int `mapstructure:"max_concurrent_auctions_per_ip"`
+	// TrustedIPs are the IPs and CIDR ranges, like our own edge, which max_concurrent_auctions_per_ip doesn't apply to.
+	// Both are matched against the peer which connected, not X-Forwarded-For.
+	TrustedIPs []string `mapstructure:"trusted_ips"`
+	// RequiredRequestFields lists the /auction request fields which must be present, besides the ad units.
+	// See requiredFieldChecks in the pbs package for the supported fields.
+	RequiredRequestFields []string `mapstructure:"required_request_fields"`
+	// RequestValidation is "off", "warn" or "enforce", and decides whether /auction requests are checked
+	// against the request schema, and whether the ones which fail are logged or rejected.
+	RequestValidation string `mapstructure:"request_validation"`
+	// DropBiddersWithoutParams leaves a bidder out of the ad units where its params are missing or empty.
+	// Bidders left without any ad units get a "Missing params" error instead of being called.
+	DropBiddersWithoutParams bool `mapstructure:"drop_bidders_without_params"`
+	// RequestParamFields copy request fields into the bidders' params, for adapters which need a value the
+	// client already sends once for the whole request. Params the bidder was given in the request win.
+	RequestParamFields []RequestParamField `mapstructure:"request_param_fields"`
+	// AnonymizeIP truncates the client's IP, to the first 3 octets of IPv4 or the first 48 bits of IPv6,
+	// before it's sent to the adapters.
+	AnonymizeIP bool `mapstructure:"anonymize_ip"`
+	// SChainASI is the host's ads.txt domain. When it's set, the host adds its own node to the schain of the
+	// requests which carry one, with the account ID as the seller ID.
+	SChainASI string `mapstructure:"schain_asi"`
+	// DuplicateBidders is either "dedup" or "reject", and decides what happens to requests which
+	// list the same bidder more than once for an ad unit.
+	DuplicateBidders string `mapstructure:"duplicate_bidders"`
+	// FoldAdUnitCodes lowercases the ad unit codes, which are always trimmed of whitespace
+	FoldAdUnitCodes bool `mapstructure:"fold_ad_unit_codes"`
+	// MinTimeoutMillis and MaxTimeoutMillis bound the timeout_millis of /auction requests. InvalidTimeout is either
+	// "default" or "reject", and decides whether requests outside of the bounds get default_timeout_ms or are rejected.
+	// MaxTimeoutMillis defaults to 2000.
+	MinTimeoutMillis uint64 `mapstructure:"min_timeout_ms"`
+	MaxTimeoutMillis uint64 `mapstructure:"max_timeout_ms"`
+	InvalidTimeout   string `mapstructure:"invalid_timeout"`
+	// DuplicateAdUnits is either "dedup" or "reject", and decides what happens to requests with
+	// more than one ad unit using the same code.
+	DuplicateAdUnits string `mapstructure:"duplicate_ad_units"`
+	// AppWithCookie is "app", "web" or "reject", and decides how app requests which also carry a uids cookie
+	// are handled: as app traffic, as web traffic, or not at all.
+	AppWithCookie string `mapstructure:"app_with_cookie"`
+	// DefaultAccountID is used for /auction requests which don't give an account_id. Empty means there's no default.
+	DefaultAccountID string `mapstructure:"default_account_id"`
+	// NoBidPixelURL is the tracking URL returned for ad units without bids, when the request turns on the
+	// no_bid_pixels flag. $AD_UNIT_CODE and $TID are replaced with the ad unit's code and the request's tid.
+	NoBidPixelURL string `mapstructure:"no_bid_pixel_url"`
+	// DemandSDKBidders get the demand_sdk creative load type in their targeting, since their creatives
+	// must be rendered by their own SDK. The default is just audienceNetwork.
+	DemandSDKBidders []string `mapstructure:"demand_sdk_bidders"`
+	// NoCachePaths are the request paths whose responses get headers which stop browsers caching them.
+	// Everything else, like /static, can be cached normally.
+	NoCachePaths []string `mapstructure:"no_cache_paths"`
+	// KeywordProfiles are the ad server keyword formats which requests can choose with keyword_profile
+	KeywordProfiles map[string]KeywordProfile `mapstructure:"keyword_profiles"`
+	// DefaultKeywordProfile names the keyword profile used by requests which don't choose one.
+	// If it's empty, the DFP style hb_ keys are used.
+	DefaultKeywordProfile string `mapstructure:"default_keyword_profile"`
+	// Accounts holds the host's settings for individual accounts, keyed by account ID
+	Accounts map[string]Account `mapstructure:"accounts"`
+	// RequestFlags maps each experimental feature flag to the accounts allowed to turn it on. "*" allows every account.
+	RequestFlags map[string][]string `mapstructure:"request_flags"`
+}
+
+// Account holds the settings which a host can turn on for a single account
+type Account struct {
+	// DedupCreatives drops the lower priced bids on an ad unit which have the same creative as a higher priced one
+	DedupCreatives bool `mapstructure:"dedup_creatives"`
+	// AllowedSizes lists the creative sizes, as "WxH", which the account accepts. Empty allows every size.
+	AllowedSizes []string `mapstructure:"allowed_sizes"`
+	// FallbackBidder is held back from the account's auctions, and only called when no other bidder bids.
+	// It still has to be listed in the request, with its params.
+	FallbackBidder string `mapstructure:"fallback_bidder"`
+	// HouseAd is returned for every ad unit when no bidder, including the fallback bidder, bids
+	HouseAd HouseAd `mapstructure:"house_ad"`
+	// ExtraPriceGranularities are also emitted for the top bid, as hb_pb_<granularity>, next to hb_pb at the
+	// account's own granularity.
+	ExtraPriceGranularities []string `mapstructure:"extra_price_granularities"`
+	// AdapterEndpoints override the adapters' endpoints for the account, keyed by bidder code, for publishers
+	// with their own managed endpoint at an SSP
+	AdapterEndpoints map[string]string `mapstructure:"adapter_endpoints"`
+	// MinAdSize overrides the host's min_ad_size for the account, when its width or height is set
+	MinAdSize AdSize `mapstructure:"min_ad_size"`
+	// CacheNamespace prefixes the cache IDs of the account's bids, so they're kept apart from other accounts'.
+	// prebid-cache has to allow setting keys. Empty lets prebid-cache pick the IDs. It may only have letters,
+	// digits and dashes.
+	CacheNamespace string `mapstructure:"cache_namespace"`
+}
+
+// AdSize is a creative size in pixels
+type AdSize struct {
+	Width  uint64 `mapstructure:"width"`
+	Height uint64 `mapstructure:"height"`
+}
+
+// HouseAd is an account's own ad, used to fill ad units which get no bids. An empty Adm turns it off.
+type HouseAd struct {
+	CPM float64 `mapstructure:"cpm"`
+	// Width and Height default to the ad unit's first size
+	Width  uint64 `mapstructure:"width"`
+	Height uint64 `mapstructure:"height"`
+	Adm    string `mapstructure:"adm"`
+}
+
+// RequestParamField copies the request's Field into the Param of the Bidder's params. It's a list rather than
+// a map, because viper would lowercase the param names. See requestParamValues in the pbs package for the
+// supported fields.
+type RequestParamField struct {
+	Bidder string `mapstructure:"bidder"`
+	Param  string `mapstructure:"param"`
+	Field  string `mapstructure:"field"`
+}
+
+// GetAccount returns the settings for an account. Accounts without settings get the zero value.
+func (cfg *Configuration) GetAccount(id string) Account {
+	// viper lowercases every map key
+	return cfg.Accounts[strings.ToLower(id)]
 }
 
 type HostCookie struct {
@@ -36,6 +226,64 @@ type Adapter struct {
 		Password string `mapstructure:"password"`
 		Tracker  string `mapstructure:"tracker"`
 	} `mapstructure:"xapi"` // needed for Rubicon
+	// CookieFamily overrides the adapter's own cookie family, for syncs and user ID lookups
+	CookieFamily string `mapstructure:"cookie_family"`
+	// Priority decides which adapters get called first when max_concurrent_adapter_calls is reached. Higher goes first.
+	Priority int `mapstructure:"priority"`
+	// TimeoutNotificationURL gets a GET with the request's tid whenever this adapter times out. Empty disables it.
+	TimeoutNotificationURL string `mapstructure:"timeout_notification_url"`
+	// Timeouts for the stages of the adapter's HTTP calls. 0 leaves the stage limited only by the auction's timeout.
+	ConnectTimeoutMillis        uint64 `mapstructure:"connect_timeout_ms"`
+	TLSHandshakeTimeoutMillis   uint64 `mapstructure:"tls_handshake_timeout_ms"`
+	ResponseHeaderTimeoutMillis uint64 `mapstructure:"response_header_timeout_ms"`
+	// MaxBids overrides max_bids_per_adapter for this adapter, when it's above 0
+	MaxBids int `mapstructure:"max_bids"`
+	// MaxBandwidthBytes limits the request and response bytes within each bandwidth_window_seconds. Once it's used up,
+	// the adapter isn't called until the window is over. 0 means no limit.
+	MaxBandwidthBytes int64 `mapstructure:"max_bandwidth_bytes"`
+	// ResponseFieldMap renames fields in the bidder's responses, in order, so they match what the adapter expects
+	ResponseFieldMap []ResponseField `mapstructure:"response_field_map"`
+	// HoldoutPercent leaves the adapter out of this percentage of auctions, picked from the request's tid,
+	// so its incremental value can be measured. 0 turns the A/B split off.
+	HoldoutPercent float64 `mapstructure:"holdout_percent"`
+	// ResponseCache reuses the adapter's responses for identical requests. It's off unless a TTL is set.
+	ResponseCache ResponseCache `mapstructure:"response_cache"`
+	// Currency is the currency of the adapter's bids. Empty means US Dollars.
+	Currency string `mapstructure:"currency"`
+	// MaxCPM is the highest price the adapter's bids can sanely have. Bids over it are dropped, or capped at
+	// MaxCPM if MaxCPMPolicy is "cap". 0 means no limit.
+	MaxCPM       float64 `mapstructure:"max_cpm"`
+	MaxCPMPolicy string  `mapstructure:"max_cpm_policy"`
+	// Proxy overrides outbound_proxy for this adapter, when its URL is set
+	Proxy Proxy `mapstructure:"proxy"`
+	// BodyFormat is "json" or "form", and decides how the adapter's request bodies are encoded. Defaults to json.
+	BodyFormat string `mapstructure:"body_format"`
+	// SLAMillis is the response time the adapter has agreed to. Its calls are counted as having met or missed it,
+	// for the partner's scorecard. 0 means no SLA, and every call meets it.
+	SLAMillis int `mapstructure:"sla_ms"`
+}
+
+// Proxy is an outbound HTTP(S) proxy. The username and password, if set, are sent as basic auth to the proxy.
+type Proxy struct {
+	URL      string `mapstructure:"url"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+}
+
+// ResponseCache configures an adapter's response cache. It should only be turned on for demand which
+// doesn't bid differently for each user.
+type ResponseCache struct {
+	TTLSeconds int `mapstructure:"ttl_seconds"`
+	// KeyFields are the parts of the request, besides the ad unit codes, which requests must share to get
+	// the same response: "sizes", "params", "geo" and "domain". Defaults to sizes, params and geo.
+	KeyFields []string `mapstructure:"key_fields"`
+}
+
+// ResponseField renames the field at Path, like "seatbid.bid.cpm", to To, like "price".
+// Arrays along the path are walked through.
+type ResponseField struct {
+	Path string `mapstructure:"path"`
+	To   string `mapstructure:"to"`
 }
 
 type Metrics struct {
@@ -43,6 +291,141 @@ type Metrics struct {
 	Database string `mapstructure:"database"`
 	Username string `mapstructure:"username"`
 	Password string `mapstructure:"password"`
+	// MaxDumpAccounts caps how many accounts are included in the admin JSON metrics dump. 0 means no limit.
+	MaxDumpAccounts int `mapstructure:"max_dump_accounts"`
+	// AccountIdleSeconds drops the metrics of the accounts without any requests for this long, so they stop
+	// being exported. 0 keeps every account's metrics.
+	AccountIdleSeconds int `mapstructure:"account_idle_seconds"`
+}
+
+// KeywordProfile changes the format of the ad server targeting keywords. Empty fields keep the DFP style default.
+type KeywordProfile struct {
+	// KeyPrefix replaces the "hb_" which starts every key
+	KeyPrefix string `mapstructure:"key_prefix"`
+	// BidderSeparator goes between a key and the bidder code in the per-bidder keys, instead of "_"
+	BidderSeparator string `mapstructure:"bidder_separator"`
+	// SizeSeparator goes between the width and height of the size value, instead of "x"
+	SizeSeparator string `mapstructure:"size_separator"`
+}
+
+// SafariNoCookie changes how auctions are run for Safari requests without any synced cookies. Since Safari
+// blocks most third party cookies, syncing rarely helps, and bidders which need a cookie rarely bid.
+// The zero value runs these auctions like any other.
+type SafariNoCookie struct {
+	// SkipBidders are never called for these requests
+	SkipBidders []string `mapstructure:"skip_bidders"`
+	// SkipNoCookieBidders leaves out every bidder without a user ID, not just the ones which ask for it
+	SkipNoCookieBidders bool `mapstructure:"skip_no_cookie_bidders"`
+	// SkipUsersyncs doesn't return usersync info for bidders without a user ID
+	SkipUsersyncs bool `mapstructure:"skip_usersyncs"`
+}
+
+// Chaos slows down adapter calls on purpose, to test how timeouts and partial results are handled.
+// It's only for test environments, and does nothing unless Enabled is set.
+type Chaos struct {
+	Enabled bool `mapstructure:"enabled"`
+	// AdapterDelays maps bidder codes to the milliseconds each of their calls is delayed by
+	AdapterDelays map[string]uint64 `mapstructure:"adapter_delays_ms"`
+}
+
+// Overload sheds /auction requests with a 503 while the process is overloaded, so the load balancers can
+// retry them elsewhere. Each threshold is off when it's 0, so nothing is shed by default.
+type Overload struct {
+	// MaxGoroutines is the most goroutines the process can have before it's overloaded
+	MaxGoroutines int `mapstructure:"max_goroutines"`
+	// MaxMemoryPercent is the most of the host's memory which can be in use before the process is overloaded
+	MaxMemoryPercent float64 `mapstructure:"max_memory_percent"`
+	// CheckIntervalMillis is how often the load is measured
+	CheckIntervalMillis uint64 `mapstructure:"check_interval_ms"`
+	// RetryAfterSeconds is sent in the Retry-After header of the shed requests
+	RetryAfterSeconds int `mapstructure:"retry_after_seconds"`
+}
+
+// Pprof controls the net/http/pprof profiling endpoints on the admin port
+type Pprof struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Token, if set, must be sent in the X-Pprof-Token header or the token query param
+	Token string `mapstructure:"token"`
+	// AllowedIPs, if set, are the only client IPs which can use the endpoints
+	AllowedIPs []string `mapstructure:"allowed_ips"`
+}
+
+// KeyValues limits the publisher key-values which /auction requests can pass through to the ad server targeting.
+// Requests over any of the limits are rejected.
+type KeyValues struct {
+	MaxCount       int `mapstructure:"max_count"`
+	MaxKeyLength   int `mapstructure:"max_key_length"`
+	MaxValueLength int `mapstructure:"max_value_length"`
+}
+
+// TestBids configures the synthetic bids returned to the test account, so clients can check how they
+// render ads and handle keywords without any real demand.
+type TestBids struct {
+	// AccountID is the only account which gets test bids. Empty turns test bids off.
+	AccountID string `mapstructure:"account_id"`
+	// SkipAdapters returns only the test bids, without calling the adapters
+	SkipAdapters bool    `mapstructure:"skip_adapters"`
+	CPM          float64 `mapstructure:"cpm"`
+	// Width and Height default to the ad unit's first size
+	Width  uint64 `mapstructure:"width"`
+	Height uint64 `mapstructure:"height"`
+	Adm    string `mapstructure:"adm"`
+	// StoredResponses maps bidder codes to a JSON list of bids, which the bidder returns to the test account
+	// instead of being called. Bids without a code are made for every ad unit.
+	StoredResponses map[string]string `mapstructure:"stored_responses"`
+}
+
+// Trace configures the sampled capture of adapter requests and responses
+type Trace struct {
+	// SampleRate is the fraction of adapter calls which get traced. 0 disables tracing.
+	SampleRate float64 `mapstructure:"sample_rate"`
+	// Store is "file" or "postgres". The postgres store uses the datacache's connection settings.
+	Store    string `mapstructure:"store"`
+	Filename string `mapstructure:"filename"`
+}
+
+// APIKey is a partner's credential for /auction. Keys without any AccountIDs can be used for every account.
+type APIKey struct {
+	Key        string   `mapstructure:"key"`
+	AccountIDs []string `mapstructure:"account_ids"`
+}
+
+// Alerts configures the notifications sent when adapters are slow or failing. They're off without a WebhookURL.
+type Alerts struct {
+	// WebhookURL gets a POST with a Slack style {"text": "..."} body for every alert
+	WebhookURL string `mapstructure:"webhook_url"`
+	// CheckIntervalSeconds is how often the adapters' metrics are checked. It must be above 0 when alerts are on.
+	CheckIntervalSeconds int `mapstructure:"check_interval_seconds"`
+	// SustainedChecks is how many checks in a row an adapter has to breach a threshold before it's reported
+	SustainedChecks int `mapstructure:"sustained_checks"`
+	// RepeatMinutes is the least time between two alerts for the same adapter
+	RepeatMinutes int `mapstructure:"repeat_minutes"`
+	// Default thresholds apply to every adapter. Adapters is keyed by bidder code, and replaces the
+	// defaults for single adapters.
+	Default  AlertThresholds            `mapstructure:"default"`
+	Adapters map[string]AlertThresholds `mapstructure:"adapters"`
+}
+
+// AlertThresholds are the limits which trigger an alert. 0 turns a threshold off.
+type AlertThresholds struct {
+	// P95LatencyMillis is the highest p95 of the adapter's request time
+	P95LatencyMillis int64 `mapstructure:"p95_latency_ms"`
+	// ErrorRate is the highest fraction of the adapter's requests, since the last check, which may fail.
+	// Timeouts don't count as errors.
+	ErrorRate float64 `mapstructure:"error_rate"`
+}
+
+// ErrorDegradation decides when an adapter is degraded, and how much of the auction's time it gets then.
+// It's off unless ErrorRate is set. Unlike the alerts, timeouts count as failures.
+type ErrorDegradation struct {
+	// WindowSeconds is how far back the adapter's calls are counted, between one and two windows
+	WindowSeconds int `mapstructure:"window_seconds"`
+	// MinRequests is how many calls the adapter needs in the window before it can be degraded
+	MinRequests int `mapstructure:"min_requests"`
+	// ErrorRate is the fraction of the adapter's calls which have to fail for it to be degraded
+	ErrorRate float64 `mapstructure:"error_rate"`
+	// TimeoutPercent is the percentage of the time left in the auction which a degraded adapter gets
+	TimeoutPercent float64 `mapstructure:"timeout_percent"`
 }
 
 type DataCache struct {
@@ -54,6 +437,15 @@ type DataCache struct {
 	Password   string `mapstructure:"password"`
 	CacheSize  int    `mapstructure:"cache_size"`
 	TTLSeconds int    `mapstructure:"ttl_seconds"`
+
+	// ReloadSeconds is how often the filecache checks its file for changes. 0 disables reloading.
+	ReloadSeconds int `mapstructure:"reload_seconds"`
+	// EnvVar names the environment variable holding the account JSON for the env datacache.
+	// If Filename is set, the JSON is read from that file instead.
+	EnvVar string `mapstructure:"env_var"`
+	// ServeStale keeps serving the postgres datacache's expired entries while the database can't be reached,
+	// instead of failing their requests. Each entry's lookup is retried every 10 seconds meanwhile.
+	ServeStale bool `mapstructure:"serve_stale"`
 }
 
 // New uses viper to get our server configurations
@@ -66,13 +66,32 @@ host: prebid-server.prebid.org
 port: 1234
 admin_port: 5678
 default_timeout_ms: 123
+timeout_buffer_ms: 30
 prebid_cache_url: http://prebidcache.net/test/a1?qs=something
+prebid_cache_batch_size: 20
+max_cached_bids: 10
+max_bids_per_adapter: 40
+bandwidth_window_seconds: 30
+prebid_cache_id_secret: cachesecret
 recaptcha_secret: asdfasdfasdfasdf
+recaptcha_min_score: 0.5
+api_keys:
+  - key: PartnerKey
+    account_ids: ["1001"]
+cache_ttl_seconds: 300
+cache_ttl_by_media_type:
+  video: 3600
+fill_metric_sizes: ["300x250", "728x90"]
+summary_log_level: 1
+currency_rates:
+  EUR: 0.85
 metrics:
   host: upstream:8232
   database: metricsdb
   username: admin
   password: admin1324
+  max_dump_accounts: 50
+  account_idle_seconds: 600
 datacache:
   type: postgres
   filename: /usr/db/db.db
@@ -82,9 +101,140 @@ datacache:
   password: db2342
   cache_size: 10000000
   ttl_seconds: 3600
+  serve_stale: true
+  reload_seconds: 30
+  env_var: PBS_TEST_ACCOUNTS
+safari_no_cookie:
+  skip_bidders: ["rubicon"]
+  skip_no_cookie_bidders: true
+  skip_usersyncs: true
+chaos:
+  enabled: true
+  adapter_delays_ms:
+    appnexus: 300
+pprof:
+  enabled: true
+  token: profiletoken
+  allowed_ips: ["10.0.0.1"]
+key_values:
+  max_count: 10
+  max_key_length: 20
+  max_value_length: 40
+test_bids:
+  account_id: qa
+  skip_adapters: true
+  cpm: 1.5
+  width: 320
+  height: 50
+  adm: <div>test</div>
+  stored_responses:
+    appnexus: '[{"price": 2.5, "adm": "<div>stored</div>"}]'
+trace:
+  sample_rate: 0.01
+  store: file
+  filename: /var/log/pbs/traces.json
+max_concurrent_adapter_calls: 64
+max_concurrent_auctions: 800
+auction_queue_timeout_ms: 25
+max_concurrent_auctions_per_ip: 20
+trusted_ips: ["10.0.0.0/8", "192.0.2.1"]
+outbound_user_agent: prebid-server/1.2.3
+invalid_markup: drop
+min_ad_size:
+  width: 2
+  height: 2
+outbound_proxy:
+  url: http://egress.example.com:3128
+  username: pbs
+  password: secret
+required_request_fields: ["account_id", "tid"]
+duplicate_bidders: reject
+drop_bidders_without_params: true
+request_param_fields:
+  - bidder: appnexus
+    param: placementId
+    field: account_id
+anonymize_ip: true
+schain_asi: prebid.example.com
+request_validation: warn
+cache_unavailable: error
+min_bids_to_cache: 3
+fold_ad_unit_codes: true
+duplicate_ad_units: reject
+min_timeout_ms: 50
+max_timeout_ms: 1500
+invalid_timeout: reject
+app_with_cookie: web
+default_account_id: acct1
+default_keyword_profile: other
+demand_sdk_bidders: ["audienceNetwork", "sdkbidder"]
+no_cache_paths: ["/auction", "/cookie_sync"]
+keyword_profiles:
+  other:
+    key_prefix: pbs_
+    bidder_separator: "-"
+    size_separator: "*"
+no_bid_pixel_url: http://tracker.test/nobid?code=$AD_UNIT_CODE&tid=$TID
+accounts:
+  acct1:
+    dedup_creatives: true
+    allowed_sizes: ["300x250", "728x90"]
+    fallback_bidder: rubicon
+    extra_price_granularities: ["low", "dense"]
+    adapter_endpoints:
+      appnexus: http://acct1.ib.adnxs.com/openrtb2
+    min_ad_size:
+      width: 120
+      height: 50
+    cache_namespace: acct1
+    house_ad:
+      cpm: 0.05
+      adm: <div>house</div>
+overload:
+  max_goroutines: 20000
+  max_memory_percent: 90
+  retry_after_seconds: 5
+alerts:
+  webhook_url: https://hooks.slack.test/services/abc
+  sustained_checks: 2
+  default:
+    p95_latency_ms: 400
+    error_rate: 0.1
+  adapters:
+    rubicon:
+      p95_latency_ms: 600
+error_degradation:
+  window_seconds: 30
+  min_requests: 50
+  error_rate: 0.5
+  timeout_percent: 40
+request_flags:
+  new_sort: ["acct1", "acct2"]
 adapters:
   indexExchange:
     endpoint: http://ixtest.com/api
+  districtm:
+    cookie_family: adnxs
+    priority: 5
+    timeout_notification_url: http://districtm.test/timeout
+    connect_timeout_ms: 20
+    tls_handshake_timeout_ms: 30
+    response_header_timeout_ms: 400
+    max_bids: 8
+    max_bandwidth_bytes: 1000000
+    holdout_percent: 12.5
+    max_cpm: 40
+    max_cpm_policy: cap
+    proxy:
+      url: https://districtm-egress.example.com:3128
+    body_format: form
+    sla_ms: 150
+    response_cache:
+      ttl_seconds: 30
+      key_fields: ["params", "domain"]
+    response_field_map:
+      - path: seatbid.bid.cpm
+        to: price
   rubicon:
     endpoint: http://rubitest.com/api
     usersync_url: http://pixel.rubiconproject.com/sync.php?p=prebid
@@ -128,12 +278,43 @@ func TestFullConfig(t *testing.T) {
 	if cfg.DefaultTimeout != 123 {
 		t.Errorf("DefaultTimeout was %d not 123", cfg.DefaultTimeout)
 	}
+	if cfg.TimeoutBuffer != 30 {
+		t.Errorf("TimeoutBuffer was %d not 30", cfg.TimeoutBuffer)
+	}
 	cmpStrings(t, "prebid_cache_url", cfg.CacheURL, "http://prebidcache.net/test/a1?qs=something")
+	cmpInts(t, "prebid_cache_batch_size", cfg.CacheBatchSize, 20)
+	cmpInts(t, "max_cached_bids", cfg.MaxCachedBids, 10)
+	cmpInts(t, "max_bids_per_adapter", cfg.MaxBidsPerAdapter, 40)
+	cmpInts(t, "bandwidth_window_seconds", cfg.BandwidthWindowSeconds, 30)
+	cmpStrings(t, "prebid_cache_id_secret", cfg.CacheIDSecret, "cachesecret")
 	cmpStrings(t, "recaptcha_secret", cfg.RecaptchaSecret, "asdfasdfasdfasdf")
+	if cfg.RecaptchaDisabled {
+		t.Errorf("recaptcha_disabled should default to false")
+	}
+	if len(cfg.APIKeys) != 1 || len(cfg.APIKeys[0].AccountIDs) != 1 {
+		t.Fatalf("api_keys was %v", cfg.APIKeys)
+	}
+	cmpStrings(t, "api_keys.key", cfg.APIKeys[0].Key, "PartnerKey")
+	cmpStrings(t, "api_keys.account_ids", cfg.APIKeys[0].AccountIDs[0], "1001")
+	cmpInts(t, "cache_ttl_seconds", int(cfg.CacheTTLSeconds), 300)
+	cmpInts(t, "cache_ttl_by_media_type.video", int(cfg.CacheTTLByMediaType["video"]), 3600)
+	if len(cfg.FillMetricSizes) != 2 {
+		t.Fatalf("fill_metric_sizes was %v", cfg.FillMetricSizes)
+	}
+	cmpStrings(t, "fill_metric_sizes", cfg.FillMetricSizes[1], "728x90")
+	cmpInts(t, "summary_log_level", cfg.SummaryLogLevel, 1)
+	cmpStrings(t, "schain_asi", cfg.SChainASI, "prebid.example.com")
+	if cfg.CurrencyRates["eur"] != 0.85 {
+		t.Errorf("currency_rates.eur was %v", cfg.CurrencyRates["eur"])
+	}
+	if cfg.RecaptchaMinScore != 0.5 {
+		t.Errorf("recaptcha_min_score was %v", cfg.RecaptchaMinScore)
+	}
 	cmpStrings(t, "metrics.host", cfg.Metrics.Host, "upstream:8232")
 	cmpStrings(t, "metrics.database", cfg.Metrics.Database, "metricsdb")
 	cmpStrings(t, "metrics.username", cfg.Metrics.Username, "admin")
 	cmpStrings(t, "metrics.password", cfg.Metrics.Password, "admin1324")
+	cmpInts(t, "metrics.max_dump_accounts", cfg.Metrics.MaxDumpAccounts, 50)
 	cmpStrings(t, "datacache.type", cfg.DataCache.Type, "postgres")
 	cmpStrings(t, "datacache.filename", cfg.DataCache.Filename, "/usr/db/db.db")
 	cmpStrings(t, "datacache.dbname", cfg.DataCache.Database, "pbsdb")
@@ -142,6 +323,47 @@ func TestFullConfig(t *testing.T) {
 	cmpStrings(t, "datacache.password", cfg.DataCache.Password, "db2342")
 	cmpInts(t, "datacache.cache_size", cfg.DataCache.CacheSize, 10000000)
 	cmpInts(t, "datacache.ttl_seconds", cfg.DataCache.TTLSeconds, 3600)
+	cmpInts(t, "datacache.reload_seconds", cfg.DataCache.ReloadSeconds, 30)
+	if !cfg.DataCache.ServeStale {
+		t.Errorf("datacache.serve_stale should be true")
+	}
+	cmpStrings(t, "datacache.env_var", cfg.DataCache.EnvVar, "PBS_TEST_ACCOUNTS")
+	if cfg.Trace.SampleRate != 0.01 {
+		t.Errorf("trace.sample_rate was %f not 0.01", cfg.Trace.SampleRate)
+	}
+	cmpStrings(t, "trace.store", cfg.Trace.Store, "file")
+	if skip := cfg.SafariNoCookie.SkipBidders; len(skip) != 1 || skip[0] != "rubicon" {
+		t.Errorf("safari_no_cookie.skip_bidders was %v", skip)
+	}
+	if !cfg.SafariNoCookie.SkipNoCookieBidders || !cfg.SafariNoCookie.SkipUsersyncs {
+		t.Errorf("safari_no_cookie should skip no cookie bidders and usersyncs")
+	}
+	if !cfg.Chaos.Enabled {
+		t.Errorf("chaos.enabled should be true")
+	}
+	cmpInts(t, "chaos.adapter_delays_ms.appnexus", int(cfg.Chaos.AdapterDelays["appnexus"]), 300)
+	if !cfg.Pprof.Enabled {
+		t.Errorf("pprof.enabled should be true")
+	}
+	cmpStrings(t, "pprof.token", cfg.Pprof.Token, "profiletoken")
+	if ips := cfg.Pprof.AllowedIPs; len(ips) != 1 || ips[0] != "10.0.0.1" {
+		t.Errorf("pprof.allowed_ips was %v", ips)
+	}
+	cmpInts(t, "key_values.max_count", cfg.KeyValues.MaxCount, 10)
+	cmpInts(t, "key_values.max_key_length", cfg.KeyValues.MaxKeyLength, 20)
+	cmpInts(t, "key_values.max_value_length", cfg.KeyValues.MaxValueLength, 40)
+	cmpStrings(t, "test_bids.account_id", cfg.TestBids.AccountID, "qa")
+	if !cfg.TestBids.SkipAdapters {
+		t.Errorf("test_bids.skip_adapters should be true")
+	}
+	if cfg.TestBids.CPM != 1.5 {
+		t.Errorf("test_bids.cpm was %f not 1.5", cfg.TestBids.CPM)
+	}
+	cmpInts(t, "test_bids.width", int(cfg.TestBids.Width), 320)
+	cmpInts(t, "test_bids.height", int(cfg.TestBids.Height), 50)
+	cmpStrings(t, "test_bids.adm", cfg.TestBids.Adm, "<div>test</div>")
+	cmpStrings(t, "test_bids.stored_responses.appnexus", cfg.TestBids.StoredResponses["appnexus"], `[{"price": 2.5, "adm": "<div>stored</div>"}]`)
+	cmpStrings(t, "trace.filename", cfg.Trace.Filename, "/var/log/pbs/traces.json")
 	cmpStrings(t, "adapters.indexExchange.endpoint", cfg.Adapters["indexexchange"].Endpoint, "http://ixtest.com/api")
 	cmpStrings(t, "adapters.rubicon.endpoint", cfg.Adapters["rubicon"].Endpoint, "http://rubitest.com/api")
 	cmpStrings(t, "adapters.rubicon.usersync_url", cfg.Adapters["rubicon"].UserSyncURL, "http://pixel.rubiconproject.com/sync.php?p=prebid")
@@ -150,4 +372,124 @@ func TestFullConfig(t *testing.T) {
 	cmpStrings(t, "adapters.facebook.endpoint", cfg.Adapters["facebook"].Endpoint, "http://facebook.com/pbs")
 	cmpStrings(t, "adapters.facebook.usersync_url", cfg.Adapters["facebook"].UserSyncURL, "http://facebook.com/ortb/prebid-s2s")
 	cmpStrings(t, "adapters.facebook.platform_id", cfg.Adapters["facebook"].PlatformID, "abcdefgh1234")
+	if flags := cfg.RequestFlags["new_sort"]; len(flags) != 2 || flags[0] != "acct1" || flags[1] != "acct2" {
+		t.Errorf("request_flags.new_sort was %v", flags)
+	}
+	cmpStrings(t, "adapters.districtm.cookie_family", cfg.Adapters["districtm"].CookieFamily, "adnxs")
+	cmpInts(t, "adapters.districtm.priority", cfg.Adapters["districtm"].Priority, 5)
+	cmpInts(t, "adapters.districtm.connect_timeout_ms", int(cfg.Adapters["districtm"].ConnectTimeoutMillis), 20)
+	cmpInts(t, "adapters.districtm.tls_handshake_timeout_ms", int(cfg.Adapters["districtm"].TLSHandshakeTimeoutMillis), 30)
+	cmpInts(t, "adapters.districtm.max_bids", cfg.Adapters["districtm"].MaxBids, 8)
+	cmpInts(t, "adapters.districtm.max_bandwidth_bytes", int(cfg.Adapters["districtm"].MaxBandwidthBytes), 1000000)
+	cmpInts(t, "adapters.districtm.response_cache.ttl_seconds", cfg.Adapters["districtm"].ResponseCache.TTLSeconds, 30)
+	if fields := cfg.Adapters["districtm"].ResponseCache.KeyFields; len(fields) != 2 || fields[0] != "params" || fields[1] != "domain" {
+		t.Errorf("adapters.districtm.response_cache.key_fields was %v", fields)
+	}
+	cmpInts(t, "adapters.districtm.max_cpm", int(cfg.Adapters["districtm"].MaxCPM), 40)
+	cmpStrings(t, "adapters.districtm.max_cpm_policy", cfg.Adapters["districtm"].MaxCPMPolicy, "cap")
+	cmpStrings(t, "adapters.districtm.proxy.url", cfg.Adapters["districtm"].Proxy.URL, "https://districtm-egress.example.com:3128")
+	cmpStrings(t, "adapters.districtm.body_format", cfg.Adapters["districtm"].BodyFormat, "form")
+	cmpInts(t, "adapters.districtm.sla_ms", cfg.Adapters["districtm"].SLAMillis, 150)
+	if pct := cfg.Adapters["districtm"].HoldoutPercent; pct != 12.5 {
+		t.Errorf("adapters.districtm.holdout_percent was %v", pct)
+	}
+	if fields := cfg.Adapters["districtm"].ResponseFieldMap; len(fields) != 1 || fields[0].Path != "seatbid.bid.cpm" || fields[0].To != "price" {
+		t.Errorf("adapters.districtm.response_field_map was %v", fields)
+	}
+	cmpInts(t, "adapters.districtm.response_header_timeout_ms", int(cfg.Adapters["districtm"].ResponseHeaderTimeoutMillis), 400)
+	cmpStrings(t, "adapters.districtm.timeout_notification_url", cfg.Adapters["districtm"].TimeoutNotificationURL, "http://districtm.test/timeout")
+	cmpInts(t, "max_concurrent_adapter_calls", cfg.MaxConcurrentAdapterCalls, 64)
+	cmpInts(t, "max_concurrent_auctions", cfg.MaxConcurrentAuctions, 800)
+	cmpInts(t, "auction_queue_timeout_ms", int(cfg.AuctionQueueTimeoutMillis), 25)
+	cmpInts(t, "max_concurrent_auctions_per_ip", cfg.MaxConcurrentAuctionsPerIP, 20)
+	if ips := cfg.TrustedIPs; len(ips) != 2 || ips[0] != "10.0.0.0/8" || ips[1] != "192.0.2.1" {
+		t.Errorf("trusted_ips was %v", ips)
+	}
+	cmpStrings(t, "outbound_user_agent", cfg.OutboundUserAgent, "prebid-server/1.2.3")
+	cmpStrings(t, "invalid_markup", cfg.InvalidMarkup, "drop")
+	cmpInts(t, "min_ad_size.width", int(cfg.MinAdSize.Width), 2)
+	cmpInts(t, "min_ad_size.height", int(cfg.MinAdSize.Height), 2)
+	cmpStrings(t, "outbound_proxy.url", cfg.OutboundProxy.URL, "http://egress.example.com:3128")
+	cmpStrings(t, "outbound_proxy.username", cfg.OutboundProxy.Username, "pbs")
+	cmpStrings(t, "outbound_proxy.password", cfg.OutboundProxy.Password, "secret")
+	cmpStrings(t, "default_account_id", cfg.DefaultAccountID, "acct1")
+	cmpStrings(t, "default_keyword_profile", cfg.DefaultKeywordProfile, "other")
+	if bidders := cfg.DemandSDKBidders; len(bidders) != 2 || bidders[0] != "audienceNetwork" || bidders[1] != "sdkbidder" {
+		t.Errorf("demand_sdk_bidders was %v", bidders)
+	}
+	cmpStrings(t, "keyword_profiles.other.key_prefix", cfg.KeywordProfiles["other"].KeyPrefix, "pbs_")
+	cmpStrings(t, "keyword_profiles.other.bidder_separator", cfg.KeywordProfiles["other"].BidderSeparator, "-")
+	cmpStrings(t, "keyword_profiles.other.size_separator", cfg.KeywordProfiles["other"].SizeSeparator, "*")
+	cmpStrings(t, "no_bid_pixel_url", cfg.NoBidPixelURL, "http://tracker.test/nobid?code=$AD_UNIT_CODE&tid=$TID")
+	if !cfg.GetAccount("acct1").DedupCreatives {
+		t.Errorf("accounts.acct1.dedup_creatives should be true")
+	}
+	if sizes := cfg.GetAccount("acct1").AllowedSizes; len(sizes) != 2 || sizes[0] != "300x250" || sizes[1] != "728x90" {
+		t.Errorf("accounts.acct1.allowed_sizes was %v", sizes)
+	}
+	cmpStrings(t, "accounts.acct1.fallback_bidder", cfg.GetAccount("acct1").FallbackBidder, "rubicon")
+	cmpStrings(t, "accounts.acct1.house_ad.adm", cfg.GetAccount("acct1").HouseAd.Adm, "<div>house</div>")
+	cmpStrings(t, "accounts.acct1.adapter_endpoints.appnexus", cfg.GetAccount("acct1").AdapterEndpoints["appnexus"], "http://acct1.ib.adnxs.com/openrtb2")
+	cmpInts(t, "accounts.acct1.min_ad_size.width", int(cfg.GetAccount("acct1").MinAdSize.Width), 120)
+	cmpInts(t, "accounts.acct1.min_ad_size.height", int(cfg.GetAccount("acct1").MinAdSize.Height), 50)
+	cmpStrings(t, "accounts.acct1.cache_namespace", cfg.GetAccount("acct1").CacheNamespace, "acct1")
+	if g := cfg.GetAccount("acct1").ExtraPriceGranularities; len(g) != 2 || g[0] != "low" || g[1] != "dense" {
+		t.Errorf("accounts.acct1.extra_price_granularities was %v", g)
+	}
+	if cpm := cfg.GetAccount("acct1").HouseAd.CPM; cpm != 0.05 {
+		t.Errorf("accounts.acct1.house_ad.cpm was %v", cpm)
+	}
+	if cfg.GetAccount("acct2").DedupCreatives {
+		t.Errorf("accounts.acct2.dedup_creatives should default to false")
+	}
+	cmpStrings(t, "duplicate_bidders", cfg.DuplicateBidders, "reject")
+	if !cfg.DropBiddersWithoutParams {
+		t.Errorf("drop_bidders_without_params should be true")
+	}
+	if fields := cfg.RequestParamFields; len(fields) != 1 {
+		t.Errorf("request_param_fields was %v", fields)
+	} else {
+		cmpStrings(t, "request_param_fields.bidder", fields[0].Bidder, "appnexus")
+		cmpStrings(t, "request_param_fields.param", fields[0].Param, "placementId")
+		cmpStrings(t, "request_param_fields.field", fields[0].Field, "account_id")
+	}
+	if !cfg.AnonymizeIP {
+		t.Errorf("anonymize_ip should be true")
+	}
+	cmpStrings(t, "request_validation", cfg.RequestValidation, "warn")
+	cmpStrings(t, "cache_unavailable", cfg.CacheUnavailable, "error")
+	cmpInts(t, "overload.max_goroutines", cfg.Overload.MaxGoroutines, 20000)
+	cmpInts(t, "overload.max_memory_percent", int(cfg.Overload.MaxMemoryPercent), 90)
+	cmpInts(t, "overload.retry_after_seconds", cfg.Overload.RetryAfterSeconds, 5)
+	cmpInts(t, "metrics.account_idle_seconds", cfg.Metrics.AccountIdleSeconds, 600)
+	cmpStrings(t, "alerts.webhook_url", cfg.Alerts.WebhookURL, "https://hooks.slack.test/services/abc")
+	cmpInts(t, "alerts.sustained_checks", cfg.Alerts.SustainedChecks, 2)
+	cmpInts(t, "alerts.default.p95_latency_ms", int(cfg.Alerts.Default.P95LatencyMillis), 400)
+	if rate := cfg.Alerts.Default.ErrorRate; rate != 0.1 {
+		t.Errorf("alerts.default.error_rate was %v", rate)
+	}
+	cmpInts(t, "alerts.adapters.rubicon.p95_latency_ms", int(cfg.Alerts.Adapters["rubicon"].P95LatencyMillis), 600)
+	cmpInts(t, "error_degradation.window_seconds", cfg.ErrorDegradation.WindowSeconds, 30)
+	cmpInts(t, "error_degradation.min_requests", cfg.ErrorDegradation.MinRequests, 50)
+	if rate := cfg.ErrorDegradation.ErrorRate; rate != 0.5 {
+		t.Errorf("error_degradation.error_rate was %v", rate)
+	}
+	if percent := cfg.ErrorDegradation.TimeoutPercent; percent != 40 {
+		t.Errorf("error_degradation.timeout_percent was %v", percent)
+	}
+	cmpInts(t, "min_bids_to_cache", cfg.MinBidsToCache, 3)
+	if paths := cfg.NoCachePaths; len(paths) != 2 || paths[0] != "/auction" || paths[1] != "/cookie_sync" {
+		t.Errorf("no_cache_paths was %v", paths)
+	}
+	if !cfg.FoldAdUnitCodes {
+		t.Errorf("fold_ad_unit_codes should be true")
+	}
+	cmpStrings(t, "duplicate_ad_units", cfg.DuplicateAdUnits, "reject")
+	cmpInts(t, "min_timeout_ms", int(cfg.MinTimeoutMillis), 50)
+	cmpInts(t, "max_timeout_ms", int(cfg.MaxTimeoutMillis), 1500)
+	cmpStrings(t, "invalid_timeout", cfg.InvalidTimeout, "reject")
+	cmpStrings(t, "app_with_cookie", cfg.AppWithCookie, "web")
+	if fields := cfg.RequiredRequestFields; len(fields) != 2 || fields[0] != "account_id" || fields[1] != "tid" {
+		t.Errorf("required_request_fields was %v", fields)
+	}
 }
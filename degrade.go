@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dbmedialab/prebid-server/config"
+	"github.com/dbmedialab/prebid-server/pbsmetrics"
+)
+
+// errorRateTracker counts an adapter's failed calls, errors and timeouts alike, over the current and the
+// previous window. While the failure rate is over the threshold the adapter is degraded, and its calls get
+// only a part of the time left in the auction, so a flaky adapter can't hold up every request.
+//
+// A nil *errorRateTracker is never degraded, so callers don't need to check whether degradation is configured.
+type errorRateTracker struct {
+	cfg    config.ErrorDegradation
+	window time.Duration
+
+	mu           sync.Mutex
+	windowStart  time.Time
+	calls        int64
+	failures     int64
+	prevCalls    int64
+	prevFailures int64
+
+	// metrics is set once the adapter metrics exist, before any auctions are run
+	metrics *pbsmetrics.AdapterMetrics
+}
+
+// checkErrorDegradation makes sure a degraded adapter is still called, and that an adapter can be degraded at all
+func checkErrorDegradation(cfg config.ErrorDegradation) error {
+	if cfg.TimeoutPercent <= 0 || cfg.TimeoutPercent > 100 {
+		return fmt.Errorf("error_degradation.timeout_percent must be above 0, and at most 100; got %v", cfg.TimeoutPercent)
+	}
+	if cfg.ErrorRate < 0 || cfg.ErrorRate >= 1 {
+		return fmt.Errorf("error_degradation.error_rate must be at least 0, and below 1; got %v", cfg.ErrorRate)
+	}
+	return nil
+}
+
+// newErrorRateTracker makes the tracker configured by cfg, or returns nil if degradation is turned off
+func newErrorRateTracker(cfg config.ErrorDegradation) *errorRateTracker {
+	if cfg.ErrorRate <= 0 || cfg.WindowSeconds <= 0 {
+		return nil
+	}
+	return &errorRateTracker{
+		cfg:         cfg,
+		window:      time.Duration(cfg.WindowSeconds) * time.Second,
+		windowStart: time.Now(),
+	}
+}
+
+// record counts a call to the adapter, and whether it failed
+func (t *errorRateTracker) record(failed bool) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rollWindow()
+	t.calls++
+	if failed {
+		t.failures++
+	}
+}
+
+// degraded is true if enough of the adapter's recent calls failed
+func (t *errorRateTracker) degraded() bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rollWindow()
+	calls := t.calls + t.prevCalls
+	if calls == 0 || calls < int64(t.cfg.MinRequests) {
+		return false
+	}
+	return float64(t.failures+t.prevFailures)/float64(calls) > t.cfg.ErrorRate
+}
+
+func (t *errorRateTracker) rollWindow() {
+	now := time.Now()
+	elapsed := now.Sub(t.windowStart)
+	if elapsed < t.window {
+		return
+	}
+	if elapsed < 2*t.window {
+		t.prevCalls, t.prevFailures = t.calls, t.failures
+	} else {
+		// Nothing happened in the last window, so the old counts are stale
+		t.prevCalls, t.prevFailures = 0, 0
+	}
+	t.calls, t.failures = 0, 0
+	t.windowStart = now
+}
+
+// shorten returns a context which gives the degraded adapter timeout_percent of the time left in ctx
+func (t *errorRateTracker) shorten(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	left := deadline.Sub(time.Now())
+	return context.WithTimeout(ctx, time.Duration(float64(left)*t.cfg.TimeoutPercent/100))
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dbmedialab/prebid-server/config"
+	"github.com/dbmedialab/prebid-server/pbs"
+	"github.com/mxmCherry/openrtb"
+)
+
+func TestErrorRateTracker(t *testing.T) {
+	tracker := newErrorRateTracker(config.ErrorDegradation{WindowSeconds: 1, MinRequests: 4, ErrorRate: 0.5, TimeoutPercent: 50})
+	tracker.window = 20 * time.Millisecond
+	for _, failed := range []bool{true, true, true} {
+		tracker.record(failed)
+	}
+	if tracker.degraded() {
+		t.Errorf("The adapter shouldn't be degraded before it has min_requests calls")
+	}
+	tracker.record(false)
+	if !tracker.degraded() {
+		t.Errorf("The adapter should be degraded once too many of its calls fail")
+	}
+
+	// The last window still counts in the next one
+	time.Sleep(25 * time.Millisecond)
+	if !tracker.degraded() {
+		t.Errorf("The failures of the last window should still count")
+	}
+	for i := 0; i < 4; i++ {
+		tracker.record(false)
+	}
+	if tracker.degraded() {
+		t.Errorf("The adapter should recover once its calls succeed again")
+	}
+
+	time.Sleep(45 * time.Millisecond)
+	tracker.record(true)
+	if tracker.degraded() {
+		t.Errorf("Counts older than the last window should be forgotten")
+	}
+}
+
+func TestDisabledErrorRateTracker(t *testing.T) {
+	if tracker := newErrorRateTracker(config.ErrorDegradation{WindowSeconds: 10, MinRequests: 1}); tracker != nil {
+		t.Errorf("The tracker should be off without an error_rate")
+	}
+
+	var none *errorRateTracker
+	none.record(true)
+	if none.degraded() {
+		t.Errorf("A nil tracker should never be degraded")
+	}
+}
+
+func TestCheckErrorDegradation(t *testing.T) {
+	tests := []struct {
+		description string
+		cfg         config.ErrorDegradation
+		valid       bool
+	}{
+		{"The defaults are fine", config.ErrorDegradation{ErrorRate: 0, TimeoutPercent: 50}, true},
+		{"The whole timeout is fine", config.ErrorDegradation{ErrorRate: 0.5, TimeoutPercent: 100}, true},
+		{"A degraded adapter must get some time", config.ErrorDegradation{ErrorRate: 0.5, TimeoutPercent: 0}, false},
+		{"A negative timeout is rejected", config.ErrorDegradation{ErrorRate: 0.5, TimeoutPercent: -10}, false},
+		{"A degraded adapter can't get more time", config.ErrorDegradation{ErrorRate: 0.5, TimeoutPercent: 150}, false},
+		{"A negative error rate is rejected", config.ErrorDegradation{ErrorRate: -0.1, TimeoutPercent: 50}, false},
+		{"An error rate which can't be passed is rejected", config.ErrorDegradation{ErrorRate: 1, TimeoutPercent: 50}, false},
+	}
+	for _, test := range tests {
+		if err := checkErrorDegradation(test.cfg); (err == nil) != test.valid {
+			t.Errorf("%s: got error %v", test.description, err)
+		}
+	}
+}
+
+func TestErrorRateTrackerShorten(t *testing.T) {
+	tracker := newErrorRateTracker(config.ErrorDegradation{WindowSeconds: 1, ErrorRate: 0.5, TimeoutPercent: 25})
+	parent, cancel := context.WithTimeout(context.Background(), 400*time.Millisecond)
+	defer cancel()
+
+	ctx, cancelShort := tracker.shorten(parent)
+	defer cancelShort()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		t.Fatalf("The shortened context should have a deadline")
+	}
+	if left := deadline.Sub(time.Now()); left > 100*time.Millisecond || left < 50*time.Millisecond {
+		t.Errorf("Expected about 100ms left on the shortened context; got %v", left)
+	}
+}
+
+func TestDegradedAdapterRecovers(t *testing.T) {
+	tracker := newErrorRateTracker(config.ErrorDegradation{WindowSeconds: 1, MinRequests: 2, ErrorRate: 0.5, TimeoutPercent: 5})
+	tracker.window = 20 * time.Millisecond
+	tracker.record(true)
+	tracker.record(true)
+	saved := errorRates
+	errorRates = map[string]*errorRateTracker{"slow": tracker}
+	defer func() { errorRates = saved }()
+
+	// The adapter answers in 40ms, well within the auction's timeout but not 5% of it
+	ex := &delayedAdapter{Adapter: &adUnitAdapter{}, delay: 40 * time.Millisecond}
+	bidder := &pbs.PBSBidder{
+		BidderCode: "slow",
+		AdUnits:    []pbs.PBSAdUnit{{Code: "first", BidID: "a", Sizes: []openrtb.Format{{W: 300, H: 250}}}},
+	}
+	call := func() (adapterCall, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+		_, result, err := callAdapter(ctx, ex, &pbs.PBSRequest{}, bidder, 0)
+		return result, err
+	}
+
+	result, err := call()
+	if err != context.DeadlineExceeded {
+		t.Fatalf("The degraded call should be cut off by the shortened deadline; got %v", err)
+	}
+	if result.measured {
+		t.Errorf("A call cut off by the shortened deadline shouldn't meet or miss the SLA")
+	}
+	if tracker.calls+tracker.prevCalls != 2 {
+		t.Errorf("Calls cut off by the shortened deadline shouldn't be counted; got %d calls", tracker.calls+tracker.prevCalls)
+	}
+
+	// Once the failures age out, the adapter gets the full timeout again and its answers count
+	time.Sleep(45 * time.Millisecond)
+	result, err = call()
+	if err != nil {
+		t.Fatalf("The recovered adapter should answer within the full timeout; got %v", err)
+	}
+	if !result.measured {
+		t.Errorf("A call with the full timeout should count for the SLA")
+	}
+	if tracker.degraded() {
+		t.Errorf("An adapter which answers within the normal timeout should recover")
+	}
+}
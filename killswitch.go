@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// bidderKillSwitch tracks the bidders which have been disabled at runtime through the admin port.
+// Disabled bidders are left out of auctions and cookie syncs until they are enabled again.
+// Nothing is persisted, so every bidder is enabled again after a restart.
+type bidderKillSwitch struct {
+	mu       sync.RWMutex
+	disabled map[string]bool
+}
+
+func newBidderKillSwitch() *bidderKillSwitch {
+	return &bidderKillSwitch{disabled: make(map[string]bool)}
+}
+
+func (s *bidderKillSwitch) isDisabled(bidderCode string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.disabled[bidderCode]
+}
+
+func (s *bidderKillSwitch) setDisabled(bidderCode string, disabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if disabled {
+		s.disabled[bidderCode] = true
+	} else {
+		delete(s.disabled, bidderCode)
+	}
+}
+
+// list returns the disabled bidders in sorted order
+func (s *bidderKillSwitch) list() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	codes := make([]string, 0, len(s.disabled))
+	for code := range s.disabled {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// handler serves the admin endpoint for the kill switch. GET lists the disabled bidders,
+// POST ?bidder=<code> disables a bidder and DELETE ?bidder=<code> enables it again.
+// Only the bidder codes in known can be disabled.
+func (s *bidderKillSwitch) handler(known map[string]bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			bidderCode := r.URL.Query().Get("bidder")
+			if !known[bidderCode] {
+				http.Error(w, fmt.Sprintf("Unknown bidder '%s'", bidderCode), http.StatusNotFound)
+				return
+			}
+			switch r.Method {
+			case http.MethodPost:
+				s.setDisabled(bidderCode, true)
+				glog.Warningf("Bidder %s disabled through the admin port", bidderCode)
+			case http.MethodDelete:
+				s.setDisabled(bidderCode, false)
+				glog.Warningf("Bidder %s enabled through the admin port", bidderCode)
+			default:
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.list())
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dbmedialab/prebid-server/config"
+	"github.com/dbmedialab/prebid-server/pbsmetrics"
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestBidderKillSwitchHandler(t *testing.T) {
+	s := newBidderKillSwitch()
+	handler := s.handler(map[string]bool{"appnexus": true, "rubicon": true})
+
+	call := func(method string, target string) (int, []string) {
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest(method, target, nil))
+		var disabled []string
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &disabled); err != nil {
+				t.Fatalf("Bad response body: %v", err)
+			}
+		}
+		return rr.Code, disabled
+	}
+
+	if code, disabled := call("POST", "/bidders/disabled?bidder=rubicon"); code != http.StatusOK || len(disabled) != 1 || disabled[0] != "rubicon" {
+		t.Errorf("Disabling rubicon failed: %d %v", code, disabled)
+	}
+	if !s.isDisabled("rubicon") || s.isDisabled("appnexus") {
+		t.Errorf("Only rubicon should be disabled")
+	}
+	if code, _ := call("POST", "/bidders/disabled?bidder=nope"); code != http.StatusNotFound {
+		t.Errorf("Disabling an unknown bidder should fail; got %d", code)
+	}
+	if code, disabled := call("GET", "/bidders/disabled"); code != http.StatusOK || len(disabled) != 1 {
+		t.Errorf("Listing the disabled bidders failed: %d %v", code, disabled)
+	}
+	if code, disabled := call("DELETE", "/bidders/disabled?bidder=rubicon"); code != http.StatusOK || len(disabled) != 0 {
+		t.Errorf("Enabling rubicon failed: %d %v", code, disabled)
+	}
+	if s.isDisabled("rubicon") {
+		t.Errorf("rubicon should be enabled again")
+	}
+}
+
+func TestCookieSyncSkipsDisabledBidders(t *testing.T) {
+	cfg, err := config.New()
+	if err != nil {
+		t.Fatalf("Unable to config: %v", err)
+	}
+	setupExchanges(cfg)
+	m := pbsmetrics.NewMetrics(keys(exchanges))
+	router := httprouter.New()
+	router.POST("/cookie_sync", (&cookieSyncDeps{cfg, m}).cookieSync)
+
+	disabledBidders.setDisabled("appnexus", true)
+	defer disabledBidders.setDisabled("appnexus", false)
+
+	csbuf := bytes.NewBufferString(`{"uuid": "abcdefg", "bidders": ["appnexus", "audienceNetwork"]}`)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/cookie_sync", csbuf))
+
+	csresp := cookieSyncResponse{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &csresp); err != nil {
+		t.Fatalf("Unmarshal response failed: %v", err)
+	}
+	if len(csresp.BidderStatus) != 1 || csresp.BidderStatus[0].BidderCode != "audienceNetwork" {
+		t.Errorf("Only audienceNetwork should need a sync while appnexus is disabled; got %v", csresp.BidderStatus)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dbmedialab/prebid-server/pbsmetrics"
+	"github.com/julienschmidt/httprouter"
+)
+
+// prioritySemaphore limits how many adapter calls, or auctions, can be in flight at once. When calls have to wait
+// for a slot, the waiter with the highest priority gets the next free one. Waiters with equal priority
+// are served in the order they arrived.
+//
+// A nil *prioritySemaphore doesn't limit anything, so callers don't need to check whether a limit is configured.
+type prioritySemaphore struct {
+	mu      sync.Mutex
+	free    int
+	waiters waiterQueue
+	arrived uint64
+}
+
+type waiter struct {
+	priority int
+	order    uint64
+	ready    chan struct{}
+	index    int
+}
+
+// waiterQueue implements heap.Interface, with the next waiter to be served at the top.
+type waiterQueue []*waiter
+
+func (q waiterQueue) Len() int {
+	return len(q)
+}
+
+func (q waiterQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].order < q[j].order
+}
+
+func (q waiterQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *waiterQueue) Push(x interface{}) {
+	w := x.(*waiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+
+func (q *waiterQueue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	*q = old[:len(old)-1]
+	w.index = -1
+	return w
+}
+
+func newPrioritySemaphore(size int) *prioritySemaphore {
+	return &prioritySemaphore{free: size}
+}
+
+// acquire blocks until a slot is free, or the context is done. Every successful acquire must be
+// followed by a call to release.
+func (s *prioritySemaphore) acquire(ctx context.Context, priority int) error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	if s.free > 0 && s.waiters.Len() == 0 {
+		s.free--
+		s.mu.Unlock()
+		return nil
+	}
+	w := &waiter{
+		priority: priority,
+		order:    s.arrived,
+		ready:    make(chan struct{}),
+	}
+	s.arrived++
+	heap.Push(&s.waiters, w)
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if w.index < 0 {
+			// The slot was handed over while the context finished, so give it to someone else.
+			s.releaseLocked()
+		} else {
+			heap.Remove(&s.waiters, w.index)
+		}
+		return ctx.Err()
+	}
+}
+
+// release frees a slot taken by acquire, handing it to the highest priority waiter if there is one.
+func (s *prioritySemaphore) release() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.releaseLocked()
+	s.mu.Unlock()
+}
+
+func (s *prioritySemaphore) releaseLocked() {
+	if s.waiters.Len() > 0 {
+		w := heap.Pop(&s.waiters).(*waiter)
+		close(w.ready)
+		return
+	}
+	s.free++
+}
+
+// limitAuctions holds /auction requests until one of the slots is free, so a burst of traffic can't
+// spawn an unbounded number of auctions. Requests which wait longer than queueTimeout are turned away
+// with a 503. The number of waiting requests is kept in the AuctionQueueGauge.
+func limitAuctions(handle httprouter.Handle, slots *prioritySemaphore, queueTimeout time.Duration, m *pbsmetrics.Metrics) httprouter.Handle {
+	var queued int64
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		ctx, cancel := context.WithTimeout(r.Context(), queueTimeout)
+		m.AuctionQueueGauge.Update(atomic.AddInt64(&queued, 1))
+		err := slots.acquire(ctx, 0)
+		m.AuctionQueueGauge.Update(atomic.AddInt64(&queued, -1))
+		cancel()
+		if err != nil {
+			m.ShedAuctionMeter.Mark(1)
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			writeAuctionError(w, "Server is overloaded", nil)
+			return
+		}
+		defer slots.release()
+		handle(w, r, ps)
+	}
+}
+
+// clientLimiter caps the /auction requests in flight from each client IP, so one misbehaving client can't
+// take up all the auction slots. Trusted IPs, like our own edge, aren't limited.
+//
+// A nil *clientLimiter doesn't limit anything, so callers don't need to check whether a limit is configured.
+type clientLimiter struct {
+	max         int
+	trustedIPs  map[string]bool
+	trustedNets []*net.IPNet
+
+	mu       sync.Mutex
+	inFlight map[string]int
+}
+
+// newClientLimiter makes a limiter of max requests per IP, or returns nil if max is 0. Each trusted entry must
+// be either an IP or a CIDR range.
+func newClientLimiter(max int, trusted []string) (*clientLimiter, error) {
+	if max <= 0 {
+		return nil, nil
+	}
+	l := &clientLimiter{
+		max:        max,
+		trustedIPs: make(map[string]bool, len(trusted)),
+		inFlight:   make(map[string]int),
+	}
+	for _, entry := range trusted {
+		if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+			l.trustedNets = append(l.trustedNets, ipNet)
+		} else if ip := net.ParseIP(entry); ip != nil {
+			l.trustedIPs[ip.String()] = true
+		} else {
+			return nil, fmt.Errorf("trusted_ips entry '%s' is neither an IP nor a CIDR range", entry)
+		}
+	}
+	return l, nil
+}
+
+// trusted checks ip against the trusted IPs. IPs which don't parse are never trusted.
+func (l *clientLimiter) trusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	if l.trustedIPs[parsed.String()] {
+		return true
+	}
+	for _, ipNet := range l.trustedNets {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// acquire counts a request from ip, unless it already has max requests in flight.
+// Every successful acquire must be followed by a release.
+func (l *clientLimiter) acquire(ip string) bool {
+	if l == nil || l.trusted(ip) {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight[ip] >= l.max {
+		return false
+	}
+	l.inFlight[ip]++
+	return true
+}
+
+func (l *clientLimiter) release(ip string) {
+	if l == nil || l.trusted(ip) {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight[ip] <= 1 {
+		// The IPs without requests are dropped, so the map doesn't grow with every client ever seen
+		delete(l.inFlight, ip)
+	} else {
+		l.inFlight[ip]--
+	}
+}
+
+// limitClients turns away /auction requests with a 429 when their client IP already has too many in flight.
+// The client is the peer which connected to us. The X-Forwarded-For and X-Real-IP headers aren't used,
+// since any client can set them.
+func limitClients(handle httprouter.Handle, limiter *clientLimiter, m *pbsmetrics.Metrics) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		ip := peerIP(r)
+		if !limiter.acquire(ip) {
+			m.ClientLimitedAuctionMeter.Mark(1)
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			writeAuctionError(w, "Too many concurrent requests", nil)
+			return
+		}
+		// Deferred, so the request is let go of even if the handler panics
+		defer limiter.release(ip)
+		handle(w, r, ps)
+	}
+}
+
+// peerIP is the IP of the peer which connected to us, or the whole RemoteAddr if it has no port
+func peerIP(r *http.Request) string {
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return ip
+	}
+	return r.RemoteAddr
+}
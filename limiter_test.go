@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dbmedialab/prebid-server/pbsmetrics"
+	"github.com/julienschmidt/httprouter"
+)
+
+func waitForWaiters(t *testing.T, s *prioritySemaphore, n int) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		s.mu.Lock()
+		waiting := s.waiters.Len()
+		s.mu.Unlock()
+		if waiting == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Expected %d waiters on the semaphore", n)
+}
+
+func TestPrioritySemaphoreOrdering(t *testing.T) {
+	s := newPrioritySemaphore(1)
+	if err := s.acquire(context.Background(), 0); err != nil {
+		t.Fatalf("First acquire failed: %v", err)
+	}
+
+	order := make(chan int, 4)
+	for i, priority := range []int{1, 3, 2, 3} {
+		go func(priority int) {
+			if err := s.acquire(context.Background(), priority); err != nil {
+				t.Errorf("Acquire with priority %d failed: %v", priority, err)
+				return
+			}
+			order <- priority
+			s.release()
+		}(priority)
+		waitForWaiters(t, s, i+1)
+	}
+
+	s.release()
+	for _, expected := range []int{3, 3, 2, 1} {
+		if priority := <-order; priority != expected {
+			t.Errorf("Expected priority %d to get the next slot; got %d", expected, priority)
+		}
+	}
+}
+
+func TestPrioritySemaphoreTimeout(t *testing.T) {
+	s := newPrioritySemaphore(1)
+	if err := s.acquire(context.Background(), 0); err != nil {
+		t.Fatalf("First acquire failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if err := s.acquire(ctx, 10); err != context.DeadlineExceeded {
+		t.Errorf("Acquire should time out when no slot is free; got %v", err)
+	}
+
+	// The timed out waiter must not hold on to the slot
+	s.release()
+	if err := s.acquire(context.Background(), 0); err != nil {
+		t.Errorf("Acquire after release failed: %v", err)
+	}
+}
+
+func TestNilPrioritySemaphore(t *testing.T) {
+	var s *prioritySemaphore
+	if err := s.acquire(context.Background(), 0); err != nil {
+		t.Errorf("A nil semaphore shouldn't limit anything; got %v", err)
+	}
+	s.release()
+}
+
+func TestLimitAuctions(t *testing.T) {
+	m := pbsmetrics.NewMetrics(nil)
+	slots := newPrioritySemaphore(1)
+	handled := make(chan struct{}, 1)
+	handle := limitAuctions(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		handled <- struct{}{}
+	}, slots, 5*time.Millisecond, m)
+
+	rr := httptest.NewRecorder()
+	handle(rr, httptest.NewRequest("POST", "/auction", nil), nil)
+	if rr.Code != http.StatusOK || len(handled) != 1 {
+		t.Fatalf("The request should be handled while a slot is free; got status %d", rr.Code)
+	}
+	<-handled
+
+	// With the only slot taken, the next request times out in the queue
+	if err := slots.acquire(context.Background(), 0); err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+	rr = httptest.NewRecorder()
+	handle(rr, httptest.NewRequest("POST", "/auction", nil), nil)
+	if rr.Code != http.StatusServiceUnavailable || len(handled) != 0 {
+		t.Errorf("The request should be shed when no slot comes free; got status %d", rr.Code)
+	}
+	if m.ShedAuctionMeter.Count() != 1 {
+		t.Errorf("The shed request should be counted; got %d", m.ShedAuctionMeter.Count())
+	}
+	if m.AuctionQueueGauge.Value() != 0 {
+		t.Errorf("Nothing should be left in the queue; got %d", m.AuctionQueueGauge.Value())
+	}
+}
+
+func TestClientLimiter(t *testing.T) {
+	l, err := newClientLimiter(2, []string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if !l.acquire("203.0.113.5") {
+			t.Fatalf("Request %d should be under the limit", i+1)
+		}
+	}
+	if l.acquire("203.0.113.5") {
+		t.Errorf("The third request from the same IP should be over the limit")
+	}
+	if !l.acquire("203.0.113.6") {
+		t.Errorf("Other IPs should have their own limit")
+	}
+	l.release("203.0.113.5")
+	if !l.acquire("203.0.113.5") {
+		t.Errorf("A released request should free up a slot")
+	}
+
+	for _, ip := range []string{"10.1.2.3", "192.0.2.1"} {
+		for i := 0; i < 3; i++ {
+			if !l.acquire(ip) {
+				t.Errorf("Trusted IP '%s' shouldn't be limited", ip)
+			}
+		}
+	}
+
+	// IPs which don't parse are limited like any other client
+	for _, ip := range []string{"", "x", "10.0.0.0/8"} {
+		for i := 0; i < 2; i++ {
+			l.acquire(ip)
+		}
+		if l.acquire(ip) {
+			t.Errorf("Unparseable IP '%s' should be limited", ip)
+		}
+	}
+
+	l.release("203.0.113.6")
+	if _, ok := l.inFlight["203.0.113.6"]; ok {
+		t.Errorf("IPs without requests in flight should be forgotten")
+	}
+
+	if _, err := newClientLimiter(2, []string{"10.0.0.0/8", "not an ip"}); err == nil {
+		t.Errorf("Invalid trusted_ips entries should be rejected")
+	}
+	if none, err := newClientLimiter(0, []string{"not an ip"}); err != nil || none != nil {
+		t.Errorf("Without a limit there should be no limiter; got %v and %v", none, err)
+	}
+
+	var none *clientLimiter
+	if !none.acquire("203.0.113.5") {
+		t.Errorf("A nil limiter shouldn't limit anything")
+	}
+	none.release("203.0.113.5")
+}
+
+func TestLimitClients(t *testing.T) {
+	m := pbsmetrics.NewMetrics(nil)
+	limiter, _ := newClientLimiter(1, []string{"192.0.2.1"})
+	handle := limitClients(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		panic("auction failed")
+	}, limiter, m)
+
+	request := func(forwardedFor string) (code int) {
+		defer func() { recover() }()
+		rr := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/auction", nil)
+		r.RemoteAddr = "203.0.113.5:1234"
+		if forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		handle(rr, r, nil)
+		return rr.Code
+	}
+	request("")
+	if len(limiter.inFlight) != 0 {
+		t.Errorf("A request should be let go of when the handler panics")
+	}
+
+	if !limiter.acquire("203.0.113.5") {
+		t.Fatalf("Acquire failed")
+	}
+	if code := request(""); code != http.StatusTooManyRequests {
+		t.Errorf("Expected a 429 for a client over its limit; got %d", code)
+	}
+	// Clients can't get around the limit with the headers they send
+	for _, forwardedFor := range []string{"192.0.2.1", "198.51.100.7", "x"} {
+		if code := request(forwardedFor); code != http.StatusTooManyRequests {
+			t.Errorf("Expected a 429 with X-Forwarded-For: %s; got %d", forwardedFor, code)
+		}
+	}
+	if m.ClientLimitedAuctionMeter.Count() != 4 {
+		t.Errorf("The limited request should be counted; got %d", m.ClientLimitedAuctionMeter.Count())
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry/gosigar"
+	"github.com/dbmedialab/prebid-server/config"
+	"github.com/dbmedialab/prebid-server/pbsmetrics"
+	"github.com/golang/glog"
+	"github.com/julienschmidt/httprouter"
+)
+
+// loadMonitor measures the process's load in the background, so requests only have to read the result.
+//
+// A nil *loadMonitor is never overloaded, so callers don't need to check whether the thresholds are configured.
+type loadMonitor struct {
+	maxGoroutines    int
+	maxMemoryPercent float64
+	// memoryPercent measures how much of the host's memory is in use
+	memoryPercent func() (float64, error)
+
+	// overloaded is 1 while a threshold is exceeded. It must only be accessed through the sync/atomic package.
+	overloaded int32
+}
+
+// setupLoadMonitor starts measuring the load configured by cfg, or returns nil if every threshold is off.
+// A threshold without a check interval is an error, since the load would never be measured again.
+func setupLoadMonitor(cfg *config.Overload) (*loadMonitor, error) {
+	if cfg.MaxGoroutines <= 0 && cfg.MaxMemoryPercent <= 0 {
+		return nil, nil
+	}
+	if cfg.CheckIntervalMillis == 0 {
+		return nil, fmt.Errorf("overload.check_interval_ms must be above 0 when a threshold is set")
+	}
+	l := &loadMonitor{
+		maxGoroutines:    cfg.MaxGoroutines,
+		maxMemoryPercent: cfg.MaxMemoryPercent,
+		memoryPercent:    sigarMemoryPercent,
+	}
+	l.check()
+	go func() {
+		for range time.Tick(time.Duration(cfg.CheckIntervalMillis) * time.Millisecond) {
+			l.check()
+		}
+	}()
+	return l, nil
+}
+
+func sigarMemoryPercent() (float64, error) {
+	mem := sigar.Mem{}
+	if err := mem.Get(); err != nil {
+		return 0, err
+	}
+	if mem.Total == 0 {
+		return 0, nil
+	}
+	return float64(mem.ActualUsed) / float64(mem.Total) * 100, nil
+}
+
+// check measures the load, and updates whether the process is overloaded
+func (l *loadMonitor) check() {
+	var overloaded int32
+	if goroutines := runtime.NumGoroutine(); l.maxGoroutines > 0 && goroutines > l.maxGoroutines {
+		overloaded = 1
+	}
+	if l.maxMemoryPercent > 0 {
+		used, err := l.memoryPercent()
+		if err != nil {
+			glog.Warningf("Failed to measure memory use: %v", err)
+		} else if used > l.maxMemoryPercent {
+			overloaded = 1
+		}
+	}
+	if atomic.SwapInt32(&l.overloaded, overloaded) != overloaded {
+		if overloaded == 1 {
+			glog.Warning("Server is overloaded, shedding /auction requests")
+		} else {
+			glog.Info("Server is no longer overloaded")
+		}
+	}
+}
+
+func (l *loadMonitor) isOverloaded() bool {
+	if l == nil {
+		return false
+	}
+	return atomic.LoadInt32(&l.overloaded) == 1
+}
+
+// shedOverload turns /auction requests away with a 503 and a Retry-After header while the process is overloaded
+func shedOverload(handle httprouter.Handle, load *loadMonitor, retryAfterSeconds int, m *pbsmetrics.Metrics) httprouter.Handle {
+	if load == nil {
+		return handle
+	}
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if load.isOverloaded() {
+			m.OverloadMeter.Mark(1)
+			w.Header().Add("Content-Type", "application/json")
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			writeAuctionError(w, "Server is overloaded", nil)
+			return
+		}
+		handle(w, r, ps)
+	}
+}
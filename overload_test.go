@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/dbmedialab/prebid-server/config"
+	"github.com/dbmedialab/prebid-server/pbsmetrics"
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestLoadMonitor(t *testing.T) {
+	memory := 50.0
+	l := &loadMonitor{
+		maxMemoryPercent: 80,
+		memoryPercent: func() (float64, error) {
+			return memory, nil
+		},
+	}
+	l.check()
+	if l.isOverloaded() {
+		t.Errorf("50%% memory use shouldn't be an overload")
+	}
+	memory = 90
+	l.check()
+	if !l.isOverloaded() {
+		t.Errorf("90%% memory use should be an overload")
+	}
+	memory = 50
+	l.check()
+	if l.isOverloaded() {
+		t.Errorf("The overload should end once memory use drops")
+	}
+
+	l = &loadMonitor{maxGoroutines: runtime.NumGoroutine() - 1}
+	l.check()
+	if !l.isOverloaded() {
+		t.Errorf("Too many goroutines should be an overload")
+	}
+
+	var nilMonitor *loadMonitor
+	if nilMonitor.isOverloaded() {
+		t.Errorf("A nil monitor should never be overloaded")
+	}
+}
+
+func TestSetupLoadMonitor(t *testing.T) {
+	if l, err := setupLoadMonitor(&config.Overload{CheckIntervalMillis: 1000}); l != nil || err != nil {
+		t.Errorf("The monitor should be off without thresholds; got %v and error %v", l, err)
+	}
+	if _, err := setupLoadMonitor(&config.Overload{MaxGoroutines: 100000}); err == nil {
+		t.Errorf("A threshold without a check interval should be rejected")
+	}
+	if l, err := setupLoadMonitor(&config.Overload{MaxGoroutines: 100000, CheckIntervalMillis: 1000}); l == nil || err != nil {
+		t.Errorf("Expected a monitor; got error %v", err)
+	}
+}
+
+func TestShedOverload(t *testing.T) {
+	m := pbsmetrics.NewMetrics(nil)
+	l := &loadMonitor{maxGoroutines: 1}
+	handled := 0
+	handle := shedOverload(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		handled++
+	}, l, 5, m)
+
+	rr := httptest.NewRecorder()
+	handle(rr, httptest.NewRequest("POST", "/auction", nil), nil)
+	if rr.Code != http.StatusOK || handled != 1 {
+		t.Errorf("Requests should be handled before any overload is measured; got status %d", rr.Code)
+	}
+
+	l.check()
+	rr = httptest.NewRecorder()
+	handle(rr, httptest.NewRequest("POST", "/auction", nil), nil)
+	if rr.Code != http.StatusServiceUnavailable || handled != 1 {
+		t.Errorf("Requests should be shed while overloaded; got status %d", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") != "5" {
+		t.Errorf("Expected Retry-After: 5; got %q", rr.Header().Get("Retry-After"))
+	}
+	if m.OverloadMeter.Count() != 1 {
+		t.Errorf("The shed request should be counted; got %d", m.OverloadMeter.Count())
+	}
+}
@@ -1,11 +1,17 @@
 package pbs
 
 import (
+	"bytes"
+	crand "crypto/rand"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"reflect"
+	"sort"
 	"strings"
 	"time"
 
@@ -16,6 +22,7 @@ import (
 	"github.com/blang/semver"
 	"github.com/mxmCherry/openrtb"
 	"github.com/dbmedialab/prebid-server/cache"
+	"github.com/dbmedialab/prebid-server/config"
 	"github.com/dbmedialab/prebid-server/prebid"
 )
 
@@ -28,6 +35,95 @@ const (
 	MEDIA_TYPE_VIDEO
 )
 
+// Response formats which a client can request through PBSRequest.ResponseFormat.
+// The flat format is the default, and returns every bid in PBSResponse.Bids.
+const (
+	RESPONSE_FORMAT_FLAT    = "flat"
+	RESPONSE_FORMAT_SEATBID = "seatbid"
+	RESPONSE_FORMAT_BOTH    = "both"
+)
+
+// Creative load types for the hb_creative_loadtype key, which PBSRequest.CreativeLoadTypes can force for a bidder.
+// CREATIVE_LOADTYPE_HTML loads the creative in the ad server's webview, and CREATIVE_LOADTYPE_DEMAND_SDK in the
+// bidder's own SDK.
+const (
+	CREATIVE_LOADTYPE_HTML       = "html"
+	CREATIVE_LOADTYPE_DEMAND_SDK = "demand_sdk"
+)
+
+// Ways of handling a timeout_millis outside of min_timeout_ms and max_timeout_ms, set by the invalid_timeout config.
+// With INVALID_TIMEOUT_DEFAULT (the default) the request gets default_timeout_ms instead. Requests without a
+// timeout always get the default.
+const (
+	INVALID_TIMEOUT_DEFAULT = "default"
+	INVALID_TIMEOUT_REJECT  = "reject"
+)
+
+// Ways of handling a bidder which is listed more than once for the same ad unit, set by the duplicate_bidders config.
+// With DUPLICATE_BIDDERS_DEDUP (the default) only the first listing is used.
+// The duplicate_ad_units config takes the same values, for ad units which share a code.
+const (
+	DUPLICATE_BIDDERS_DEDUP  = "dedup"
+	DUPLICATE_BIDDERS_REJECT = "reject"
+)
+
+// Ways of handling app requests which also carry a uids cookie, set by the app_with_cookie config.
+// With APP_WITH_COOKIE_APP (the default) the cookie is ignored, and with APP_WITH_COOKIE_WEB the app is.
+const (
+	APP_WITH_COOKIE_APP    = "app"
+	APP_WITH_COOKIE_WEB    = "web"
+	APP_WITH_COOKIE_REJECT = "reject"
+)
+
+// ErrAppWithCookie is returned for app requests which carry a uids cookie, when app_with_cookie is "reject"
+var ErrAppWithCookie = &InvalidRequestError{"request has both an app and a uids cookie"}
+
+// BIDDER_ERROR_MISSING_PARAMS is the Error of the bidders dropped from the auction, when drop_bidders_without_params
+// is on, because none of their ad units had any params.
+const BIDDER_ERROR_MISSING_PARAMS = "Missing params"
+
+// Bidder dispositions sum up what happened to each bidder in an auction, in PBSBidder.Disposition
+const (
+	DISPOSITION_BID            = "bid"
+	DISPOSITION_NO_BID         = "no_bid"
+	DISPOSITION_ERROR          = "error"
+	DISPOSITION_TIMEOUT        = "timeout"
+	DISPOSITION_NO_COOKIE      = "no_cookie"
+	DISPOSITION_UNSUPPORTED    = "unsupported"
+	DISPOSITION_DISABLED       = "disabled"
+	DISPOSITION_RATE_LIMITED   = "rate_limited"
+	DISPOSITION_MISSING_PARAMS = "missing_params"
+	// DISPOSITION_SKIPPED is for bidders which weren't needed: the test account's bidders when it skips the
+	// adapters, and fallback bidders when another bidder bid.
+	DISPOSITION_SKIPPED = "skipped"
+	// DISPOSITION_HOLDOUT is for bidders left out of the auction by their A/B split
+	DISPOSITION_HOLDOUT = "holdout"
+)
+
+// Arms of a bidder's A/B split, in PBSBidder.TestArm
+const (
+	TEST_ARM_INCLUDED = "included"
+	TEST_ARM_HOLDOUT  = "holdout"
+)
+
+// Flags which features check through PBSRequest.FlagEnabled
+const (
+	// FLAG_CACHE_URL returns the full prebid-cache URL of cached bids, along with their cache ID
+	FLAG_CACHE_URL = "cache_url"
+	// FLAG_NO_BID_PIXELS returns a tracking pixel for each ad unit which got no bids
+	FLAG_NO_BID_PIXELS = "no_bid_pixels"
+	// FLAG_SORT_BIDS returns the bids sorted by price across all the ad units, instead of in the order they arrived
+	FLAG_SORT_BIDS = "sort_bids"
+	// FLAG_TOP_TARGETING adds the keywords of the top bid across all the ad units to the response's targeting,
+	// for clients which show one ad at a time. It only works with "sort_bids": 1, since that adds the keywords.
+	FLAG_TOP_TARGETING = "top_targeting"
+	// FLAG_NO_CONTENT answers auctions without any bids, where none of the bidders failed, with an empty 204
+	FLAG_NO_CONTENT = "no_content"
+	// FLAG_ECHO lets an account's requests ask for the request echo with ?echo=1, outside of debug mode.
+	// It's only checked against request_flags, since clients turn the echo on with the query param.
+	FLAG_ECHO = "echo"
+)
+
 type ConfigCache interface {
 	LoadConfig(string) ([]Bids, error)
 }
@@ -87,6 +183,21 @@ type AdUnit struct {
 	MediaTypes []string         `json:"media_types"`
 	Instl      int8             `json:"instl"`
 	Video      PBSVideo         `json:"video"`
+	// EligibleBidders, if given, limits which of the Bids (or bids from ConfigID) are sent out for this ad unit
+	EligibleBidders []string `json:"eligible_bidders"`
+}
+
+// eligible reports whether this ad unit may be sent to the bidder
+func (unit *AdUnit) eligible(bidderCode string) bool {
+	if len(unit.EligibleBidders) == 0 {
+		return true
+	}
+	for _, code := range unit.EligibleBidders {
+		if code == bidderCode {
+			return true
+		}
+	}
+	return false
 }
 
 type PBSAdUnit struct {
@@ -125,8 +236,21 @@ type PBSBidder struct {
 	NoBid        bool           `json:"no_bid,omitempty"`
 	UsersyncInfo *UsersyncInfo  `json:"usersync,omitempty"`
 	Debug        []*BidderDebug `json:"debug,omitempty"`
+	// DebugNotes explain, in debug mode, what prebid-server did with the bidder's response
+	DebugNotes []string `json:"debug_notes,omitempty"`
+	// Disposition is one of the DISPOSITION_ constants, and says whether the bidder was called and how it went.
+	// Error, NoCookie and NoBid carry the details. Verbose /cookie_sync responses use it for the reason a
+	// bidder isn't synced.
+	Disposition string `json:"disposition,omitempty"`
+	// TestArm is the bidder's arm of its A/B split, if it has one
+	TestArm string `json:"test_arm,omitempty"`
 
 	AdUnits []PBSAdUnit `json:"-"`
+	// Endpoint overrides the adapter's configured endpoint for this call, for accounts with their own endpoint
+	Endpoint string `json:"-"`
+	// UserID is the bidder's own ID for the user, from the uids cookie, for the adapter to send to the bidder.
+	// It's only ever the ID synced for this bidder's cookie family.
+	UserID string `json:"-"`
 }
 
 func (bidder *PBSBidder) LookupBidID(Code string) string {
@@ -147,20 +271,74 @@ func (bidder *PBSBidder) LookupAdUnit(Code string) (unit *PBSAdUnit) {
 	return nil
 }
 
+// SupplyChain is the OpenRTB supply chain object, which lists every seller the request passed through
+type SupplyChain struct {
+	Complete int               `json:"complete"`
+	Nodes    []SupplyChainNode `json:"nodes"`
+	Ver      string            `json:"ver"`
+	Ext      json.RawMessage   `json:"ext,omitempty"`
+}
+
+// SupplyChainNode is a seller in the SupplyChain. ASI is the seller's ads.txt domain, and SID is its ID
+// for the next seller, as listed in its sellers.json.
+type SupplyChainNode struct {
+	ASI    string          `json:"asi"`
+	SID    string          `json:"sid"`
+	RID    string          `json:"rid,omitempty"`
+	Name   string          `json:"name,omitempty"`
+	Domain string          `json:"domain,omitempty"`
+	HP     int             `json:"hp"`
+	Ext    json.RawMessage `json:"ext,omitempty"`
+}
+
+// valid checks that the supply chain has a version, and that every node names its seller
+func (chain *SupplyChain) valid() bool {
+	if chain.Ver == "" {
+		return false
+	}
+	for _, node := range chain.Nodes {
+		if node.ASI == "" || node.SID == "" {
+			return false
+		}
+	}
+	return true
+}
+
 type PBSRequest struct {
-	AccountID     string          `json:"account_id"`
-	Tid           string          `json:"tid"`
-	CacheMarkup   int8            `json:"cache_markup"`
-	SortBids      int8            `json:"sort_bids"`
-	MaxKeyLength  int8            `json:"max_key_length"`
-	Secure        int8            `json:"secure"`
-	TimeoutMillis int64           `json:"timeout_millis"`
-	AdUnits       []AdUnit        `json:"ad_units"`
-	IsDebug       bool            `json:"is_debug"`
-	App           *openrtb.App    `json:"app"`
-	Device        *openrtb.Device `json:"device"`
-	PBSUser       json.RawMessage `json:"user"`
-	SDK           *SDK            `json:"sdk"`
+	AccountID      string          `json:"account_id"`
+	Tid            string          `json:"tid"`
+	CacheMarkup    int8            `json:"cache_markup"`
+	SortBids       int8            `json:"sort_bids"`
+	MaxKeyLength   int8            `json:"max_key_length"`
+	ResponseFormat string          `json:"response_format"`
+	KeywordProfile string          `json:"keyword_profile"`
+	Flags          map[string]bool `json:"flags"`
+	Secure         int8            `json:"secure"`
+	TimeoutMillis  int64           `json:"timeout_millis"`
+	AdUnits        []AdUnit        `json:"ad_units"`
+	IsDebug        bool            `json:"is_debug"`
+	App            *openrtb.App    `json:"app"`
+	Device         *openrtb.Device `json:"device"`
+	PBSUser        json.RawMessage `json:"user"`
+	SDK            *SDK            `json:"sdk"`
+
+	// KeyValues are the publisher's own targeting, which is returned alongside the bids' keywords
+	KeyValues map[string]string `json:"key_values"`
+	// TargetingKeys limits the keywords added with sort_bids to these keys, named as in the default
+	// hb_ profile. Empty emits every key.
+	TargetingKeys []string `json:"targeting_keys"`
+	// Currency is the currency the bids should be returned in, like "EUR". Empty means US Dollars.
+	Currency string `json:"currency"`
+	// CacheTTLSeconds is how long the bids put in prebid cache should be kept. 0 uses the host's defaults.
+	CacheTTLSeconds int64 `json:"cache_ttl_seconds"`
+	// SChain is the supply chain of the request up to prebid-server, which is forwarded to the adapters
+	SChain *SupplyChain `json:"schain"`
+	// CreativeLoadTypes force the hb_creative_loadtype of the bidders' bids, keyed by bidder code, for apps
+	// which know how their SDK renders them. Other bidders get the host's default.
+	CreativeLoadTypes map[string]string `json:"creative_loadtypes"`
+	// BidderPriority decides which bidder wins when bids have the same price, with the first bidder listed
+	// winning. Ties between bidders which aren't listed are decided by response time.
+	BidderPriority []string `json:"bidder_priority"`
 
 	// internal
 	Bidders []*PBSBidder  `json:"-"`
@@ -169,6 +347,283 @@ type PBSRequest struct {
 	Url     string        `json:"-"`
 	Domain  string        `json:"-"`
 	Start   time.Time
+	// ClientIP is the full IP of the client. Device.IP is what the adapters see, which is anonymized
+	// when anonymize_ip is on, so ClientIP must never be sent to them.
+	ClientIP string `json:"-"`
+	// AppWithCookie is set for app requests which also carried a uids cookie, whichever way they were handled
+	AppWithCookie bool `json:"-"`
+	// Echo is set when the response should include the RequestEcho, which needs ?echo=1 and either debug mode
+	// or the echo flag allowed for the account
+	Echo bool `json:"-"`
+	// Warnings are the problems with the request which didn't stop it from being parsed, like unknown fields
+	// or values which had to be changed. They're returned in debug mode, so publishers can clean up their requests.
+	Warnings []string `json:"-"`
+}
+
+// warn records a problem with the request which doesn't stop it from being parsed
+func (req *PBSRequest) warn(format string, args ...interface{}) {
+	req.Warnings = append(req.Warnings, fmt.Sprintf(format, args...))
+}
+
+// requestFieldNames are the top level JSON fields of a PBSRequest
+var requestFieldNames = jsonFieldNames(reflect.TypeOf(PBSRequest{}))
+
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	names := make(map[string]bool, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = t.Field(i).Name
+		}
+		names[name] = true
+	}
+	return names
+}
+
+// unknownFields lists the request's top level fields which prebid-server doesn't use, in sorted order
+func unknownFields(body []byte) []string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil
+	}
+	var unknown []string
+	for name := range fields {
+		if !requestFieldNames[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// anonymizeIP zeroes the last octet of an IPv4 address, or the last 80 bits of an IPv6 address.
+// Anything which doesn't parse as an IP is dropped.
+func anonymizeIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// FlagEnabled reports whether the client turned on an experimental feature for this request,
+// and the host allows that feature for the request's account.
+func (req *PBSRequest) FlagEnabled(flag string) bool {
+	return req.Flags[flag]
+}
+
+// flagAllowed checks the request_flags config, which maps each flag to the accounts that may use it.
+// An account list containing "*" allows the flag for every account. Flags without config aren't allowed.
+func flagAllowed(flag string, accountID string) bool {
+	for _, allowed := range viper.GetStringSlice("request_flags." + flag) {
+		if allowed == "*" || allowed == accountID {
+			return true
+		}
+	}
+	return false
+}
+
+// InvalidRequestError is returned by ParsePBSRequest when a request parses fine, but is missing something it needs.
+type InvalidRequestError struct {
+	Message string
+}
+
+func (e *InvalidRequestError) Error() string {
+	return e.Message
+}
+
+// requiredFieldChecks are the fields which the host can require through the required_request_fields config,
+// on top of the ad units which every request needs.
+var requiredFieldChecks = map[string]struct {
+	present func(req *PBSRequest) bool
+	message string
+}{
+	"account_id": {
+		present: func(req *PBSRequest) bool { return req.AccountID != "" },
+		message: "account_id is required",
+	},
+	"tid": {
+		present: func(req *PBSRequest) bool { return req.Tid != "" },
+		message: "tid is required",
+	},
+	"sizes": {
+		present: func(req *PBSRequest) bool {
+			for _, unit := range req.AdUnits {
+				if len(unit.Sizes) == 0 {
+					return false
+				}
+			}
+			return true
+		},
+		message: "every ad unit needs at least one size",
+	},
+}
+
+// requestParamValues are the request fields which request_param_fields can copy into the bidder params
+var requestParamValues = map[string]func(req *PBSRequest) string{
+	"account_id": func(req *PBSRequest) string { return req.AccountID },
+	"tid":        func(req *PBSRequest) string { return req.Tid },
+	"url":        func(req *PBSRequest) string { return req.Url },
+	"domain":     func(req *PBSRequest) string { return req.Domain },
+	"app_id": func(req *PBSRequest) string {
+		if req.App == nil {
+			return ""
+		}
+		return req.App.ID
+	},
+	"app_bundle": func(req *PBSRequest) string {
+		if req.App == nil {
+			return ""
+		}
+		return req.App.Bundle
+	},
+}
+
+// RequestParamFields are the request_param_fields, keyed by bidder code. They're made once at startup
+// by NewRequestParamFields.
+type RequestParamFields map[string][]config.RequestParamField
+
+// NewRequestParamFields checks the configured request_param_fields, and groups them by bidder
+func NewRequestParamFields(fields []config.RequestParamField) (RequestParamFields, error) {
+	byBidder := make(RequestParamFields, len(fields))
+	for _, field := range fields {
+		if _, ok := requestParamValues[field.Field]; !ok {
+			return nil, fmt.Errorf("request_param_fields: unknown field '%s' for bidder %s", field.Field, field.Bidder)
+		}
+		if field.Bidder == "" || field.Param == "" {
+			return nil, fmt.Errorf("request_param_fields: field '%s' needs both a bidder and a param", field.Field)
+		}
+		byBidder[field.Bidder] = append(byBidder[field.Bidder], field)
+	}
+	return byBidder, nil
+}
+
+// addRequestParams returns the bidder params with the request fields copied in. Params the bidder already has
+// are kept, and empty fields aren't copied. Params which aren't an object are left for the adapter to complain about.
+func addRequestParams(params json.RawMessage, req *PBSRequest, fields []config.RequestParamField) json.RawMessage {
+	if len(fields) == 0 {
+		return params
+	}
+	var values map[string]json.RawMessage
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &values); err != nil {
+			return params
+		}
+	}
+	if values == nil {
+		values = make(map[string]json.RawMessage, len(fields))
+	}
+	added := false
+	for _, field := range fields {
+		if _, ok := values[field.Param]; ok {
+			continue
+		}
+		value := requestParamValues[field.Field](req)
+		if value == "" {
+			continue
+		}
+		// Strings always encode
+		values[field.Param], _ = json.Marshal(value)
+		added = true
+	}
+	if !added {
+		return params
+	}
+	merged, err := json.Marshal(values)
+	if err != nil {
+		return params
+	}
+	return merged
+}
+
+// newRequestID returns a random (version 4) UUID
+func newRequestID() string {
+	var b [16]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		// Not unique, but still better than no id at all
+		return fmt.Sprintf("pbs-%d", rand.Int63())
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+func checkRequiredFields(req *PBSRequest) error {
+	if len(req.AdUnits) == 0 {
+		return &InvalidRequestError{"at least one ad unit required"}
+	}
+	for _, field := range viper.GetStringSlice("required_request_fields") {
+		check, ok := requiredFieldChecks[field]
+		if !ok {
+			glog.Warningf("Unknown field '%s' in required_request_fields", field)
+			continue
+		}
+		if !check.present(req) {
+			return &InvalidRequestError{check.message}
+		}
+	}
+	return nil
+}
+
+// defaultMaxTimeoutMillis is the max_timeout_ms used when it isn't set
+const defaultMaxTimeoutMillis = 2000
+
+func maxTimeoutMillis() int64 {
+	if max := int64(viper.GetInt("max_timeout_ms")); max > 0 {
+		return max
+	}
+	return defaultMaxTimeoutMillis
+}
+
+// checkTimeout makes sure the request's timeout is within min_timeout_ms and max_timeout_ms. Requests without
+// a timeout, and ones outside of the limits unless invalid_timeout is "reject", get default_timeout_ms.
+func checkTimeout(req *PBSRequest) error {
+	if req.TimeoutMillis == 0 {
+		req.TimeoutMillis = int64(viper.GetInt("default_timeout_ms"))
+		return nil
+	}
+	var problem string
+	if min := int64(viper.GetInt("min_timeout_ms")); req.TimeoutMillis < 0 || req.TimeoutMillis < min {
+		problem = fmt.Sprintf("timeout_millis %d is under the %dms minimum", req.TimeoutMillis, min)
+	} else if max := maxTimeoutMillis(); req.TimeoutMillis > max {
+		problem = fmt.Sprintf("timeout_millis %d is over the %dms limit", req.TimeoutMillis, max)
+	}
+	if problem == "" {
+		return nil
+	}
+	if viper.GetString("invalid_timeout") == INVALID_TIMEOUT_REJECT {
+		return &InvalidRequestError{problem}
+	}
+	req.warn("%s, so the default timeout was used", problem)
+	req.TimeoutMillis = int64(viper.GetInt("default_timeout_ms"))
+	return nil
+}
+
+// CheckTimeouts makes sure the timeout config can be used by checkTimeout, so the requests which get
+// default_timeout_ms end up within the bounds too
+func CheckTimeouts(cfg *config.Configuration) error {
+	switch cfg.InvalidTimeout {
+	case "", INVALID_TIMEOUT_DEFAULT, INVALID_TIMEOUT_REJECT:
+	default:
+		return fmt.Errorf("invalid_timeout must be %s or %s, not %q", INVALID_TIMEOUT_DEFAULT, INVALID_TIMEOUT_REJECT, cfg.InvalidTimeout)
+	}
+	max := cfg.MaxTimeoutMillis
+	if max == 0 {
+		max = defaultMaxTimeoutMillis
+	}
+	if cfg.MinTimeoutMillis > max {
+		return fmt.Errorf("min_timeout_ms %d is over max_timeout_ms %d", cfg.MinTimeoutMillis, max)
+	}
+	if cfg.DefaultTimeout == 0 || cfg.DefaultTimeout < cfg.MinTimeoutMillis || cfg.DefaultTimeout > max {
+		return fmt.Errorf("default_timeout_ms %d must be above 0, and within min_timeout_ms %d and max_timeout_ms %d", cfg.DefaultTimeout, cfg.MinTimeoutMillis, max)
+	}
+	return nil
 }
 
 func ConfigGet(cache cache.Cache, id string) ([]Bids, error) {
@@ -211,28 +666,161 @@ func ParseMediaTypes(types []string) []MediaType {
 	return mtypes
 }
 
-func ParsePBSRequest(r *http.Request, cache cache.Cache, hostCookieSettings *HostCookieSettings) (*PBSRequest, error) {
+// normalizeAdUnitCodes trims the whitespace around the ad unit codes, and lowercases them if fold_ad_unit_codes
+// is set, so codes which only differ in those ways match up in the response. Ad units which end up with the same
+// code are dropped or rejected, depending on duplicate_ad_units.
+func normalizeAdUnitCodes(req *PBSRequest) error {
+	foldCase := viper.GetBool("fold_ad_unit_codes")
+	seen := make(map[string]bool, len(req.AdUnits))
+	units := req.AdUnits[:0]
+	for _, unit := range req.AdUnits {
+		unit.Code = strings.TrimSpace(unit.Code)
+		if foldCase {
+			unit.Code = strings.ToLower(unit.Code)
+		}
+		if seen[unit.Code] {
+			glog.Warningf("Ad unit code '%s' is used by more than one ad unit", unit.Code)
+			if viper.GetString("duplicate_ad_units") == DUPLICATE_BIDDERS_REJECT {
+				return &InvalidRequestError{fmt.Sprintf("ad unit code '%s' is used by more than one ad unit", unit.Code)}
+			}
+			req.warn("Ad unit code '%s' is used by more than one ad unit, so only the first was used", unit.Code)
+			continue
+		}
+		seen[unit.Code] = true
+		units = append(units, unit)
+	}
+	req.AdUnits = units
+	return nil
+}
+
+// targetingKeyNames are the targeting keys which PBSRequest.TargetingKeys can select, as they're named in
+// the default keyword profile
+var targetingKeyNames = []string{"hb_pb", "hb_bidder", "hb_cache_id", "hb_cache_url", "hb_size", "hb_creative_loadtype"}
+
+// checkTargetingKeys makes sure the requested targeting keys are all ones prebid-server emits
+func checkTargetingKeys(keys []string) error {
+	for _, key := range keys {
+		known := false
+		for _, name := range targetingKeyNames {
+			if key == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return &InvalidRequestError{fmt.Sprintf("Unknown targeting_keys key '%s'. Expected one of %s", key, strings.Join(targetingKeyNames, ", "))}
+		}
+	}
+	return nil
+}
+
+// checkKeyValues makes sure the publisher key-values fit in the host's key_values limits. 0 means no limit.
+func checkKeyValues(keyValues map[string]string) error {
+	if max := viper.GetInt("key_values.max_count"); max > 0 && len(keyValues) > max {
+		return &InvalidRequestError{fmt.Sprintf("at most %d key_values are allowed", max)}
+	}
+	maxKey := viper.GetInt("key_values.max_key_length")
+	maxValue := viper.GetInt("key_values.max_value_length")
+	for key, value := range keyValues {
+		if key == "" {
+			return &InvalidRequestError{"key_values keys can't be empty"}
+		}
+		if maxKey > 0 && len(key) > maxKey {
+			return &InvalidRequestError{fmt.Sprintf("key_values key '%s' is longer than %d characters", key, maxKey)}
+		}
+		if maxValue > 0 && len(value) > maxValue {
+			return &InvalidRequestError{fmt.Sprintf("key_values value for '%s' is longer than %d characters", key, maxValue)}
+		}
+	}
+	return nil
+}
+
+func ParsePBSRequest(r *http.Request, cache cache.Cache, hostCookieSettings *HostCookieSettings, paramFields RequestParamFields) (*PBSRequest, error) {
 	defer r.Body.Close()
 
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
 	pbsReq := &PBSRequest{}
-	err := json.NewDecoder(r.Body).Decode(&pbsReq)
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(&pbsReq)
 	if err != nil {
 		return nil, err
 	}
 	pbsReq.Start = time.Now()
+	for _, field := range unknownFields(body) {
+		pbsReq.warn("Unknown field '%s' was ignored", field)
+	}
+
+	// Requests without an account use the host's default account, if it has one
+	if pbsReq.AccountID == "" {
+		pbsReq.AccountID = viper.GetString("default_account_id")
+	}
+
+	if err := checkRequiredFields(pbsReq); err != nil {
+		return nil, err
+	}
 
-	if len(pbsReq.AdUnits) == 0 {
-		return nil, fmt.Errorf("No ad units specified")
+	// Requests without a tid get one from us, so that their logs and responses can still be matched up
+	if pbsReq.Tid == "" {
+		pbsReq.Tid = newRequestID()
+	}
+
+	if err := normalizeAdUnitCodes(pbsReq); err != nil {
+		return nil, err
 	}
 
-	if pbsReq.TimeoutMillis == 0 || pbsReq.TimeoutMillis > 2000 {
-		pbsReq.TimeoutMillis = int64(viper.GetInt("default_timeout_ms"))
+	switch pbsReq.ResponseFormat {
+	case "":
+		pbsReq.ResponseFormat = RESPONSE_FORMAT_FLAT
+	case RESPONSE_FORMAT_FLAT, RESPONSE_FORMAT_SEATBID, RESPONSE_FORMAT_BOTH:
+	default:
+		return nil, fmt.Errorf("Invalid response_format '%s'", pbsReq.ResponseFormat)
+	}
+
+	if err := checkKeyValues(pbsReq.KeyValues); err != nil {
+		return nil, err
+	}
+	if err := checkTargetingKeys(pbsReq.TargetingKeys); err != nil {
+		return nil, err
+	}
+	for bidder, loadType := range pbsReq.CreativeLoadTypes {
+		if loadType != CREATIVE_LOADTYPE_HTML && loadType != CREATIVE_LOADTYPE_DEMAND_SDK {
+			return nil, &InvalidRequestError{fmt.Sprintf("Invalid creative_loadtypes '%s' for bidder %s. Expected %s or %s", loadType, bidder, CREATIVE_LOADTYPE_HTML, CREATIVE_LOADTYPE_DEMAND_SDK)}
+		}
+	}
+
+	// Unknown flags, and flags the host hasn't allowed for this account, are dropped
+	for flag, enabled := range pbsReq.Flags {
+		if !enabled || !flagAllowed(flag, pbsReq.AccountID) {
+			if enabled {
+				pbsReq.warn("Flag '%s' isn't available, so it was ignored", flag)
+			}
+			delete(pbsReq.Flags, flag)
+		}
+	}
+
+	if pbsReq.SChain != nil {
+		if !pbsReq.SChain.valid() {
+			pbsReq.warn("schain needs a ver, and an asi and sid on every node, so it was dropped")
+			pbsReq.SChain = nil
+		} else if asi := viper.GetString("schain_asi"); asi != "" {
+			pbsReq.SChain.Nodes = append(pbsReq.SChain.Nodes, SupplyChainNode{ASI: asi, SID: pbsReq.AccountID, HP: 1})
+		}
+	}
+
+	if err := checkTimeout(pbsReq); err != nil {
+		return nil, err
 	}
 
 	if pbsReq.Device == nil {
 		pbsReq.Device = &openrtb.Device{}
 	}
-	pbsReq.Device.IP = prebid.GetIP(r)
+	pbsReq.ClientIP = prebid.GetIP(r)
+	pbsReq.Device.IP = pbsReq.ClientIP
+	if viper.GetBool("anonymize_ip") {
+		pbsReq.Device.IP = anonymizeIP(pbsReq.ClientIP)
+	}
 
 	if pbsReq.SDK == nil {
 		pbsReq.SDK = &SDK{}
@@ -250,12 +838,29 @@ func ParsePBSRequest(r *http.Request, cache cache.Cache, hostCookieSettings *Hos
 				return nil, err
 			}
 		}
+	} else if pbsReq.PBSUser != nil {
+		pbsReq.warn("user is only used with sdk.version 0.0.2 or later, so it was ignored")
 	}
 
 	if pbsReq.User == nil {
 		pbsReq.User = &openrtb.User{}
 	}
 
+	if pbsReq.App != nil {
+		if _, err := r.Cookie(COOKIE_NAME); err == nil {
+			pbsReq.AppWithCookie = true
+			switch viper.GetString("app_with_cookie") {
+			case APP_WITH_COOKIE_REJECT:
+				return nil, ErrAppWithCookie
+			case APP_WITH_COOKIE_WEB:
+				pbsReq.warn("Request has both an app and a uids cookie, so it was handled as web traffic")
+				pbsReq.App = nil
+			default:
+				pbsReq.warn("Request has both an app and a uids cookie, so the cookie was ignored")
+			}
+		}
+	}
+
 	// use client-side data for web requests
 	if pbsReq.App == nil {
 		pbsReq.Cookie = ParsePBSCookieFromRequest(r)
@@ -296,6 +901,13 @@ func ParsePBSRequest(r *http.Request, cache cache.Cache, hostCookieSettings *Hos
 	if r.FormValue("debug") == "1" {
 		pbsReq.IsDebug = true
 	}
+	if r.FormValue("echo") == "1" {
+		if pbsReq.IsDebug || flagAllowed(FLAG_ECHO, pbsReq.AccountID) {
+			pbsReq.Echo = true
+		} else {
+			pbsReq.warn("echo isn't available for this account outside of debug mode, so it was ignored")
+		}
+	}
 
 	if prebid.IsSecure(r) {
 		pbsReq.Secure = 1
@@ -303,6 +915,8 @@ func ParsePBSRequest(r *http.Request, cache cache.Cache, hostCookieSettings *Hos
 
 	pbsReq.Bidders = make([]*PBSBidder, 0, MAX_BIDDERS)
 
+	dropMissingParams := viper.GetBool("drop_bidders_without_params")
+	var missingParams []string
 	for _, unit := range pbsReq.AdUnits {
 		bidders := unit.Bids
 		if unit.ConfigID != "" {
@@ -319,7 +933,26 @@ func ParsePBSRequest(r *http.Request, cache cache.Cache, hostCookieSettings *Hos
 		}
 
 		mtypes := ParseMediaTypes(unit.MediaTypes)
+		seen := make(map[string]bool, len(bidders))
 		for _, b := range bidders {
+			if !unit.eligible(b.BidderCode) {
+				continue
+			}
+			if seen[b.BidderCode] {
+				glog.Warningf("Bidder %s is listed more than once for ad unit %s", b.BidderCode, unit.Code)
+				if viper.GetString("duplicate_bidders") == DUPLICATE_BIDDERS_REJECT {
+					return nil, &InvalidRequestError{fmt.Sprintf("bidder %s is listed more than once for ad unit %s", b.BidderCode, unit.Code)}
+				}
+				pbsReq.warn("Bidder %s is listed more than once for ad unit %s, so only the first was used", b.BidderCode, unit.Code)
+				continue
+			}
+			seen[b.BidderCode] = true
+			b.Params = addRequestParams(b.Params, pbsReq, paramFields[b.BidderCode])
+			if dropMissingParams && paramsMissing(b.Params) {
+				missingParams = append(missingParams, b.BidderCode)
+				pbsReq.warn("Bidder %s has no params for ad unit %s, so it was left out", b.BidderCode, unit.Code)
+				continue
+			}
 			var bidder *PBSBidder
 			// index requires a different request for each ad unit
 			if b.BidderCode != "indexExchange" {
@@ -355,9 +988,38 @@ func ParsePBSRequest(r *http.Request, cache cache.Cache, hostCookieSettings *Hos
 		}
 	}
 
+	// Bidders which lost every ad unit to missing params are still reported, so the publisher can see why
+	for _, bidderCode := range missingParams {
+		if pbsReq.lookupBidder(bidderCode) == nil {
+			pbsReq.Bidders = append(pbsReq.Bidders, &PBSBidder{BidderCode: bidderCode, Error: BIDDER_ERROR_MISSING_PARAMS})
+		}
+	}
+
 	return pbsReq, nil
 }
 
+func (req *PBSRequest) lookupBidder(bidderCode string) *PBSBidder {
+	for _, bidder := range req.Bidders {
+		if bidder.BidderCode == bidderCode {
+			return bidder
+		}
+	}
+	return nil
+}
+
+// paramsMissing is true if the bidder params are absent, null or an empty object
+func paramsMissing(params json.RawMessage) bool {
+	if len(params) == 0 {
+		return true
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(params, &fields); err != nil {
+		// Params which aren't an object are left for the adapter to complain about
+		return false
+	}
+	return len(fields) == 0
+}
+
 func (req PBSRequest) Elapsed() int {
 	return int(time.Since(req.Start) / 1000000)
 }
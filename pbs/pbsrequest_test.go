@@ -2,12 +2,15 @@ package pbs
 
 import (
 	"bytes"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
 	"github.com/magiconair/properties/assert"
+	"github.com/spf13/viper"
 	"github.com/dbmedialab/prebid-server/cache/dummycache"
+	"github.com/dbmedialab/prebid-server/config"
 )
 
 const mimeVideoMp4 = "video/mp4"
@@ -72,7 +75,7 @@ func TestParseSimpleRequest(t *testing.T) {
 	d, _ := dummycache.New()
 	hcs := HostCookieSettings{}
 
-	pbs_req, err := ParsePBSRequest(r, d, &hcs)
+	pbs_req, err := ParsePBSRequest(r, d, &hcs, nil)
 	if err != nil {
 		t.Fatalf("Parse simple request failed: %v", err)
 	}
@@ -154,7 +157,7 @@ func TestHeaderParsing(t *testing.T) {
 
 	d.Config().Set("dummy", dummyConfig)
 
-	pbs_req, err := ParsePBSRequest(r, d, &hcs)
+	pbs_req, err := ParsePBSRequest(r, d, &hcs, nil)
 	if err != nil {
 		t.Fatalf("Parse simple request failed")
 	}
@@ -236,7 +239,7 @@ func TestParseConfig(t *testing.T) {
 
 	d.Config().Set("dummy", dummyConfig)
 
-	pbs_req, err := ParsePBSRequest(r, d, &hcs)
+	pbs_req, err := ParsePBSRequest(r, d, &hcs, nil)
 	if err != nil {
 		t.Fatalf("Parse simple request failed: %v", err)
 	}
@@ -271,6 +274,152 @@ func TestParseConfig(t *testing.T) {
 	}
 }
 
+func TestParseAdUnitBidders(t *testing.T) {
+	body := []byte(`{
+        "tid": "abcd",
+        "ad_units": [
+            {
+                "code": "first",
+                "sizes": [{"w": 300, "h": 250}],
+                "eligible_bidders": ["appnexus"],
+                "bids": [
+                    {
+                        "bidder": "indexExchange"
+                    },
+                    {
+                        "bidder": "appnexus"
+                    }
+                ]
+            },
+            {
+                "code": "second",
+                "sizes": [{"w": 728, "h": 90}],
+                "eligible_bidders": ["appnexus", "pubmatic"],
+                "config_id": "abcd"
+            }
+        ]
+    }
+    `)
+	r := httptest.NewRequest("POST", "/auction", bytes.NewBuffer(body))
+	r.Header.Add("Referer", "http://nytimes.com/cool.html")
+	d, _ := dummycache.New()
+	hcs := HostCookieSettings{}
+
+	d.Config().Set("dummy", dummyConfig)
+
+	pbs_req, err := ParsePBSRequest(r, d, &hcs, nil)
+	if err != nil {
+		t.Fatalf("Parse request failed: %v", err)
+	}
+
+	if len(pbs_req.Bidders) != 2 {
+		t.Fatalf("Should have 2 eligible bidders, not %d", len(pbs_req.Bidders))
+	}
+	if pbs_req.Bidders[0].BidderCode != "appnexus" {
+		t.Errorf("First bidder not appnexus")
+	}
+	if len(pbs_req.Bidders[0].AdUnits) != 2 {
+		t.Errorf("AppNexus bidder should have 2 ad units")
+	}
+	if pbs_req.Bidders[1].BidderCode != "pubmatic" {
+		t.Errorf("Second bidder not pubmatic")
+	}
+	if len(pbs_req.Bidders[1].AdUnits) != 1 || pbs_req.Bidders[1].AdUnits[0].Code != "second" {
+		t.Errorf("Pubmatic bidder should only have the second ad unit")
+	}
+}
+
+func TestParseDuplicateBidders(t *testing.T) {
+	body := `{
+        "tid": "abcd",
+        "ad_units": [
+            {
+                "code": "first",
+                "sizes": [{"w": 300, "h": 250}],
+                "bids": [
+                    {"bidder": "appnexus", "bid_id": "1"},
+                    {"bidder": "indexExchange"},
+                    {"bidder": "appnexus", "bid_id": "2"},
+                    {"bidder": "indexExchange"}
+                ]
+            }
+        ]
+    }`
+	d, _ := dummycache.New()
+	hcs := HostCookieSettings{}
+
+	r := httptest.NewRequest("POST", "/auction", bytes.NewBufferString(body))
+	r.Header.Add("Referer", "http://nytimes.com/cool.html")
+	pbs_req, err := ParsePBSRequest(r, d, &hcs, nil)
+	if err != nil {
+		t.Fatalf("Parse request failed: %v", err)
+	}
+	if len(pbs_req.Bidders) != 2 {
+		t.Fatalf("Duplicate bidders should be dropped, leaving 2 not %d", len(pbs_req.Bidders))
+	}
+	if len(pbs_req.Bidders[0].AdUnits) != 1 || pbs_req.Bidders[0].AdUnits[0].BidID != "1" {
+		t.Errorf("Only the first appnexus listing should be kept")
+	}
+
+	viper.Set("duplicate_bidders", DUPLICATE_BIDDERS_REJECT)
+	defer viper.Set("duplicate_bidders", DUPLICATE_BIDDERS_DEDUP)
+
+	r = httptest.NewRequest("POST", "/auction", bytes.NewBufferString(body))
+	r.Header.Add("Referer", "http://nytimes.com/cool.html")
+	if _, err := ParsePBSRequest(r, d, &hcs, nil); err == nil {
+		t.Errorf("Duplicate bidders should be rejected")
+	} else if _, ok := err.(*InvalidRequestError); !ok {
+		t.Errorf("Duplicate bidders should be an InvalidRequestError; got %v", err)
+	}
+}
+
+func TestParseAdUnitCodes(t *testing.T) {
+	body := `{
+        "tid": "abcd",
+        "ad_units": [
+            {"code": " first\t", "bids": [{"bidder": "appnexus", "bid_id": "1"}]},
+            {"code": "First", "bids": [{"bidder": "appnexus", "bid_id": "2"}]},
+            {"code": "first ", "bids": [{"bidder": "appnexus", "bid_id": "3"}]}
+        ]
+    }`
+	d, _ := dummycache.New()
+	hcs := HostCookieSettings{}
+	parse := func() (*PBSRequest, error) {
+		r := httptest.NewRequest("POST", "/auction", bytes.NewBufferString(body))
+		r.Header.Add("Referer", "http://nytimes.com/cool.html")
+		return ParsePBSRequest(r, d, &hcs, nil)
+	}
+
+	pbs_req, err := parse()
+	if err != nil {
+		t.Fatalf("Parse request failed: %v", err)
+	}
+	if len(pbs_req.AdUnits) != 2 || pbs_req.AdUnits[0].Code != "first" || pbs_req.AdUnits[1].Code != "First" {
+		t.Fatalf("Codes should be trimmed and the duplicate dropped; got %+v", pbs_req.AdUnits)
+	}
+	if units := pbs_req.Bidders[0].AdUnits; len(units) != 2 || units[0].Code != "first" || units[0].BidID != "1" {
+		t.Errorf("Bidders should get the normalized codes of the first listings; got %+v", units)
+	}
+
+	viper.Set("fold_ad_unit_codes", true)
+	defer viper.Set("fold_ad_unit_codes", false)
+	pbs_req, err = parse()
+	if err != nil {
+		t.Fatalf("Parse request failed: %v", err)
+	}
+	if len(pbs_req.AdUnits) != 1 || pbs_req.AdUnits[0].Code != "first" {
+		t.Errorf("Codes which only differ by case should be duplicates when folding case; got %+v", pbs_req.AdUnits)
+	}
+
+	viper.Set("duplicate_ad_units", DUPLICATE_BIDDERS_REJECT)
+	defer viper.Set("duplicate_ad_units", DUPLICATE_BIDDERS_DEDUP)
+	if _, err := parse(); err == nil {
+		t.Errorf("Duplicate ad unit codes should be rejected")
+	} else if _, ok := err.(*InvalidRequestError); !ok {
+		t.Errorf("Duplicate ad unit codes should be an InvalidRequestError; got %v", err)
+	}
+}
+
 func TestParseMobileRequestFirstVersion(t *testing.T) {
 	body := []byte(`{
 	   "max_key_length":20,
@@ -317,7 +466,7 @@ func TestParseMobileRequestFirstVersion(t *testing.T) {
 	d, _ := dummycache.New()
 	hcs := HostCookieSettings{}
 
-	pbs_req, err := ParsePBSRequest(r, d, &hcs)
+	pbs_req, err := ParsePBSRequest(r, d, &hcs, nil)
 	if err != nil {
 		t.Fatalf("Parse simple request failed: %v", err)
 	}
@@ -413,7 +562,7 @@ func TestParseMobileRequest(t *testing.T) {
 	d, _ := dummycache.New()
 	hcs := HostCookieSettings{}
 
-	pbs_req, err := ParsePBSRequest(r, d, &hcs)
+	pbs_req, err := ParsePBSRequest(r, d, &hcs, nil)
 	if err != nil {
 		t.Fatalf("Parse simple request failed: %v", err)
 	}
@@ -513,7 +662,7 @@ func TestParseMalformedMobileRequest(t *testing.T) {
 	d, _ := dummycache.New()
 	hcs := HostCookieSettings{}
 
-	pbs_req, err := ParsePBSRequest(r, d, &hcs)
+	pbs_req, err := ParsePBSRequest(r, d, &hcs, nil)
 	if err != nil {
 		t.Fatalf("Parse simple request failed: %v", err)
 	}
@@ -617,7 +766,7 @@ func TestParseRequestWithInstl(t *testing.T) {
 	d, _ := dummycache.New()
 	hcs := HostCookieSettings{}
 
-	pbs_req, err := ParsePBSRequest(r, d, &hcs)
+	pbs_req, err := ParsePBSRequest(r, d, &hcs, nil)
 	if err != nil {
 		t.Fatalf("Parse simple request failed: %v", err)
 	}
@@ -665,7 +814,7 @@ func TestParsePBSRequestUsesHostCookie(t *testing.T) {
 		Family:     "family",
 	}
 
-	pbs_req, err2 := ParsePBSRequest(r, d, &hcs)
+	pbs_req, err2 := ParsePBSRequest(r, d, &hcs, nil)
 	if err2 != nil {
 		t.Fatalf("Parse simple request failed %v", err2)
 	}
@@ -673,3 +822,632 @@ func TestParsePBSRequestUsesHostCookie(t *testing.T) {
 		t.Errorf("Failed to leverage host cookie space for user identifier")
 	}
 }
+
+func TestParseResponseFormat(t *testing.T) {
+	formats := map[string]string{
+		``:                              RESPONSE_FORMAT_FLAT,
+		`"response_format": "flat",`:    RESPONSE_FORMAT_FLAT,
+		`"response_format": "seatbid",`: RESPONSE_FORMAT_SEATBID,
+		`"response_format": "both",`:    RESPONSE_FORMAT_BOTH,
+	}
+	for field, expected := range formats {
+		body := []byte(`{
+            "tid": "abcd",
+            ` + field + `
+            "ad_units": [{"code": "first", "sizes": [{"w": 300, "h": 250}], "bids": [{"bidder": "appnexus"}]}]
+        }`)
+		r := httptest.NewRequest("POST", "/auction", bytes.NewBuffer(body))
+		r.Header.Add("Referer", "http://nytimes.com/cool.html")
+		d, _ := dummycache.New()
+		hcs := HostCookieSettings{}
+
+		pbs_req, err := ParsePBSRequest(r, d, &hcs, nil)
+		if err != nil {
+			t.Fatalf("Parse request with %s failed: %v", field, err)
+		}
+		if pbs_req.ResponseFormat != expected {
+			t.Errorf("Expected response format %s; got %s", expected, pbs_req.ResponseFormat)
+		}
+	}
+
+	body := []byte(`{
+        "tid": "abcd",
+        "response_format": "ortb",
+        "ad_units": [{"code": "first", "sizes": [{"w": 300, "h": 250}], "bids": [{"bidder": "appnexus"}]}]
+    }`)
+	r := httptest.NewRequest("POST", "/auction", bytes.NewBuffer(body))
+	r.Header.Add("Referer", "http://nytimes.com/cool.html")
+	d, _ := dummycache.New()
+	hcs := HostCookieSettings{}
+	if _, err := ParsePBSRequest(r, d, &hcs, nil); err == nil {
+		t.Errorf("Parse should fail for an unknown response_format")
+	}
+}
+
+func TestParseEcho(t *testing.T) {
+	viper.Set("request_flags.echo", []string{"acct1"})
+	defer viper.Set("request_flags", nil)
+
+	d, _ := dummycache.New()
+	hcs := HostCookieSettings{}
+	parse := func(account string, query string) *PBSRequest {
+		body := fmt.Sprintf(`{"tid": "abcd", "account_id": "%s", "ad_units": [{"code": "first", "sizes": [{"w": 300, "h": 250}], "bids": [{"bidder": "appnexus"}]}]}`, account)
+		r := httptest.NewRequest("POST", "/auction?"+query, bytes.NewBufferString(body))
+		r.Header.Add("Referer", "http://nytimes.com/cool.html")
+		pbs_req, err := ParsePBSRequest(r, d, &hcs, nil)
+		if err != nil {
+			t.Fatalf("Parse request failed: %v", err)
+		}
+		return pbs_req
+	}
+
+	if !parse("acct1", "echo=1").Echo {
+		t.Errorf("acct1 is allowed the echo")
+	}
+	if parse("acct1", "").Echo {
+		t.Errorf("The echo should only be returned when it's asked for")
+	}
+	if pbs_req := parse("acct2", "echo=1"); pbs_req.Echo || len(pbs_req.Warnings) != 1 {
+		t.Errorf("acct2 isn't allowed the echo, and should be warned about it")
+	}
+	if !parse("acct2", "echo=1&debug=1").Echo {
+		t.Errorf("Any account should get the echo in debug mode")
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	viper.Set("request_flags.new_sort", []string{"acct1"})
+	viper.Set("request_flags.everyone", []string{"*"})
+	defer viper.Set("request_flags", nil)
+
+	body := []byte(`{
+        "tid": "abcd",
+        "account_id": "acct1",
+        "flags": {"new_sort": true, "everyone": true, "unknown": true},
+        "ad_units": [{"code": "first", "sizes": [{"w": 300, "h": 250}], "bids": [{"bidder": "appnexus"}]}]
+    }`)
+	r := httptest.NewRequest("POST", "/auction", bytes.NewBuffer(body))
+	r.Header.Add("Referer", "http://nytimes.com/cool.html")
+	d, _ := dummycache.New()
+	hcs := HostCookieSettings{}
+
+	pbs_req, err := ParsePBSRequest(r, d, &hcs, nil)
+	if err != nil {
+		t.Fatalf("Parse request failed: %v", err)
+	}
+	if !pbs_req.FlagEnabled("new_sort") {
+		t.Errorf("new_sort should be enabled for acct1")
+	}
+	if !pbs_req.FlagEnabled("everyone") {
+		t.Errorf("everyone should be enabled for any account")
+	}
+	if pbs_req.FlagEnabled("unknown") {
+		t.Errorf("Unknown flags should be ignored")
+	}
+
+	body = []byte(`{
+        "tid": "abcd",
+        "account_id": "acct2",
+        "flags": {"new_sort": true},
+        "ad_units": [{"code": "first", "sizes": [{"w": 300, "h": 250}], "bids": [{"bidder": "appnexus"}]}]
+    }`)
+	r = httptest.NewRequest("POST", "/auction", bytes.NewBuffer(body))
+	r.Header.Add("Referer", "http://nytimes.com/cool.html")
+
+	pbs_req, err = ParsePBSRequest(r, d, &hcs, nil)
+	if err != nil {
+		t.Fatalf("Parse request failed: %v", err)
+	}
+	if pbs_req.FlagEnabled("new_sort") {
+		t.Errorf("new_sort should not be enabled for acct2")
+	}
+}
+
+func TestParseRequiredFields(t *testing.T) {
+	d, _ := dummycache.New()
+	hcs := HostCookieSettings{}
+
+	parse := func(body string) error {
+		r := httptest.NewRequest("POST", "/auction", bytes.NewBufferString(body))
+		r.Header.Add("Referer", "http://nytimes.com/cool.html")
+		_, err := ParsePBSRequest(r, d, &hcs, nil)
+		return err
+	}
+
+	err := parse(`{"tid": "abcd", "ad_units": []}`)
+	if _, ok := err.(*InvalidRequestError); !ok || err.Error() != "at least one ad unit required" {
+		t.Errorf("Expected a missing ad units error; got %v", err)
+	}
+
+	noAccount := `{"tid": "abcd", "ad_units": [{"code": "first", "bids": [{"bidder": "appnexus"}]}]}`
+	if err := parse(noAccount); err != nil {
+		t.Errorf("account_id shouldn't be required by default; got %v", err)
+	}
+
+	viper.Set("required_request_fields", []string{"account_id", "sizes"})
+	defer viper.Set("required_request_fields", []string{})
+
+	err = parse(noAccount)
+	if _, ok := err.(*InvalidRequestError); !ok || err.Error() != "account_id is required" {
+		t.Errorf("Expected a missing account_id error; got %v", err)
+	}
+
+	err = parse(`{"tid": "abcd", "account_id": "acct", "ad_units": [{"code": "first", "bids": [{"bidder": "appnexus"}]}]}`)
+	if _, ok := err.(*InvalidRequestError); !ok || err.Error() != "every ad unit needs at least one size" {
+		t.Errorf("Expected a missing sizes error; got %v", err)
+	}
+
+	if err := parse(`{"tid": "abcd", "account_id": "acct", "ad_units": [{"code": "first", "sizes": [{"w": 300, "h": 250}], "bids": [{"bidder": "appnexus"}]}]}`); err != nil {
+		t.Errorf("Request with all the required fields failed: %v", err)
+	}
+}
+
+func TestParseDefaultAccount(t *testing.T) {
+	d, _ := dummycache.New()
+	hcs := HostCookieSettings{}
+
+	parse := func(body string) (*PBSRequest, error) {
+		r := httptest.NewRequest("POST", "/auction", bytes.NewBufferString(body))
+		r.Header.Add("Referer", "http://nytimes.com/cool.html")
+		return ParsePBSRequest(r, d, &hcs, nil)
+	}
+
+	noAccount := `{"tid": "abcd", "ad_units": [{"code": "first", "bids": [{"bidder": "appnexus"}]}]}`
+	pbs_req, err := parse(noAccount)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if pbs_req.AccountID != "" {
+		t.Errorf("Account should stay empty without a default account; got %s", pbs_req.AccountID)
+	}
+
+	viper.Set("default_account_id", "internal")
+	defer viper.Set("default_account_id", "")
+
+	pbs_req, err = parse(noAccount)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if pbs_req.AccountID != "internal" {
+		t.Errorf("Request without an account should get the default account; got %s", pbs_req.AccountID)
+	}
+
+	pbs_req, err = parse(`{"tid": "abcd", "account_id": "acct", "ad_units": [{"code": "first", "bids": [{"bidder": "appnexus"}]}]}`)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if pbs_req.AccountID != "acct" {
+		t.Errorf("The request's own account should win over the default; got %s", pbs_req.AccountID)
+	}
+
+	// The default account satisfies a required account_id
+	viper.Set("required_request_fields", []string{"account_id"})
+	defer viper.Set("required_request_fields", []string{})
+	if _, err := parse(noAccount); err != nil {
+		t.Errorf("The default account should count as the request's account_id; got %v", err)
+	}
+}
+
+func TestParseGeneratesTid(t *testing.T) {
+	d, _ := dummycache.New()
+	hcs := HostCookieSettings{}
+
+	parse := func(body string) *PBSRequest {
+		r := httptest.NewRequest("POST", "/auction", bytes.NewBufferString(body))
+		r.Header.Add("Referer", "http://nytimes.com/cool.html")
+		pbs_req, err := ParsePBSRequest(r, d, &hcs, nil)
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		return pbs_req
+	}
+
+	first := parse(`{"ad_units": [{"code": "first", "bids": [{"bidder": "appnexus"}]}]}`)
+	second := parse(`{"ad_units": [{"code": "first", "bids": [{"bidder": "appnexus"}]}]}`)
+	if len(first.Tid) != 36 {
+		t.Errorf("Expected a UUID for a request without a tid; got '%s'", first.Tid)
+	}
+	if first.Tid == second.Tid {
+		t.Errorf("Generated tids should be unique; got %s twice", first.Tid)
+	}
+
+	if own := parse(`{"tid": "abcd", "ad_units": [{"code": "first", "bids": [{"bidder": "appnexus"}]}]}`); own.Tid != "abcd" {
+		t.Errorf("The request's own tid should be kept; got %s", own.Tid)
+	}
+}
+
+func TestParseKeyValues(t *testing.T) {
+	viper.Set("key_values.max_count", 2)
+	viper.Set("key_values.max_key_length", 5)
+	viper.Set("key_values.max_value_length", 10)
+	defer func() {
+		viper.Set("key_values.max_count", 0)
+		viper.Set("key_values.max_key_length", 0)
+		viper.Set("key_values.max_value_length", 0)
+	}()
+
+	d, _ := dummycache.New()
+	hcs := HostCookieSettings{}
+	parse := func(keyValues string) (*PBSRequest, error) {
+		body := `{"tid": "abcd", "key_values": ` + keyValues + `, "ad_units": [{"code": "first", "bids": [{"bidder": "appnexus"}]}]}`
+		r := httptest.NewRequest("POST", "/auction", bytes.NewBufferString(body))
+		r.Header.Add("Referer", "http://nytimes.com/cool.html")
+		return ParsePBSRequest(r, d, &hcs, nil)
+	}
+
+	pbs_req, err := parse(`{"sect": "sport", "kw": "football"}`)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if len(pbs_req.KeyValues) != 2 || pbs_req.KeyValues["sect"] != "sport" {
+		t.Errorf("Key values weren't parsed: %v", pbs_req.KeyValues)
+	}
+
+	invalid := []string{
+		`{"a": "1", "b": "2", "c": "3"}`,
+		`{"section": "sport"}`,
+		`{"sect": "much too long"}`,
+		`{"": "empty"}`,
+	}
+	for _, keyValues := range invalid {
+		if _, err := parse(keyValues); err == nil {
+			t.Errorf("Expected %s to be rejected", keyValues)
+		} else if _, ok := err.(*InvalidRequestError); !ok {
+			t.Errorf("Expected an InvalidRequestError for %s; got %v", keyValues, err)
+		}
+	}
+}
+
+func TestParseMissingParams(t *testing.T) {
+	d, _ := dummycache.New()
+	hcs := HostCookieSettings{}
+	body := `{
+        "tid": "abcd",
+        "ad_units": [
+            {"code": "first", "bids": [{"bidder": "appnexus", "params": {"placementId": 1}}, {"bidder": "rubicon"}, {"bidder": "pubmatic", "params": {}}]},
+            {"code": "second", "bids": [{"bidder": "appnexus"}, {"bidder": "rubicon", "params": null}]}
+        ]
+    }`
+	parse := func() *PBSRequest {
+		r := httptest.NewRequest("POST", "/auction", bytes.NewBufferString(body))
+		r.Header.Add("Referer", "http://nytimes.com/cool.html")
+		pbs_req, err := ParsePBSRequest(r, d, &hcs, nil)
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		return pbs_req
+	}
+
+	if pbs_req := parse(); len(pbs_req.Bidders) != 3 || pbs_req.lookupBidder("rubicon").Error != "" {
+		t.Errorf("Bidders without params should be kept by default")
+	}
+
+	viper.Set("drop_bidders_without_params", true)
+	defer viper.Set("drop_bidders_without_params", false)
+	pbs_req := parse()
+	if appnexus := pbs_req.lookupBidder("appnexus"); appnexus == nil || len(appnexus.AdUnits) != 1 || appnexus.AdUnits[0].Code != "first" {
+		t.Errorf("appnexus should only keep the ad unit with params")
+	}
+	for _, bidderCode := range []string{"rubicon", "pubmatic"} {
+		if bidder := pbs_req.lookupBidder(bidderCode); bidder == nil || bidder.Error != BIDDER_ERROR_MISSING_PARAMS || len(bidder.AdUnits) != 0 {
+			t.Errorf("%s should be reported as missing params", bidderCode)
+		}
+	}
+}
+
+func TestParseRequestParamFields(t *testing.T) {
+	fields, err := NewRequestParamFields([]config.RequestParamField{
+		{Bidder: "appnexus", Param: "member", Field: "account_id"},
+		{Bidder: "appnexus", Param: "pageUrl", Field: "url"},
+		{Bidder: "rubicon", Param: "siteDomain", Field: "domain"},
+		{Bidder: "rubicon", Param: "bundle", Field: "app_bundle"},
+	})
+	if err != nil {
+		t.Fatalf("Unable to make the request_param_fields: %v", err)
+	}
+
+	d, _ := dummycache.New()
+	hcs := HostCookieSettings{}
+	body := `{
+        "tid": "abcd",
+        "account_id": "1001",
+        "ad_units": [
+            {"code": "first", "bids": [{"bidder": "appnexus", "params": {"placementId": 1}}, {"bidder": "rubicon"}]},
+            {"code": "second", "bids": [{"bidder": "appnexus", "params": {"member": "2002"}}, {"bidder": "pubmatic", "params": {"publisherId": "p"}}]}
+        ]
+    }`
+	r := httptest.NewRequest("POST", "/auction", bytes.NewBufferString(body))
+	r.Header.Add("Referer", "http://nytimes.com/cool.html")
+	pbs_req, err := ParsePBSRequest(r, d, &hcs, fields)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	params := func(bidderCode string, i int) string {
+		bidder := pbs_req.lookupBidder(bidderCode)
+		if bidder == nil || len(bidder.AdUnits) <= i {
+			t.Fatalf("Bidder %s is missing ad unit %d", bidderCode, i)
+		}
+		return string(bidder.AdUnits[i].Params)
+	}
+	if p := params("appnexus", 0); p != `{"member":"1001","pageUrl":"http://nytimes.com/cool.html","placementId":1}` {
+		t.Errorf("The request fields should be copied into the appnexus params; got %s", p)
+	}
+	if p := params("appnexus", 1); p != `{"member":"2002","pageUrl":"http://nytimes.com/cool.html"}` {
+		t.Errorf("Params from the request should win over the request fields; got %s", p)
+	}
+	if p := params("rubicon", 0); p != `{"siteDomain":"nytimes.com"}` {
+		t.Errorf("Empty fields shouldn't be copied; got %s", p)
+	}
+	if p := params("pubmatic", 0); p != `{"publisherId": "p"}` {
+		t.Errorf("Bidders without request_param_fields should keep their params as they were; got %s", p)
+	}
+}
+
+func TestCheckTimeouts(t *testing.T) {
+	tests := []struct {
+		description string
+		cfg         config.Configuration
+		valid       bool
+	}{
+		{"The defaults are fine", config.Configuration{DefaultTimeout: 250, MinTimeoutMillis: 1, MaxTimeoutMillis: 2000}, true},
+		{"Rejecting is fine", config.Configuration{DefaultTimeout: 250, MaxTimeoutMillis: 2000, InvalidTimeout: INVALID_TIMEOUT_REJECT}, true},
+		{"max_timeout_ms has a default", config.Configuration{DefaultTimeout: 1500, MinTimeoutMillis: 100}, true},
+		{"Unknown policies are rejected", config.Configuration{DefaultTimeout: 250, MaxTimeoutMillis: 2000, InvalidTimeout: "rejct"}, false},
+		{"The min can't be over the max", config.Configuration{DefaultTimeout: 250, MinTimeoutMillis: 500, MaxTimeoutMillis: 400}, false},
+		{"The default can't be under the min", config.Configuration{DefaultTimeout: 50, MinTimeoutMillis: 100, MaxTimeoutMillis: 2000}, false},
+		{"The default can't be over the max", config.Configuration{DefaultTimeout: 3000, MaxTimeoutMillis: 2000}, false},
+		{"The default can't be over the default max", config.Configuration{DefaultTimeout: 3000}, false},
+		{"The default can't be 0", config.Configuration{MaxTimeoutMillis: 2000}, false},
+	}
+	for _, test := range tests {
+		if err := CheckTimeouts(&test.cfg); (err == nil) != test.valid {
+			t.Errorf("%s: got error %v", test.description, err)
+		}
+	}
+}
+
+func TestNewRequestParamFields(t *testing.T) {
+	if _, err := NewRequestParamFields([]config.RequestParamField{{Bidder: "appnexus", Param: "member", Field: "acount_id"}}); err == nil {
+		t.Errorf("Unknown fields should be rejected")
+	}
+	if _, err := NewRequestParamFields([]config.RequestParamField{{Bidder: "appnexus", Field: "account_id"}}); err == nil {
+		t.Errorf("Fields without a param should be rejected")
+	}
+	if fields, err := NewRequestParamFields(nil); err != nil || len(fields) != 0 {
+		t.Errorf("No request_param_fields should be fine; got %v and error %v", fields, err)
+	}
+}
+
+func TestAnonymizeIP(t *testing.T) {
+	for ip, expected := range map[string]string{
+		"123.45.67.89":                         "123.45.67.0",
+		"2001:db8:85a3:8d3:1319:8a2e:370:7348": "2001:db8:85a3::",
+		"::ffff:10.0.0.5":                      "10.0.0.0",
+		"not an ip":                            "",
+	} {
+		if anonymized := anonymizeIP(ip); anonymized != expected {
+			t.Errorf("Expected %s to be anonymized to %s; got %s", ip, expected, anonymized)
+		}
+	}
+}
+
+func TestParseAnonymizesIP(t *testing.T) {
+	d, _ := dummycache.New()
+	hcs := HostCookieSettings{}
+	parse := func() *PBSRequest {
+		r := httptest.NewRequest("POST", "/auction", bytes.NewBufferString(`{"tid": "abcd", "ad_units": [{"code": "first", "bids": [{"bidder": "appnexus"}]}]}`))
+		r.Header.Add("Referer", "http://nytimes.com/cool.html")
+		r.Header.Add("X-Real-IP", "123.45.67.89")
+		pbs_req, err := ParsePBSRequest(r, d, &hcs, nil)
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		return pbs_req
+	}
+
+	if pbs_req := parse(); pbs_req.Device.IP != "123.45.67.89" {
+		t.Errorf("The IP shouldn't be anonymized by default; got %s", pbs_req.Device.IP)
+	}
+
+	viper.Set("anonymize_ip", true)
+	defer viper.Set("anonymize_ip", false)
+	pbs_req := parse()
+	if pbs_req.Device.IP != "123.45.67.0" {
+		t.Errorf("Expected the device IP to be anonymized; got %s", pbs_req.Device.IP)
+	}
+	if pbs_req.ClientIP != "123.45.67.89" {
+		t.Errorf("The full IP should still be kept internally; got %s", pbs_req.ClientIP)
+	}
+}
+
+func TestParseTargetingKeys(t *testing.T) {
+	d, _ := dummycache.New()
+	hcs := HostCookieSettings{}
+	for keys, valid := range map[string]bool{
+		`[]`:                     true,
+		`["hb_pb", "hb_bidder"]`: true,
+		`["hb_pb", "hb_deal"]`:   false,
+	} {
+		body := `{"tid": "abcd", "targeting_keys": ` + keys + `, "ad_units": [{"code": "first", "bids": [{"bidder": "appnexus"}]}]}`
+		r := httptest.NewRequest("POST", "/auction", bytes.NewBufferString(body))
+		r.Header.Add("Referer", "http://nytimes.com/cool.html")
+		_, err := ParsePBSRequest(r, d, &hcs, nil)
+		if valid && err != nil {
+			t.Errorf("Expected targeting_keys %s to be accepted; got %v", keys, err)
+		} else if !valid {
+			if _, ok := err.(*InvalidRequestError); !ok {
+				t.Errorf("Expected an InvalidRequestError for targeting_keys %s; got %v", keys, err)
+			}
+		}
+	}
+}
+
+func TestParseTimeoutBounds(t *testing.T) {
+	viper.Set("default_timeout_ms", 250)
+	viper.Set("min_timeout_ms", 20)
+	viper.Set("max_timeout_ms", 1000)
+	defer viper.Set("default_timeout_ms", nil)
+	defer viper.Set("min_timeout_ms", nil)
+	defer viper.Set("max_timeout_ms", nil)
+
+	d, _ := dummycache.New()
+	hcs := HostCookieSettings{}
+	parse := func(timeout int) (*PBSRequest, error) {
+		body := fmt.Sprintf(`{"tid": "abcd", "timeout_millis": %d, "ad_units": [{"code": "first", "bids": [{"bidder": "appnexus"}]}]}`, timeout)
+		r := httptest.NewRequest("POST", "/auction", bytes.NewBufferString(body))
+		r.Header.Add("Referer", "http://nytimes.com/cool.html")
+		return ParsePBSRequest(r, d, &hcs, nil)
+	}
+
+	for timeout, expected := range map[int]int64{0: 250, 500: 500, -100: 250, 10: 250, 1500: 250} {
+		pbs_req, err := parse(timeout)
+		if err != nil {
+			t.Errorf("Parse with timeout %d failed: %v", timeout, err)
+		} else if pbs_req.TimeoutMillis != expected {
+			t.Errorf("Expected timeout %d to become %d; got %d", timeout, expected, pbs_req.TimeoutMillis)
+		}
+	}
+
+	viper.Set("invalid_timeout", INVALID_TIMEOUT_REJECT)
+	defer viper.Set("invalid_timeout", nil)
+	for _, timeout := range []int{-100, 10, 1500} {
+		if _, err := parse(timeout); err == nil {
+			t.Errorf("Expected timeout %d to be rejected", timeout)
+		} else if _, ok := err.(*InvalidRequestError); !ok {
+			t.Errorf("Expected an InvalidRequestError for timeout %d; got %v", timeout, err)
+		}
+	}
+	if pbs_req, err := parse(0); err != nil || pbs_req.TimeoutMillis != 250 {
+		t.Errorf("Requests without a timeout should still get the default; got %v", err)
+	}
+}
+
+func TestParseWarnings(t *testing.T) {
+	d, _ := dummycache.New()
+	hcs := HostCookieSettings{}
+	body := `{"tid": "abcd", "timeout_millis": 5000, "page_url": "x", "extra": 1, "ad_units": [{"code": "first", "bids": [{"bidder": "appnexus"}, {"bidder": "appnexus"}]}]}`
+	r := httptest.NewRequest("POST", "/auction", bytes.NewBufferString(body))
+	r.Header.Add("Referer", "http://nytimes.com/cool.html")
+	pbs_req, err := ParsePBSRequest(r, d, &hcs, nil)
+	if err != nil {
+		t.Fatalf("Warnings shouldn't fail the parse; got %v", err)
+	}
+	expected := []string{
+		"Unknown field 'extra' was ignored",
+		"Unknown field 'page_url' was ignored",
+		"timeout_millis 5000 is over the 2000ms limit, so the default timeout was used",
+		"Bidder appnexus is listed more than once for ad unit first, so only the first was used",
+	}
+	if len(pbs_req.Warnings) != len(expected) {
+		t.Fatalf("Expected %d warnings; got %v", len(expected), pbs_req.Warnings)
+	}
+	for i, warning := range expected {
+		if pbs_req.Warnings[i] != warning {
+			t.Errorf("Expected warning %q; got %q", warning, pbs_req.Warnings[i])
+		}
+	}
+
+	r = httptest.NewRequest("POST", "/auction", bytes.NewBufferString(`{"tid": "abcd", "ad_units": [{"code": "first", "bids": [{"bidder": "appnexus"}]}]}`))
+	r.Header.Add("Referer", "http://nytimes.com/cool.html")
+	if pbs_req, _ = ParsePBSRequest(r, d, &hcs, nil); len(pbs_req.Warnings) != 0 {
+		t.Errorf("A clean request shouldn't have any warnings; got %v", pbs_req.Warnings)
+	}
+}
+
+func TestParseSupplyChain(t *testing.T) {
+	d, _ := dummycache.New()
+	hcs := HostCookieSettings{}
+	parse := func(schain string) *PBSRequest {
+		body := `{"account_id": "acct", "tid": "abcd", "schain": ` + schain + `, "ad_units": [{"code": "first", "bids": [{"bidder": "appnexus"}]}]}`
+		r := httptest.NewRequest("POST", "/auction", bytes.NewBufferString(body))
+		r.Header.Add("Referer", "http://nytimes.com/cool.html")
+		pbs_req, err := ParsePBSRequest(r, d, &hcs, nil)
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		return pbs_req
+	}
+
+	pbs_req := parse(`{"complete": 1, "ver": "1.0", "nodes": [{"asi": "publisher.com", "sid": "123", "hp": 1}]}`)
+	if pbs_req.SChain == nil || len(pbs_req.SChain.Nodes) != 1 || pbs_req.SChain.Nodes[0].SID != "123" {
+		t.Errorf("Expected the schain to be kept as it is; got %+v", pbs_req.SChain)
+	}
+
+	viper.Set("schain_asi", "prebid.example.com")
+	defer viper.Set("schain_asi", "")
+	pbs_req = parse(`{"complete": 1, "ver": "1.0", "nodes": [{"asi": "publisher.com", "sid": "123", "hp": 1}]}`)
+	if len(pbs_req.SChain.Nodes) != 2 {
+		t.Fatalf("Expected the host's node to be added; got %+v", pbs_req.SChain.Nodes)
+	}
+	if node := pbs_req.SChain.Nodes[1]; node.ASI != "prebid.example.com" || node.SID != "acct" || node.HP != 1 {
+		t.Errorf("Bad host node: %+v", node)
+	}
+
+	pbs_req = parse(`{"complete": 1, "ver": "1.0", "nodes": [{"asi": "publisher.com"}]}`)
+	if pbs_req.SChain != nil || len(pbs_req.Warnings) != 1 {
+		t.Errorf("An schain with a node missing its sid should be dropped with a warning; got %+v", pbs_req.SChain)
+	}
+}
+
+func TestParseCreativeLoadTypes(t *testing.T) {
+	d, _ := dummycache.New()
+	hcs := HostCookieSettings{}
+	parse := func(loadTypes string) (*PBSRequest, error) {
+		body := `{"tid": "abcd", "creative_loadtypes": ` + loadTypes + `, "ad_units": [{"code": "first", "bids": [{"bidder": "appnexus"}]}]}`
+		r := httptest.NewRequest("POST", "/auction", bytes.NewBufferString(body))
+		r.Header.Add("Referer", "http://nytimes.com/cool.html")
+		return ParsePBSRequest(r, d, &hcs, nil)
+	}
+
+	pbs_req, err := parse(`{"audienceNetwork": "html", "appnexus": "demand_sdk"}`)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if pbs_req.CreativeLoadTypes["audienceNetwork"] != CREATIVE_LOADTYPE_HTML || pbs_req.CreativeLoadTypes["appnexus"] != CREATIVE_LOADTYPE_DEMAND_SDK {
+		t.Errorf("Expected the load types to be kept; got %v", pbs_req.CreativeLoadTypes)
+	}
+
+	if _, err := parse(`{"appnexus": "webview"}`); err == nil {
+		t.Errorf("An unknown load type should be rejected")
+	} else if _, ok := err.(*InvalidRequestError); !ok {
+		t.Errorf("An unknown load type should be an invalid request; got %v", err)
+	}
+}
+
+func TestParseAppWithCookie(t *testing.T) {
+	d, _ := dummycache.New()
+	hcs := HostCookieSettings{}
+	parse := func() (*PBSRequest, error) {
+		body := `{"tid": "abcd", "app": {"bundle": "com.example.app"}, "ad_units": [{"code": "first", "bids": [{"bidder": "appnexus"}]}]}`
+		r := httptest.NewRequest("POST", "/auction", bytes.NewBufferString(body))
+		r.Header.Add("Referer", "http://nytimes.com/cool.html")
+		pc := NewPBSCookie()
+		pc.TrySync("adnxs", "123")
+		r.AddCookie(pc.ToHTTPCookie())
+		return ParsePBSRequest(r, d, &hcs, nil)
+	}
+
+	pbs_req, err := parse()
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if !pbs_req.AppWithCookie || pbs_req.App == nil || pbs_req.Cookie != nil {
+		t.Errorf("The app should be preferred by default")
+	}
+
+	viper.Set("app_with_cookie", APP_WITH_COOKIE_WEB)
+	defer viper.Set("app_with_cookie", APP_WITH_COOKIE_APP)
+	pbs_req, err = parse()
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if !pbs_req.AppWithCookie || pbs_req.App != nil || pbs_req.Cookie.LiveSyncCount() != 1 {
+		t.Errorf("The request should be handled as web traffic")
+	}
+
+	viper.Set("app_with_cookie", APP_WITH_COOKIE_REJECT)
+	if _, err = parse(); err != ErrAppWithCookie {
+		t.Errorf("Expected the request to be rejected; got %v", err)
+	}
+}
@@ -1,5 +1,13 @@
 package pbs
 
+import (
+	"bytes"
+	"net/url"
+	"sort"
+	"strings"
+	"text/template"
+)
+
 // PBSBid is a bid from the auction. These are produced by Adapters, and target a particular Ad Unit.
 //
 // This JSON format is a contract with both Prebid.js and Prebid-mobile.
@@ -22,15 +30,25 @@ type PBSBid struct {
 	BidderCode string `json:"bidder"`
 	// BidHash is the hash of the bidder's unique bid identifier for blockchain. It should not be sent to browser.
 	BidHash string `json:"-"`
-	// Price is the cpm, in US Dollars, which the bidder is willing to pay if this bid is chosen.
-	// TODO: Add support for other currencies someday.
+	// Price is the cpm, in US Dollars or the request's currency, which the bidder is willing to pay if this bid is chosen.
 	Price float64 `json:"price"`
+	// OriginalCurrency and OriginalPrice are the bid as the bidder made it, and ConversionRate is what
+	// its price was multiplied by to get Price. They're only set when the bid was converted.
+	OriginalCurrency string  `json:"original_currency,omitempty"`
+	OriginalPrice    float64 `json:"original_price,omitempty"`
+	ConversionRate   float64 `json:"conversion_rate,omitempty"`
 	// NURL is a URL which returns ad markup, and should be called if the bid wins.
 	// If NURL and Adm are both defined, then Adm takes precedence.
 	NURL string `json:"nurl,omitempty"`
 	// Adm is the ad markup which should be used to deliver the ad, if this bid is chosen.
 	// If NURL and Adm are both defined, then Adm takes precedence.
 	Adm string `json:"adm,omitempty"`
+	// WinNoticeURL is the bidder's billing notice URL (the OpenRTB "burl"), which should be called if the bid wins.
+	// Unlike NURL, it never returns ad markup, so it stays in the response when the markup is cached.
+	WinNoticeURL string `json:"win_notice_url,omitempty"`
+	// ImpressionID is the bidder's own ID for this bid (the OpenRTB bid.id), so that the publisher can match
+	// the bid up with the bidder's reports. It's empty for bidders which don't give one.
+	ImpressionID string `json:"impression_id,omitempty"`
 	// Width is the intended width which Adm should be shown, in pixels.
 	Width uint64 `json:"width,omitempty"`
 	// Height is the intended width which Adm should be shown, in pixels.
@@ -41,13 +59,17 @@ type PBSBid struct {
 	// CacheId is an ID in prebid-cache which can be used to fetch this ad's content.
 	// This supports prebid-mobile, which requires that the content be available from a URL.
 	CacheID string `json:"cache_id,omitempty"`
+	// CacheURL is the URL which fetches this ad's content from prebid-cache. It's only set if the
+	// request turned on the cache_url flag.
+	CacheURL string `json:"cache_url,omitempty"`
 	// ResponseTime is the number of milliseconds it took for the adapter to return a bid.
 	ResponseTime      int               `json:"response_time_ms,omitempty"`
 	AdServerTargeting map[string]string `json:"ad_server_targeting,omitempty"`
 }
 
 // PBSBidSlice attaches the methods of sort.Interface to []PBSBid, ordering them by price.
-// If two prices are equal, then the response time will be used as a tiebreaker.
+// If two prices are equal, then the response time will be used as a tiebreaker. PreferringBidders lets the
+// request decide ties instead.
 // For more information, see https://golang.org/pkg/sort/#Interface
 type PBSBidSlice []*PBSBid
 
@@ -65,6 +87,42 @@ func (bids PBSBidSlice) Swap(i, j int) {
 	bids[i], bids[j] = bids[j], bids[i]
 }
 
+// PreferringBidders orders the bids like PBSBidSlice, except that a bid from one of the preferred bidders
+// wins over an equally priced bid from a bidder later in the list, or not in it. Without any preferred
+// bidders, the bids themselves are returned.
+func (bids PBSBidSlice) PreferringBidders(preferred []string) sort.Interface {
+	if len(preferred) == 0 {
+		return bids
+	}
+	rank := make(map[string]int, len(preferred))
+	for i, bidderCode := range preferred {
+		if _, ok := rank[bidderCode]; !ok {
+			rank[bidderCode] = i
+		}
+	}
+	return preferredBidSlice{PBSBidSlice: bids, rank: rank}
+}
+
+type preferredBidSlice struct {
+	PBSBidSlice
+	rank map[string]int
+}
+
+func (bids preferredBidSlice) Less(i, j int) bool {
+	bidi, bidj := bids.PBSBidSlice[i], bids.PBSBidSlice[j]
+	if bidi.Price == bidj.Price {
+		ranki, iok := bids.rank[bidi.BidderCode]
+		rankj, jok := bids.rank[bidj.BidderCode]
+		if iok != jok {
+			return iok
+		}
+		if iok && ranki != rankj {
+			return ranki < rankj
+		}
+	}
+	return bids.PBSBidSlice.Less(i, j)
+}
+
 type BidderDebug struct {
 	RequestURI   string `json:"request_uri,omitempty"`
 	RequestBody  string `json:"request_body,omitempty"`
@@ -76,12 +134,118 @@ type UsersyncInfo struct {
 	URL         string `json:"url,omitempty"`
 	Type        string `json:"type,omitempty"`
 	SupportCORS bool   `json:"supportCORS,omitempty"`
+	// RedirectURL is the bidder's /setuid URL, which fills in the URL's {{.RedirectURL}} macro once
+	// its own macros are filled in and it's been query escaped. It can use every macro but {{.RedirectURL}}.
+	RedirectURL string `json:"-"`
+}
+
+// UsersyncMacros are the values which a UsersyncInfo's URL and RedirectURL can use, as {{.GDPR}} and so on.
+// They're filled in for each request, since they depend on the user.
+type UsersyncMacros struct {
+	RedirectURL string
+	GDPR        string
+	GDPRConsent string
+	USPrivacy   string
+}
+
+// WithMacros returns a copy of the UsersyncInfo with the macros in its URL filled in. Every value is
+// query escaped, so the URL stays valid whatever the request sent.
+func (i *UsersyncInfo) WithMacros(macros UsersyncMacros) (*UsersyncInfo, error) {
+	if i == nil {
+		return nil, nil
+	}
+	escaped := UsersyncMacros{
+		GDPR:        url.QueryEscape(macros.GDPR),
+		GDPRConsent: url.QueryEscape(macros.GDPRConsent),
+		USPrivacy:   url.QueryEscape(macros.USPrivacy),
+	}
+	redirect, err := fillMacros(i.RedirectURL, escaped)
+	if err != nil {
+		return nil, err
+	}
+	escaped.RedirectURL = url.QueryEscape(redirect)
+
+	filled := *i
+	filled.RedirectURL = ""
+	if filled.URL, err = fillMacros(i.URL, escaped); err != nil {
+		return nil, err
+	}
+	return &filled, nil
+}
+
+func fillMacros(s string, macros UsersyncMacros) (string, error) {
+	if !strings.Contains(s, "{{") {
+		return s, nil
+	}
+	tmpl, err := template.New("usersync").Parse(s)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &macros); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// PBSSeatBid groups the bids made by a single bidder, in the spirit of the OpenRTB SeatBid object.
+type PBSSeatBid struct {
+	// Seat is the PBSBidder.BidderCode of the bidder who made these bids.
+	Seat string      `json:"seat"`
+	Bids PBSBidSlice `json:"bid"`
 }
 
 type PBSResponse struct {
-	TID          string       `json:"tid,omitempty"`
-	Status       string       `json:"status,omitempty"`
-	BidderStatus []*PBSBidder `json:"bidder_status,omitempty"`
-	Bids         PBSBidSlice  `json:"bids,omitempty"`
-	BUrl         string       `json:"burl,omitempty"`
+	TID          string        `json:"tid,omitempty"`
+	Status       string        `json:"status,omitempty"`
+	BidderStatus []*PBSBidder  `json:"bidder_status,omitempty"`
+	Bids         PBSBidSlice   `json:"bids,omitempty"`
+	SeatBids     []*PBSSeatBid `json:"seatbid,omitempty"`
+	BUrl         string        `json:"burl,omitempty"`
+	// NoBidPixels maps the codes of the ad units which got no bids to a tracking URL for the client to fire
+	NoBidPixels map[string]string `json:"no_bid_pixels,omitempty"`
+	// Targeting is the request-wide ad server targeting, which starts with the publisher's key_values.
+	// With the top_targeting flag, it also has the keywords of the top bid across all the ad units.
+	Targeting map[string]string `json:"targeting,omitempty"`
+	// CacheUnavailable is set when the request asked for cached markup, but prebid cache couldn't be used.
+	// The bids are returned with their markup instead.
+	CacheUnavailable bool `json:"cache_unavailable,omitempty"`
+	// ServerTimeMillis is how long prebid-server took with the request, up to encoding the response
+	ServerTimeMillis int `json:"server_time_ms,omitempty"`
+	// TimedOutBidders is how many of the bidders missed the request's deadline
+	TimedOutBidders int `json:"timed_out_bidders,omitempty"`
+	// Warnings are the problems with the request which didn't stop the auction. They're only returned in debug mode.
+	Warnings []string `json:"warnings,omitempty"`
+	// Echo is only returned for requests with ?echo=1, when the account or debug mode allows it
+	Echo *RequestEcho `json:"echo,omitempty"`
+}
+
+// RequestEcho is how prebid-server read the request, once the host's and the account's config was applied,
+// so publishers can check what became of their request.
+type RequestEcho struct {
+	AccountID string `json:"account_id"`
+	// TimeoutMillis is the request's timeout after the default and the limit were applied.
+	// BidderTimeoutMillis is the part of it the bidders got.
+	TimeoutMillis       int64  `json:"timeout_millis"`
+	BidderTimeoutMillis int64  `json:"bidder_timeout_millis"`
+	PriceGranularity    string `json:"price_granularity"`
+	// Bidders are the bidders which were called, after every bidder which was left out was filtered
+	Bidders []string `json:"bidders"`
+}
+
+// GroupBidsBySeat groups the bids by BidderCode. Seats appear in the order in which each bidder's
+// first bid appears, and each seat keeps its bids in their original order.
+func GroupBidsBySeat(bids PBSBidSlice) []*PBSSeatBid {
+	seats := make([]*PBSSeatBid, 0)
+	seatsByCode := make(map[string]*PBSSeatBid)
+	for _, bid := range bids {
+		seat, ok := seatsByCode[bid.BidderCode]
+		if !ok {
+			seat = &PBSSeatBid{Seat: bid.BidderCode}
+			seatsByCode[bid.BidderCode] = seat
+			seats = append(seats, seat)
+		}
+		seat.Bids = append(seat.Bids, bid)
+	}
+	return seats
 }
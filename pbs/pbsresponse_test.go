@@ -86,3 +86,85 @@ func TestSortBidsWithResponseTimes(t *testing.T) {
 		t.Error("Expected bid 3 to be last")
 	}
 }
+
+func TestSortBidsPreferringBidders(t *testing.T) {
+	direct := &PBSBid{BidderCode: "direct", Price: 1.0, ResponseTime: 90}
+	fast := &PBSBid{BidderCode: "fast", Price: 1.0, ResponseTime: 10}
+	slow := &PBSBid{BidderCode: "slow", Price: 1.0, ResponseTime: 50}
+	second := &PBSBid{BidderCode: "second", Price: 1.0, ResponseTime: 70}
+	high := &PBSBid{BidderCode: "high", Price: 2.0, ResponseTime: 99}
+
+	bids := PBSBidSlice{slow, fast, second, direct, high}
+	sort.Sort(bids.PreferringBidders([]string{"direct", "second"}))
+	for i, expected := range []*PBSBid{high, direct, second, fast, slow} {
+		if bids[i] != expected {
+			t.Errorf("Expected %s in place %d; got %s", expected.BidderCode, i, bids[i].BidderCode)
+		}
+	}
+
+	if _, ok := bids.PreferringBidders(nil).(PBSBidSlice); !ok {
+		t.Errorf("Without preferred bidders, the bids should sort as they are")
+	}
+}
+
+func TestGroupBidsBySeat(t *testing.T) {
+	bid1 := PBSBid{BidID: "bid1", AdUnitCode: "first", BidderCode: "appnexus", Price: 1.0}
+	bid2 := PBSBid{BidID: "bid2", AdUnitCode: "first", BidderCode: "rubicon", Price: 2.0}
+	bid3 := PBSBid{BidID: "bid3", AdUnitCode: "second", BidderCode: "appnexus", Price: 3.0}
+
+	seats := GroupBidsBySeat(PBSBidSlice{&bid1, &bid2, &bid3})
+	if len(seats) != 2 {
+		t.Fatalf("Expected 2 seats; got %d", len(seats))
+	}
+	if seats[0].Seat != "appnexus" || len(seats[0].Bids) != 2 {
+		t.Errorf("Expected the first seat to be appnexus with 2 bids; got %s with %d", seats[0].Seat, len(seats[0].Bids))
+	}
+	if seats[0].Bids[0] != &bid1 || seats[0].Bids[1] != &bid3 {
+		t.Errorf("Expected the appnexus seat to keep its bids in order")
+	}
+	if seats[1].Seat != "rubicon" || len(seats[1].Bids) != 1 {
+		t.Errorf("Expected the second seat to be rubicon with 1 bid; got %s with %d", seats[1].Seat, len(seats[1].Bids))
+	}
+
+	if len(GroupBidsBySeat(nil)) != 0 {
+		t.Errorf("Expected no seats when there are no bids")
+	}
+}
+
+func TestUsersyncInfoWithMacros(t *testing.T) {
+	info := &UsersyncInfo{
+		URL:         "//sync.example.com/sync?us_privacy={{.USPrivacy}}&redirect={{.RedirectURL}}",
+		Type:        "redirect",
+		RedirectURL: "http://localhost/setuid?bidder=example&gdpr={{.GDPR}}&gdpr_consent={{.GDPRConsent}}&uid=$UID",
+	}
+	filled, err := info.WithMacros(UsersyncMacros{GDPR: "0", GDPRConsent: "a b", USPrivacy: "1YNN"})
+	if err != nil {
+		t.Fatalf("Failed to fill in the macros: %v", err)
+	}
+	expected := "//sync.example.com/sync?us_privacy=1YNN&redirect=http%3A%2F%2Flocalhost%2Fsetuid%3Fbidder%3Dexample%26gdpr%3D0%26gdpr_consent%3Da%2Bb%26uid%3D%24UID"
+	if filled.URL != expected {
+		t.Errorf("Expected the URL %s; got %s", expected, filled.URL)
+	}
+	if filled.Type != "redirect" || filled.RedirectURL != "" {
+		t.Errorf("The rest of the usersync info should be copied, without the redirect; got %v", filled)
+	}
+	if info.URL == filled.URL {
+		t.Errorf("The adapter's usersync info shouldn't be changed")
+	}
+
+	// URLs without macros are left alone
+	static := &UsersyncInfo{URL: "//sync.example.com/sync?rurl=%%VGUID%%"}
+	if filled, err := static.WithMacros(UsersyncMacros{GDPR: "1"}); err != nil || filled.URL != static.URL {
+		t.Errorf("A URL without macros shouldn't change; got %v, %v", filled, err)
+	}
+
+	unknown := &UsersyncInfo{URL: "//sync.example.com/sync?x={{.Unknown}}"}
+	if _, err := unknown.WithMacros(UsersyncMacros{}); err == nil {
+		t.Errorf("An unknown macro should be an error")
+	}
+
+	var none *UsersyncInfo
+	if filled, err := none.WithMacros(UsersyncMacros{}); filled != nil || err != nil {
+		t.Errorf("A nil usersync info should stay nil; got %v, %v", filled, err)
+	}
+}
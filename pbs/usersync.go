@@ -56,8 +56,14 @@ type uidWithExpiry struct {
 }
 
 type UserSyncDeps struct {
-	ExternalUrl        string
-	RecaptchaSecret    string
+	ExternalUrl     string
+	RecaptchaSecret string
+	// RecaptchaDisabled skips the recaptcha on /optout
+	RecaptchaDisabled bool
+	// RecaptchaMinScore is the lowest recaptcha v3 score accepted. 0 accepts every recaptcha which passes.
+	RecaptchaMinScore float64
+	// RecaptchaURL verifies the recaptcha responses. It defaults to RECAPTCHA_URL.
+	RecaptchaURL       string
 	OptOutUrl          string
 	OptInUrl           string
 	HostCookieSettings *HostCookieSettings
@@ -322,6 +328,8 @@ func (deps *UserSyncDeps) SetUID(w http.ResponseWriter, r *http.Request, _ httpr
 type googleResponse struct {
 	Success    bool
 	ErrorCodes []string `json:"error-codes"`
+	// Score is only given for recaptcha v3
+	Score float64 `json:"score"`
 }
 
 func (deps *UserSyncDeps) VerifyRecaptcha(response string) error {
@@ -332,7 +340,11 @@ func (deps *UserSyncDeps) VerifyRecaptcha(response string) error {
 	client := &http.Client{
 		Transport: ts,
 	}
-	resp, err := client.PostForm(RECAPTCHA_URL,
+	verifyURL := deps.RecaptchaURL
+	if verifyURL == "" {
+		verifyURL = RECAPTCHA_URL
+	}
+	resp, err := client.PostForm(verifyURL,
 		url.Values{"secret": {deps.RecaptchaSecret}, "response": {response}})
 	if err != nil {
 		return err
@@ -345,25 +357,30 @@ func (deps *UserSyncDeps) VerifyRecaptcha(response string) error {
 	if !gr.Success {
 		return fmt.Errorf("Captcha verify failed: %s", strings.Join(gr.ErrorCodes, ", "))
 	}
+	if gr.Score < deps.RecaptchaMinScore {
+		return fmt.Errorf("Captcha score %.2f is below %.2f", gr.Score, deps.RecaptchaMinScore)
+	}
 	return nil
 }
 
 func (deps *UserSyncDeps) OptOut(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	optout := r.FormValue("optout")
-	rr := r.FormValue("g-recaptcha-response")
+	if !deps.RecaptchaDisabled {
+		rr := r.FormValue("g-recaptcha-response")
 
-	if rr == "" {
-		http.Redirect(w, r, fmt.Sprintf("%s/static/optout.html", deps.ExternalUrl), 301)
-		return
-	}
+		if rr == "" {
+			http.Redirect(w, r, fmt.Sprintf("%s/static/optout.html", deps.ExternalUrl), 301)
+			return
+		}
 
-	err := deps.VerifyRecaptcha(rr)
-	if err != nil {
-		if glog.V(2) {
-			glog.Infof("Opt Out failed recaptcha: %v", err)
+		err := deps.VerifyRecaptcha(rr)
+		if err != nil {
+			if glog.V(2) {
+				glog.Infof("Opt Out failed recaptcha: %v", err)
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+			return
 		}
-		w.WriteHeader(http.StatusUnauthorized)
-		return
 	}
 
 	pc := ParsePBSCookieFromRequest(r)
@@ -3,6 +3,7 @@ package pbs
 import (
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -101,6 +102,42 @@ func TestOptIn(t *testing.T) {
 	ensureConsistency(t, cookie)
 }
 
+func TestOptOutRecaptcha(t *testing.T) {
+	score := 0.9
+	recaptcha := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"success": true, "score": %v}`, score)
+	}))
+	defer recaptcha.Close()
+
+	deps := &UserSyncDeps{
+		RecaptchaURL:       recaptcha.URL,
+		RecaptchaMinScore:  0.5,
+		OptOutUrl:          "http://example.com/optout",
+		OptInUrl:           "http://example.com/optin",
+		HostCookieSettings: &HostCookieSettings{},
+	}
+	optOut := func() int {
+		rr := httptest.NewRecorder()
+		deps.OptOut(rr, httptest.NewRequest("POST", "/optout?optout=1&g-recaptcha-response=abc", nil), nil)
+		return rr.Code
+	}
+
+	if code := optOut(); code != http.StatusMovedPermanently {
+		t.Errorf("A score over the minimum should opt out; got status %d", code)
+	}
+	score = 0.3
+	if code := optOut(); code != http.StatusUnauthorized {
+		t.Errorf("A score below the minimum should be rejected; got status %d", code)
+	}
+
+	deps.RecaptchaDisabled = true
+	rr := httptest.NewRecorder()
+	deps.OptOut(rr, httptest.NewRequest("POST", "/optout?optout=1", nil), nil)
+	if rr.Code != http.StatusMovedPermanently || rr.Header().Get("Location") != deps.OptOutUrl {
+		t.Errorf("Opt outs shouldn't need a recaptcha when it's disabled; got status %d", rr.Code)
+	}
+}
+
 func TestParseCorruptedCookie(t *testing.T) {
 	raw := http.Cookie{
 		Name:  "uids",
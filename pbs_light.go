@@ -1,18 +1,28 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
-	_ "net/http/pprof"
+	"net/url"
+	"regexp"
 	"sort"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/cloudfoundry/gosigar"
 	"github.com/golang/glog"
@@ -29,6 +39,7 @@ import (
 	"github.com/dbmedialab/prebid-server/adapters"
 	"github.com/dbmedialab/prebid-server/cache"
 	"github.com/dbmedialab/prebid-server/cache/dummycache"
+	"github.com/dbmedialab/prebid-server/cache/envcache"
 	"github.com/dbmedialab/prebid-server/cache/filecache"
 	"github.com/dbmedialab/prebid-server/cache/postgrescache"
 	"github.com/dbmedialab/prebid-server/config"
@@ -38,12 +49,40 @@ import (
 	pbc "github.com/dbmedialab/prebid-server/prebid_cache_client"
 )
 
+// Version identifies this build. It's set with -ldflags "-X main.Version=<version>".
+var Version = "dev"
+
 var hostCookieSettings pbs.HostCookieSettings
 
+// requestParamFields are the request_param_fields, checked once at startup
+var requestParamFields pbs.RequestParamFields
+
 var exchanges map[string]adapters.Adapter
+
+// bandwidth tracks the bytes used by each adapter, keyed by bidder code
+var bandwidth map[string]*bandwidthTracker
+
+// errorRates tracks the failed calls of each adapter, keyed by bidder code, if error_degradation is on
+var errorRates map[string]*errorRateTracker
+
+// responseCaches holds the response caches of the adapters which have one, keyed by bidder code
+var responseCaches map[string]*responseCache
 var dataCache cache.Cache
 var reqSchema *gojsonschema.Schema
 
+// adapterLimiter caps the number of adapter calls in flight, if max_concurrent_adapter_calls is set
+var adapterLimiter *prioritySemaphore
+
+// disabledBidders holds the bidders switched off at runtime through the admin port
+var disabledBidders = newBidderKillSwitch()
+
+// tracer records a sample of the adapter calls, if trace.sample_rate is set
+var tracer *adapterTracer
+
+// serverReady is flipped to 1 by serve() once every dependency used by /auction has been initialized.
+// It must only be accessed through the sync/atomic package.
+var serverReady int32
+
 type bidResult struct {
 	bidder   *pbs.PBSBidder
 	bid_list pbs.PBSBidSlice
@@ -58,13 +97,103 @@ const hbpbConstantKey = "hb_pb"
 const hbCreativeLoadMethodConstantKey = "hb_creative_loadtype"
 const hbBidderConstantKey = "hb_bidder"
 const hbCacheIdConstantKey = "hb_cache_id"
+const hbCacheUrlConstantKey = "hb_cache_url"
 const hbSizeConstantKey = "hb_size"
 
 // hb_creative_loadtype key can be one of `demand_sdk` or `html`
 // default is `html` where the creative is loaded in the primary ad server's webview through AppNexus hosted JS
 // `demand_sdk` is for bidders who insist on their creatives being loaded in their own SDK's webview
-const hbCreativeLoadMethodHTML = "html"
-const hbCreativeLoadMethodDemandSDK = "demand_sdk"
+// Requests can force either one for a bidder with creative_loadtypes
+const hbCreativeLoadMethodHTML = pbs.CREATIVE_LOADTYPE_HTML
+const hbCreativeLoadMethodDemandSDK = pbs.CREATIVE_LOADTYPE_DEMAND_SDK
+
+// defaultKeyPrefix starts every targeting key in the default keyword format
+const defaultKeyPrefix = "hb_"
+
+// keywordFormat holds the targeting key names and value formats to use for an ad server
+type keywordFormat struct {
+	priceKey    string
+	bidderKey   string
+	cacheIDKey  string
+	cacheURLKey string
+	sizeKey     string
+	loadTypeKey string
+	// bidderSeparator goes between a key and the bidder code in the per-bidder keys
+	bidderSeparator string
+	// sizeSeparator goes between the width and height in the size value
+	sizeSeparator string
+}
+
+// defaultKeywordFormat is the DFP style format, which is used unless another profile is selected
+var defaultKeywordFormat = keywordFormat{
+	priceKey:        hbpbConstantKey,
+	bidderKey:       hbBidderConstantKey,
+	cacheIDKey:      hbCacheIdConstantKey,
+	cacheURLKey:     hbCacheUrlConstantKey,
+	sizeKey:         hbSizeConstantKey,
+	loadTypeKey:     hbCreativeLoadMethodConstantKey,
+	bidderSeparator: "_",
+	sizeSeparator:   "x",
+}
+
+// selectKeys returns the format's keys which should be emitted, given the keys a request asked for by
+// their default names. Requests which don't ask for any keys get all of them.
+func (format keywordFormat) selectKeys(requested []string) map[string]bool {
+	keys := map[string]string{
+		hbpbConstantKey:                 format.priceKey,
+		hbBidderConstantKey:             format.bidderKey,
+		hbCacheIdConstantKey:            format.cacheIDKey,
+		hbCacheUrlConstantKey:           format.cacheURLKey,
+		hbSizeConstantKey:               format.sizeKey,
+		hbCreativeLoadMethodConstantKey: format.loadTypeKey,
+	}
+	selected := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		selected[key] = len(requested) == 0
+	}
+	for _, name := range requested {
+		if key, ok := keys[name]; ok {
+			selected[key] = true
+		}
+	}
+	return selected
+}
+
+// newKeywordFormat applies a configured keyword profile to the default format
+func newKeywordFormat(profile config.KeywordProfile) keywordFormat {
+	format := defaultKeywordFormat
+	if profile.KeyPrefix != "" {
+		for _, key := range []*string{&format.priceKey, &format.bidderKey, &format.cacheIDKey, &format.cacheURLKey, &format.sizeKey, &format.loadTypeKey} {
+			*key = profile.KeyPrefix + strings.TrimPrefix(*key, defaultKeyPrefix)
+		}
+	}
+	if profile.BidderSeparator != "" {
+		format.bidderSeparator = profile.BidderSeparator
+	}
+	if profile.SizeSeparator != "" {
+		format.sizeSeparator = profile.SizeSeparator
+	}
+	return format
+}
+
+// selectKeywordFormat returns the format for the named keyword profile. If no profile is named,
+// the host's default profile is used, and the default format if there's none of those either.
+func selectKeywordFormat(cfg *config.Configuration, name string) keywordFormat {
+	if name == "" {
+		name = cfg.DefaultKeywordProfile
+	}
+	if name == "" {
+		return defaultKeywordFormat
+	}
+	profile, ok := cfg.KeywordProfiles[strings.ToLower(name)]
+	if !ok {
+		if glog.V(2) {
+			glog.Infof("Unknown keyword profile '%s', using the default keywords", name)
+		}
+		return defaultKeywordFormat
+	}
+	return newKeywordFormat(profile)
+}
 
 func min(x, y int) int {
 	if x < y {
@@ -73,6 +202,36 @@ func min(x, y int) int {
 	return y
 }
 
+// metSLA is true if the bidder responded within slaMillis. Bidders without an SLA always meet it.
+// Debug requests get a note on the bidders which missed theirs.
+func metSLA(req *pbs.PBSRequest, bidder *pbs.PBSBidder, slaMillis int) bool {
+	if slaMillis <= 0 || bidder.ResponseTime <= slaMillis {
+		return true
+	}
+	if req.IsDebug {
+		bidder.DebugNotes = append(bidder.DebugNotes, fmt.Sprintf("Responded in %dms, which missed its %dms SLA", bidder.ResponseTime, slaMillis))
+	}
+	return false
+}
+
+// markErrorClass marks the meter which tracks errors of the given adapters.ERROR_CLASS_* value
+func markErrorClass(am *pbsmetrics.AdapterMetrics, errorClass string) {
+	switch errorClass {
+	case adapters.ERROR_CLASS_DNS:
+		am.DNSErrorMeter.Mark(1)
+	case adapters.ERROR_CLASS_CONNECTION_REFUSED:
+		am.ConnectionRefusedErrorMeter.Mark(1)
+	case adapters.ERROR_CLASS_TLS:
+		am.TLSErrorMeter.Mark(1)
+	case adapters.ERROR_CLASS_BAD_STATUS:
+		am.BadStatusErrorMeter.Mark(1)
+	case adapters.ERROR_CLASS_BAD_RESPONSE:
+		am.BadResponseErrorMeter.Mark(1)
+	default:
+		am.OtherErrorMeter.Mark(1)
+	}
+}
+
 func writeAuctionError(w http.ResponseWriter, s string, err error) {
 	var resp pbs.PBSResponse
 	if err != nil {
@@ -88,9 +247,49 @@ func writeAuctionError(w http.ResponseWriter, s string, err error) {
 	}
 }
 
+// requireReady wraps an endpoint so that it responds with a 503 until the server has finished
+// initializing the data cache, the prebid cache client and the request schema.
+func requireReady(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if atomic.LoadInt32(&serverReady) == 0 {
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			writeAuctionError(w, "Server is not ready", nil)
+			return
+		}
+		handle(w, r, ps)
+	}
+}
+
 type cookieSyncRequest struct {
 	UUID    string   `json:"uuid"`
 	Bidders []string `json:"bidders"`
+	// The privacy signals, which fill in the {{.GDPR}}, {{.GDPRConsent}} and {{.USPrivacy}} usersync macros
+	GDPR        *int   `json:"gdpr"`
+	GDPRConsent string `json:"gdpr_consent"`
+	USPrivacy   string `json:"us_privacy"`
+	// Verbose also lists the bidders which won't be synced, with the reason as their disposition
+	Verbose bool `json:"verbose"`
+}
+
+// Reasons a bidder isn't synced, given as its disposition in verbose /cookie_sync responses
+const (
+	SYNC_STATUS_UNKNOWN_BIDDER   = "unknown_bidder"
+	SYNC_STATUS_DISABLED         = "disabled"
+	SYNC_STATUS_NO_USERSYNC_INFO = "no_usersync_info"
+	SYNC_STATUS_ALREADY_SYNCED   = "already_synced"
+)
+
+// usersyncMacros are the usersync macro values given by the /cookie_sync request
+func (csReq *cookieSyncRequest) usersyncMacros() pbs.UsersyncMacros {
+	macros := pbs.UsersyncMacros{
+		GDPRConsent: csReq.GDPRConsent,
+		USPrivacy:   csReq.USPrivacy,
+	}
+	if csReq.GDPR != nil {
+		macros.GDPR = strconv.Itoa(*csReq.GDPR)
+	}
+	return macros
 }
 
 type cookieSyncResponse struct {
@@ -100,7 +299,70 @@ type cookieSyncResponse struct {
 }
 
 type cookieSyncDeps struct {
-	m *pbsmetrics.Metrics
+	cfg *config.Configuration
+	m   *pbsmetrics.Metrics
+}
+
+// cookieFamily returns the cookie family used to sync and look up the user's ID for a bidder.
+// This is the adapter's own FamilyName(), unless adapters.<bidder>.cookie_family overrides it.
+func cookieFamily(cfg *config.Configuration, bidderCode string, ex adapters.Adapter) string {
+	if family := cfg.Adapters[strings.ToLower(bidderCode)].CookieFamily; family != "" {
+		return family
+	}
+	return ex.FamilyName()
+}
+
+// usersyncInfo returns the adapter's usersync info with its macros filled in. It returns nil if the
+// macros can't be filled in, since the URL would be no use to the bidder.
+func usersyncInfo(bidderCode string, ex adapters.Adapter, macros pbs.UsersyncMacros) *pbs.UsersyncInfo {
+	info, err := ex.GetUsersyncInfo().WithMacros(macros)
+	if err != nil {
+		glog.Warningf("Failed to fill in the usersync URL for %s: %v", bidderCode, err)
+		return nil
+	}
+	return info
+}
+
+// recoverCookieSyncRequest picks the uuid and bidders out of a /cookie_sync request which didn't parse,
+// skipping over fields of the wrong type and stopping at the first syntax error. It only succeeds if
+// the bidders could be read.
+func recoverCookieSyncRequest(body []byte) (*cookieSyncRequest, bool) {
+	csReq := &cookieSyncRequest{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, false
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			break
+		}
+		key, _ := t.(string)
+		var value interface{}
+		switch key {
+		case "uuid":
+			value = &csReq.UUID
+		case "bidders":
+			value = &csReq.Bidders
+		case "gdpr":
+			value = &csReq.GDPR
+		case "gdpr_consent":
+			value = &csReq.GDPRConsent
+		case "us_privacy":
+			value = &csReq.USPrivacy
+		case "verbose":
+			value = &csReq.Verbose
+		default:
+			value = &json.RawMessage{}
+		}
+		// The decoder can carry on past values of the wrong type, but not past bad syntax
+		if err := dec.Decode(value); err != nil {
+			if _, ok := err.(*json.UnmarshalTypeError); !ok {
+				break
+			}
+		}
+	}
+	return csReq, csReq.Bidders != nil
 }
 
 func (deps *cookieSyncDeps) cookieSync(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
@@ -113,14 +375,24 @@ func (deps *cookieSyncDeps) cookieSync(w http.ResponseWriter, r *http.Request, _
 
 	defer r.Body.Close()
 
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read the request body", http.StatusBadRequest)
+		return
+	}
 	csReq := &cookieSyncRequest{}
-	err := json.NewDecoder(r.Body).Decode(&csReq)
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(&csReq)
 	if err != nil {
-		if glog.V(2) {
-			glog.Infof("Failed to parse /cookie_sync request body: %v", err)
+		var recovered bool
+		csReq, recovered = recoverCookieSyncRequest(body)
+		if !recovered {
+			if glog.V(2) {
+				glog.Infof("Failed to parse /cookie_sync request body: %v", err)
+			}
+			http.Error(w, "JSON parse failed", http.StatusBadRequest)
+			return
 		}
-		http.Error(w, "JSON parse failed", http.StatusBadRequest)
-		return
+		glog.Warningf("Recovered the bidders from a malformed /cookie_sync request from %s: %v", r.UserAgent(), err)
 	}
 
 	csResp := cookieSyncResponse{
@@ -128,206 +400,1353 @@ func (deps *cookieSyncDeps) cookieSync(w http.ResponseWriter, r *http.Request, _
 		BidderStatus: make([]*pbs.PBSBidder, 0, len(csReq.Bidders)),
 	}
 
-	if userSyncCookie.LiveSyncCount() == 0 {
-		csResp.Status = "no_cookie"
-	} else {
-		csResp.Status = "ok"
+	if userSyncCookie.LiveSyncCount() == 0 {
+		csResp.Status = "no_cookie"
+	} else {
+		csResp.Status = "ok"
+	}
+
+	macros := csReq.usersyncMacros()
+	skip := func(bidder string, reason string) {
+		if csReq.Verbose {
+			csResp.BidderStatus = append(csResp.BidderStatus, &pbs.PBSBidder{BidderCode: bidder, Disposition: reason})
+		}
+	}
+	for _, bidder := range csReq.Bidders {
+		if disabledBidders.isDisabled(bidder) {
+			skip(bidder, SYNC_STATUS_DISABLED)
+			continue
+		}
+		ex, ok := exchanges[bidder]
+		if !ok {
+			skip(bidder, SYNC_STATUS_UNKNOWN_BIDDER)
+			continue
+		}
+		if userSyncCookie.HasLiveSync(cookieFamily(deps.cfg, bidder, ex)) {
+			skip(bidder, SYNC_STATUS_ALREADY_SYNCED)
+			continue
+		}
+		info := usersyncInfo(bidder, ex, macros)
+		if info == nil {
+			skip(bidder, SYNC_STATUS_NO_USERSYNC_INFO)
+			continue
+		}
+		b := pbs.PBSBidder{
+			BidderCode:   bidder,
+			NoCookie:     true,
+			UsersyncInfo: info,
+		}
+		csResp.BidderStatus = append(csResp.BidderStatus, &b)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	//enc.SetIndent("", "  ")
+	enc.Encode(csResp)
+}
+
+// adapterCall is how a call made by callAdapter went, besides its bids and error
+type adapterCall struct {
+	// start is when the adapter was called, once it had a slot. The time queued for the slot is our own,
+	// so it doesn't count against the adapter's SLA.
+	start time.Time
+	// measured is false if the response time says nothing about the adapter: it was never called since no
+	// slot came free, or its call was cut off by the shortened deadline of a degraded adapter
+	measured bool
+}
+
+// callAdapter makes the adapter's call once adapterLimiter has a free slot for it
+func callAdapter(ctx context.Context, ex adapters.Adapter, req *pbs.PBSRequest, bidder *pbs.PBSBidder, priority int) (pbs.PBSBidSlice, adapterCall, error) {
+	if err := adapterLimiter.acquire(ctx, priority); err != nil {
+		return nil, adapterCall{start: time.Now()}, err
+	}
+	defer adapterLimiter.release()
+
+	tracker := errorRates[bidder.BidderCode]
+	callCtx := ctx
+	if tracker.degraded() {
+		var cancel context.CancelFunc
+		callCtx, cancel = tracker.shorten(ctx)
+		defer cancel()
+		if tracker.metrics != nil {
+			tracker.metrics.DegradedMeter.Mark(1)
+		}
+	}
+	call := adapterCall{start: time.Now()}
+	bids, err := ex.Call(callCtx, req, bidder)
+	// Calls cut off by the shortened deadline would have had time left, so they don't say whether the
+	// adapter is still failing. Counting them would keep it degraded for good.
+	if err == nil || ctx.Err() != nil || callCtx.Err() != context.DeadlineExceeded {
+		tracker.record(err != nil)
+		call.measured = true
+	}
+	return bids, call, err
+}
+
+// timeoutNotifyClient is used for timeout notifications. They're best effort, so it gives up quickly.
+var timeoutNotifyClient = &http.Client{Timeout: 2 * time.Second}
+
+// notifyTimeout tells the adapter's partner that their call for request tid timed out, if they've
+// configured a URL for it. It doesn't block, and any failure is ignored.
+func notifyTimeout(notifyURL string, tid string) {
+	if notifyURL == "" {
+		return
+	}
+	u, err := url.Parse(notifyURL)
+	if err != nil {
+		glog.Warningf("Invalid timeout notification URL %s: %v", notifyURL, err)
+		return
+	}
+	q := u.Query()
+	q.Set("tid", tid)
+	u.RawQuery = q.Encode()
+	go func() {
+		resp, err := timeoutNotifyClient.Get(u.String())
+		if err != nil {
+			if glog.V(2) {
+				glog.Infof("Timeout notification to %s failed: %v", u.Host, err)
+			}
+			return
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
+
+// noCookiePolicy is how an auction treats the bidders when the request has no cookies, such as for
+// Safari requests. The zero value treats them as usual.
+type noCookiePolicy struct {
+	skipBidders         map[string]bool
+	skipNoCookieBidders bool
+	skipUsersyncs       bool
+}
+
+func newNoCookiePolicy(cfg config.SafariNoCookie) noCookiePolicy {
+	policy := noCookiePolicy{
+		skipBidders:         make(map[string]bool, len(cfg.SkipBidders)),
+		skipNoCookieBidders: cfg.SkipNoCookieBidders,
+		skipUsersyncs:       cfg.SkipUsersyncs,
+	}
+	for _, bidder := range cfg.SkipBidders {
+		policy.skipBidders[bidder] = true
+	}
+	return policy
+}
+
+// Request validation levels for the request_validation config. The /validate endpoint always validates fully.
+const (
+	// VALIDATION_OFF doesn't check auction requests against the schema
+	VALIDATION_OFF = "off"
+	// VALIDATION_WARN logs the schema violations, but still runs the auction
+	VALIDATION_WARN = "warn"
+	// VALIDATION_ENFORCE rejects requests which violate the schema
+	VALIDATION_ENFORCE = "enforce"
+)
+
+// What the cache_unavailable config does with cache_markup requests when prebid cache can't be used
+const (
+	// CACHE_UNAVAILABLE_INLINE returns the bids with their markup
+	CACHE_UNAVAILABLE_INLINE = "inline"
+	// CACHE_UNAVAILABLE_ERROR fails the auction
+	CACHE_UNAVAILABLE_ERROR = "error"
+)
+
+// schemaViolations checks the request body against reqSchema, and returns the ways it violates it.
+// The body is put back so the request can still be parsed. Bodies which aren't even JSON are left
+// for the parser to reject.
+func schemaViolations(r *http.Request) ([]string, error) {
+	b, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	if err != nil || reqSchema == nil {
+		return nil, err
+	}
+
+	result, err := reqSchema.Validate(gojsonschema.NewBytesLoader(b))
+	if err != nil {
+		return nil, nil
+	}
+	violations := make([]string, 0, len(result.Errors()))
+	for _, err := range result.Errors() {
+		violations = append(violations, fmt.Sprintf("%s %v", err.Context().String(), err))
+	}
+	return violations, nil
+}
+
+// requestSignatureHeader carries the hex encoded HMAC-SHA256 of the /auction request body, keyed with
+// the account's request secret
+const requestSignatureHeader = "X-Request-Signature"
+
+// validSignature checks the request's signature against the account's secret. Accounts without a secret
+// don't sign their requests, so anything goes for them.
+func validSignature(secret string, body []byte, signature string) bool {
+	if secret == "" {
+		return true
+	}
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+type auctionDeps struct {
+	cfg *config.Configuration
+	m   *pbsmetrics.Metrics
+}
+
+// bidderTimeout returns how long the bidders get to respond, reserving bufferMillis of the request's
+// timeout for the work done after they respond (caching, sorting and encoding the response).
+// If the buffer would leave the bidders no time at all, it's ignored.
+func bidderTimeout(timeoutMillis int64, bufferMillis uint64) time.Duration {
+	timeout := time.Duration(timeoutMillis) * time.Millisecond
+	buffer := time.Duration(bufferMillis) * time.Millisecond
+	if buffer < timeout {
+		return timeout - buffer
+	}
+	return timeout
+}
+
+func (deps *auctionDeps) auction(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Add("Content-Type", "application/json")
+
+	deps.m.RequestMeter.Mark(1)
+
+	isSafari := false
+	if ua := useragent.Parse(r.Header.Get("User-Agent")); ua != nil {
+		if ua.Type == useragent.Browser && ua.Name == "Safari" {
+			isSafari = true
+			deps.m.SafariRequestMeter.Mark(1)
+		}
+	}
+
+	if deps.cfg.RequestValidation == VALIDATION_WARN || deps.cfg.RequestValidation == VALIDATION_ENFORCE {
+		violations, err := schemaViolations(r)
+		if err != nil {
+			writeAuctionError(w, "Error parsing request", err)
+			deps.m.ErrorMeter.Mark(1)
+			return
+		}
+		if len(violations) > 0 {
+			deps.m.SchemaViolationMeter.Mark(1)
+			glog.Warningf("/auction request violates the schema: %s", strings.Join(violations, "; "))
+			if deps.cfg.RequestValidation == VALIDATION_ENFORCE {
+				writeAuctionError(w, "Invalid request", fmt.Errorf("Request violates the schema: %s", strings.Join(violations, "; ")))
+				deps.m.InvalidMeter.Mark(1)
+				return
+			}
+		}
+	}
+
+	// The body is kept to check the signature, once the account is known
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		writeAuctionError(w, "Error parsing request", err)
+		deps.m.ErrorMeter.Mark(1)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	pbs_req, err := pbs.ParsePBSRequest(r, dataCache, &hostCookieSettings, requestParamFields)
+	if err != nil {
+		if glog.V(2) {
+			glog.Infof("Failed to parse /auction request: %v", err)
+		}
+		if err == pbs.ErrAppWithCookie {
+			deps.m.AppWithCookieMeter.Mark(1)
+		}
+		if _, ok := err.(*pbs.InvalidRequestError); ok {
+			writeAuctionError(w, "Invalid request", err)
+			deps.m.InvalidMeter.Mark(1)
+			return
+		}
+		writeAuctionError(w, "Error parsing request", err)
+		deps.m.ErrorMeter.Mark(1)
+		return
+	}
+
+	w.Header().Set("X-Request-ID", pbs_req.Tid)
+
+	if pbs_req.AppWithCookie {
+		deps.m.AppWithCookieMeter.Mark(1)
+	}
+	deps.m.AdUnitsHistogram.Update(int64(len(pbs_req.AdUnits)))
+	deps.m.BiddersHistogram.Update(int64(len(pbs_req.Bidders)))
+
+	status := "OK"
+	safariNoCookie := false
+	if pbs_req.App != nil {
+		deps.m.AppRequestMeter.Mark(1)
+	} else if pbs_req.Cookie.LiveSyncCount() == 0 {
+		deps.m.NoCookieMeter.Mark(1)
+		if isSafari {
+			deps.m.SafariNoCookieMeter.Mark(1)
+			safariNoCookie = true
+		}
+		status = "no_cookie"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), bidderTimeout(pbs_req.TimeoutMillis, deps.cfg.TimeoutBuffer))
+	defer cancel()
+
+	account, err := dataCache.Accounts().Get(pbs_req.AccountID)
+	if err != nil {
+		if glog.V(2) {
+			glog.Infof("Request %s: invalid account id: %v", pbs_req.Tid, err)
+		}
+		writeAuctionError(w, "Unknown account id", fmt.Errorf("Unknown account"))
+		deps.m.ErrorMeter.Mark(1)
+		return
+	}
+	if !validSignature(account.RequestSecret, body, r.Header.Get(requestSignatureHeader)) {
+		if glog.V(2) {
+			glog.Infof("Request %s: invalid signature for account %s", pbs_req.Tid, pbs_req.AccountID)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		writeAuctionError(w, "Invalid request signature", nil)
+		deps.m.InvalidSignatureMeter.Mark(1)
+		deps.m.InvalidMeter.Mark(1)
+		return
+	}
+
+	// A request where none of the bidders exist is almost certainly a typo in the bidder codes,
+	// which would otherwise look just like a request nobody bid on
+	if allBiddersUnsupported(pbs_req.Bidders) {
+		for _, bidder := range pbs_req.Bidders {
+			bidder.Error = "Unsupported bidder"
+			bidder.Disposition = pbs.DISPOSITION_UNSUPPORTED
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&pbs.PBSResponse{
+			Status:       "all_bidders_unsupported",
+			TID:          pbs_req.Tid,
+			BidderStatus: pbs_req.Bidders,
+		})
+		deps.m.AllBiddersUnsupportedMeter.Mark(1)
+		deps.m.InvalidMeter.Mark(1)
+		return
+	}
+
+	am := deps.m.GetAccountMetrics(pbs_req.AccountID)
+	am.RequestMeter.Mark(1)
+
+	pbs_resp := pbs.PBSResponse{
+		Status:       status,
+		TID:          pbs_req.Tid,
+		BidderStatus: pbs_req.Bidders,
+	}
+	if pbs_req.IsDebug {
+		pbs_resp.Warnings = pbs_req.Warnings
+	}
+
+	checks := newBidChecks(deps.cfg, pbs_req.AccountID)
+
+	var safariPolicy noCookiePolicy
+	if safariNoCookie {
+		safariPolicy = newNoCookiePolicy(deps.cfg.SafariNoCookie)
+	}
+
+	isTestAccount := deps.cfg.TestBids.AccountID != "" && pbs_req.AccountID == deps.cfg.TestBids.AccountID
+
+	// The account's fallback bidder is held back, and only called if nobody else bids
+	accountCfg := deps.cfg.GetAccount(pbs_req.AccountID)
+	var fallback *pbs.PBSBidder
+
+	ch := make(chan bidResult)
+	sentBids := 0
+	var called []string
+	for _, bidder := range pbs_req.Bidders {
+		if isTestAccount && deps.cfg.TestBids.SkipAdapters {
+			bidder.Disposition = pbs.DISPOSITION_SKIPPED
+			continue
+		}
+		if bidder.Error == pbs.BIDDER_ERROR_MISSING_PARAMS {
+			bidder.Disposition = pbs.DISPOSITION_MISSING_PARAMS
+			deps.m.MissingParamsMeter.Mark(1)
+			continue
+		}
+		if bandwidth[bidder.BidderCode].tripped() {
+			bidder.Error = "Bandwidth limit exceeded"
+			bidder.Disposition = pbs.DISPOSITION_RATE_LIMITED
+			continue
+		}
+		if disabledBidders.isDisabled(bidder.BidderCode) {
+			bidder.Error = "Bidder temporarily disabled"
+			bidder.Disposition = pbs.DISPOSITION_DISABLED
+			continue
+		}
+		if bidder.TestArm = testArm(deps.cfg, pbs_req.Tid, bidder.BidderCode); bidder.TestArm == pbs.TEST_ARM_HOLDOUT {
+			bidder.Disposition = pbs.DISPOSITION_HOLDOUT
+			if ametrics, ok := deps.m.AdapterMetrics[bidder.BidderCode]; ok {
+				ametrics.HoldoutMeter.Mark(1)
+				am.AdapterMetrics[bidder.BidderCode].HoldoutMeter.Mark(1)
+			}
+			continue
+		}
+		if safariPolicy.skipBidders[bidder.BidderCode] {
+			bidder.NoCookie = true
+			bidder.Disposition = pbs.DISPOSITION_NO_COOKIE
+			continue
+		}
+		if accountCfg.FallbackBidder != "" && bidder.BidderCode == accountCfg.FallbackBidder {
+			fallback = bidder
+			continue
+		}
+		if ex, ok := exchanges[bidder.BidderCode]; ok {
+			bidder.Endpoint = accountCfg.AdapterEndpoints[strings.ToLower(bidder.BidderCode)]
+			ametrics := deps.m.AdapterMetrics[bidder.BidderCode]
+			ex = auctionAdapter(deps.cfg, ex, bidder.BidderCode, isTestAccount, ametrics)
+			accountAdapterMetric := am.AdapterMetrics[bidder.BidderCode]
+			ametrics.RequestMeter.Mark(1)
+			accountAdapterMetric.RequestMeter.Mark(1)
+			if pbs_req.App == nil {
+				uid, _, _ := pbs_req.Cookie.GetUID(cookieFamily(deps.cfg, bidder.BidderCode, ex))
+				// Only the bidder's own ID goes to its adapter
+				bidder.UserID = uid
+				if uid == "" {
+					bidder.NoCookie = true
+					if !safariPolicy.skipUsersyncs {
+						// Legacy auction requests don't carry any privacy signals, so only the redirect is filled in
+						bidder.UsersyncInfo = usersyncInfo(bidder.BidderCode, ex, pbs.UsersyncMacros{})
+					}
+					ametrics.NoCookieMeter.Mark(1)
+					accountAdapterMetric.NoCookieMeter.Mark(1)
+					if ex.SkipNoCookies() || safariPolicy.skipNoCookieBidders {
+						bidder.Disposition = pbs.DISPOSITION_NO_COOKIE
+						continue
+					}
+				}
+			}
+			sentBids++
+			called = append(called, bidder.BidderCode)
+			go func(bidder *pbs.PBSBidder) {
+				// Traced calls are made in debug mode so the adapter captures its requests and responses
+				callReq := pbs_req
+				traced := tracer.sample()
+				if traced && !pbs_req.IsDebug {
+					debugReq := *pbs_req
+					debugReq.IsDebug = true
+					callReq = &debugReq
+				}
+				debugCalls := len(bidder.Debug)
+
+				bid_list, call, err := callAdapter(ctx, ex, callReq, bidder, deps.cfg.Adapters[strings.ToLower(bidder.BidderCode)].Priority)
+				bid_list = processBids(deps, pbs_req, am, checks, bidder, bid_list, call, err)
+				if traced {
+					tracer.record(newAdapterTrace(pbs_req, bidder, call.start, bid_list, err, bidder.Debug[debugCalls:]))
+					if !pbs_req.IsDebug {
+						bidder.Debug = bidder.Debug[:debugCalls]
+					}
+				}
+
+				ch <- bidResult{
+					bidder:   bidder,
+					bid_list: bid_list,
+				}
+			}(bidder)
+
+		} else {
+			bidder.Error = "Unsupported bidder"
+			bidder.Disposition = pbs.DISPOSITION_UNSUPPORTED
+		}
+	}
+
+	for i := 0; i < sentBids; i++ {
+		result := <-ch
+
+		for _, bid := range result.bid_list {
+			pbs_resp.Bids = append(pbs_resp.Bids, bid)
+		}
+	}
+	if fallback != nil {
+		if len(pbs_resp.Bids) == 0 {
+			pbs_resp.Bids = callFallback(ctx, deps, pbs_req, am, checks, fallback)
+			if fallback.Disposition != pbs.DISPOSITION_UNSUPPORTED {
+				called = append(called, fallback.BidderCode)
+			}
+		} else {
+			fallback.Disposition = pbs.DISPOSITION_SKIPPED
+		}
+	}
+	if len(pbs_resp.Bids) == 0 && accountCfg.HouseAd.Adm != "" {
+		pbs_resp.Bids = houseAdBids(&accountCfg.HouseAd, pbs_req.AdUnits)
+	}
+	if isTestAccount {
+		pbs_resp.Bids = append(pbs_resp.Bids, testBids(&deps.cfg.TestBids, pbs_req.AdUnits)...)
+	}
+	pbs_resp.Bids = convertBids(deps.cfg, pbs_resp.Bids, pbs_req.Currency, pbs_req.Tid)
+	if deps.cfg.GetAccount(pbs_req.AccountID).DedupCreatives {
+		var dropped int
+		pbs_resp.Bids, dropped = dedupCreatives(pbs_resp.Bids)
+		deps.m.DuplicateCreativeMeter.Mark(int64(dropped))
+	}
+
+	if len(pbs_req.KeyValues) > 0 {
+		pbs_resp.Targeting = make(map[string]string, len(pbs_req.KeyValues))
+		for key, value := range pbs_req.KeyValues {
+			pbs_resp.Targeting[key] = value
+		}
+	}
+
+	if pbs_req.FlagEnabled(pbs.FLAG_NO_BID_PIXELS) && deps.cfg.NoBidPixelURL != "" {
+		pbs_resp.NoBidPixels = noBidPixels(deps.cfg.NoBidPixelURL, pbs_req, pbs_resp.Bids)
+	}
+
+	if pbs_req.CacheMarkup == 1 {
+		deps.m.CacheMarkupMeter.Mark(1)
+		am.CacheMarkupMeter.Mark(1)
+	}
+	if pbs_req.CacheMarkup == 1 && !pbc.Enabled() {
+		if deps.cfg.CacheUnavailable == CACHE_UNAVAILABLE_ERROR {
+			writeAuctionError(w, "Prebid cache is not configured", nil)
+			deps.m.ErrorMeter.Mark(1)
+			return
+		}
+		pbs_resp.CacheUnavailable = true
+	}
+	// Thin auctions can skip the cache round trip, and return their few bids with the markup
+	if pbs_req.CacheMarkup == 1 && !pbs_resp.CacheUnavailable && len(pbs_resp.Bids) >= deps.cfg.MinBidsToCache {
+		// Bids which don't make the cut for the cache are returned with their markup
+		cached := topBids(pbs_resp.Bids, deps.cfg.MaxCachedBids, pbs_req.BidderPriority)
+		cobjs := make([]*pbc.CacheObject, len(cached))
+		namespace := deps.cfg.GetAccount(pbs_req.AccountID).CacheNamespace
+		for i, bid := range cached {
+			bc := &pbc.BidCache{
+				Adm:    bid.Adm,
+				NURL:   bid.NURL,
+				Width:  bid.Width,
+				Height: bid.Height,
+			}
+			cobjs[i] = &pbc.CacheObject{
+				Value:      bc,
+				TTLSeconds: cacheTTL(deps.cfg, pbs_req, bid),
+				Namespace:  namespace,
+			}
+		}
+		var puts []pbc.PutStats
+		cacheStart := time.Now()
+		puts, err = pbc.PutBatched(ctx, cobjs, deps.cfg.CacheBatchSize)
+		am.CacheTimer.UpdateSince(cacheStart)
+		recordCachePuts(deps.m.CacheMetrics, puts)
+		stored := 0
+		for _, cobj := range cobjs {
+			if cobj.UUID != "" {
+				stored++
+			}
+		}
+		am.CachedObjectsHistogram.Update(int64(stored))
+		if err != nil {
+			if stored == 0 && deps.cfg.CacheUnavailable == CACHE_UNAVAILABLE_ERROR {
+				writeAuctionError(w, "Prebid cache failed", err)
+				deps.m.ErrorMeter.Mark(1)
+				return
+			}
+			if stored == 0 {
+				pbs_resp.CacheUnavailable = true
+				glog.Warningf("Request %s: prebid cache failed, returning the bids with their markup: %v", pbs_req.Tid, err)
+			} else {
+				glog.Warningf("Request %s: prebid cache failed for %d of %d bids: %v", pbs_req.Tid, len(cobjs)-stored, len(cobjs), err)
+			}
+		}
+		for i, bid := range cached {
+			// Bids which failed to cache keep their markup, and are returned without a cache_id
+			if cobjs[i].UUID == "" {
+				continue
+			}
+			bid.CacheID = pbc.SignID(cobjs[i].UUID)
+			if pbs_req.FlagEnabled(pbs.FLAG_CACHE_URL) {
+				bid.CacheURL = pbc.GetURL(bid.CacheID)
+			}
+			bid.NURL = ""
+			bid.Adm = ""
+		}
+	}
+
+	if pbs_req.SortBids == 1 {
+		winners := sortBidsAddKeywordsMobile(pbs_resp.Bids, pbs_req, account.PriceGranularity, deps.cfg.GetAccount(pbs_req.AccountID).ExtraPriceGranularities, selectKeywordFormat(deps.cfg, pbs_req.KeywordProfile), demandSDKBidders(deps.cfg))
+		for _, bid := range winners {
+			// Test bids don't come from an adapter, so they have no metrics
+			if ametrics, ok := deps.m.AdapterMetrics[bid.BidderCode]; ok {
+				ametrics.TopBidMeter.Mark(1)
+				am.AdapterMetrics[bid.BidderCode].TopBidMeter.Mark(1)
+			}
+		}
+		if pbs_req.FlagEnabled(pbs.FLAG_TOP_TARGETING) {
+			pbs_resp.Targeting = addTopTargeting(pbs_resp.Targeting, winners, pbs_req.BidderPriority)
+		}
+	}
+	if pbs_req.FlagEnabled(pbs.FLAG_SORT_BIDS) {
+		sort.Stable(pbs_resp.Bids.PreferringBidders(pbs_req.BidderPriority))
+	}
+
+	pbs_resp.TimedOutBidders = timedOutBidders(pbs_req.Bidders)
+	if pbs_req.Echo {
+		pbs_resp.Echo = requestEcho(deps.cfg, pbs_req, account.PriceGranularity, called)
+	}
+	am.TimedOutBiddersHistogram.Update(int64(pbs_resp.TimedOutBidders))
+	for _, count := range adUnitBidCounts(pbs_req.AdUnits, pbs_resp.Bids) {
+		am.AdUnitBidsHistogram.Update(int64(count))
+	}
+
+	// The seatbid format moves the bids out of pbs_resp.Bids
+	finalBids := pbs_resp.Bids
+	switch pbs_req.ResponseFormat {
+	case pbs.RESPONSE_FORMAT_SEATBID:
+		pbs_resp.SeatBids = pbs.GroupBidsBySeat(pbs_resp.Bids)
+		pbs_resp.Bids = nil
+	case pbs.RESPONSE_FORMAT_BOTH:
+		pbs_resp.SeatBids = pbs.GroupBidsBySeat(pbs_resp.Bids)
+	}
+
+	// The time spent in prebid-server, so clients can tell it apart from the network round trip
+	pbs_resp.ServerTimeMillis = int(time.Since(pbs_req.Start) / time.Millisecond)
+	w.Header().Set("X-Prebid-Server-Time-Ms", strconv.Itoa(pbs_resp.ServerTimeMillis))
+
+	if noContent(pbs_req, &pbs_resp, finalBids) {
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		enc.Encode(pbs_resp)
+	}
+	deps.m.RequestTimer.UpdateSince(pbs_req.Start)
+
+	if level := deps.cfg.SummaryLogLevel; level >= 0 && glog.V(glog.Level(level)) {
+		glog.Info(auctionSummary(pbs_req, finalBids, time.Since(pbs_req.Start)))
+	}
+}
+
+// cacheNamespacePattern is what a cache_namespace may hold. The namespace ends up in hb_cache_id and in the
+// prebid-cache URLs, and SignID separates the ID from its signature with a dot.
+var cacheNamespacePattern = regexp.MustCompile(`^[A-Za-z0-9-]*$`)
+
+// checkCacheNamespaces makes sure every account's cache_namespace is safe in the cache IDs
+func checkCacheNamespaces(accounts map[string]config.Account) error {
+	ids := make([]string, 0, len(accounts))
+	for id := range accounts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if namespace := accounts[id].CacheNamespace; !cacheNamespacePattern.MatchString(namespace) {
+			return fmt.Errorf("accounts.%s.cache_namespace %q may only have letters, digits and dashes", id, namespace)
+		}
+	}
+	return nil
+}
+
+// addTopTargeting adds the keywords of the best of the ad units' winning bids to the request's targeting.
+// The publisher's own key_values are kept if a keyword has the same key.
+func addTopTargeting(targeting map[string]string, winners pbs.PBSBidSlice, preferred []string) map[string]string {
+	if len(winners) == 0 {
+		return targeting
+	}
+	best := make(pbs.PBSBidSlice, len(winners))
+	copy(best, winners)
+	sort.Stable(best.PreferringBidders(preferred))
+	if len(best[0].AdServerTargeting) == 0 {
+		return targeting
+	}
+	if targeting == nil {
+		targeting = make(map[string]string, len(best[0].AdServerTargeting))
+	}
+	for key, value := range best[0].AdServerTargeting {
+		if _, ok := targeting[key]; !ok {
+			targeting[key] = value
+		}
+	}
+	return targeting
+}
+
+// requestEcho sums up how the request was read, for requests with ?echo=1
+func requestEcho(cfg *config.Configuration, req *pbs.PBSRequest, priceGranularity string, called []string) *pbs.RequestEcho {
+	if priceGranularity == "" {
+		priceGranularity = defaultPriceGranularity
+	}
+	if called == nil {
+		called = []string{}
+	}
+	return &pbs.RequestEcho{
+		AccountID:           req.AccountID,
+		TimeoutMillis:       req.TimeoutMillis,
+		BidderTimeoutMillis: int64(bidderTimeout(req.TimeoutMillis, cfg.TimeoutBuffer) / time.Millisecond),
+		PriceGranularity:    priceGranularity,
+		Bidders:             called,
+	}
+}
+
+// noContent is true if the auction should be answered with a 204 instead of the response, which needs the
+// no_content flag. Auctions in debug mode, and the ones where a bidder failed, always get the response.
+// So do the ones where the response carries anything else for the client, like usersyncs or no-bid pixels.
+func noContent(req *pbs.PBSRequest, resp *pbs.PBSResponse, bids pbs.PBSBidSlice) bool {
+	if !req.FlagEnabled(pbs.FLAG_NO_CONTENT) || req.IsDebug || len(bids) > 0 {
+		return false
+	}
+	if resp.Status != "OK" || len(resp.NoBidPixels) > 0 || len(resp.Targeting) > 0 || resp.Echo != nil {
+		return false
+	}
+	for _, bidder := range req.Bidders {
+		if bidder.Error != "" || bidder.NoCookie || bidder.UsersyncInfo != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// timedOutBidders counts the bidders which missed the deadline
+func timedOutBidders(bidders []*pbs.PBSBidder) int {
+	timedOut := 0
+	for _, bidder := range bidders {
+		if bidder.Error == "Timed out" {
+			timedOut++
+		}
+	}
+	return timedOut
+}
+
+// adUnitBidCounts returns how many bids each of the ad units got, in the order of the ad units.
+// Units without any bids are counted as 0, so they show up in the bid density.
+func adUnitBidCounts(adUnits []pbs.AdUnit, bids pbs.PBSBidSlice) []int {
+	codeBids := make(map[string]int, len(adUnits))
+	for _, bid := range bids {
+		codeBids[bid.AdUnitCode]++
+	}
+	counts := make([]int, len(adUnits))
+	for i, unit := range adUnits {
+		counts[i] = codeBids[unit.Code]
+	}
+	return counts
+}
+
+// auctionSummary is the line logged at the end of every auction, as space separated key=value pairs.
+// Dispositions counts the bidders by their disposition, like "bid:2,no_bid:1".
+func auctionSummary(req *pbs.PBSRequest, bids pbs.PBSBidSlice, latency time.Duration) string {
+	counts := make(map[string]int)
+	for _, bidder := range req.Bidders {
+		if bidder.Disposition != "" {
+			counts[bidder.Disposition]++
+		}
+	}
+	dispositions := make([]string, 0, len(counts))
+	for disposition, count := range counts {
+		dispositions = append(dispositions, fmt.Sprintf("%s:%d", disposition, count))
+	}
+	sort.Strings(dispositions)
+
+	var topCPM float64
+	cached := false
+	for _, bid := range bids {
+		if bid.Price > topCPM {
+			topCPM = bid.Price
+		}
+		if bid.CacheID != "" {
+			cached = true
+		}
+	}
+	return fmt.Sprintf("auction account=%s tid=%s ad_units=%d bidders=%d timed_out=%d dispositions=%s bids=%d top_cpm=%.2f cache=%t latency_ms=%d",
+		req.AccountID, req.Tid, len(req.AdUnits), len(req.Bidders), timedOutBidders(req.Bidders), strings.Join(dispositions, ","), len(bids), topCPM, cached, latency/time.Millisecond)
+}
+
+func recordCachePuts(cm *pbsmetrics.CacheMetrics, puts []pbc.PutStats) {
+	for _, put := range puts {
+		cm.RequestTimer.Update(put.Duration)
+		cm.BytesMeter.Mark(int64(put.Bytes))
+		cm.ObjectsHistogram.Update(int64(put.Objects))
+		if put.Err != nil {
+			cm.ErrorMeter.Mark(1)
+		}
+	}
+}
+
+// noBidPixels fills in the pixel URL template for each of the request's ad units without any bids.
+// It returns nil if every ad unit got a bid.
+func noBidPixels(template string, pbs_req *pbs.PBSRequest, bids pbs.PBSBidSlice) map[string]string {
+	filled := make(map[string]bool, len(pbs_req.AdUnits))
+	for _, bid := range bids {
+		filled[bid.AdUnitCode] = true
+	}
+
+	var pixels map[string]string
+	for _, unit := range pbs_req.AdUnits {
+		if filled[unit.Code] {
+			continue
+		}
+		if pixels == nil {
+			pixels = make(map[string]string)
+		}
+		pixels[unit.Code] = strings.NewReplacer(
+			"$AD_UNIT_CODE", url.QueryEscape(unit.Code),
+			"$TID", url.QueryEscape(pbs_req.Tid),
+		).Replace(template)
+	}
+	return pixels
+}
+
+// cacheTTL is how long prebid cache should keep the bid: the request's TTL if it has one, or else the
+// host's default for the bid's media type. 0 leaves it to prebid cache.
+func cacheTTL(cfg *config.Configuration, req *pbs.PBSRequest, bid *pbs.PBSBid) int64 {
+	if req.CacheTTLSeconds > 0 {
+		return req.CacheTTLSeconds
+	}
+	if ttl, ok := cfg.CacheTTLByMediaType[strings.ToLower(bid.CreativeMediaType)]; ok {
+		return ttl
+	}
+	return cfg.CacheTTLSeconds
+}
+
+// What the invalid_markup config does with bids whose adm isn't valid UTF-8
+const (
+	// INVALID_MARKUP_SANITIZE replaces the invalid bytes with the Unicode replacement character
+	INVALID_MARKUP_SANITIZE = "sanitize"
+	// INVALID_MARKUP_DROP drops the bid
+	INVALID_MARKUP_DROP = "drop"
+)
+
+// checkInvalidMarkup makes sure the invalid_markup policy is one we know, so a typo doesn't quietly sanitize
+func checkInvalidMarkup(policy string) error {
+	switch policy {
+	case INVALID_MARKUP_SANITIZE, INVALID_MARKUP_DROP:
+		return nil
+	}
+	return fmt.Errorf("invalid_markup must be %s or %s, not %q", INVALID_MARKUP_SANITIZE, INVALID_MARKUP_DROP, policy)
+}
+
+// filterInvalidMarkup finds the bids whose adm isn't valid UTF-8, and either drops them or replaces the
+// invalid bytes, so one bad creative can't garble the response. It returns the bids left, and how many were invalid.
+func filterInvalidMarkup(bids pbs.PBSBidSlice, drop bool) (pbs.PBSBidSlice, int) {
+	kept := bids[:0]
+	invalid := 0
+	for _, bid := range bids {
+		if !utf8.ValidString(bid.Adm) {
+			invalid++
+			if drop {
+				continue
+			}
+			bid.Adm = sanitizeUTF8(bid.Adm)
+		}
+		kept = append(kept, bid)
+	}
+	return kept, invalid
+}
+
+// sanitizeUTF8 replaces each invalid byte in s with the Unicode replacement character
+func sanitizeUTF8(s string) string {
+	var buf bytes.Buffer
+	buf.Grow(len(s))
+	for len(s) > 0 {
+		r, size := utf8.DecodeRuneInString(s)
+		if r == utf8.RuneError && size == 1 {
+			buf.WriteRune(utf8.RuneError)
+		} else {
+			buf.WriteString(s[:size])
+		}
+		s = s[size:]
+	}
+	return buf.String()
+}
+
+// Policies for the bids over an adapter's max_cpm
+const (
+	MAX_CPM_POLICY_DROP = "drop"
+	MAX_CPM_POLICY_CAP  = "cap"
+)
+
+// filterMaxCPM drops the bids priced over max, or lowers their price to max if capPrices is set.
+// It returns the bids left, and how many were over.
+func filterMaxCPM(bids pbs.PBSBidSlice, max float64, capPrices bool) (pbs.PBSBidSlice, int) {
+	kept := bids[:0]
+	over := 0
+	for _, bid := range bids {
+		if bid.Price > max {
+			over++
+			if !capPrices {
+				continue
+			}
+			bid.Price = max
+		}
+		kept = append(kept, bid)
+	}
+	return kept, over
+}
+
+// maxBids is the most bids accepted from a single call to the bidder. 0 means no limit.
+func maxBids(cfg *config.Configuration, bidderCode string) int {
+	if max := cfg.Adapters[strings.ToLower(bidderCode)].MaxBids; max > 0 {
+		return max
+	}
+	return cfg.MaxBidsPerAdapter
+}
+
+// topBids returns the max best bids, in the same order the keywords use, or all of them if max is 0.
+// Ties go to the preferred bidders first. The slice passed in isn't reordered.
+func topBids(bids pbs.PBSBidSlice, max int, preferred []string) pbs.PBSBidSlice {
+	if max <= 0 || len(bids) <= max {
+		return bids
+	}
+	best := make(pbs.PBSBidSlice, len(bids))
+	copy(best, bids)
+	sort.Stable(best.PreferringBidders(preferred))
+	return best[:max]
+}
+
+// defaultCurrency is the currency of the bids from adapters without their own currency, and of the
+// responses to requests which don't ask for one
+const defaultCurrency = "USD"
+
+// currencyRate is the number of units of the currency which make up one US Dollar
+func currencyRate(cfg *config.Configuration, currency string) (float64, bool) {
+	if currency == defaultCurrency {
+		return 1, true
+	}
+	rate, ok := cfg.CurrencyRates[strings.ToLower(currency)]
+	return rate, ok && rate > 0
+}
+
+// convertBids converts the bids which aren't in the requested currency, and records the original price and the
+// rate used on each of them. Bids which can't be converted because a rate is missing are dropped.
+func convertBids(cfg *config.Configuration, bids pbs.PBSBidSlice, currency string, tid string) pbs.PBSBidSlice {
+	to := strings.ToUpper(currency)
+	if to == "" {
+		to = defaultCurrency
+	}
+	converted := bids[:0]
+	for _, bid := range bids {
+		from := strings.ToUpper(cfg.Adapters[strings.ToLower(bid.BidderCode)].Currency)
+		if from == "" {
+			from = defaultCurrency
+		}
+		if from != to {
+			fromRate, fromOK := currencyRate(cfg, from)
+			toRate, toOK := currencyRate(cfg, to)
+			if !fromOK || !toOK {
+				glog.Warningf("Request %s: dropped a bid from %s, since there's no rate to convert %s to %s", tid, bid.BidderCode, from, to)
+				continue
+			}
+			bid.OriginalCurrency = from
+			bid.OriginalPrice = bid.Price
+			bid.ConversionRate = toRate / fromRate
+			bid.Price = bid.Price * bid.ConversionRate
+		}
+		converted = append(converted, bid)
+	}
+	return converted
+}
+
+// dedupCreatives drops the bids whose creative was also bid on the same ad unit at a higher price.
+// Creatives are compared by a hash of their markup (or NURL, if they have no markup). It returns the bids
+// which are left, in their original order, and the number of bids which were dropped.
+func dedupCreatives(bids pbs.PBSBidSlice) (pbs.PBSBidSlice, int) {
+	best := make(map[string]*pbs.PBSBid, len(bids))
+	for _, bid := range bids {
+		key, ok := creativeKey(bid)
+		if !ok {
+			continue
+		}
+		if b, seen := best[key]; !seen || bid.Price > b.Price {
+			best[key] = bid
+		}
+	}
+
+	deduped := make(pbs.PBSBidSlice, 0, len(bids))
+	for _, bid := range bids {
+		if key, ok := creativeKey(bid); ok && best[key] != bid {
+			continue
+		}
+		deduped = append(deduped, bid)
+	}
+	return deduped, len(bids) - len(deduped)
+}
+
+func creativeKey(bid *pbs.PBSBid) (string, bool) {
+	creative := bid.Adm
+	if creative == "" {
+		creative = bid.NURL
+	}
+	if creative == "" {
+		return "", false
+	}
+	hash := sha256.Sum256([]byte(creative))
+	return bid.AdUnitCode + ":" + hex.EncodeToString(hash[:]), true
+}
+
+// testBidderCode is the bidder code of the bids made by testBids
+const testBidderCode = "pbs_test"
+
+// testBids makes a synthetic bid for each ad unit, as configured for the test account
+func testBids(cfg *config.TestBids, adUnits []pbs.AdUnit) pbs.PBSBidSlice {
+	return syntheticBids(testBidderCode, "test", cfg.CPM, cfg.Width, cfg.Height, cfg.Adm, adUnits)
+}
+
+const houseAdBidderCode = "house"
+
+// houseAdBids makes a bid with the account's house ad for each ad unit
+func houseAdBids(cfg *config.HouseAd, adUnits []pbs.AdUnit) pbs.PBSBidSlice {
+	return syntheticBids(houseAdBidderCode, "house", cfg.CPM, cfg.Width, cfg.Height, cfg.Adm, adUnits)
+}
+
+// syntheticBids makes a bid for each ad unit, which didn't come from any adapter. Bid and creative
+// ids start with idPrefix, and bids without a size get the ad unit's first size.
+func syntheticBids(bidderCode string, idPrefix string, cpm float64, width uint64, height uint64, adm string, adUnits []pbs.AdUnit) pbs.PBSBidSlice {
+	bids := make(pbs.PBSBidSlice, 0, len(adUnits))
+	for _, unit := range adUnits {
+		bid := &pbs.PBSBid{
+			BidID:             idPrefix + "-" + unit.Code,
+			AdUnitCode:        unit.Code,
+			Creative_id:       idPrefix + "-creative",
+			CreativeMediaType: "banner",
+			BidderCode:        bidderCode,
+			Price:             cpm,
+			Adm:               adm,
+			Width:             width,
+			Height:            height,
+		}
+		if (bid.Width == 0 || bid.Height == 0) && len(unit.Sizes) > 0 {
+			bid.Width = unit.Sizes[0].W
+			bid.Height = unit.Sizes[0].H
+		}
+		bids = append(bids, bid)
+	}
+	return bids
+}
+
+// callDisposition sums up how the call to a bidder went, once its bids have been checked
+func callDisposition(bidder *pbs.PBSBidder, err error) string {
+	switch {
+	case err == context.DeadlineExceeded:
+		return pbs.DISPOSITION_TIMEOUT
+	case err != nil:
+		return pbs.DISPOSITION_ERROR
+	case bidder.NumBids == 0:
+		return pbs.DISPOSITION_NO_BID
 	}
+	return pbs.DISPOSITION_BID
+}
 
-	for _, bidder := range csReq.Bidders {
-		if ex, ok := exchanges[bidder]; ok {
-			if !userSyncCookie.HasLiveSync(ex.FamilyName()) {
-				b := pbs.PBSBidder{
-					BidderCode:   bidder,
-					NoCookie:     true,
-					UsersyncInfo: ex.GetUsersyncInfo(),
-				}
-				csResp.BidderStatus = append(csResp.BidderStatus, &b)
-			}
+// allBiddersUnsupported is true if the request names some bidders, but none of them exist
+func allBiddersUnsupported(bidders []*pbs.PBSBidder) bool {
+	for _, bidder := range bidders {
+		if _, ok := exchanges[bidder.BidderCode]; ok {
+			return false
 		}
 	}
-
-	enc := json.NewEncoder(w)
-	enc.SetEscapeHTML(false)
-	//enc.SetIndent("", "  ")
-	enc.Encode(csResp)
+	return len(bidders) > 0
 }
 
-type auctionDeps struct {
-	m *pbsmetrics.Metrics
+// bidChecks are the account's settings which every bidder's bids are checked against
+type bidChecks struct {
+	allowedSizes map[string]bool
+	minSize      config.AdSize
+	// fillSizes are the sizes which get their own bid metrics
+	fillSizes map[string]bool
 }
 
-func (deps *auctionDeps) auction(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	w.Header().Add("Content-Type", "application/json")
-
-	deps.m.RequestMeter.Mark(1)
+func newBidChecks(cfg *config.Configuration, accountID string) *bidChecks {
+	checks := &bidChecks{
+		allowedSizes: make(map[string]bool),
+		minSize:      minAdSize(cfg, accountID),
+		fillSizes:    make(map[string]bool, len(cfg.FillMetricSizes)),
+	}
+	for _, size := range cfg.GetAccount(accountID).AllowedSizes {
+		checks.allowedSizes[size] = true
+	}
+	for _, size := range cfg.FillMetricSizes {
+		checks.fillSizes[size] = true
+	}
+	return checks
+}
 
-	isSafari := false
-	if ua := useragent.Parse(r.Header.Get("User-Agent")); ua != nil {
-		if ua.Type == useragent.Browser && ua.Name == "Safari" {
-			isSafari = true
-			deps.m.SafariRequestMeter.Mark(1)
+// processBids handles a bidder's response once callAdapter is done with it.
+// It checks and filters the bids, records the metrics, and fills in the bidder's status. It returns the
+// bids which made it through. Every adapter call in the auction goes through here, fallback included.
+func processBids(deps *auctionDeps, pbs_req *pbs.PBSRequest, am *pbsmetrics.AccountMetrics, checks *bidChecks, bidder *pbs.PBSBidder, bid_list pbs.PBSBidSlice, call adapterCall, err error) pbs.PBSBidSlice {
+	ametrics := deps.m.AdapterMetrics[bidder.BidderCode]
+	accountAdapterMetric := am.AdapterMetrics[bidder.BidderCode]
+	bidder.ResponseTime = int(time.Since(call.start) / time.Millisecond)
+	// Calls which didn't get their time from us neither meet nor miss the SLA
+	if call.measured {
+		if metSLA(pbs_req, bidder, deps.cfg.Adapters[strings.ToLower(bidder.BidderCode)].SLAMillis) {
+			ametrics.SLAMetMeter.Mark(1)
+			accountAdapterMetric.SLAMetMeter.Mark(1)
+		} else {
+			ametrics.SLAMissedMeter.Mark(1)
+			accountAdapterMetric.SLAMissedMeter.Mark(1)
 		}
 	}
-
-	pbs_req, err := pbs.ParsePBSRequest(r, dataCache, &hostCookieSettings)
-	if err != nil {
+	var invalid int
+	bid_list, invalid = filterInvalidMarkup(bid_list, deps.cfg.InvalidMarkup == INVALID_MARKUP_DROP)
+	if invalid > 0 {
+		ametrics.InvalidMarkupMeter.Mark(int64(invalid))
+		accountAdapterMetric.InvalidMarkupMeter.Mark(int64(invalid))
+		glog.Warningf("Request %s: %d bids from %s had markup which isn't valid UTF-8", pbs_req.Tid, invalid, bidder.BidderCode)
+	}
+	adapterCfg := deps.cfg.Adapters[strings.ToLower(bidder.BidderCode)]
+	if adapterCfg.MaxCPM > 0 {
+		var over int
+		bid_list, over = filterMaxCPM(bid_list, adapterCfg.MaxCPM, adapterCfg.MaxCPMPolicy == MAX_CPM_POLICY_CAP)
+		if over > 0 {
+			ametrics.OverMaxCPMMeter.Mark(int64(over))
+			accountAdapterMetric.OverMaxCPMMeter.Mark(int64(over))
+			if glog.V(2) {
+				glog.Infof("Request %s: %d bids from %s were over its max CPM of %.2f", pbs_req.Tid, over, bidder.BidderCode, adapterCfg.MaxCPM)
+			}
+		}
+	}
+	if max := maxBids(deps.cfg, bidder.BidderCode); max > 0 && len(bid_list) > max {
+		excess := len(bid_list) - max
+		bid_list = topBids(bid_list, max, nil)
+		ametrics.ExcessBidsMeter.Mark(int64(excess))
+		accountAdapterMetric.ExcessBidsMeter.Mark(int64(excess))
 		if glog.V(2) {
-			glog.Infof("Failed to parse /auction request: %v", err)
+			glog.Infof("Request %s: dropped %d bids from %s, which is limited to %d", pbs_req.Tid, excess, bidder.BidderCode, max)
 		}
-		writeAuctionError(w, "Error parsing request", err)
-		deps.m.ErrorMeter.Mark(1)
-		return
 	}
-
-	status := "OK"
-	if pbs_req.App != nil {
-		deps.m.AppRequestMeter.Mark(1)
-	} else if pbs_req.Cookie.LiveSyncCount() == 0 {
-		deps.m.NoCookieMeter.Mark(1)
-		if isSafari {
-			deps.m.SafariNoCookieMeter.Mark(1)
+	ametrics.RequestTimer.UpdateSince(call.start)
+	accountAdapterMetric.RequestTimer.UpdateSince(call.start)
+	if err != nil {
+		switch err {
+		case context.DeadlineExceeded:
+			ametrics.TimeoutMeter.Mark(1)
+			accountAdapterMetric.TimeoutMeter.Mark(1)
+			bidder.Error = "Timed out"
+			notifyTimeout(deps.cfg.Adapters[strings.ToLower(bidder.BidderCode)].TimeoutNotificationURL, pbs_req.Tid)
+		case context.Canceled:
+			fallthrough
+		default:
+			ametrics.ErrorMeter.Mark(1)
+			accountAdapterMetric.ErrorMeter.Mark(1)
+			errorClass := adapters.ClassifyError(err)
+			markErrorClass(ametrics, errorClass)
+			markErrorClass(accountAdapterMetric, errorClass)
+			bidder.Error = fmt.Sprintf("%s error: %s", errorClass, err.Error())
+			glog.Warningf("Request %s: error from bidder %v. Ignoring all bids: %v", pbs_req.Tid, bidder.BidderCode, err)
 		}
-		status = "no_cookie"
+	} else if bid_list != nil {
+		var unrequested []string
+		bid_list, unrequested = dropUnrequestedBids(bid_list, bidder)
+		if len(unrequested) > 0 {
+			ametrics.UnrequestedBidsMeter.Mark(int64(len(unrequested)))
+			accountAdapterMetric.UnrequestedBidsMeter.Mark(int64(len(unrequested)))
+			if pbs_req.IsDebug {
+				bidder.DebugNotes = append(bidder.DebugNotes, fmt.Sprintf("Dropped bids for ad units which weren't requested: %s", strings.Join(unrequested, ", ")))
+			}
+		}
+		bid_list = checkForValidBidSize(bid_list, bidder)
+		var undersized int
+		bid_list, undersized = filterUndersizedBids(bid_list, bidder, checks.minSize)
+		deps.m.UndersizedBidMeter.Mark(int64(undersized))
+		if len(checks.allowedSizes) > 0 {
+			var dropped int
+			bid_list, dropped = filterAllowedSizes(bid_list, checks.allowedSizes)
+			deps.m.DisallowedSizeMeter.Mark(int64(dropped))
+		}
+		markSizeBids(am, bid_list, checks.fillSizes)
+		bidder.NumBids = len(bid_list)
+		am.BidsReceivedMeter.Mark(int64(bidder.NumBids))
+		accountAdapterMetric.BidsReceivedMeter.Mark(int64(bidder.NumBids))
+		for _, bid := range bid_list {
+			var cpm = int64(bid.Price * 1000)
+			ametrics.PriceHistogram.Update(cpm)
+			am.PriceHistogram.Update(cpm)
+			accountAdapterMetric.PriceHistogram.Update(cpm)
+			bid.ResponseTime = bidder.ResponseTime
+		}
+	} else {
+		bidder.NoBid = true
+		ametrics.NoBidMeter.Mark(1)
+		accountAdapterMetric.NoBidMeter.Mark(1)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*time.Duration(pbs_req.TimeoutMillis))
-	defer cancel()
+	bidder.Disposition = callDisposition(bidder, err)
+	return bid_list
+}
 
-	account, err := dataCache.Accounts().Get(pbs_req.AccountID)
-	if err != nil {
-		if glog.V(2) {
-			glog.Infof("Invalid account id: %v", err)
-		}
-		writeAuctionError(w, "Unknown account id", fmt.Errorf("Unknown account"))
-		deps.m.ErrorMeter.Mark(1)
-		return
+// callFallback calls the account's fallback bidder, once it's clear that nobody else bid. Its bids go
+// through the same checks as any other bidder's.
+func callFallback(ctx context.Context, deps *auctionDeps, pbs_req *pbs.PBSRequest, am *pbsmetrics.AccountMetrics, checks *bidChecks, bidder *pbs.PBSBidder) pbs.PBSBidSlice {
+	ex, ok := exchanges[bidder.BidderCode]
+	if !ok {
+		bidder.Error = "Unsupported bidder"
+		bidder.Disposition = pbs.DISPOSITION_UNSUPPORTED
+		return nil
 	}
+	deps.m.AdapterMetrics[bidder.BidderCode].RequestMeter.Mark(1)
+	am.AdapterMetrics[bidder.BidderCode].RequestMeter.Mark(1)
+	deps.m.FallbackMeter.Mark(1)
 
-	am := deps.m.GetAccountMetrics(pbs_req.AccountID)
-	am.RequestMeter.Mark(1)
+	bids, call, err := callAdapter(ctx, ex, pbs_req, bidder, deps.cfg.Adapters[strings.ToLower(bidder.BidderCode)].Priority)
+	return processBids(deps, pbs_req, am, checks, bidder, bids, call, err)
+}
 
-	pbs_resp := pbs.PBSResponse{
-		Status:       status,
-		TID:          pbs_req.Tid,
-		BidderStatus: pbs_req.Bidders,
+// auctionAdapter wraps the bidder's adapter in the auction's layers: the test account's stored responses,
+// the chaos delays and the response cache. The test account skips the response cache, since its stored
+// responses share the cache keys of real traffic.
+func auctionAdapter(cfg *config.Configuration, ex adapters.Adapter, bidderCode string, isTestAccount bool, m *pbsmetrics.AdapterMetrics) adapters.Adapter {
+	if stored, ok := cfg.TestBids.StoredResponses[strings.ToLower(bidderCode)]; ok && isTestAccount {
+		ex = &storedResponseAdapter{Adapter: ex, response: stored}
+	}
+	if delay := chaosDelay(&cfg.Chaos, bidderCode); delay > 0 {
+		ex = &delayedAdapter{Adapter: ex, delay: delay}
 	}
+	if c := responseCaches[bidderCode]; c != nil && !isTestAccount {
+		ex = &cachingAdapter{Adapter: ex, cache: c, metrics: m}
+	}
+	return ex
+}
 
-	ch := make(chan bidResult)
-	sentBids := 0
-	for _, bidder := range pbs_req.Bidders {
-		if ex, ok := exchanges[bidder.BidderCode]; ok {
-			ametrics := deps.m.AdapterMetrics[bidder.BidderCode]
-			accountAdapterMetric := am.AdapterMetrics[bidder.BidderCode]
-			ametrics.RequestMeter.Mark(1)
-			accountAdapterMetric.RequestMeter.Mark(1)
-			if pbs_req.App == nil {
-				uid, _, _ := pbs_req.Cookie.GetUID(ex.FamilyName())
-				if uid == "" {
-					bidder.NoCookie = true
-					bidder.UsersyncInfo = ex.GetUsersyncInfo()
-					ametrics.NoCookieMeter.Mark(1)
-					accountAdapterMetric.NoCookieMeter.Mark(1)
-					if ex.SkipNoCookies() {
-						continue
-					}
-				}
+// storedResponseAdapter answers calls with a stored response, instead of calling the bidder.
+// It's only used for the test account.
+type storedResponseAdapter struct {
+	adapters.Adapter
+	// response is a JSON list of bids. Bids without a code are made for every ad unit the bidder is on,
+	// and bids without a size get the ad unit's first size.
+	response string
+}
+
+func (a *storedResponseAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidder *pbs.PBSBidder) (pbs.PBSBidSlice, error) {
+	var stored pbs.PBSBidSlice
+	if err := json.Unmarshal([]byte(a.response), &stored); err != nil {
+		return nil, fmt.Errorf("Bad stored response for %s: %v", bidder.BidderCode, err)
+	}
+
+	bids := make(pbs.PBSBidSlice, 0, len(stored))
+	for _, unit := range bidder.AdUnits {
+		for _, storedBid := range stored {
+			if storedBid.AdUnitCode != "" && storedBid.AdUnitCode != unit.Code {
+				continue
 			}
-			sentBids++
-			go func(bidder *pbs.PBSBidder) {
-				start := time.Now()
-				bid_list, err := ex.Call(ctx, pbs_req, bidder)
-				bidder.ResponseTime = int(time.Since(start) / time.Millisecond)
-				ametrics.RequestTimer.UpdateSince(start)
-				accountAdapterMetric.RequestTimer.UpdateSince(start)
-				if err != nil {
-					switch err {
-					case context.DeadlineExceeded:
-						ametrics.TimeoutMeter.Mark(1)
-						accountAdapterMetric.TimeoutMeter.Mark(1)
-						bidder.Error = "Timed out"
-					case context.Canceled:
-						fallthrough
-					default:
-						ametrics.ErrorMeter.Mark(1)
-						accountAdapterMetric.ErrorMeter.Mark(1)
-						bidder.Error = err.Error()
-						glog.Warningf("Error from bidder %v. Ignoring all bids: %v", bidder.BidderCode, err)
-					}
-				} else if bid_list != nil {
-					bid_list = checkForValidBidSize(bid_list, bidder)
-					bidder.NumBids = len(bid_list)
-					am.BidsReceivedMeter.Mark(int64(bidder.NumBids))
-					accountAdapterMetric.BidsReceivedMeter.Mark(int64(bidder.NumBids))
-					for _, bid := range bid_list {
-						var cpm = int64(bid.Price * 1000)
-						ametrics.PriceHistogram.Update(cpm)
-						am.PriceHistogram.Update(cpm)
-						accountAdapterMetric.PriceHistogram.Update(cpm)
-						bid.ResponseTime = bidder.ResponseTime
-					}
-				} else {
-					bidder.NoBid = true
-					ametrics.NoBidMeter.Mark(1)
-					accountAdapterMetric.NoBidMeter.Mark(1)
-				}
+			bid := *storedBid
+			bid.AdUnitCode = unit.Code
+			bid.BidID = unit.BidID
+			bid.BidderCode = bidder.BidderCode
+			if (bid.Width == 0 || bid.Height == 0) && len(unit.Sizes) > 0 {
+				bid.Width = unit.Sizes[0].W
+				bid.Height = unit.Sizes[0].H
+			}
+			bids = append(bids, &bid)
+		}
+	}
+	return bids, nil
+}
 
-				ch <- bidResult{
-					bidder:   bidder,
-					bid_list: bid_list,
-				}
-			}(bidder)
+// dropUnrequestedBids drops the bids for ad units which the bidder wasn't asked to bid on. It returns the bids
+// left, and the ad unit codes of the dropped bids.
+func dropUnrequestedBids(bids pbs.PBSBidSlice, bidder *pbs.PBSBidder) (pbs.PBSBidSlice, []string) {
+	requested := make(map[string]bool, len(bidder.AdUnits))
+	for _, unit := range bidder.AdUnits {
+		requested[unit.Code] = true
+	}
 
+	var unrequested []string
+	kept := bids[:0]
+	for _, bid := range bids {
+		if requested[bid.AdUnitCode] {
+			kept = append(kept, bid)
 		} else {
-			bidder.Error = "Unsupported bidder"
+			unrequested = append(unrequested, bid.AdUnitCode)
 		}
 	}
+	return kept, unrequested
+}
 
-	for i := 0; i < sentBids; i++ {
-		result := <-ch
+// testArm puts the bidder into one arm of its A/B split, or returns "" if it has none. The arm
+// is picked from a hash of the tid and the bidder code, so retries of a request land in the same arm.
+func testArm(cfg *config.Configuration, tid string, bidderCode string) string {
+	percent := cfg.Adapters[strings.ToLower(bidderCode)].HoldoutPercent
+	if percent <= 0 {
+		return ""
+	}
+	h := fnv.New32a()
+	h.Write([]byte(tid + "|" + bidderCode))
+	if float64(h.Sum32()%10000) < percent*100 {
+		return pbs.TEST_ARM_HOLDOUT
+	}
+	return pbs.TEST_ARM_INCLUDED
+}
 
-		for _, bid := range result.bid_list {
-			pbs_resp.Bids = append(pbs_resp.Bids, bid)
-		}
+// chaosDelay is how long the chaos config delays the bidder's calls by
+func chaosDelay(cfg *config.Chaos, bidderCode string) time.Duration {
+	if !cfg.Enabled {
+		return 0
 	}
-	if pbs_req.CacheMarkup == 1 {
-		cobjs := make([]*pbc.CacheObject, len(pbs_resp.Bids))
-		for i, bid := range pbs_resp.Bids {
-			bc := &pbc.BidCache{
-				Adm:    bid.Adm,
-				NURL:   bid.NURL,
-				Width:  bid.Width,
-				Height: bid.Height,
-			}
-			cobjs[i] = &pbc.CacheObject{
-				Value: bc,
-			}
-		}
-		err = pbc.Put(ctx, cobjs)
-		if err != nil {
-			writeAuctionError(w, "Prebid cache failed", err)
-			deps.m.ErrorMeter.Mark(1)
-			return
+	return time.Duration(cfg.AdapterDelays[strings.ToLower(bidderCode)]) * time.Millisecond
+}
+
+// delayedAdapter waits before making each call, to simulate a slow bidder. Calls which reach
+// their deadline while waiting fail like any other timed out call.
+type delayedAdapter struct {
+	adapters.Adapter
+	delay time.Duration
+}
+
+func (a *delayedAdapter) Call(ctx context.Context, req *pbs.PBSRequest, bidder *pbs.PBSBidder) (pbs.PBSBidSlice, error) {
+	timer := time.NewTimer(a.delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return a.Adapter.Call(ctx, req, bidder)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// markSizeBids counts the bids of each size in sizes for the account. Bids of other sizes aren't counted.
+func markSizeBids(am *pbsmetrics.AccountMetrics, bids pbs.PBSBidSlice, sizes map[string]bool) {
+	for _, bid := range bids {
+		if size := fmt.Sprintf("%dx%d", bid.Width, bid.Height); sizes[size] {
+			am.SizeBidsMeter(size).Mark(1)
 		}
-		for i, bid := range pbs_resp.Bids {
-			bid.CacheID = cobjs[i].UUID
-			bid.NURL = ""
-			bid.Adm = ""
+	}
+}
+
+// filterAllowedSizes drops the bids whose "WxH" size isn't in allowed, and returns the bids left along
+// with the number dropped.
+func filterAllowedSizes(bids pbs.PBSBidSlice, allowed map[string]bool) (pbs.PBSBidSlice, int) {
+	kept := bids[:0]
+	for _, bid := range bids {
+		if allowed[fmt.Sprintf("%dx%d", bid.Width, bid.Height)] {
+			kept = append(kept, bid)
 		}
 	}
+	return kept, len(bids) - len(kept)
+}
 
-	if pbs_req.SortBids == 1 {
-		sortBidsAddKeywordsMobile(pbs_resp.Bids, pbs_req, account.PriceGranularity)
+// minAdSize is the smallest bid size which the account accepts
+func minAdSize(cfg *config.Configuration, accountID string) config.AdSize {
+	if min := cfg.GetAccount(accountID).MinAdSize; min.Width > 0 || min.Height > 0 {
+		return min
 	}
+	return cfg.MinAdSize
+}
 
-	if glog.V(2) {
-		glog.Infof("Request for %d ad units on url %s by account %s got %d bids", len(pbs_req.AdUnits), pbs_req.Url, pbs_req.AccountID, len(pbs_resp.Bids))
+// filterUndersizedBids drops the bids narrower or shorter than min, unless their ad unit asked for that size.
+// Bids without a size, like most video bids, are kept. It returns the bids left along with how many were dropped.
+func filterUndersizedBids(bids pbs.PBSBidSlice, bidder *pbs.PBSBidder, min config.AdSize) (pbs.PBSBidSlice, int) {
+	kept := bids[:0]
+	for _, bid := range bids {
+		if bid.Width == 0 || bid.Height == 0 || (bid.Width >= min.Width && bid.Height >= min.Height) || requestedSize(bidder, bid) {
+			kept = append(kept, bid)
+		}
 	}
+	return kept, len(bids) - len(kept)
+}
 
-	enc := json.NewEncoder(w)
-	enc.SetEscapeHTML(false)
-	enc.Encode(pbs_resp)
-	deps.m.RequestTimer.UpdateSince(pbs_req.Start)
+// requestedSize is true if the bid's ad unit asked for the bid's size
+func requestedSize(bidder *pbs.PBSBidder, bid *pbs.PBSBid) bool {
+	for _, unit := range bidder.AdUnits {
+		if unit.Code != bid.AdUnitCode {
+			continue
+		}
+		for _, size := range unit.Sizes {
+			if size.W == bid.Width && size.H == bid.Height {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // checkForValidBidSize goes through list of bids & find those which are banner mediaType and with height or width not defined
@@ -361,10 +1780,52 @@ bidLoop:
 	return finalValidBids[:finalBidCounter]
 }
 
+// keyHashLength is how many hex characters of the key's hash are used to tell truncated keys apart
+const keyHashLength = 6
+
+// truncateKey shortens key to maxLength, if maxLength is set. usedKeys maps the keys already handed out to the
+// key they were made from. If the truncated key was already handed out for a different key, the end of it is
+// replaced with a short hash of the full key instead. If that doesn't fit or still collides, the key is dropped
+// with a warning and ok is false.
+func truncateKey(key string, maxLength int, usedKeys map[string]string) (truncated string, ok bool) {
+	truncated = key
+	if maxLength != 0 && len(key) > maxLength {
+		truncated = key[:maxLength]
+	}
+	owner, used := usedKeys[truncated]
+	if !used || owner == key {
+		usedKeys[truncated] = key
+		return truncated, true
+	}
+
+	if maxLength > keyHashLength+1 {
+		sum := sha256.Sum256([]byte(key))
+		hashed := key[:min(len(key), maxLength-keyHashLength-1)] + "_" + hex.EncodeToString(sum[:])[:keyHashLength]
+		if hashedOwner, used := usedKeys[hashed]; !used || hashedOwner == key {
+			usedKeys[hashed] = key
+			return hashed, true
+		}
+	}
+
+	glog.Warningf("Dropping targeting key %s, it collides with %s when truncated to %d characters", key, owner, maxLength)
+	return "", false
+}
+
+// demandSDKBidders are the bidders whose creatives have to be loaded by their own SDK
+func demandSDKBidders(cfg *config.Configuration) map[string]bool {
+	bidders := make(map[string]bool, len(cfg.DemandSDKBidders))
+	for _, bidder := range cfg.DemandSDKBidders {
+		bidders[bidder] = true
+	}
+	return bidders
+}
+
 // sortBidsAddKeywordsMobile sorts the bids and adds ad server targeting keywords to each bid.
 // The bids are sorted by cpm to find the highest bid.
 // The ad server targeting keywords are added to all bids, with specific keywords for the highest bid.
-func sortBidsAddKeywordsMobile(bids pbs.PBSBidSlice, pbs_req *pbs.PBSRequest, priceGranularitySetting string) {
+// The highest bid also gets a price key for each of the extra granularities.
+// It returns the highest bid of each ad unit.
+func sortBidsAddKeywordsMobile(bids pbs.PBSBidSlice, pbs_req *pbs.PBSRequest, priceGranularitySetting string, extraGranularities []string, format keywordFormat, demandSDK map[string]bool) pbs.PBSBidSlice {
 	if priceGranularitySetting == "" {
 		priceGranularitySetting = defaultPriceGranularity
 	}
@@ -375,7 +1836,10 @@ func sortBidsAddKeywordsMobile(bids pbs.PBSBidSlice, pbs_req *pbs.PBSRequest, pr
 		code_bids[bid.AdUnitCode] = append(code_bids[bid.AdUnitCode], bid)
 	}
 
+	emit := format.selectKeys(pbs_req.TargetingKeys)
+
 	// loop through ad units to find top bid
+	winners := make(pbs.PBSBidSlice, 0, len(pbs_req.AdUnits))
 	for _, unit := range pbs_req.AdUnits {
 		bar := code_bids[unit.Code]
 
@@ -385,7 +1849,18 @@ func sortBidsAddKeywordsMobile(bids pbs.PBSBidSlice, pbs_req *pbs.PBSRequest, pr
 			}
 			continue
 		}
-		sort.Sort(bar)
+		sort.Sort(bar.PreferringBidders(pbs_req.BidderPriority))
+
+		// The bids for an ad unit end up in the same ad server request, so keys must be unique across all of them.
+		// The top bid keys are never truncated, so reserve them first.
+		usedKeys := map[string]string{
+			format.priceKey:    format.priceKey,
+			format.bidderKey:   format.bidderKey,
+			format.cacheIDKey:  format.cacheIDKey,
+			format.cacheURLKey: format.cacheURLKey,
+			format.sizeKey:     format.sizeKey,
+			format.loadTypeKey: format.loadTypeKey,
+		}
 
 		// after sorting we need to add the ad targeting keywords
 		for i, bid := range bar {
@@ -396,44 +1871,66 @@ func sortBidsAddKeywordsMobile(bids pbs.PBSBidSlice, pbs_req *pbs.PBSRequest, pr
 			if bid.Width != 0 && bid.Height != 0 {
 				width := strconv.FormatUint(bid.Width, 10)
 				height := strconv.FormatUint(bid.Height, 10)
-				hbSize = width + "x" + height
+				hbSize = width + format.sizeSeparator + height
 			}
 
-			hbPbBidderKey := hbpbConstantKey + "_" + bid.BidderCode
-			hbBidderBidderKey := hbBidderConstantKey + "_" + bid.BidderCode
-			hbCacheIdBidderKey := hbCacheIdConstantKey + "_" + bid.BidderCode
-			hbSizeBidderKey := hbSizeConstantKey + "_" + bid.BidderCode
-			if pbs_req.MaxKeyLength != 0 {
-				hbPbBidderKey = hbPbBidderKey[:min(len(hbPbBidderKey), int(pbs_req.MaxKeyLength))]
-				hbBidderBidderKey = hbBidderBidderKey[:min(len(hbBidderBidderKey), int(pbs_req.MaxKeyLength))]
-				hbCacheIdBidderKey = hbCacheIdBidderKey[:min(len(hbCacheIdBidderKey), int(pbs_req.MaxKeyLength))]
-				hbSizeBidderKey = hbSizeBidderKey[:min(len(hbSizeBidderKey), int(pbs_req.MaxKeyLength))]
+			pbs_kvs := make(map[string]string)
+			setBidderKey := func(prefix string, value string) {
+				if !emit[prefix] {
+					return
+				}
+				if key, ok := truncateKey(prefix+format.bidderSeparator+bid.BidderCode, int(pbs_req.MaxKeyLength), usedKeys); ok {
+					pbs_kvs[key] = value
+				}
 			}
-			pbs_kvs := map[string]string{
-				hbPbBidderKey:      roundedCpm,
-				hbBidderBidderKey:  bid.BidderCode,
-				hbCacheIdBidderKey: bid.CacheID,
+			setKey := func(key string, value string) {
+				if emit[key] {
+					pbs_kvs[key] = value
+				}
 			}
+			setBidderKey(format.priceKey, roundedCpm)
+			setBidderKey(format.bidderKey, bid.BidderCode)
+			setBidderKey(format.cacheIDKey, bid.CacheID)
 			if hbSize != "" {
-				pbs_kvs[hbSizeBidderKey] = hbSize
+				setBidderKey(format.sizeKey, hbSize)
+			}
+			if bid.CacheURL != "" {
+				setBidderKey(format.cacheURLKey, bid.CacheURL)
 			}
 			// For the top bid, we want to add the following additional keys
 			if i == 0 {
-				pbs_kvs[hbpbConstantKey] = roundedCpm
-				pbs_kvs[hbBidderConstantKey] = bid.BidderCode
-				pbs_kvs[hbCacheIdConstantKey] = bid.CacheID
+				winners = append(winners, bid)
+				setKey(format.priceKey, roundedCpm)
+				setKey(format.bidderKey, bid.BidderCode)
+				setKey(format.cacheIDKey, bid.CacheID)
 				if hbSize != "" {
-					pbs_kvs[hbSizeConstantKey] = hbSize
+					setKey(format.sizeKey, hbSize)
+				}
+				if bid.CacheURL != "" {
+					setKey(format.cacheURLKey, bid.CacheURL)
 				}
-				if bid.BidderCode == "audienceNetwork" {
-					pbs_kvs[hbCreativeLoadMethodConstantKey] = hbCreativeLoadMethodDemandSDK
+				if loadType, ok := pbs_req.CreativeLoadTypes[bid.BidderCode]; ok {
+					setKey(format.loadTypeKey, loadType)
+				} else if demandSDK[bid.BidderCode] {
+					setKey(format.loadTypeKey, hbCreativeLoadMethodDemandSDK)
 				} else {
-					pbs_kvs[hbCreativeLoadMethodConstantKey] = hbCreativeLoadMethodHTML
+					setKey(format.loadTypeKey, hbCreativeLoadMethodHTML)
+				}
+				for _, granularity := range extraGranularities {
+					if granularity == priceGranularitySetting || !emit[format.priceKey] {
+						continue
+					}
+					if cpm, ok := priceBucketStringMap[granularity]; ok {
+						if key, ok := truncateKey(format.priceKey+"_"+granularity, int(pbs_req.MaxKeyLength), usedKeys); ok {
+							pbs_kvs[key] = cpm
+						}
+					}
 				}
 			}
 			bid.AdServerTargeting = pbs_kvs
 		}
 	}
+	return winners
 }
 
 func status(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
@@ -480,14 +1977,26 @@ func serveIndex(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	http.ServeFile(w, r, "static/index.html")
 }
 
+// NoCache stops browsers from caching the responses for the paths it's given
 type NoCache struct {
 	handler http.Handler
+	paths   map[string]bool
+}
+
+func NewNoCache(handler http.Handler, paths []string) NoCache {
+	m := NoCache{handler: handler, paths: make(map[string]bool, len(paths))}
+	for _, path := range paths {
+		m.paths[path] = true
+	}
+	return m
 }
 
 func (m NoCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Cache-Control", "no-cache, no-store, must-revalidate")
-	w.Header().Add("Pragma", "no-cache")
-	w.Header().Add("Expires", "0")
+	if m.paths[r.URL.Path] {
+		w.Header().Add("Cache-Control", "no-cache, no-store, must-revalidate")
+		w.Header().Add("Pragma", "no-cache")
+		w.Header().Add("Expires", "0")
+	}
 	m.handler.ServeHTTP(w, r)
 }
 
@@ -566,10 +2075,29 @@ func loadPostgresDataCache(cfg *config.Configuration) (cache.Cache, error) {
 		Password: cfg.DataCache.Password,
 		Size:     cfg.DataCache.CacheSize,
 		TTL:      cfg.DataCache.TTLSeconds,
+
+		ServeStale: cfg.DataCache.ServeStale,
 	})
 
 }
 
+// loadEnvDataCache reads the account JSON from the configured file if there is one, or the environment otherwise
+func loadEnvDataCache(cfg *config.Configuration) (cache.Cache, error) {
+	if cfg.DataCache.Filename != "" {
+		data, err := ioutil.ReadFile(cfg.DataCache.Filename)
+		if err != nil {
+			return nil, err
+		}
+		return envcache.New(data)
+	}
+
+	data, ok := os.LookupEnv(cfg.DataCache.EnvVar)
+	if !ok {
+		return nil, fmt.Errorf("Environment variable %s is not set", cfg.DataCache.EnvVar)
+	}
+	return envcache.New([]byte(data))
+}
+
 func loadDataCache(cfg *config.Configuration) (err error) {
 
 	switch cfg.DataCache.Type {
@@ -586,10 +2114,20 @@ func loadDataCache(cfg *config.Configuration) (err error) {
 		}
 
 	case "filecache":
-		dataCache, err = filecache.New(cfg.DataCache.Filename)
+		fc, err := filecache.New(cfg.DataCache.Filename)
 		if err != nil {
 			return fmt.Errorf("FileCache Error: %s", err.Error())
 		}
+		if cfg.DataCache.ReloadSeconds > 0 {
+			fc.WatchFile(time.Duration(cfg.DataCache.ReloadSeconds) * time.Second)
+		}
+		dataCache = fc
+
+	case "env":
+		dataCache, err = loadEnvDataCache(cfg)
+		if err != nil {
+			return fmt.Errorf("EnvCache Error: %s", err.Error())
+		}
 
 	default:
 		return fmt.Errorf("Unknown datacache.type: %s", cfg.DataCache.Type)
@@ -606,8 +2144,52 @@ func init() {
 	viper.SetDefault("external_url", "http://localhost:8000")
 	viper.SetDefault("port", 8000)
 	viper.SetDefault("admin_port", 6060)
+	viper.SetDefault("pprof.enabled", true)
+	viper.SetDefault("metrics.max_dump_accounts", 100)
+	viper.SetDefault("overload.check_interval_ms", 1000)
+	viper.SetDefault("overload.retry_after_seconds", 1)
+	viper.SetDefault("alerts.check_interval_seconds", 60)
+	viper.SetDefault("alerts.sustained_checks", 3)
+	viper.SetDefault("alerts.repeat_minutes", 30)
+	viper.SetDefault("error_degradation.window_seconds", 10)
+	viper.SetDefault("error_degradation.min_requests", 20)
+	viper.SetDefault("error_degradation.error_rate", 0)
+	viper.SetDefault("error_degradation.timeout_percent", 50)
 	viper.SetDefault("default_timeout_ms", 250)
+	viper.SetDefault("min_timeout_ms", 1)
+	viper.SetDefault("max_timeout_ms", 2000)
+	viper.SetDefault("invalid_timeout", pbs.INVALID_TIMEOUT_DEFAULT)
+	viper.SetDefault("timeout_buffer_ms", 0)
+	viper.SetDefault("outbound_user_agent", "prebid-server/"+Version)
+	viper.SetDefault("required_request_fields", []string{})
+	viper.SetDefault("duplicate_bidders", pbs.DUPLICATE_BIDDERS_DEDUP)
+	viper.SetDefault("fold_ad_unit_codes", false)
+	viper.SetDefault("duplicate_ad_units", pbs.DUPLICATE_BIDDERS_DEDUP)
+	viper.SetDefault("app_with_cookie", pbs.APP_WITH_COOKIE_APP)
+	viper.SetDefault("default_account_id", "")
+	viper.SetDefault("demand_sdk_bidders", []string{"audienceNetwork"})
+	viper.SetDefault("request_validation", VALIDATION_OFF)
+	viper.SetDefault("cache_unavailable", CACHE_UNAVAILABLE_INLINE)
+	viper.SetDefault("min_bids_to_cache", 1)
+	viper.SetDefault("no_cache_paths", []string{"/auction", "/cookie_sync", "/validate", "/status", "/ip", "/getuids", "/setuid", "/optout"})
+	viper.SetDefault("max_bids_per_adapter", 50)
+	viper.SetDefault("invalid_markup", INVALID_MARKUP_SANITIZE)
+	viper.SetDefault("min_ad_size.width", 1)
+	viper.SetDefault("min_ad_size.height", 1)
+	viper.SetDefault("fill_metric_sizes", []string{"300x250", "728x90", "160x600", "300x600", "320x50", "970x250"})
+	viper.SetDefault("max_concurrent_auctions", 5000)
+	viper.SetDefault("auction_queue_timeout_ms", 50)
+	viper.SetDefault("max_concurrent_auctions_per_ip", 0)
+	viper.SetDefault("trusted_ips", []string{})
+	viper.SetDefault("bandwidth_window_seconds", 60)
+	viper.SetDefault("drop_bidders_without_params", false)
+	viper.SetDefault("anonymize_ip", false)
+	viper.SetDefault("schain_asi", "")
+	viper.SetDefault("key_values.max_count", 20)
+	viper.SetDefault("key_values.max_key_length", 20)
+	viper.SetDefault("key_values.max_value_length", 40)
 	viper.SetDefault("datacache.type", "dummy")
+	viper.SetDefault("datacache.env_var", "PBS_ACCOUNTS")
 	// no metrics configured by default (metrics{host|database|username|password})
 
 	viper.SetDefault("adapters.pubmatic.endpoint", "http://openbid.pubmatic.com/translator?source=prebid-server")
@@ -631,18 +2213,100 @@ func main() {
 	}
 }
 
-func setupExchanges(cfg *config.Configuration) {
+// adapterHTTPConfig applies the adapter's own settings, from the config under adapters.<configKey>, to the base config
+func adapterHTTPConfig(base adapters.HTTPAdapterConfig, cfg *config.Configuration, configKey string) (*adapters.HTTPAdapterConfig, error) {
+	adapterCfg := cfg.Adapters[configKey]
+	base.ConnectTimeout = time.Duration(adapterCfg.ConnectTimeoutMillis) * time.Millisecond
+	base.TLSHandshakeTimeout = time.Duration(adapterCfg.TLSHandshakeTimeoutMillis) * time.Millisecond
+	base.ResponseHeaderTimeout = time.Duration(adapterCfg.ResponseHeaderTimeoutMillis) * time.Millisecond
+	switch adapterCfg.BodyFormat {
+	case "", adapters.BODY_FORMAT_JSON, adapters.BODY_FORMAT_FORM:
+		base.BodyFormat = adapterCfg.BodyFormat
+	default:
+		return nil, fmt.Errorf("adapters.%s.body_format must be %s or %s, not %q", configKey, adapters.BODY_FORMAT_JSON, adapters.BODY_FORMAT_FORM, adapterCfg.BodyFormat)
+	}
+	proxy := cfg.OutboundProxy
+	if adapterCfg.Proxy.URL != "" {
+		proxy = adapterCfg.Proxy
+	}
+	if proxy.URL != "" {
+		proxyURL, err := url.Parse(proxy.URL)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("adapters.%s: invalid proxy URL %q", configKey, proxy.URL)
+		}
+		if proxy.Username != "" {
+			proxyURL.User = url.UserPassword(proxy.Username, proxy.Password)
+		}
+		base.Proxy = proxyURL
+	}
+	if len(adapterCfg.ResponseFieldMap) > 0 {
+		renames := make([]adapters.FieldRename, len(adapterCfg.ResponseFieldMap))
+		for i, field := range adapterCfg.ResponseFieldMap {
+			renames[i] = adapters.FieldRename{Path: field.Path, To: field.To}
+		}
+		fields, err := adapters.NewFieldMap(renames)
+		if err != nil {
+			return nil, fmt.Errorf("adapters.%s.response_field_map: %v", configKey, err)
+		}
+		base.ResponseFieldMap = fields
+	}
+	return &base, nil
+}
+
+// adapterConfigKeys maps each bidder code to the key of its settings under adapters in the config
+var adapterConfigKeys = map[string]string{
+	"appnexus":        "appnexus",
+	"districtm":       "districtm",
+	"indexExchange":   "indexexchange",
+	"pubmatic":        "pubmatic",
+	"pulsepoint":      "pulsepoint",
+	"rubicon":         "rubicon",
+	"audienceNetwork": "facebook",
+	"lifestreet":      "lifestreet",
+}
+
+func setupExchanges(cfg *config.Configuration) error {
+	httpConfig := *adapters.DefaultHTTPAdapterConfig
+	if cfg.OutboundUserAgent != "" {
+		httpConfig.UserAgent = cfg.OutboundUserAgent
+	}
+	window := time.Duration(cfg.BandwidthWindowSeconds) * time.Second
+	bandwidth = make(map[string]*bandwidthTracker, len(adapterConfigKeys))
+	httpConfigs := make(map[string]*adapters.HTTPAdapterConfig, len(adapterConfigKeys))
+	responseCaches = make(map[string]*responseCache)
+	errorRates = make(map[string]*errorRateTracker, len(adapterConfigKeys))
+	for bidderCode, configKey := range adapterConfigKeys {
+		adapterCfg := cfg.Adapters[configKey]
+		switch adapterCfg.MaxCPMPolicy {
+		case "", MAX_CPM_POLICY_DROP, MAX_CPM_POLICY_CAP:
+		default:
+			return fmt.Errorf("adapters.%s.max_cpm_policy must be %s or %s, not %q", configKey, MAX_CPM_POLICY_DROP, MAX_CPM_POLICY_CAP, adapterCfg.MaxCPMPolicy)
+		}
+		if c := newResponseCache(&adapterCfg.ResponseCache); c != nil {
+			responseCaches[bidderCode] = c
+		}
+		c, err := adapterHTTPConfig(httpConfig, cfg, configKey)
+		if err != nil {
+			return err
+		}
+		tracker := newBandwidthTracker(cfg.Adapters[configKey].MaxBandwidthBytes, window)
+		c.ByteCounter = tracker
+		bandwidth[bidderCode] = tracker
+		errorRates[bidderCode] = newErrorRateTracker(cfg.ErrorDegradation)
+		httpConfigs[bidderCode] = c
+	}
 	exchanges = map[string]adapters.Adapter{
-		"appnexus":      adapters.NewAppNexusAdapter(adapters.DefaultHTTPAdapterConfig, cfg.ExternalURL),
-		"districtm":     adapters.NewAppNexusAdapter(adapters.DefaultHTTPAdapterConfig, cfg.ExternalURL),
-		"indexExchange": adapters.NewIndexAdapter(adapters.DefaultHTTPAdapterConfig, cfg.Adapters["indexexchange"].Endpoint, cfg.Adapters["indexexchange"].UserSyncURL),
-		"pubmatic":      adapters.NewPubmaticAdapter(adapters.DefaultHTTPAdapterConfig, cfg.Adapters["pubmatic"].Endpoint, cfg.ExternalURL),
-		"pulsepoint":    adapters.NewPulsePointAdapter(adapters.DefaultHTTPAdapterConfig, cfg.Adapters["pulsepoint"].Endpoint, cfg.ExternalURL),
-		"rubicon": adapters.NewRubiconAdapter(adapters.DefaultHTTPAdapterConfig, cfg.Adapters["rubicon"].Endpoint,
+		"appnexus":      adapters.NewAppNexusAdapter(httpConfigs["appnexus"], cfg.ExternalURL),
+		"districtm":     adapters.NewAppNexusAdapter(httpConfigs["districtm"], cfg.ExternalURL),
+		"indexExchange": adapters.NewIndexAdapter(httpConfigs["indexExchange"], cfg.Adapters["indexexchange"].Endpoint, cfg.Adapters["indexexchange"].UserSyncURL),
+		"pubmatic":      adapters.NewPubmaticAdapter(httpConfigs["pubmatic"], cfg.Adapters["pubmatic"].Endpoint, cfg.ExternalURL),
+		"pulsepoint":    adapters.NewPulsePointAdapter(httpConfigs["pulsepoint"], cfg.Adapters["pulsepoint"].Endpoint, cfg.ExternalURL),
+		"rubicon": adapters.NewRubiconAdapter(httpConfigs["rubicon"], cfg.Adapters["rubicon"].Endpoint,
 			cfg.Adapters["rubicon"].XAPI.Username, cfg.Adapters["rubicon"].XAPI.Password, cfg.Adapters["rubicon"].XAPI.Tracker, cfg.Adapters["rubicon"].UserSyncURL),
-		"audienceNetwork": adapters.NewFacebookAdapter(adapters.DefaultHTTPAdapterConfig, cfg.Adapters["facebook"].PlatformID, cfg.Adapters["facebook"].UserSyncURL),
-		"lifestreet":      adapters.NewLifestreetAdapter(adapters.DefaultHTTPAdapterConfig, cfg.ExternalURL),
+		"audienceNetwork": adapters.NewFacebookAdapter(httpConfigs["audienceNetwork"], cfg.Adapters["facebook"].PlatformID, cfg.Adapters["facebook"].UserSyncURL),
+		"lifestreet":      adapters.NewLifestreetAdapter(httpConfigs["lifestreet"], cfg.ExternalURL),
 	}
+	return nil
 }
 
 func serve(cfg *config.Configuration) error {
@@ -650,12 +2314,65 @@ func serve(cfg *config.Configuration) error {
 		return fmt.Errorf("Prebid Server could not load data cache: %v", err)
 	}
 
-	setupExchanges(cfg)
+	if err := setupExchanges(cfg); err != nil {
+		return fmt.Errorf("Prebid Server could not set up the adapters: %v", err)
+	}
+	if err := checkInvalidMarkup(cfg.InvalidMarkup); err != nil {
+		return fmt.Errorf("Prebid Server has a bad config: %v", err)
+	}
+	if err := checkAPIKeys(cfg.APIKeys); err != nil {
+		return fmt.Errorf("Prebid Server has a bad config: %v", err)
+	}
+	if err := checkErrorDegradation(cfg.ErrorDegradation); err != nil {
+		return fmt.Errorf("Prebid Server has a bad config: %v", err)
+	}
+	if err := pbs.CheckTimeouts(cfg); err != nil {
+		return fmt.Errorf("Prebid Server has a bad config: %v", err)
+	}
+	if err := checkCacheNamespaces(cfg.Accounts); err != nil {
+		return fmt.Errorf("Prebid Server has a bad config: %v", err)
+	}
+	var err error
+	requestParamFields, err = pbs.NewRequestParamFields(cfg.RequestParamFields)
+	if err != nil {
+		return fmt.Errorf("Prebid Server has a bad config: %v", err)
+	}
+	if cfg.Chaos.Enabled {
+		glog.Warningf("Chaos testing is enabled. Adapter calls will be delayed by %v", cfg.Chaos.AdapterDelays)
+	}
+	if cfg.MaxConcurrentAdapterCalls > 0 {
+		adapterLimiter = newPrioritySemaphore(cfg.MaxConcurrentAdapterCalls)
+	}
+
+	tracer, err = setupAdapterTracer(cfg)
+	if err != nil {
+		return fmt.Errorf("Prebid Server could not set up adapter tracing: %v", err)
+	}
 
 	m := pbsmetrics.NewMetrics(keys(exchanges))
+	for bidderCode, tracker := range bandwidth {
+		tracker.metrics = m.AdapterMetrics[bidderCode]
+	}
+	for bidderCode, tracker := range errorRates {
+		if tracker != nil {
+			tracker.metrics = m.AdapterMetrics[bidderCode]
+		}
+	}
+	if pc, ok := dataCache.(*postgrescache.Cache); ok {
+		pc.SetStaleMeter(m.StaleDataCacheMeter)
+	}
 	if cfg.Metrics.Host != "" {
 		go m.Export(cfg)
 	}
+	if cfg.Metrics.AccountIdleSeconds > 0 {
+		go m.EvictIdleAccounts(time.Duration(cfg.Metrics.AccountIdleSeconds) * time.Second)
+	}
+	if err := pbsmetrics.CheckAlerts(&cfg.Alerts); err != nil {
+		return fmt.Errorf("Prebid Server has a bad config: %v", err)
+	}
+	if cfg.Alerts.WebhookURL != "" {
+		go m.MonitorAdapters(&cfg.Alerts)
+	}
 
 	b, err := ioutil.ReadFile("static/pbs_request.json")
 	if err != nil {
@@ -668,12 +2385,30 @@ func serve(cfg *config.Configuration) error {
 		}
 	}
 
+	pbc.InitPrebidCache(cfg.CacheURL)
+	pbc.InitSigning(cfg.CacheIDSecret)
+
 	stopSignals := make(chan os.Signal)
 	signal.Notify(stopSignals, syscall.SIGTERM, syscall.SIGINT)
 
+	adminMux := http.NewServeMux()
+	adminMux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := m.WriteJSON(w, cfg.Metrics.MaxDumpAccounts); err != nil {
+			glog.Errorf("Failed to write metrics: %v", err)
+		}
+	})
+
+	knownBidders := make(map[string]bool, len(exchanges))
+	for code := range exchanges {
+		knownBidders[code] = true
+	}
+	adminMux.HandleFunc("/bidders/disabled", disabledBidders.handler(knownBidders))
+	registerPprof(adminMux, &cfg.Pprof)
+
 	/* Run admin on different port thats not exposed */
 	adminURI := fmt.Sprintf("%s:%d", cfg.Host, cfg.AdminPort)
-	adminServer := &http.Server{Addr: adminURI}
+	adminServer := &http.Server{Addr: adminURI, Handler: adminMux}
 	go (func() {
 		fmt.Println("Admin running on: ", adminURI)
 		err := adminServer.ListenAndServe()
@@ -682,9 +2417,25 @@ func serve(cfg *config.Configuration) error {
 	})()
 
 	router := httprouter.New()
-	router.POST("/auction", (&auctionDeps{m}).auction)
+	var auctionSlots *prioritySemaphore
+	if cfg.MaxConcurrentAuctions > 0 {
+		auctionSlots = newPrioritySemaphore(cfg.MaxConcurrentAuctions)
+	}
+	auctionQueueTimeout := time.Duration(cfg.AuctionQueueTimeoutMillis) * time.Millisecond
+	load, err := setupLoadMonitor(&cfg.Overload)
+	if err != nil {
+		return fmt.Errorf("Prebid Server has a bad config: %v", err)
+	}
+	clients, err := newClientLimiter(cfg.MaxConcurrentAuctionsPerIP, cfg.TrustedIPs)
+	if err != nil {
+		return fmt.Errorf("Prebid Server has a bad config: %v", err)
+	}
+	auction := limitAuctions((&auctionDeps{cfg, m}).auction, auctionSlots, auctionQueueTimeout, m)
+	auction = limitClients(auction, clients, m)
+	auction = shedOverload(auction, load, cfg.Overload.RetryAfterSeconds, m)
+	router.POST("/auction", requireReady(requireAPIKey(auction, cfg.APIKeys)))
 	router.GET("/bidders/params", NewJsonDirectoryServer(schemaDirectory))
-	router.POST("/cookie_sync", (&cookieSyncDeps{m}).cookieSync)
+	router.POST("/cookie_sync", (&cookieSyncDeps{cfg, m}).cookieSync)
 	router.POST("/validate", validate)
 	router.GET("/status", status)
 	router.GET("/", serveIndex)
@@ -703,6 +2454,8 @@ func serve(cfg *config.Configuration) error {
 		HostCookieSettings: &hostCookieSettings,
 		ExternalUrl:        cfg.ExternalURL,
 		RecaptchaSecret:    cfg.RecaptchaSecret,
+		RecaptchaDisabled:  cfg.RecaptchaDisabled,
+		RecaptchaMinScore:  cfg.RecaptchaMinScore,
 		Metrics:            m,
 	}
 
@@ -711,14 +2464,12 @@ func serve(cfg *config.Configuration) error {
 	router.POST("/optout", userSyncDeps.OptOut)
 	router.GET("/optout", userSyncDeps.OptOut)
 
-	pbc.InitPrebidCache(cfg.CacheURL)
-
 	// Add CORS middleware
 	c := cors.New(cors.Options{AllowCredentials: true})
 	corsRouter := c.Handler(router)
 
 	// Add no cache headers
-	noCacheHandler := NoCache{corsRouter}
+	noCacheHandler := NewNoCache(corsRouter, cfg.NoCachePaths)
 
 	server := &http.Server{
 		Addr:         fmt.Sprintf("%s:%d", cfg.Host, cfg.Port),
@@ -727,6 +2478,9 @@ func serve(cfg *config.Configuration) error {
 		WriteTimeout: 15 * time.Second,
 	}
 
+	// Every dependency is initialized by now, so it's safe to start taking auctions.
+	atomic.StoreInt32(&serverReady, 1)
+
 	go (func() {
 		fmt.Printf("Main server running on: %s\n", server.Addr)
 		serverErr := server.ListenAndServe()
@@ -0,0 +1,153 @@
+package pbsmetrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dbmedialab/prebid-server/config"
+	"github.com/golang/glog"
+)
+
+// adapterMonitor checks the adapter metrics against the alert thresholds. An adapter is reported once it
+// breaches a threshold on SustainedChecks checks in a row, and then at most once every RepeatMinutes.
+type adapterMonitor struct {
+	cfg      *config.Alerts
+	adapters map[string]*AdapterMetrics
+	state    map[string]*alertState
+}
+
+type alertState struct {
+	// The adapter's counts at the last check, so each check only looks at the requests since
+	requests int64
+	errors   int64
+
+	breaches  int
+	lastAlert time.Time
+}
+
+func newAdapterMonitor(cfg *config.Alerts, adapters map[string]*AdapterMetrics) *adapterMonitor {
+	m := &adapterMonitor{
+		cfg:      cfg,
+		adapters: adapters,
+		state:    make(map[string]*alertState, len(adapters)),
+	}
+	for code, metrics := range adapters {
+		m.state[code] = &alertState{requests: metrics.RequestMeter.Count(), errors: metrics.ErrorMeter.Count()}
+	}
+	return m
+}
+
+// thresholds returns the adapter's own thresholds, or the defaults if it has none
+func (m *adapterMonitor) thresholds(bidderCode string) config.AlertThresholds {
+	if t, ok := m.cfg.Adapters[strings.ToLower(bidderCode)]; ok {
+		return t
+	}
+	return m.cfg.Default
+}
+
+// check looks at every adapter, and returns the alerts which should be sent now. Adapters which
+// weren't called since the last check are skipped, since their metrics haven't changed.
+func (m *adapterMonitor) check(now time.Time) []string {
+	codes := make([]string, 0, len(m.adapters))
+	for code := range m.adapters {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	var alerts []string
+	for _, code := range codes {
+		metrics := m.adapters[code]
+		state := m.state[code]
+		requests, errors := metrics.RequestMeter.Count(), metrics.ErrorMeter.Count()
+		newRequests, newErrors := requests-state.requests, errors-state.errors
+		state.requests, state.errors = requests, errors
+		if newRequests <= 0 {
+			continue
+		}
+
+		t := m.thresholds(code)
+		var problems []string
+		p95 := int64(metrics.RequestTimer.Percentile(0.95)) / int64(time.Millisecond)
+		if t.P95LatencyMillis > 0 && p95 > t.P95LatencyMillis {
+			problems = append(problems, fmt.Sprintf("p95 latency is %dms, over the %dms threshold", p95, t.P95LatencyMillis))
+		}
+		errorRate := float64(newErrors) / float64(newRequests)
+		if t.ErrorRate > 0 && errorRate > t.ErrorRate {
+			problems = append(problems, fmt.Sprintf("error rate is %.1f%%, over the %.1f%% threshold", errorRate*100, t.ErrorRate*100))
+		}
+
+		if len(problems) == 0 {
+			state.breaches = 0
+			continue
+		}
+		state.breaches++
+		repeat := time.Duration(m.cfg.RepeatMinutes) * time.Minute
+		if state.breaches >= m.cfg.SustainedChecks && now.Sub(state.lastAlert) >= repeat {
+			state.lastAlert = now
+			alerts = append(alerts, fmt.Sprintf("prebid-server: adapter %s %s", code, strings.Join(problems, " and ")))
+		}
+	}
+	return alerts
+}
+
+// CheckAlerts makes sure the alerts can be monitored. Without a webhook_url they're off, so nothing is checked.
+// The errors leave out the webhook URL, since it's a credential.
+func CheckAlerts(cfg *config.Alerts) error {
+	if cfg.WebhookURL == "" {
+		return nil
+	}
+	if cfg.CheckIntervalSeconds <= 0 {
+		return fmt.Errorf("alerts.check_interval_seconds must be above 0 when alerts.webhook_url is set")
+	}
+	if u, err := url.Parse(cfg.WebhookURL); err != nil || u.Host == "" {
+		return fmt.Errorf("alerts.webhook_url must be an absolute URL")
+	}
+	return nil
+}
+
+// MonitorAdapters checks the adapters' metrics every check_interval_seconds, and posts an alert to the
+// webhook when one is slow or failing. The config must have passed CheckAlerts.
+// This blocks indefinitely, so it should be run inside a goroutine.
+func (m *Metrics) MonitorAdapters(cfg *config.Alerts) {
+	monitor := newAdapterMonitor(cfg, m.AdapterMetrics)
+	client := &http.Client{Timeout: 10 * time.Second}
+	// Only the host is logged, since the rest of the webhook URL is a credential
+	var host string
+	if u, err := url.Parse(cfg.WebhookURL); err == nil {
+		host = u.Host
+	}
+	for now := range time.Tick(time.Duration(cfg.CheckIntervalSeconds) * time.Second) {
+		for _, alert := range monitor.check(now) {
+			glog.Warning(alert)
+			if err := postAlert(client, cfg.WebhookURL, alert); err != nil {
+				glog.Errorf("Failed to send alert to the webhook at %s: %v", host, err)
+			}
+		}
+	}
+}
+
+func postAlert(client *http.Client, webhookURL string, text string) error {
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// The *url.Error repeats the webhook URL, so only its cause is kept
+		if urlErr, ok := err.(*url.Error); ok {
+			return urlErr.Err
+		}
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package pbsmetrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dbmedialab/prebid-server/config"
+)
+
+func TestAdapterMonitorErrorRate(t *testing.T) {
+	m := NewMetrics([]string{"appnexus", "rubicon"})
+	cfg := &config.Alerts{
+		SustainedChecks: 2,
+		RepeatMinutes:   30,
+		Default:         config.AlertThresholds{ErrorRate: 0.2},
+		Adapters:        map[string]config.AlertThresholds{"rubicon": {ErrorRate: 0.6}},
+	}
+	monitor := newAdapterMonitor(cfg, m.AdapterMetrics)
+	fail := func() {
+		for _, code := range []string{"appnexus", "rubicon"} {
+			m.AdapterMetrics[code].RequestMeter.Mark(10)
+			m.AdapterMetrics[code].ErrorMeter.Mark(5)
+		}
+	}
+
+	now := time.Now()
+	fail()
+	if alerts := monitor.check(now); len(alerts) != 0 {
+		t.Errorf("A single breach shouldn't be reported; got %v", alerts)
+	}
+	fail()
+	alerts := monitor.check(now.Add(time.Minute))
+	if len(alerts) != 1 || !strings.Contains(alerts[0], "appnexus") || !strings.Contains(alerts[0], "error rate is 50.0%") {
+		t.Errorf("Expected an alert for appnexus only, since rubicon has a higher threshold; got %v", alerts)
+	}
+	fail()
+	if alerts := monitor.check(now.Add(2 * time.Minute)); len(alerts) != 0 {
+		t.Errorf("Alerts should be rate limited; got %v", alerts)
+	}
+	fail()
+	if alerts := monitor.check(now.Add(32 * time.Minute)); len(alerts) != 1 {
+		t.Errorf("The alert should repeat once repeat_minutes have passed; got %v", alerts)
+	}
+
+	// Without new requests there's nothing to check
+	if alerts := monitor.check(now.Add(64 * time.Minute)); len(alerts) != 0 {
+		t.Errorf("Idle adapters shouldn't be reported; got %v", alerts)
+	}
+}
+
+func TestAdapterMonitorLatency(t *testing.T) {
+	m := NewMetrics([]string{"appnexus"})
+	cfg := &config.Alerts{SustainedChecks: 1, Default: config.AlertThresholds{P95LatencyMillis: 100}}
+	monitor := newAdapterMonitor(cfg, m.AdapterMetrics)
+
+	m.AdapterMetrics["appnexus"].RequestMeter.Mark(1)
+	m.AdapterMetrics["appnexus"].RequestTimer.Update(50 * time.Millisecond)
+	if alerts := monitor.check(time.Now()); len(alerts) != 0 {
+		t.Errorf("Fast adapters shouldn't be reported; got %v", alerts)
+	}
+	for i := 0; i < 10; i++ {
+		m.AdapterMetrics["appnexus"].RequestMeter.Mark(1)
+		m.AdapterMetrics["appnexus"].RequestTimer.Update(300 * time.Millisecond)
+	}
+	if alerts := monitor.check(time.Now()); len(alerts) != 1 || !strings.Contains(alerts[0], "p95 latency is 300ms") {
+		t.Errorf("Expected a latency alert; got %v", alerts)
+	}
+}
+
+func TestPostAlert(t *testing.T) {
+	var text string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		text = body["text"]
+	}))
+	defer server.Close()
+
+	if err := postAlert(server.Client(), server.URL, "adapter appnexus is slow"); err != nil {
+		t.Fatalf("Post failed: %v", err)
+	}
+	if text != "adapter appnexus is slow" {
+		t.Errorf("Expected the alert in a Slack style text field; got %q", text)
+	}
+}
+
+func TestPostAlertHidesWebhookURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	webhookURL := server.URL + "/services/T000/B000/s3cret"
+	server.Close()
+
+	err := postAlert(server.Client(), webhookURL, "adapter appnexus is slow")
+	if err == nil {
+		t.Fatalf("Posting to a closed server should fail")
+	}
+	if strings.Contains(err.Error(), "s3cret") {
+		t.Errorf("The error shouldn't have the webhook URL in it; got %v", err)
+	}
+}
+
+func TestCheckAlerts(t *testing.T) {
+	if err := CheckAlerts(&config.Alerts{}); err != nil {
+		t.Errorf("Alerts without a webhook are off, so they needn't be configured; got %v", err)
+	}
+	if err := CheckAlerts(&config.Alerts{WebhookURL: "https://hooks.example.com/s3cret", CheckIntervalSeconds: 60}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	for _, interval := range []int{0, -1} {
+		if err := CheckAlerts(&config.Alerts{WebhookURL: "https://hooks.example.com/s3cret", CheckIntervalSeconds: interval}); err == nil {
+			t.Errorf("A check interval of %d should be rejected", interval)
+		}
+	}
+	err := CheckAlerts(&config.Alerts{WebhookURL: "hooks.example.com/s3cret", CheckIntervalSeconds: 60})
+	if err == nil {
+		t.Errorf("A webhook URL without a host should be rejected")
+	} else if strings.Contains(err.Error(), "s3cret") {
+		t.Errorf("The error shouldn't have the webhook URL in it; got %v", err)
+	}
+}
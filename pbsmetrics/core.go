@@ -1,7 +1,11 @@
 package pbsmetrics
 
 import (
+	"encoding/json"
+	"io"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"github.com/rcrowley/go-metrics"
 	"fmt"
 	"time"
@@ -13,8 +17,14 @@ const (
 	USERSYNC_OPT_OUT     = "usersync.opt_outs"
 	USERSYNC_BAD_REQUEST = "usersync.bad_requests"
 	USERSYNC_SUCCESS     = "usersync.%s.sets"
+
+	// ACCOUNT_METRICS_PREFIX is the start of the full name of every per-account metric
+	ACCOUNT_METRICS_PREFIX = "prebidserver.account."
 )
 
+// registryPrefix is added to the name of every metric in the registry
+const registryPrefix = "prebidserver."
+
 type DomainMetrics struct {
 	RequestMeter metrics.Meter
 }
@@ -23,8 +33,80 @@ type AccountMetrics struct {
 	RequestMeter      metrics.Meter
 	BidsReceivedMeter metrics.Meter
 	PriceHistogram    metrics.Histogram
+	// TimedOutBiddersHistogram is the distribution of how many bidders timed out in each of the account's auctions
+	TimedOutBiddersHistogram metrics.Histogram
+	// AdUnitBidsHistogram is the distribution of how many bids each of the account's ad units got
+	AdUnitBidsHistogram metrics.Histogram
+	// CacheMarkupMeter counts the account's requests with cache_markup set. CacheTimer is the time spent
+	// putting their bids in prebid-cache, and CachedObjectsHistogram how many of the bids were stored.
+	CacheMarkupMeter       metrics.Meter
+	CacheTimer             metrics.Timer
+	CachedObjectsHistogram metrics.Histogram
 	// store account by adapter metrics. Type is map[PBSBidder.BidderCode]
 	AdapterMetrics map[string]*AdapterMetrics
+
+	registry   *accountRegistry
+	id         string
+	sizeMeters *sync.Map // This is a *map[string]metrics.Meter
+	// lastUsed is the UnixNano time of the last GetAccountMetrics call for the account.
+	// It must only be accessed through the sync/atomic package.
+	lastUsed int64
+}
+
+// SizeBidsMeter counts the account's bids with the given "WxH" size. Every size gets its own metric, so
+// callers should stick to a known set of sizes.
+func (am *AccountMetrics) SizeBidsMeter(size string) metrics.Meter {
+	if meter, ok := am.sizeMeters.Load(size); ok {
+		return meter.(metrics.Meter)
+	}
+	// Meters are ticked for as long as the process lives, so one is only made when the size is new
+	meter, _ := am.sizeMeters.LoadOrStore(size, metrics.GetOrRegisterMeter(fmt.Sprintf("account.%s.sizes.%s.bids", am.id, size), am.registry))
+	return meter.(metrics.Meter)
+}
+
+// accountRegistry registers an account's metrics in the shared registry, and keeps their names. Account IDs
+// can have dots in them, so the names are the only way to tell which metrics belong to the account.
+type accountRegistry struct {
+	metrics.Registry
+
+	mu    sync.Mutex
+	names map[string]bool
+}
+
+func (r *accountRegistry) GetOrRegister(name string, metric interface{}) interface{} {
+	r.record(name)
+	return r.Registry.GetOrRegister(name, metric)
+}
+
+func (r *accountRegistry) Register(name string, metric interface{}) error {
+	r.record(name)
+	return r.Registry.Register(name, metric)
+}
+
+func (r *accountRegistry) record(name string) {
+	r.mu.Lock()
+	r.names[name] = true
+	r.mu.Unlock()
+}
+
+// registered returns the names of the account's metrics
+func (r *accountRegistry) registered() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.names))
+	for name := range r.names {
+		names = append(names, name)
+	}
+	return names
+}
+
+// unregisterAll removes every metric the account registered from the shared registry
+func (r *accountRegistry) unregisterAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name := range r.names {
+		r.Registry.Unregister(name)
+	}
 }
 
 type AdapterMetrics struct {
@@ -36,6 +118,38 @@ type AdapterMetrics struct {
 	RequestTimer      metrics.Timer
 	PriceHistogram    metrics.Histogram
 	BidsReceivedMeter metrics.Meter
+	ExcessBidsMeter   metrics.Meter
+	// Bytes sent to and received from the adapter. These are only tracked per adapter, not per account.
+	RequestBytesMeter  metrics.Meter
+	ResponseBytesMeter metrics.Meter
+	// Calls answered from the adapter's response cache, and the ones it had to make. These are also only
+	// tracked per adapter.
+	ResponseCacheHitMeter  metrics.Meter
+	ResponseCacheMissMeter metrics.Meter
+	// TopBidMeter counts the ad units where the adapter had the highest bid, when the request sorts bids
+	TopBidMeter metrics.Meter
+	// UnrequestedBidsMeter counts the bids dropped because they were for an ad unit the adapter wasn't asked about
+	UnrequestedBidsMeter metrics.Meter
+	// HoldoutMeter counts the auctions the adapter was left out of by its A/B split
+	HoldoutMeter metrics.Meter
+	// DegradedMeter counts the calls made with a shortened timeout, because too many of the adapter's calls failed.
+	// It's only tracked per adapter, not per account.
+	DegradedMeter metrics.Meter
+	// OverMaxCPMMeter counts the bids priced over the adapter's max_cpm, which were dropped or capped
+	OverMaxCPMMeter metrics.Meter
+	// InvalidMarkupMeter counts the bids whose markup wasn't valid UTF-8, which were sanitized or dropped
+	InvalidMarkupMeter metrics.Meter
+	// SLAMetMeter and SLAMissedMeter count the calls which did and didn't respond within the adapter's sla_ms
+	SLAMetMeter    metrics.Meter
+	SLAMissedMeter metrics.Meter
+
+	// Breakdown of ErrorMeter by the kind of failure
+	DNSErrorMeter               metrics.Meter
+	ConnectionRefusedErrorMeter metrics.Meter
+	TLSErrorMeter               metrics.Meter
+	BadStatusErrorMeter         metrics.Meter
+	BadResponseErrorMeter       metrics.Meter
+	OtherErrorMeter             metrics.Meter
 }
 
 type UserSyncMetrics struct {
@@ -45,6 +159,14 @@ type UserSyncMetrics struct {
 	successMeters   *sync.Map  // This is a *map[string]metrics.Meter
 }
 
+// CacheMetrics track the PUT requests made to prebid-cache
+type CacheMetrics struct {
+	RequestTimer     metrics.Timer
+	ErrorMeter       metrics.Meter
+	BytesMeter       metrics.Meter
+	ObjectsHistogram metrics.Histogram
+}
+
 func (u *UserSyncMetrics) SuccessMeter(bidder string) metrics.Meter {
 	meter, loaded := u.successMeters.LoadOrStore(bidder, metrics.NewMeter())
 	if !loaded {
@@ -65,6 +187,42 @@ type Metrics struct{
 	RequestTimer        metrics.Timer
 	CookieSyncMeter     metrics.Meter
 	UserSyncMetrics     *UserSyncMetrics
+	CacheMetrics        *CacheMetrics
+	// DuplicateCreativeMeter counts the bids dropped because another bidder offered the same creative for more
+	DuplicateCreativeMeter metrics.Meter
+	// DisallowedSizeMeter counts the bids dropped because their size isn't in the account's allowed sizes
+	DisallowedSizeMeter metrics.Meter
+	// UndersizedBidMeter counts the bids dropped because they're smaller than the min_ad_size
+	UndersizedBidMeter metrics.Meter
+	// SchemaViolationMeter counts the auction requests which fail schema validation, when it's turned on
+	SchemaViolationMeter metrics.Meter
+	// MissingParamsMeter counts the bidders left out of auctions because they had no params
+	MissingParamsMeter metrics.Meter
+	// FallbackMeter counts the calls to an account's fallback bidder
+	FallbackMeter metrics.Meter
+	// AuctionQueueGauge is how many /auction requests are waiting for a free slot, when auctions are limited
+	AuctionQueueGauge metrics.Gauge
+	// ShedAuctionMeter counts the /auction requests turned away with a 503 because no slot came free in time
+	ShedAuctionMeter metrics.Meter
+	// ClientLimitedAuctionMeter counts the /auction requests turned away with a 429 because their client IP had
+	// too many in flight
+	ClientLimitedAuctionMeter metrics.Meter
+	// OverloadMeter counts the /auction requests turned away with a 503 because the process was overloaded
+	OverloadMeter metrics.Meter
+	// AppWithCookieMeter counts the app requests which also carried a uids cookie
+	AppWithCookieMeter metrics.Meter
+	// AllBiddersUnsupportedMeter counts the auction requests turned away because none of their bidders exist
+	AllBiddersUnsupportedMeter metrics.Meter
+	// InvalidSignatureMeter counts the auction requests turned away because their signature didn't match the account's secret
+	InvalidSignatureMeter metrics.Meter
+	// StaleDataCacheMeter counts the failed database lookups which fell back to a stale datacache entry
+	StaleDataCacheMeter metrics.Meter
+	// CacheMarkupMeter counts the auction requests with cache_markup set, whether or not their bids could be cached
+	CacheMarkupMeter metrics.Meter
+
+	// Distributions of how many ad units and bidders each auction request carries
+	AdUnitsHistogram metrics.Histogram
+	BiddersHistogram metrics.Histogram
 
 	AdapterMetrics      map[string]*AdapterMetrics
 
@@ -87,6 +245,40 @@ func (m *Metrics) Export(cfg *config.Configuration) {
 	)
 }
 
+// WriteJSON writes a point-in-time snapshot of every metric to w, as a JSON object keyed by metric name.
+// Only the first maxAccounts accounts (ordered by ID) are included, so that the dump stays a manageable size.
+// 0 includes every account.
+func (m *Metrics) WriteJSON(w io.Writer, maxAccounts int) error {
+	m.accountMetricsRWMutex.RLock()
+	ids := make([]string, 0, len(m.accountMetrics))
+	for id := range m.accountMetrics {
+		ids = append(ids, id)
+	}
+	m.accountMetricsRWMutex.RUnlock()
+
+	sort.Strings(ids)
+	excluded := make(map[string]bool)
+	if maxAccounts > 0 && len(ids) > maxAccounts {
+		m.accountMetricsRWMutex.RLock()
+		for _, id := range ids[maxAccounts:] {
+			if am, ok := m.accountMetrics[id]; ok {
+				for _, name := range am.registry.registered() {
+					excluded[registryPrefix+name] = true
+				}
+			}
+		}
+		m.accountMetricsRWMutex.RUnlock()
+	}
+
+	snapshot := metrics.NewRegistry()
+	m.metricsRegistry.Each(func(name string, metric interface{}) {
+		if !excluded[name] {
+			snapshot.Register(name, metric)
+		}
+	})
+	return json.NewEncoder(w).Encode(snapshot)
+}
+
 func (m *Metrics) GetAccountMetrics(id string) *AccountMetrics {
 	var am *AccountMetrics
 	var ok bool
@@ -96,26 +288,66 @@ func (m *Metrics) GetAccountMetrics(id string) *AccountMetrics {
 	m.accountMetricsRWMutex.RUnlock()
 
 	if ok {
+		atomic.StoreInt64(&am.lastUsed, time.Now().UnixNano())
 		return am
 	}
 
 	m.accountMetricsRWMutex.Lock()
 	am, ok = m.accountMetrics[id]
 	if !ok {
-		am = &AccountMetrics{}
-		am.RequestMeter = metrics.GetOrRegisterMeter(fmt.Sprintf("account.%s.requests", id), m.metricsRegistry)
-		am.BidsReceivedMeter = metrics.GetOrRegisterMeter(fmt.Sprintf("account.%s.bids_received", id), m.metricsRegistry)
-		am.PriceHistogram = metrics.GetOrRegisterHistogram(fmt.Sprintf("account.%s.prices", id), m.metricsRegistry, metrics.NewExpDecaySample(1028, 0.015))
-		am.AdapterMetrics = makeExchangeMetrics(fmt.Sprintf("account.%s", id), m.exchanges, m.metricsRegistry)
+		registry := &accountRegistry{Registry: m.metricsRegistry, names: make(map[string]bool)}
+		am = &AccountMetrics{registry: registry, id: id, sizeMeters: &sync.Map{}}
+		am.RequestMeter = metrics.GetOrRegisterMeter(fmt.Sprintf("account.%s.requests", id), registry)
+		am.BidsReceivedMeter = metrics.GetOrRegisterMeter(fmt.Sprintf("account.%s.bids_received", id), registry)
+		am.PriceHistogram = metrics.GetOrRegisterHistogram(fmt.Sprintf("account.%s.prices", id), registry, metrics.NewExpDecaySample(1028, 0.015))
+		am.TimedOutBiddersHistogram = metrics.GetOrRegisterHistogram(fmt.Sprintf("account.%s.timed_out_bidders", id), registry, metrics.NewExpDecaySample(1028, 0.015))
+		am.AdUnitBidsHistogram = metrics.GetOrRegisterHistogram(fmt.Sprintf("account.%s.ad_unit_bids", id), registry, metrics.NewExpDecaySample(1028, 0.015))
+		am.CacheMarkupMeter = metrics.GetOrRegisterMeter(fmt.Sprintf("account.%s.cache_markup_requests", id), registry)
+		am.CacheTimer = metrics.GetOrRegisterTimer(fmt.Sprintf("account.%s.cache_time", id), registry)
+		am.CachedObjectsHistogram = metrics.GetOrRegisterHistogram(fmt.Sprintf("account.%s.cached_objects", id), registry, metrics.NewExpDecaySample(1028, 0.015))
+		am.AdapterMetrics = makeExchangeMetrics(fmt.Sprintf("account.%s", id), m.exchanges, registry)
 		m.accountMetrics[id] = am
 	}
+	atomic.StoreInt64(&am.lastUsed, time.Now().UnixNano())
 	m.accountMetricsRWMutex.Unlock()
 
 	return am
 }
 
+// EvictIdleAccounts drops the metrics of the accounts which had no requests in the last idle period, so
+// they stop being exported and their memory is freed. They're made again if the account comes back.
+// This blocks indefinitely, so it should be run inside a goroutine.
+func (m *Metrics) EvictIdleAccounts(idle time.Duration) {
+	for now := range time.Tick(idle) {
+		m.evictIdleAccounts(now, idle)
+	}
+}
+
+// evictIdleAccounts drops the metrics of the accounts which weren't used since now-idle, and returns their IDs
+func (m *Metrics) evictIdleAccounts(now time.Time, idle time.Duration) []string {
+	cutoff := now.Add(-idle).UnixNano()
+	var evicted []string
+	// The metrics are unregistered under the write lock too. Otherwise a GetAccountMetrics in between would
+	// get the old metrics back from the registry, just before they're unregistered.
+	m.accountMetricsRWMutex.Lock()
+	for id, am := range m.accountMetrics {
+		if atomic.LoadInt64(&am.lastUsed) < cutoff {
+			delete(m.accountMetrics, id)
+			am.registry.unregisterAll()
+			evicted = append(evicted, id)
+		}
+	}
+	m.accountMetricsRWMutex.Unlock()
+	if len(evicted) == 0 {
+		return nil
+	}
+
+	sort.Strings(evicted)
+	return evicted
+}
+
 func NewMetrics(exchanges []string) *Metrics {
-	registry := metrics.NewPrefixedRegistry("prebidserver.")
+	registry := metrics.NewPrefixedRegistry(registryPrefix)
 	return &Metrics{
 		metricsRegistry: registry,
 		RequestMeter: metrics.GetOrRegisterMeter("requests", registry),
@@ -127,6 +359,23 @@ func NewMetrics(exchanges []string) *Metrics {
 		InvalidMeter: metrics.GetOrRegisterMeter("invalid_requests", registry),
 		RequestTimer: metrics.GetOrRegisterTimer("request_time", registry),
 		CookieSyncMeter: metrics.GetOrRegisterMeter("cookie_sync_requests", registry),
+		DuplicateCreativeMeter: metrics.GetOrRegisterMeter("duplicate_creatives", registry),
+		DisallowedSizeMeter: metrics.GetOrRegisterMeter("disallowed_size_bids", registry),
+		UndersizedBidMeter: metrics.GetOrRegisterMeter("undersized_bids", registry),
+		SchemaViolationMeter: metrics.GetOrRegisterMeter("schema_violations", registry),
+		MissingParamsMeter: metrics.GetOrRegisterMeter("missing_params_bidders", registry),
+		FallbackMeter: metrics.GetOrRegisterMeter("fallback_requests", registry),
+		AuctionQueueGauge: metrics.GetOrRegisterGauge("auction_queue_depth", registry),
+		ShedAuctionMeter: metrics.GetOrRegisterMeter("shed_auction_requests", registry),
+		ClientLimitedAuctionMeter: metrics.GetOrRegisterMeter("client_limited_auction_requests", registry),
+		OverloadMeter: metrics.GetOrRegisterMeter("overload_requests", registry),
+		AppWithCookieMeter: metrics.GetOrRegisterMeter("app_with_cookie_requests", registry),
+		AllBiddersUnsupportedMeter: metrics.GetOrRegisterMeter("all_bidders_unsupported_requests", registry),
+		InvalidSignatureMeter: metrics.GetOrRegisterMeter("invalid_signature_requests", registry),
+		StaleDataCacheMeter: metrics.GetOrRegisterMeter("stale_datacache_lookups", registry),
+		CacheMarkupMeter: metrics.GetOrRegisterMeter("cache_markup_requests", registry),
+		AdUnitsHistogram: metrics.GetOrRegisterHistogram("request_ad_units", registry, metrics.NewExpDecaySample(1028, 0.015)),
+		BiddersHistogram: metrics.GetOrRegisterHistogram("request_bidders", registry, metrics.NewExpDecaySample(1028, 0.015)),
 		AdapterMetrics: makeExchangeMetrics("adapter", exchanges, registry),
 		UserSyncMetrics: &UserSyncMetrics{
 			registry: registry,
@@ -134,6 +383,12 @@ func NewMetrics(exchanges []string) *Metrics {
 			OptOutMeter: metrics.GetOrRegisterMeter(USERSYNC_OPT_OUT, registry),
 			successMeters: &sync.Map{},
 		},
+		CacheMetrics: &CacheMetrics{
+			RequestTimer: metrics.GetOrRegisterTimer("prebid_cache.request_time", registry),
+			ErrorMeter: metrics.GetOrRegisterMeter("prebid_cache.errors", registry),
+			BytesMeter: metrics.GetOrRegisterMeter("prebid_cache.bytes_written", registry),
+			ObjectsHistogram: metrics.GetOrRegisterHistogram("prebid_cache.objects_per_put", registry, metrics.NewExpDecaySample(1028, 0.015)),
+		},
 
 		accountMetrics: make(map[string]*AccountMetrics),
 		exchanges: exchanges,
@@ -151,7 +406,27 @@ func makeExchangeMetrics(adapterOrAccount string, exchanges []string, registry m
 		a.TimeoutMeter = metrics.GetOrRegisterMeter(fmt.Sprintf("%[1]s.%[2]s.timeout_requests", adapterOrAccount, exchange), registry)
 		a.RequestTimer = metrics.GetOrRegisterTimer(fmt.Sprintf("%[1]s.%[2]s.request_time", adapterOrAccount, exchange), registry)
 		a.PriceHistogram = metrics.GetOrRegisterHistogram(fmt.Sprintf("%[1]s.%[2]s.prices", adapterOrAccount, exchange), registry, metrics.NewExpDecaySample(1028, 0.015))
-		if adapterOrAccount != "adapter" {
+		a.DNSErrorMeter = metrics.GetOrRegisterMeter(fmt.Sprintf("%[1]s.%[2]s.errors.dns", adapterOrAccount, exchange), registry)
+		a.ConnectionRefusedErrorMeter = metrics.GetOrRegisterMeter(fmt.Sprintf("%[1]s.%[2]s.errors.connection_refused", adapterOrAccount, exchange), registry)
+		a.TLSErrorMeter = metrics.GetOrRegisterMeter(fmt.Sprintf("%[1]s.%[2]s.errors.tls", adapterOrAccount, exchange), registry)
+		a.BadStatusErrorMeter = metrics.GetOrRegisterMeter(fmt.Sprintf("%[1]s.%[2]s.errors.bad_status", adapterOrAccount, exchange), registry)
+		a.BadResponseErrorMeter = metrics.GetOrRegisterMeter(fmt.Sprintf("%[1]s.%[2]s.errors.bad_response", adapterOrAccount, exchange), registry)
+		a.OtherErrorMeter = metrics.GetOrRegisterMeter(fmt.Sprintf("%[1]s.%[2]s.errors.other", adapterOrAccount, exchange), registry)
+		a.TopBidMeter = metrics.GetOrRegisterMeter(fmt.Sprintf("%[1]s.%[2]s.top_bids", adapterOrAccount, exchange), registry)
+		a.ExcessBidsMeter = metrics.GetOrRegisterMeter(fmt.Sprintf("%[1]s.%[2]s.excess_bids", adapterOrAccount, exchange), registry)
+		a.UnrequestedBidsMeter = metrics.GetOrRegisterMeter(fmt.Sprintf("%[1]s.%[2]s.unrequested_bids", adapterOrAccount, exchange), registry)
+		a.HoldoutMeter = metrics.GetOrRegisterMeter(fmt.Sprintf("%[1]s.%[2]s.holdout_requests", adapterOrAccount, exchange), registry)
+		a.OverMaxCPMMeter = metrics.GetOrRegisterMeter(fmt.Sprintf("%[1]s.%[2]s.over_max_cpm_bids", adapterOrAccount, exchange), registry)
+		a.InvalidMarkupMeter = metrics.GetOrRegisterMeter(fmt.Sprintf("%[1]s.%[2]s.invalid_markup_bids", adapterOrAccount, exchange), registry)
+		a.SLAMetMeter = metrics.GetOrRegisterMeter(fmt.Sprintf("%[1]s.%[2]s.sla_met", adapterOrAccount, exchange), registry)
+		a.SLAMissedMeter = metrics.GetOrRegisterMeter(fmt.Sprintf("%[1]s.%[2]s.sla_missed", adapterOrAccount, exchange), registry)
+		if adapterOrAccount == "adapter" {
+			a.RequestBytesMeter = metrics.GetOrRegisterMeter(fmt.Sprintf("%[1]s.%[2]s.request_bytes", adapterOrAccount, exchange), registry)
+			a.ResponseBytesMeter = metrics.GetOrRegisterMeter(fmt.Sprintf("%[1]s.%[2]s.response_bytes", adapterOrAccount, exchange), registry)
+			a.ResponseCacheHitMeter = metrics.GetOrRegisterMeter(fmt.Sprintf("%[1]s.%[2]s.response_cache_hits", adapterOrAccount, exchange), registry)
+			a.ResponseCacheMissMeter = metrics.GetOrRegisterMeter(fmt.Sprintf("%[1]s.%[2]s.response_cache_misses", adapterOrAccount, exchange), registry)
+			a.DegradedMeter = metrics.GetOrRegisterMeter(fmt.Sprintf("%[1]s.%[2]s.degraded_requests", adapterOrAccount, exchange), registry)
+		} else {
 			a.BidsReceivedMeter = metrics.GetOrRegisterMeter(fmt.Sprintf("%[1]s.%[2]s.bids_received", adapterOrAccount, exchange), registry)
 		}
 
@@ -1,9 +1,15 @@
 package pbsmetrics
 
 import (
+	"bytes"
+	"encoding/json"
 	"testing"
 	"github.com/rcrowley/go-metrics"
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 func TestNewMetrics(t *testing.T) {
@@ -17,12 +23,38 @@ func TestNewMetrics(t *testing.T) {
 	ensureContains(t, registry, "safari_no_cookie_requests", m.SafariNoCookieMeter)
 	ensureContains(t, registry, "error_requests", m.ErrorMeter)
 	ensureContains(t, registry, "invalid_requests", m.InvalidMeter)
+	ensureContains(t, registry, "schema_violations", m.SchemaViolationMeter)
+	ensureContains(t, registry, "missing_params_bidders", m.MissingParamsMeter)
+	ensureContains(t, registry, "fallback_requests", m.FallbackMeter)
+	ensureContains(t, registry, "auction_queue_depth", m.AuctionQueueGauge)
+	ensureContains(t, registry, "shed_auction_requests", m.ShedAuctionMeter)
+	ensureContains(t, registry, "client_limited_auction_requests", m.ClientLimitedAuctionMeter)
+	ensureContains(t, registry, "overload_requests", m.OverloadMeter)
+	ensureContains(t, registry, "app_with_cookie_requests", m.AppWithCookieMeter)
+	ensureContains(t, registry, "all_bidders_unsupported_requests", m.AllBiddersUnsupportedMeter)
+	ensureContains(t, registry, "invalid_signature_requests", m.InvalidSignatureMeter)
+	ensureContains(t, registry, "stale_datacache_lookups", m.StaleDataCacheMeter)
+	ensureContains(t, registry, "cache_markup_requests", m.CacheMarkupMeter)
 	ensureContains(t, registry, "request_time", m.RequestTimer)
 	ensureContains(t, registry, "cookie_sync_requests", m.CookieSyncMeter)
+	ensureContains(t, registry, "duplicate_creatives", m.DuplicateCreativeMeter)
+	ensureContains(t, registry, "disallowed_size_bids", m.DisallowedSizeMeter)
+	ensureContains(t, registry, "undersized_bids", m.UndersizedBidMeter)
+	ensureContains(t, registry, "request_ad_units", m.AdUnitsHistogram)
+	ensureContains(t, registry, "request_bidders", m.BiddersHistogram)
 	ensureContains(t, registry, "usersync.bad_requests", m.UserSyncMetrics.BadRequestMeter)
 	ensureContains(t, registry, "usersync.opt_outs", m.UserSyncMetrics.OptOutMeter)
+	ensureContains(t, registry, "prebid_cache.request_time", m.CacheMetrics.RequestTimer)
+	ensureContains(t, registry, "prebid_cache.errors", m.CacheMetrics.ErrorMeter)
+	ensureContains(t, registry, "prebid_cache.bytes_written", m.CacheMetrics.BytesMeter)
+	ensureContains(t, registry, "prebid_cache.objects_per_put", m.CacheMetrics.ObjectsHistogram)
 	ensureContainsAdapterMetrics(t, registry, "adapter.appnexus", m.AdapterMetrics["appnexus"])
 	ensureContainsAdapterMetrics(t, registry, "adapter.rubicon", m.AdapterMetrics["rubicon"])
+	ensureContains(t, registry, "adapter.appnexus.request_bytes", m.AdapterMetrics["appnexus"].RequestBytesMeter)
+	ensureContains(t, registry, "adapter.appnexus.response_bytes", m.AdapterMetrics["appnexus"].ResponseBytesMeter)
+	ensureContains(t, registry, "adapter.appnexus.response_cache_hits", m.AdapterMetrics["appnexus"].ResponseCacheHitMeter)
+	ensureContains(t, registry, "adapter.appnexus.response_cache_misses", m.AdapterMetrics["appnexus"].ResponseCacheMissMeter)
+	ensureContains(t, registry, "adapter.appnexus.degraded_requests", m.AdapterMetrics["appnexus"].DegradedMeter)
 }
 
 func TestLazyLoadUsersyncMetrics(t *testing.T) {
@@ -39,6 +71,132 @@ func TestLazyLoadAccountMetrics(t *testing.T) {
 	m.GetAccountMetrics("foo") // Call this twice to make sure we get the same meter
 	ensureContainsAccountMetrics(t, registry, "account.foo", m.GetAccountMetrics("foo"))
 	ensureContainsAdapterMetrics(t, registry, "account.foo.appnexus", m.GetAccountMetrics("foo").AdapterMetrics["appnexus"])
+	ensureMissing(t, registry, "account.foo.appnexus.degraded_requests")
+}
+
+func TestLazyLoadSizeMetrics(t *testing.T) {
+	m := NewMetrics([]string{"appnexus"})
+	registry := m.metricsRegistry
+	am := m.GetAccountMetrics("foo")
+	first := am.SizeBidsMeter("300x250") // Call this twice to make sure we get the same meter
+	ensureContains(t, registry, "account.foo.sizes.300x250.bids", am.SizeBidsMeter("300x250"))
+	if am.SizeBidsMeter("300x250") != first {
+		t.Errorf("Every call for the same size should return the same meter")
+	}
+	ensureMissing(t, registry, "account.foo.sizes.728x90.bids")
+}
+
+func TestEvictIdleAccounts(t *testing.T) {
+	m := NewMetrics([]string{"appnexus"})
+	registry := m.metricsRegistry
+	m.GetAccountMetrics("idle").SizeBidsMeter("300x250")
+	m.GetAccountMetrics("busy")
+
+	if evicted := m.evictIdleAccounts(time.Now(), time.Minute); len(evicted) != 0 {
+		t.Errorf("Accounts used within the window shouldn't be evicted; got %v", evicted)
+	}
+
+	m.GetAccountMetrics("busy").RequestMeter.Mark(1)
+	atomic.StoreInt64(&m.GetAccountMetrics("idle").lastUsed, time.Now().Add(-2*time.Minute).UnixNano())
+	evicted := m.evictIdleAccounts(time.Now(), time.Minute)
+	if len(evicted) != 1 || evicted[0] != "idle" {
+		t.Fatalf("Expected only the idle account to be evicted; got %v", evicted)
+	}
+	ensureMissing(t, registry, "account.idle.requests")
+	ensureMissing(t, registry, "account.idle.appnexus.requests")
+	ensureMissing(t, registry, "account.idle.sizes.300x250.bids")
+	ensureContainsAccountMetrics(t, registry, "account.busy", m.GetAccountMetrics("busy"))
+
+	// Accounts which come back get fresh metrics
+	ensureContainsAccountMetrics(t, registry, "account.idle", m.GetAccountMetrics("idle"))
+}
+
+func TestEvictIdleAccountsWithDots(t *testing.T) {
+	m := NewMetrics([]string{"appnexus"})
+	registry := m.metricsRegistry
+	m.GetAccountMetrics("a")
+	m.GetAccountMetrics("a.b")
+	atomic.StoreInt64(&m.GetAccountMetrics("a").lastUsed, time.Now().Add(-2*time.Minute).UnixNano())
+	if evicted := m.evictIdleAccounts(time.Now(), time.Minute); len(evicted) != 1 || evicted[0] != "a" {
+		t.Fatalf("Expected only account a to be evicted; got %v", evicted)
+	}
+	ensureMissing(t, registry, "account.a.requests")
+	ensureContainsAccountMetrics(t, registry, "account.a.b", m.GetAccountMetrics("a.b"))
+
+	atomic.StoreInt64(&m.GetAccountMetrics("a.b").lastUsed, time.Now().Add(-2*time.Minute).UnixNano())
+	m.evictIdleAccounts(time.Now(), time.Minute)
+	ensureMissing(t, registry, "account.a.b.requests")
+	ensureMissing(t, registry, "account.a.b.appnexus.requests")
+}
+
+func TestEvictIdleAccountsRace(t *testing.T) {
+	// Plenty of exchanges, so that eviction takes a while to unregister all the account's metrics
+	exchanges := make([]string, 20)
+	for i := range exchanges {
+		exchanges[i] = fmt.Sprintf("exchange%d", i)
+	}
+	m := NewMetrics(exchanges)
+	registry := m.metricsRegistry
+	for i := 0; i < 50; i++ {
+		m.GetAccountMetrics("foo")
+		var evicting int32 = 1
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			// A cutoff in the future evicts the account, even if it's used in the meantime
+			m.evictIdleAccounts(time.Now().Add(time.Hour), time.Minute)
+			atomic.StoreInt32(&evicting, 0)
+		}()
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&evicting) == 1 {
+				m.GetAccountMetrics("foo")
+			}
+		}()
+		wg.Wait()
+
+		am := m.GetAccountMetrics("foo")
+		if registry.Get("account.foo.requests") != am.RequestMeter {
+			t.Fatalf("Iteration %d: the account's metrics should stay registered after a concurrent eviction", i)
+		}
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	m := NewMetrics([]string{"appnexus"})
+	m.RequestMeter.Mark(3)
+	m.GetAccountMetrics("a").RequestMeter.Mark(1)
+	m.GetAccountMetrics("b").RequestMeter.Mark(1)
+	m.GetAccountMetrics("c").RequestMeter.Mark(1)
+
+	buf := new(bytes.Buffer)
+	if err := m.WriteJSON(buf, 2); err != nil {
+		t.Fatalf("WriteJSON failed: %v", err)
+	}
+
+	var dump map[string]map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &dump); err != nil {
+		t.Fatalf("WriteJSON wrote invalid JSON: %v", err)
+	}
+
+	if count := dump["prebidserver.requests"]["count"]; count != 3.0 {
+		t.Errorf("Expected 3 requests in the dump; got %v", count)
+	}
+	if _, ok := dump["prebidserver.adapter.appnexus.requests"]; !ok {
+		t.Errorf("Adapter metrics missing from the dump")
+	}
+	if _, ok := dump["prebidserver.account.a.requests"]; !ok {
+		t.Errorf("Account a should be in the dump")
+	}
+	if _, ok := dump["prebidserver.account.b.appnexus.requests"]; !ok {
+		t.Errorf("Account b should be in the dump")
+	}
+	for name := range dump {
+		if strings.HasPrefix(name, "prebidserver.account.c.") {
+			t.Errorf("Account c should have been capped out of the dump, but found %s", name)
+		}
+	}
 }
 
 func ensureMissing(t *testing.T, registry metrics.Registry, name string) {
@@ -64,6 +222,20 @@ func ensureContainsAdapterMetrics(t *testing.T, registry metrics.Registry, name
 	ensureContains(t, registry, fmt.Sprintf("%s.timeout_requests", name), adapterMetrics.TimeoutMeter)
 	ensureContains(t, registry, fmt.Sprintf("%s.request_time", name), adapterMetrics.RequestTimer)
 	ensureContains(t, registry, fmt.Sprintf("%s.prices", name), adapterMetrics.PriceHistogram)
+	ensureContains(t, registry, fmt.Sprintf("%s.errors.dns", name), adapterMetrics.DNSErrorMeter)
+	ensureContains(t, registry, fmt.Sprintf("%s.errors.connection_refused", name), adapterMetrics.ConnectionRefusedErrorMeter)
+	ensureContains(t, registry, fmt.Sprintf("%s.errors.tls", name), adapterMetrics.TLSErrorMeter)
+	ensureContains(t, registry, fmt.Sprintf("%s.errors.bad_status", name), adapterMetrics.BadStatusErrorMeter)
+	ensureContains(t, registry, fmt.Sprintf("%s.errors.bad_response", name), adapterMetrics.BadResponseErrorMeter)
+	ensureContains(t, registry, fmt.Sprintf("%s.errors.other", name), adapterMetrics.OtherErrorMeter)
+	ensureContains(t, registry, fmt.Sprintf("%s.top_bids", name), adapterMetrics.TopBidMeter)
+	ensureContains(t, registry, fmt.Sprintf("%s.excess_bids", name), adapterMetrics.ExcessBidsMeter)
+	ensureContains(t, registry, fmt.Sprintf("%s.unrequested_bids", name), adapterMetrics.UnrequestedBidsMeter)
+	ensureContains(t, registry, fmt.Sprintf("%s.holdout_requests", name), adapterMetrics.HoldoutMeter)
+	ensureContains(t, registry, fmt.Sprintf("%s.over_max_cpm_bids", name), adapterMetrics.OverMaxCPMMeter)
+	ensureContains(t, registry, fmt.Sprintf("%s.invalid_markup_bids", name), adapterMetrics.InvalidMarkupMeter)
+	ensureContains(t, registry, fmt.Sprintf("%s.sla_met", name), adapterMetrics.SLAMetMeter)
+	ensureContains(t, registry, fmt.Sprintf("%s.sla_missed", name), adapterMetrics.SLAMissedMeter)
 }
 
 func ensureContainsAccountMetrics(t *testing.T, registry metrics.Registry, name string, accountMetrics *AccountMetrics) {
@@ -71,4 +243,46 @@ func ensureContainsAccountMetrics(t *testing.T, registry metrics.Registry, name
 	ensureContains(t, registry, fmt.Sprintf("%s.requests", name), accountMetrics.RequestMeter)
 	ensureContains(t, registry, fmt.Sprintf("%s.bids_received", name), accountMetrics.BidsReceivedMeter)
 	ensureContains(t, registry, fmt.Sprintf("%s.prices", name), accountMetrics.PriceHistogram)
+	ensureContains(t, registry, fmt.Sprintf("%s.timed_out_bidders", name), accountMetrics.TimedOutBiddersHistogram)
+	ensureContains(t, registry, fmt.Sprintf("%s.ad_unit_bids", name), accountMetrics.AdUnitBidsHistogram)
+	ensureContains(t, registry, fmt.Sprintf("%s.cache_markup_requests", name), accountMetrics.CacheMarkupMeter)
+	ensureContains(t, registry, fmt.Sprintf("%s.cache_time", name), accountMetrics.CacheTimer)
+	ensureContains(t, registry, fmt.Sprintf("%s.cached_objects", name), accountMetrics.CachedObjectsHistogram)
+}
+
+func TestWriteJSONAccountsWithDots(t *testing.T) {
+	m := NewMetrics([]string{"appnexus"})
+	m.GetAccountMetrics("a")
+	m.GetAccountMetrics("a.b")
+	m.GetAccountMetrics("b")
+
+	dumpNames := func(maxAccounts int) map[string]bool {
+		buf := new(bytes.Buffer)
+		if err := m.WriteJSON(buf, maxAccounts); err != nil {
+			t.Fatalf("WriteJSON failed: %v", err)
+		}
+		var dump map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &dump); err != nil {
+			t.Fatalf("WriteJSON wrote invalid JSON: %v", err)
+		}
+		names := make(map[string]bool, len(dump))
+		for name := range dump {
+			names[name] = true
+		}
+		return names
+	}
+
+	// Sorted by ID, a.b is the second account and b the one capped out
+	names := dumpNames(2)
+	if !names["prebidserver.account.a.requests"] || !names["prebidserver.account.a.b.requests"] {
+		t.Errorf("Accounts a and a.b should be in the dump")
+	}
+	if names["prebidserver.account.b.requests"] {
+		t.Errorf("Account b should have been capped out of the dump")
+	}
+
+	names = dumpNames(0)
+	if !names["prebidserver.account.b.requests"] || !names["prebidserver.account.a.b.appnexus.requests"] {
+		t.Errorf("max_dump_accounts of 0 should include every account")
+	}
 }
@@ -3,9 +3,18 @@ package prebid_cache_client
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/net/context/ctxhttp"
 )
@@ -13,6 +22,12 @@ import (
 type CacheObject struct {
 	Value *BidCache
 	UUID  string
+	// TTLSeconds is how long prebid-cache keeps the object. 0 leaves it to prebid-cache's default.
+	TTLSeconds int64
+	// Namespace is put in front of the object's cache ID, as "<namespace>_<random id>", so the IDs of
+	// one account can't be told from, or guessed by, another's. prebid-cache must allow setting keys
+	// for this to work. Empty lets prebid-cache pick the ID.
+	Namespace string
 }
 
 type BidCache struct {
@@ -26,6 +41,9 @@ type BidCache struct {
 type putObject struct {
 	Type  string  `json:"type"`
 	Value *BidCache `json:"value"`
+
+	TTLSeconds int64  `json:"ttlseconds,omitempty"`
+	Key        string `json:"key,omitempty"`
 }
 
 type putRequest struct {
@@ -43,6 +61,9 @@ var (
 	client  *http.Client
 	baseURL string
 	putURL  string
+
+	// signingSecret is used to sign the cache IDs returned to clients. IDs aren't signed if it's empty.
+	signingSecret []byte
 )
 
 // InitPrebidCache setup the global prebid cache
@@ -60,12 +81,97 @@ func InitPrebidCache(baseurl string) {
 	}
 }
 
+// GetURL returns the URL which fetches the object with the given cache ID from prebid-cache
+func GetURL(id string) string {
+	return fmt.Sprintf("%s?uuid=%s", putURL, url.QueryEscape(id))
+}
+
+// Enabled reports whether InitPrebidCache was given a cache to put bids in
+func Enabled() bool {
+	return baseURL != ""
+}
+
+// namespacedKey makes a cache ID in the namespace, which can be stored with prebid-cache's key field
+func namespacedKey(namespace string) (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return namespace + "_" + hex.EncodeToString(b[:]), nil
+}
+
+// InitSigning sets the secret used by SignID and VerifyID. An empty secret turns signing off.
+func InitSigning(secret string) {
+	signingSecret = []byte(secret)
+}
+
+func idSignature(id string) string {
+	mac := hmac.New(sha256.New, signingSecret)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignID returns a token for the cache ID, of the form "<id>.<signature>", which VerifyID can authenticate.
+// If no signing secret is configured, the ID is returned unchanged.
+func SignID(id string) string {
+	if len(signingSecret) == 0 {
+		return id
+	}
+	return id + "." + idSignature(id)
+}
+
+// VerifyID checks a token made by SignID, and returns the cache ID inside it.
+// If no signing secret is configured, the token is the ID itself.
+func VerifyID(token string) (string, error) {
+	if len(signingSecret) == 0 {
+		return token, nil
+	}
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return "", fmt.Errorf("Cache ID is not signed")
+	}
+	id, signature := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(idSignature(id))) {
+		return "", fmt.Errorf("Cache ID signature is invalid")
+	}
+	return id, nil
+}
+
+// PutStats describes a single PUT request made to prebid-cache
+type PutStats struct {
+	Objects  int
+	Bytes    int
+	Duration time.Duration
+	Err      error
+}
+
 // Put will send the array of objs and update each with a UUID
 func Put(ctx context.Context, objs []*CacheObject) error {
+	return put(ctx, objs).Err
+}
+
+func put(ctx context.Context, objs []*CacheObject) PutStats {
+	start := time.Now()
+	stats := PutStats{Objects: len(objs)}
+	stats.Bytes, stats.Err = doPut(ctx, objs)
+	stats.Duration = time.Since(start)
+	return stats
+}
+
+// doPut makes the PUT request for objs, and returns the size of the request body
+func doPut(ctx context.Context, objs []*CacheObject) (int, error) {
 	pr := putRequest{Puts: make([]putObject, len(objs))}
 	for i, obj := range objs {
 		pr.Puts[i].Type = "json"
 		pr.Puts[i].Value = obj.Value
+		pr.Puts[i].TTLSeconds = obj.TTLSeconds
+		if obj.Namespace != "" {
+			key, err := namespacedKey(obj.Namespace)
+			if err != nil {
+				return 0, err
+			}
+			pr.Puts[i].Key = key
+		}
 	}
 	// Don't want to escape the HTML for adm and nurl
 	buf := new(bytes.Buffer)
@@ -73,38 +179,75 @@ func Put(ctx context.Context, objs []*CacheObject) error {
 	enc.SetEscapeHTML(false)
 	err := enc.Encode(pr)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	size := buf.Len()
 
 	httpReq, err := http.NewRequest("POST", putURL, buf)
 	if err != nil {
-		return err
+		return size, err
 	}
 	httpReq.Header.Add("Content-Type", "application/json;charset=utf-8")
 	httpReq.Header.Add("Accept", "application/json")
 
 	anResp, err := ctxhttp.Do(ctx, client, httpReq)
 	if err != nil {
-		return err
+		return size, err
 	}
 	defer anResp.Body.Close()
 
 	if anResp.StatusCode != 200 {
-		return fmt.Errorf("HTTP status code %d", anResp.StatusCode)
+		return size, fmt.Errorf("HTTP status code %d", anResp.StatusCode)
 	}
 
 	var resp response
 	if err := json.NewDecoder(anResp.Body).Decode(&resp); err != nil {
-		return err
+		return size, err
 	}
 
 	if len(resp.Responses) != len(objs) {
-		return fmt.Errorf("Put response length didn't match")
+		return size, fmt.Errorf("Put response length didn't match")
 	}
 
 	for i, r := range resp.Responses {
 		objs[i].UUID = r.UUID
 	}
 
-	return nil
+	return size, nil
+}
+
+// PutBatched splits objs into batches of at most batchSize objects, and Puts the batches concurrently.
+// Objects in the batches which succeed get their UUID even if other batches fail. Objects in the
+// batches which fail are left without one, and the first failure is returned.
+// If batchSize isn't positive, all the objs are sent in a single Put.
+// The stats of every PUT request made are returned, for metrics.
+func PutBatched(ctx context.Context, objs []*CacheObject, batchSize int) ([]PutStats, error) {
+	if batchSize <= 0 || len(objs) <= batchSize {
+		stats := put(ctx, objs)
+		return []PutStats{stats}, stats.Err
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	allStats := make([]PutStats, 0, (len(objs)+batchSize-1)/batchSize)
+	for start := 0; start < len(objs); start += batchSize {
+		end := start + batchSize
+		if end > len(objs) {
+			end = len(objs)
+		}
+		wg.Add(1)
+		go func(batch []*CacheObject) {
+			defer wg.Done()
+			stats := put(ctx, batch)
+			mu.Lock()
+			allStats = append(allStats, stats)
+			if stats.Err != nil && firstErr == nil {
+				firstErr = stats.Err
+			}
+			mu.Unlock()
+		}(objs[start:end])
+	}
+	wg.Wait()
+	return allStats, firstErr
 }
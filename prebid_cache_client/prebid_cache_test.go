@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -136,3 +137,184 @@ func TestPrebidClient(t *testing.T) {
 		t.Fatalf("pbc put succeeded but should have timed out")
 	}
 }
+
+func TestPrebidClientBatched(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(DummyPrebidCacheServer))
+	defer server.Close()
+	InitPrebidCache(server.URL)
+	delay = 0
+
+	// More objects than the server accepts in one request
+	cobj := make([]*CacheObject, MaxNumValues+2)
+	for i := range cobj {
+		cobj[i] = &CacheObject{
+			Value: &BidCache{
+				Adm:    fmt.Sprintf("<div>%d</div>", i),
+				Width:  300,
+				Height: 250,
+			},
+		}
+	}
+
+	ctx := context.TODO()
+	if err := Put(ctx, cobj); err == nil {
+		t.Fatalf("pbc put of %d objects should have been rejected", len(cobj))
+	}
+
+	stats, err := PutBatched(ctx, cobj, 5)
+	if err != nil {
+		t.Fatalf("pbc batched put failed: %v", err)
+	}
+	if len(stats) != 3 {
+		t.Errorf("Expected stats for 3 PUTs; got %d", len(stats))
+	}
+	objects := 0
+	for _, put := range stats {
+		objects += put.Objects
+		if put.Objects > 5 || put.Bytes == 0 || put.Err != nil {
+			t.Errorf("Unexpected PUT stats: %+v", put)
+		}
+	}
+	if objects != len(cobj) {
+		t.Errorf("PUT stats should add up to %d objects; got %d", len(cobj), objects)
+	}
+	for i, obj := range cobj {
+		if expected := fmt.Sprintf("UUID-%d", i%5+1); obj.UUID != expected {
+			t.Errorf("Object %d UUID was '%s', should have been '%s'", i, obj.UUID, expected)
+		}
+	}
+
+	// Make the second batch fail. The others should still be cached.
+	for _, obj := range cobj {
+		obj.UUID = ""
+	}
+	cobj[7].Value.Adm = strings.Repeat("a", MaxValueLength+1)
+	stats, err = PutBatched(ctx, cobj, 5)
+	if err == nil {
+		t.Fatalf("pbc batched put should have reported the failed batch")
+	}
+	failedPuts := 0
+	for _, put := range stats {
+		if put.Err != nil {
+			failedPuts++
+		}
+	}
+	if failedPuts != 1 {
+		t.Errorf("Expected 1 failed PUT in the stats; got %d", failedPuts)
+	}
+	for i, obj := range cobj {
+		if failed := i >= 5 && i < 10; failed != (obj.UUID == "") {
+			t.Errorf("Object %d had UUID '%s' after a partial failure", i, obj.UUID)
+		}
+	}
+}
+
+func TestPrebidClientTTL(t *testing.T) {
+	var put putRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&put)
+		w.Write([]byte(`{"responses":[{"uuid":"a"},{"uuid":"b"}]}`))
+	}))
+	defer server.Close()
+	InitPrebidCache(server.URL)
+
+	cobj := []*CacheObject{
+		{Value: &BidCache{Adm: "<div></div>"}, TTLSeconds: 3600},
+		{Value: &BidCache{Adm: "<div></div>"}},
+	}
+	if err := Put(context.TODO(), cobj); err != nil {
+		t.Fatalf("pbc put failed: %v", err)
+	}
+	if len(put.Puts) != 2 || put.Puts[0].TTLSeconds != 3600 || put.Puts[1].TTLSeconds != 0 {
+		t.Errorf("Each object should be sent with its own TTL; got %+v", put.Puts)
+	}
+}
+
+func TestPrebidClientNamespace(t *testing.T) {
+	var put putRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&put)
+		resp := response{Responses: make([]responseObject, len(put.Puts))}
+		for i, p := range put.Puts {
+			resp.Responses[i].UUID = p.Key
+			if p.Key == "" {
+				resp.Responses[i].UUID = "generated"
+			}
+		}
+		json.NewEncoder(w).Encode(&resp)
+	}))
+	defer server.Close()
+	InitPrebidCache(server.URL)
+
+	cobj := []*CacheObject{
+		{Value: &BidCache{Adm: "<div></div>"}, Namespace: "acct"},
+		{Value: &BidCache{Adm: "<div></div>"}, Namespace: "acct"},
+		{Value: &BidCache{Adm: "<div></div>"}},
+	}
+	if err := Put(context.TODO(), cobj); err != nil {
+		t.Fatalf("pbc put failed: %v", err)
+	}
+	for _, obj := range cobj[:2] {
+		if !strings.HasPrefix(obj.UUID, "acct_") || len(obj.UUID) != len("acct_")+32 {
+			t.Errorf("Expected a cache ID in the acct namespace; got %s", obj.UUID)
+		}
+	}
+	if cobj[0].UUID == cobj[1].UUID {
+		t.Errorf("Every object should get its own cache ID; both got %s", cobj[0].UUID)
+	}
+	if cobj[2].UUID != "generated" || put.Puts[2].Key != "" {
+		t.Errorf("Objects without a namespace should leave the ID to prebid-cache; got %s", cobj[2].UUID)
+	}
+}
+
+func TestSignID(t *testing.T) {
+	InitSigning("")
+	if token := SignID("abc-123"); token != "abc-123" {
+		t.Errorf("IDs shouldn't be signed without a secret; got %s", token)
+	}
+
+	InitSigning("s3cr3t")
+	defer InitSigning("")
+
+	token := SignID("abc-123")
+	if !strings.HasPrefix(token, "abc-123.") {
+		t.Fatalf("Signed token should start with the ID; got %s", token)
+	}
+	id, err := VerifyID(token)
+	if err != nil {
+		t.Fatalf("Verify of a signed token failed: %v", err)
+	}
+	if id != "abc-123" {
+		t.Errorf("Verify returned ID %s, expected abc-123", id)
+	}
+
+	if _, err := VerifyID("abc-123"); err == nil {
+		t.Errorf("Verify should reject an unsigned ID")
+	}
+	if _, err := VerifyID("abc-124" + strings.TrimPrefix(token, "abc-123")); err == nil {
+		t.Errorf("Verify should reject a signature for another ID")
+	}
+
+	InitSigning("another")
+	if _, err := VerifyID(token); err == nil {
+		t.Errorf("Verify should reject a token signed with another secret")
+	}
+}
+
+func TestGetURL(t *testing.T) {
+	InitPrebidCache("https://prebid-cache.example.com")
+	if url := GetURL("abc-123.sig_-"); url != "https://prebid-cache.example.com/cache?uuid=abc-123.sig_-" {
+		t.Errorf("Bad cache URL %s", url)
+	}
+}
+
+func TestEnabled(t *testing.T) {
+	InitPrebidCache("")
+	if Enabled() {
+		t.Errorf("The cache shouldn't be enabled without a URL")
+	}
+	InitPrebidCache("https://prebid-cache.example.com")
+	if !Enabled() {
+		t.Errorf("The cache should be enabled once it has a URL")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/dbmedialab/prebid-server/config"
+)
+
+// registerPprof adds the net/http/pprof endpoints to the admin mux, if they're enabled, behind the
+// configured token and IP allowlist.
+func registerPprof(mux *http.ServeMux, cfg *config.Pprof) {
+	if !cfg.Enabled {
+		return
+	}
+	guard := newPprofGuard(cfg)
+	mux.Handle("/debug/pprof/", guard.wrap(http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/cmdline", guard.wrap(http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle("/debug/pprof/profile", guard.wrap(http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", guard.wrap(http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/trace", guard.wrap(http.HandlerFunc(pprof.Trace)))
+}
+
+// pprofGuard only lets through the requests which come from an allowed IP and carry the token,
+// when the config sets them.
+type pprofGuard struct {
+	token      string
+	allowedIPs map[string]bool
+}
+
+func newPprofGuard(cfg *config.Pprof) *pprofGuard {
+	g := &pprofGuard{token: cfg.Token}
+	if len(cfg.AllowedIPs) > 0 {
+		g.allowedIPs = make(map[string]bool, len(cfg.AllowedIPs))
+		for _, ip := range cfg.AllowedIPs {
+			g.allowedIPs[ip] = true
+		}
+	}
+	return g
+}
+
+func (g *pprofGuard) allowed(r *http.Request) bool {
+	if g.allowedIPs != nil {
+		// The admin port isn't behind a proxy, so the connection's address is the client's
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil || !g.allowedIPs[ip] {
+			return false
+		}
+	}
+	if g.token != "" {
+		token := r.Header.Get("X-Pprof-Token")
+		if token == "" {
+			token = r.URL.Query().Get("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(g.token)) != 1 {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *pprofGuard) wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !g.allowed(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dbmedialab/prebid-server/config"
+)
+
+func pprofStatus(mux *http.ServeMux, remoteAddr string, token string) int {
+	r := httptest.NewRequest("GET", "/debug/pprof/cmdline", nil)
+	r.RemoteAddr = remoteAddr
+	if token != "" {
+		r.Header.Set("X-Pprof-Token", token)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestPprofDisabled(t *testing.T) {
+	mux := http.NewServeMux()
+	registerPprof(mux, &config.Pprof{Enabled: false})
+	if status := pprofStatus(mux, "10.0.0.1:1234", ""); status != http.StatusNotFound {
+		t.Errorf("Disabled pprof endpoints shouldn't exist; got status %d", status)
+	}
+}
+
+func TestPprofGuard(t *testing.T) {
+	mux := http.NewServeMux()
+	registerPprof(mux, &config.Pprof{Enabled: true, Token: "secret", AllowedIPs: []string{"10.0.0.1"}})
+
+	tests := []struct {
+		remoteAddr string
+		token      string
+		expected   int
+	}{
+		{"10.0.0.1:1234", "secret", http.StatusOK},
+		{"10.0.0.1:1234", "wrong", http.StatusForbidden},
+		{"10.0.0.1:1234", "", http.StatusForbidden},
+		{"10.0.0.2:1234", "secret", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		if status := pprofStatus(mux, test.remoteAddr, test.token); status != test.expected {
+			t.Errorf("Expected status %d from %s with token '%s'; got %d", test.expected, test.remoteAddr, test.token, status)
+		}
+	}
+
+	open := http.NewServeMux()
+	registerPprof(open, &config.Pprof{Enabled: true})
+	if status := pprofStatus(open, "10.0.0.2:1234", ""); status != http.StatusOK {
+		t.Errorf("pprof without a token or allowlist should be open; got status %d", status)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dbmedialab/prebid-server/config"
+	"github.com/dbmedialab/prebid-server/pbs"
+	"github.com/golang/glog"
+)
+
+// Adapter trace statuses
+const (
+	TRACE_STATUS_BID     = "bid"
+	TRACE_STATUS_NO_BID  = "no_bid"
+	TRACE_STATUS_ERROR   = "error"
+	TRACE_STATUS_TIMEOUT = "timeout"
+)
+
+// traceQueueSize is how many traces can wait to be written before new ones are dropped
+const traceQueueSize = 1000
+
+// adapterTrace is a sampled adapter call, as written to the trace store
+type adapterTrace struct {
+	Time          time.Time          `json:"time"`
+	Bidder        string             `json:"bidder"`
+	AccountID     string             `json:"account_id"`
+	Tid           string             `json:"tid"`
+	Status        string             `json:"status"`
+	Error         string             `json:"error,omitempty"`
+	LatencyMillis int                `json:"latency_ms"`
+	Calls         []*pbs.BidderDebug `json:"calls"`
+}
+
+func newAdapterTrace(req *pbs.PBSRequest, bidder *pbs.PBSBidder, start time.Time, bids pbs.PBSBidSlice, err error, calls []*pbs.BidderDebug) *adapterTrace {
+	trace := &adapterTrace{
+		Time:          start,
+		Bidder:        bidder.BidderCode,
+		AccountID:     req.AccountID,
+		Tid:           req.Tid,
+		Status:        traceStatus(bids, err),
+		LatencyMillis: bidder.ResponseTime,
+		Calls:         append([]*pbs.BidderDebug(nil), calls...),
+	}
+	if err != nil {
+		trace.Error = err.Error()
+	}
+	return trace
+}
+
+type traceStore interface {
+	save(trace *adapterTrace) error
+}
+
+// fileTraceStore appends each trace to a file as a line of JSON
+type fileTraceStore struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func newFileTraceStore(filename string) (*fileTraceStore, error) {
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileTraceStore{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (s *fileTraceStore) save(trace *adapterTrace) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(trace)
+}
+
+// postgresTraceStore inserts each trace into the adapter_traces table, which needs the columns
+// time (timestamp), bidder (text), status (text), latency_ms (integer) and data (json).
+type postgresTraceStore struct {
+	db *sql.DB
+}
+
+func newPostgresTraceStore(cfg *config.DataCache) (*postgresTraceStore, error) {
+	uri := fmt.Sprintf("host=%s dbname=%s user=%s password=%s sslmode=disable", cfg.Host, cfg.Database, cfg.Username, cfg.Password)
+	db, err := sql.Open("postgres", uri)
+	if err != nil {
+		return nil, err
+	}
+	return &postgresTraceStore{db: db}, nil
+}
+
+func (s *postgresTraceStore) save(trace *adapterTrace) error {
+	data, err := json.Marshal(trace)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("INSERT INTO adapter_traces (time, bidder, status, latency_ms, data) VALUES ($1, $2, $3, $4, $5)",
+		trace.Time, trace.Bidder, trace.Status, trace.LatencyMillis, string(data))
+	return err
+}
+
+// adapterTracer records a sample of the adapter calls. Traces are written by a background goroutine,
+// and dropped if the store can't keep up, so tracing never slows down an auction.
+//
+// A nil *adapterTracer never samples anything, so callers don't need to check whether tracing is configured.
+type adapterTracer struct {
+	sampleRate float64
+	store      traceStore
+	queue      chan *adapterTrace
+}
+
+func newAdapterTracer(sampleRate float64, store traceStore) *adapterTracer {
+	t := &adapterTracer{
+		sampleRate: sampleRate,
+		store:      store,
+		queue:      make(chan *adapterTrace, traceQueueSize),
+	}
+	go t.write()
+	return t
+}
+
+// setupAdapterTracer creates the tracer configured by cfg, or returns nil if tracing is off
+func setupAdapterTracer(cfg *config.Configuration) (*adapterTracer, error) {
+	if cfg.Trace.SampleRate <= 0 {
+		return nil, nil
+	}
+
+	var store traceStore
+	var err error
+	switch cfg.Trace.Store {
+	case "file":
+		store, err = newFileTraceStore(cfg.Trace.Filename)
+	case "postgres":
+		store, err = newPostgresTraceStore(&cfg.DataCache)
+	default:
+		return nil, fmt.Errorf("Unknown trace.store: %s", cfg.Trace.Store)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newAdapterTracer(cfg.Trace.SampleRate, store), nil
+}
+
+// sample decides whether the next adapter call should be traced
+func (t *adapterTracer) sample() bool {
+	if t == nil {
+		return false
+	}
+	return rand.Float64() < t.sampleRate
+}
+
+// record queues the trace to be written, or drops it if the queue is full
+func (t *adapterTracer) record(trace *adapterTrace) {
+	select {
+	case t.queue <- trace:
+	default:
+		if glog.V(2) {
+			glog.Infof("Trace queue is full, dropping trace for %s", trace.Bidder)
+		}
+	}
+}
+
+func (t *adapterTracer) write() {
+	for trace := range t.queue {
+		if err := t.store.save(trace); err != nil {
+			glog.Warningf("Failed to save adapter trace: %v", err)
+		}
+	}
+}
+
+// traceStatus sums up the outcome of an adapter call for its trace
+func traceStatus(bids pbs.PBSBidSlice, err error) string {
+	switch {
+	case err == context.DeadlineExceeded:
+		return TRACE_STATUS_TIMEOUT
+	case err != nil:
+		return TRACE_STATUS_ERROR
+	case len(bids) == 0:
+		return TRACE_STATUS_NO_BID
+	}
+	return TRACE_STATUS_BID
+}
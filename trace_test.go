@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dbmedialab/prebid-server/pbs"
+)
+
+func TestTraceStatus(t *testing.T) {
+	bids := pbs.PBSBidSlice{&pbs.PBSBid{}}
+	if status := traceStatus(bids, nil); status != TRACE_STATUS_BID {
+		t.Errorf("Expected status %s; got %s", TRACE_STATUS_BID, status)
+	}
+	if status := traceStatus(nil, nil); status != TRACE_STATUS_NO_BID {
+		t.Errorf("Expected status %s; got %s", TRACE_STATUS_NO_BID, status)
+	}
+	if status := traceStatus(nil, context.DeadlineExceeded); status != TRACE_STATUS_TIMEOUT {
+		t.Errorf("Expected status %s; got %s", TRACE_STATUS_TIMEOUT, status)
+	}
+	if status := traceStatus(nil, errors.New("bad")); status != TRACE_STATUS_ERROR {
+		t.Errorf("Expected status %s; got %s", TRACE_STATUS_ERROR, status)
+	}
+}
+
+func TestFileTraceStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "traces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "traces.json")
+
+	store, err := newFileTraceStore(filename)
+	if err != nil {
+		t.Fatalf("Failed to create the trace store: %v", err)
+	}
+	tracer := newAdapterTracer(1, store)
+	if !tracer.sample() {
+		t.Errorf("A sample rate of 1 should trace every call")
+	}
+
+	req := &pbs.PBSRequest{AccountID: "acct", Tid: "abcd"}
+	bidder := &pbs.PBSBidder{BidderCode: "appnexus", ResponseTime: 42}
+	calls := []*pbs.BidderDebug{{RequestURI: "http://ib.adnxs.com", StatusCode: 204}}
+	tracer.record(newAdapterTrace(req, bidder, time.Now(), nil, nil, calls))
+
+	var trace adapterTrace
+	for i := 0; i < 100 && trace.Bidder == ""; i++ {
+		time.Sleep(time.Millisecond)
+		f, err := os.Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(f)
+		if scanner.Scan() {
+			// The line may still be partly written, so try again if it doesn't parse yet
+			if err := json.Unmarshal(scanner.Bytes(), &trace); err != nil {
+				trace = adapterTrace{}
+			}
+		}
+		f.Close()
+	}
+
+	if trace.Bidder != "appnexus" || trace.AccountID != "acct" || trace.Tid != "abcd" {
+		t.Errorf("Trace has the wrong metadata: %+v", trace)
+	}
+	if trace.Status != TRACE_STATUS_NO_BID || trace.LatencyMillis != 42 {
+		t.Errorf("Trace has the wrong outcome: %+v", trace)
+	}
+	if len(trace.Calls) != 1 || trace.Calls[0].StatusCode != 204 {
+		t.Errorf("Trace should include the adapter's calls: %+v", trace.Calls)
+	}
+}
+
+func TestNilAdapterTracer(t *testing.T) {
+	var tracer *adapterTracer
+	if tracer.sample() {
+		t.Errorf("A nil tracer shouldn't sample anything")
+	}
+}